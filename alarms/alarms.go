@@ -0,0 +1,133 @@
+package alarms
+
+import (
+	"encoding/json"
+	"extruder_web_gui/metrics"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Severity of an alarm
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+// Alarm raised by a subsystem, identified by ID (e.g. "stale:temperature")
+type Alarm struct {
+	ID       string            `json:"id"`
+	Severity Severity          `json:"severity"`
+	Source   string            `json:"source"`
+	Message  string            `json:"message"`
+	Active   bool              `json:"active"`
+	Raised   time.Time         `json:"raised"`
+	Cleared  time.Time         `json:"cleared,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"` //Context, e.g. signal name or value
+}
+
+// Number of cleared alarms kept for /alarms
+const historySize = 100
+
+var (
+	mu        sync.Mutex
+	active    = map[string]*Alarm{}
+	history   []Alarm
+	listeners []func(Alarm)
+)
+
+var activeGauge = metrics.NewGauge("extruder_active_alarms", "Number of active alarms.")
+
+// Register function called when an alarm is raised or cleared
+func Subscribe(fn func(Alarm)) {
+	mu.Lock()
+	defer mu.Unlock()
+	listeners = append(listeners, fn)
+}
+
+// Raise alarm, does nothing if the alarm is already active
+func Raise(a Alarm) {
+	mu.Lock()
+	if _, ok := active[a.ID]; ok {
+		mu.Unlock()
+		return
+	}
+	a.Active = true
+	a.Raised = time.Now()
+	a.Cleared = time.Time{}
+	active[a.ID] = &a
+	activeGauge.Set(float64(len(active)))
+	fns := append([]func(Alarm){}, listeners...)
+	mu.Unlock()
+
+	log.Printf("Alarm raised (%s): %s", a.Severity, a.Message)
+	for _, fn := range fns {
+		fn(a)
+	}
+}
+
+// Clear active alarm
+func Clear(id string) {
+	mu.Lock()
+	a, ok := active[id]
+	if !ok {
+		mu.Unlock()
+		return
+	}
+	delete(active, id)
+	activeGauge.Set(float64(len(active)))
+	a.Active = false
+	a.Cleared = time.Now()
+	history = append(history, *a)
+	if len(history) > historySize {
+		history = history[len(history)-historySize:]
+	}
+	fns := append([]func(Alarm){}, listeners...)
+	mu.Unlock()
+
+	log.Printf("Alarm cleared: %s", a.Message)
+	for _, fn := range fns {
+		fn(*a)
+	}
+}
+
+// Return true if alarm is active
+func IsActive(id string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := active[id]
+	return ok
+}
+
+// Return active alarms, oldest first
+func Active() []Alarm {
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]Alarm, 0, len(active))
+	for _, a := range active {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Raised.Before(list[j].Raised) })
+	return list
+}
+
+// Return recently cleared alarms, newest last
+func History() []Alarm {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Alarm{}, history...)
+}
+
+// Handler for active and recently cleared alarms
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]Alarm{
+		"active":  Active(),
+		"cleared": History(),
+	})
+}
@@ -0,0 +1,41 @@
+package alarms
+
+import (
+	"testing"
+)
+
+// Remove active alarms, history and listeners when the test ends
+func reset(t *testing.T) {
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		active = map[string]*Alarm{}
+		history = nil
+		listeners = nil
+		activeGauge.Set(0)
+	})
+}
+
+// Test for Raise / Clear: listeners, idempotent raise and history
+func TestRaiseClear(t *testing.T) {
+	reset(t)
+	var notified []Alarm
+	Subscribe(func(a Alarm) { notified = append(notified, a) })
+
+	Raise(Alarm{ID: "test", Severity: SeverityWarning, Message: "Test alarm"})
+	Raise(Alarm{ID: "test", Severity: SeverityWarning, Message: "Test alarm"})
+	if !IsActive("test") || len(Active()) != 1 {
+		t.Errorf("Expected one active alarm, received: %v", Active())
+	}
+	Clear("test")
+	Clear("test")
+	if IsActive("test") {
+		t.Errorf("Alarm should be cleared")
+	}
+	if len(notified) != 2 || !notified[0].Active || notified[1].Active {
+		t.Errorf("Expected raise and clear notification, received: %v", notified)
+	}
+	if h := History(); len(h) != 1 || h[0].Cleared.IsZero() {
+		t.Errorf("Cleared alarm missing in history: %v", h)
+	}
+}
@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Results of an audited action
+const (
+	ResultOK       = "ok"
+	ResultRejected = "rejected" //Request invalid, nothing changed
+	ResultFailed   = "failed"   //Change could not be applied
+)
+
+// Audit log entry: who did what with which result
+type Entry struct {
+	Time    time.Time         `json:"time"`
+	Actor   string            `json:"actor"`  //Operator, remote address or subsystem
+	Action  string            `json:"action"` //e.g. "config.reload"
+	Result  string            `json:"result"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Number of entries kept for /audit
+const memorySize = 500
+
+var (
+	mu      sync.Mutex
+	entries []Entry
+	file    *os.File
+)
+
+// Append entries to a Json Lines file in addition to memory, empty path disables the file
+func Configure(path string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if file != nil {
+		file.Close()
+		file = nil
+	}
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening audit log: %w", err)
+	}
+	file = f
+	return nil
+}
+
+// Record entry, the time is set if missing
+func Record(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	entries = append(entries, e)
+	if len(entries) > memorySize {
+		entries = entries[len(entries)-memorySize:]
+	}
+	log.Printf("Audit: %s %s by %s: %s", e.Action, e.Result, e.Actor, e.Message)
+	if file != nil {
+		line, _ := json.Marshal(e)
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			log.Println("Error writing audit log:", err)
+		}
+	}
+}
+
+// Return recorded entries, oldest first
+func Entries() []Entry {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Entry{}, entries...)
+}
+
+// Actor of an HTTP request: operator header or remote address
+func Actor(r *http.Request) string {
+	if operator := r.Header.Get("X-Operator"); operator != "" {
+		return operator
+	}
+	return r.RemoteAddr
+}
+
+// Handler for the audit log
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Entries())
+}
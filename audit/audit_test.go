@@ -0,0 +1,45 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test for Record: entries kept in memory and appended to the file
+func TestRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := Configure(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer Configure("")
+
+	Record(Entry{Actor: "tester", Action: "config.reload", Result: ResultOK, Message: "Mode switched"})
+	list := Entries()
+	if len(list) == 0 || list[len(list)-1].Action != "config.reload" || list[len(list)-1].Time.IsZero() {
+		t.Fatalf("Unexpected entries: %+v", list)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Audit file missing: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var e Entry
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &e) != nil || e.Actor != "tester" {
+		t.Errorf("Unexpected audit file content: %s", scanner.Text())
+	}
+}
+
+// Test for Actor: operator header preferred over remote address
+func TestActor(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/config", nil)
+	r.Header.Set("X-Operator", "shift-lead")
+	if a := Actor(r); a != "shift-lead" {
+		t.Errorf("Expected: %v, received: %v", "shift-lead", a)
+	}
+}
@@ -0,0 +1,171 @@
+package chart
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strings"
+)
+
+// Text alignment relative to the anchor point
+type anchor int
+
+const (
+	anchorStart anchor = iota
+	anchorMiddle
+	anchorEnd
+)
+
+// Drawing primitives shared by the SVG and PNG output
+type canvas interface {
+	rect(x, y, w, h float64, fill color.RGBA)
+	line(x1, y1, x2, y2 float64, c color.RGBA, dashed bool)
+	polyline(points [][2]float64, c color.RGBA)
+	text(x, y float64, s string, c color.RGBA, a anchor)
+}
+
+func hex(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// SVG output, text baseline at y
+type svgCanvas struct {
+	b strings.Builder
+}
+
+func newSVGCanvas(width, height int) *svgCanvas {
+	c := &svgCanvas{}
+	fmt.Fprintf(&c.b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`+"\n",
+		width, height, width, height)
+	return c
+}
+
+func (c *svgCanvas) rect(x, y, w, h float64, fill color.RGBA) {
+	fmt.Fprintf(&c.b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n", x, y, w, h, hex(fill))
+}
+
+func (c *svgCanvas) line(x1, y1, x2, y2 float64, col color.RGBA, dashed bool) {
+	dash := ""
+	if dashed {
+		dash = ` stroke-dasharray="6 4"`
+	}
+	fmt.Fprintf(&c.b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s"%s/>`+"\n", x1, y1, x2, y2, hex(col), dash)
+}
+
+func (c *svgCanvas) polyline(points [][2]float64, col color.RGBA) {
+	if len(points) == 0 {
+		return
+	}
+	fmt.Fprintf(&c.b, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="`, hex(col))
+	for i, p := range points {
+		if i > 0 {
+			c.b.WriteByte(' ')
+		}
+		fmt.Fprintf(&c.b, "%.1f,%.1f", p[0], p[1])
+	}
+	c.b.WriteString("\"/>\n")
+}
+
+func (c *svgCanvas) text(x, y float64, s string, col color.RGBA, a anchor) {
+	align := [...]string{"start", "middle", "end"}[a]
+	fmt.Fprintf(&c.b, `<text x="%.1f" y="%.1f" fill="%s" text-anchor="%s">%s</text>`+"\n", x, y, hex(col), align, html.EscapeString(s))
+}
+
+func (c *svgCanvas) writeTo(w io.Writer) error {
+	_, err := io.WriteString(w, c.b.String()+"</svg>\n")
+	return err
+}
+
+// PNG output drawn into an RGBA image
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func newPNGCanvas(width, height int) *pngCanvas {
+	return &pngCanvas{img: image.NewRGBA(image.Rect(0, 0, width, height))}
+}
+
+func (c *pngCanvas) rect(x, y, w, h float64, fill color.RGBA) {
+	for py := int(y); py < int(y+h); py++ {
+		for px := int(x); px < int(x+w); px++ {
+			c.img.SetRGBA(px, py, fill)
+		}
+	}
+}
+
+// Bresenham line, dashed lines skip every second segment of 6 pixels
+func (c *pngCanvas) line(x1, y1, x2, y2 float64, col color.RGBA, dashed bool) {
+	ax, ay, bx, by := int(math.Round(x1)), int(math.Round(y1)), int(math.Round(x2)), int(math.Round(y2))
+	dx, dy := abs(bx-ax), -abs(by-ay)
+	sx, sy := sign(bx-ax), sign(by-ay)
+	e := dx + dy
+	for step := 0; ; step++ {
+		if !dashed || (step/6)%2 == 0 {
+			c.img.SetRGBA(ax, ay, col)
+		}
+		if ax == bx && ay == by {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			ax += sx
+		}
+		if e2 <= dx {
+			e += dx
+			ay += sy
+		}
+	}
+}
+
+func (c *pngCanvas) polyline(points [][2]float64, col color.RGBA) {
+	for i := 1; i < len(points); i++ {
+		c.line(points[i-1][0], points[i-1][1], points[i][0], points[i][1], col, false)
+	}
+}
+
+// Bitmap text, baseline at y
+func (c *pngCanvas) text(x, y float64, s string, col color.RGBA, a anchor) {
+	width := float64(len([]rune(s)) * glyphWidth)
+	switch a {
+	case anchorMiddle:
+		x -= width / 2
+	case anchorEnd:
+		x -= width
+	}
+	top := int(y) - 7
+	for i, r := range []rune(s) {
+		g, ok := glyph(r)
+		if !ok {
+			continue
+		}
+		left := int(x) + i*glyphWidth
+		for row, bits := range g {
+			for col5 := 0; col5 < 5; col5++ {
+				if bits&(0x10>>col5) != 0 {
+					c.img.SetRGBA(left+col5, top+row, col)
+				}
+			}
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func sign(v int) int {
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,354 @@
+package chart
+
+import (
+	"bytes"
+	"extruder_web_gui/data"
+	"extruder_web_gui/history"
+	"fmt"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Horizontal limit line of a signal, e.g. alarm range or tolerance
+type Limit struct {
+	Label string
+	Value float64
+}
+
+// Vertical event line, e.g. spool change
+type Marker struct {
+	Time  time.Time
+	Label string
+}
+
+// Trends shown in the UI
+var DefaultSignals = []string{"temperature", "diameter", "screwRpm", "spoolerRpm"}
+
+// Trend colors as in index.html
+var signalColors = map[string]color.RGBA{
+	"temperature": {R: 0xff, A: 0xff},
+	"diameter":    {B: 0xff, A: 0xff},
+	"screwRpm":    {A: 0xff},
+	"spoolerRpm":  {G: 0x80, A: 0xff},
+}
+
+var (
+	palette     = []color.RGBA{{R: 0x80, B: 0x80, A: 0xff}, {R: 0x00, G: 0x80, B: 0x80, A: 0xff}, {R: 0x80, G: 0x60, A: 0xff}, {R: 0x60, G: 0x60, B: 0x60, A: 0xff}}
+	white       = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	frameColor  = color.RGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}
+	gridColor   = color.RGBA{R: 0xe0, G: 0xe0, B: 0xe0, A: 0xff}
+	textColor   = color.RGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xff}
+	limitColor  = color.RGBA{R: 0xff, G: 0x8c, A: 0xff}
+	markerColor = color.RGBA{R: 0x99, G: 0x33, B: 0xcc, A: 0xff}
+)
+
+// Upper limit of plotted points per series, denser data is resampled
+const maxPoints = 2000
+
+// Time series of one signal with its own y axis
+type series struct {
+	signal string
+	label  string
+	color  color.RGBA
+	times  []time.Time
+	values []float64
+	limits []Limit
+	min    float64
+	max    float64
+}
+
+// Plot area with one or more series sharing the time axis
+type panel struct {
+	title  string
+	series []*series
+}
+
+// Renderer for trend charts from the signal history
+type Renderer struct {
+	rec *history.Recorder
+
+	// Limit lines and markers, set by main
+	Limits  func(signal string) []Limit
+	Markers func(from, to time.Time) []Marker
+}
+
+// Create renderer reading from the recorder
+func NewRenderer(rec *history.Recorder) *Renderer {
+	return &Renderer{rec: rec}
+}
+
+// Handler for SVG charts: /chart.svg?signals=...&from=...&to=...&spool=...&overlay=1&width=...&height=...
+func (c *Renderer) SVGHandler(w http.ResponseWriter, r *http.Request) {
+	width, height, panels, from, to, err := c.prepare(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cv := newSVGCanvas(width, height)
+	c.draw(cv, width, height, panels, from, to)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	cv.writeTo(w)
+}
+
+// Handler for PNG charts, same parameters as SVGHandler
+func (c *Renderer) PNGHandler(w http.ResponseWriter, r *http.Request) {
+	width, height, panels, from, to, err := c.prepare(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cv := newPNGCanvas(width, height)
+	c.draw(cv, width, height, panels, from, to)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, cv.img); err != nil {
+		http.Error(w, "Error encoding PNG", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// Parse request and load the series
+func (c *Renderer) prepare(r *http.Request) (width, height int, panels []panel, from, to time.Time, err error) {
+	q, err := c.rec.ParseQuery(r, DefaultSignals)
+	if err != nil {
+		return
+	}
+	if width, err = sizeParam(r, "width", 1200); err != nil {
+		return
+	}
+	if height, err = sizeParam(r, "height", 800); err != nil {
+		return
+	}
+	from, to = c.timeRange(q)
+
+	var all []*series
+	for i, name := range q.Signals {
+		var s *series
+		if s, err = c.load(name, from, to, q.Interval); err != nil {
+			return
+		}
+		s.color = signalColor(name, i)
+		all = append(all, s)
+	}
+	if r.URL.Query().Get("overlay") == "1" {
+		panels = []panel{{title: "Trends", series: all}}
+	} else {
+		for _, s := range all {
+			panels = append(panels, panel{title: s.label, series: []*series{s}})
+		}
+	}
+	return
+}
+
+func sizeParam(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 200 || v > 4000 {
+		return 0, fmt.Errorf("Invalid %s: %s", name, s)
+	}
+	return v, nil
+}
+
+// Open ends of the requested range default to the recorded data
+func (c *Renderer) timeRange(q history.Query) (from, to time.Time) {
+	from, to = q.From, q.To
+	if !from.IsZero() && !to.IsZero() {
+		return from, to
+	}
+	for _, name := range q.Signals {
+		samples := c.rec.Series(name, q.From, q.To)
+		if len(samples) == 0 {
+			continue
+		}
+		if q.From.IsZero() && (from.IsZero() || samples[0].Time.Before(from)) {
+			from = samples[0].Time
+		}
+		if q.To.IsZero() && samples[len(samples)-1].Time.After(to) {
+			to = samples[len(samples)-1].Time
+		}
+	}
+	if from.IsZero() || to.IsZero() {
+		to = time.Now()
+		from = to.Add(-10 * time.Minute)
+	}
+	if !to.After(from) {
+		to = from.Add(time.Second)
+	}
+	return from, to
+}
+
+// Load series of a signal, dense data is resampled to maxPoints
+func (c *Renderer) load(name string, from, to time.Time, interval time.Duration) (*series, error) {
+	s := &series{signal: name, label: name}
+	if info, ok := data.SignalInfo(name); ok && info.Unit != "" {
+		s.label = fmt.Sprintf("%s [%s]", name, info.Unit)
+	}
+	if interval <= 0 && len(c.rec.Series(name, from, to)) > maxPoints {
+		interval = to.Sub(from) / maxPoints
+	}
+	rows, err := c.rec.Table([]string{name}, from, to, interval)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if !math.IsNaN(row.Values[0]) {
+			s.times = append(s.times, row.Time)
+			s.values = append(s.values, row.Values[0])
+		}
+	}
+	if c.Limits != nil {
+		s.limits = c.Limits(name)
+	}
+	s.min, s.max = axisRange(s.values, s.limits)
+	return s, nil
+}
+
+func signalColor(name string, i int) color.RGBA {
+	if c, ok := signalColors[name]; ok {
+		return c
+	}
+	return palette[i%len(palette)]
+}
+
+// Value range of an axis incl. limit lines with 5 % padding
+func axisRange(values []float64, limits []Limit) (float64, float64) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	for _, l := range limits {
+		lo, hi = math.Min(lo, l.Value), math.Max(hi, l.Value)
+	}
+	if math.IsInf(lo, 0) {
+		return 0, 1
+	}
+	if lo == hi {
+		return lo - 1, hi + 1
+	}
+	pad := (hi - lo) * 0.05
+	return lo - pad, hi + pad
+}
+
+// Layout of the panels: two columns like the UI, one panel for a single signal or overlay
+func (c *Renderer) draw(cv canvas, width, height int, panels []panel, from, to time.Time) {
+	cv.rect(0, 0, float64(width), float64(height), white)
+	var markers []Marker
+	if c.Markers != nil {
+		markers = c.Markers(from, to)
+	}
+	cols := 1
+	if len(panels) > 1 {
+		cols = 2
+	}
+	rows := (len(panels) + cols - 1) / cols
+	pw, ph := float64(width)/float64(cols), float64(height)/float64(max(rows, 1))
+	for i, p := range panels {
+		x, y := float64(i%cols)*pw, float64(i/cols)*ph
+		drawPanel(cv, p, x, y, pw, ph, from, to, markers)
+	}
+}
+
+// Width reserved per y axis
+const axisWidth = 55
+
+func drawPanel(cv canvas, p panel, x, y, w, h float64, from, to time.Time, markers []Marker) {
+	// Axes alternate between left and right side
+	left, right := 0, 0
+	for i := range p.series {
+		if i%2 == 0 {
+			left++
+		} else {
+			right++
+		}
+	}
+	px, py := x+float64(left)*axisWidth, y+30
+	pw, ph := w-float64(left+right)*axisWidth-15, h-60
+	if pw < 10 || ph < 10 {
+		return
+	}
+	cv.text(x+w/2, y+18, p.title, textColor, anchorMiddle)
+
+	span := to.Sub(from).Seconds()
+	tx := func(t time.Time) float64 { return px + t.Sub(from).Seconds()/span*pw }
+
+	// Time axis with grid
+	layout := "15:04:05"
+	if to.Sub(from) > 24*time.Hour {
+		layout = "01-02 15:04"
+	}
+	for i := 0; i <= 5; i++ {
+		gx := px + pw*float64(i)/5
+		cv.line(gx, py, gx, py+ph, gridColor, false)
+		t := from.Add(time.Duration(float64(to.Sub(from)) * float64(i) / 5))
+		a := anchorMiddle
+		if i == 5 {
+			a = anchorEnd // Keep last label inside the panel
+		}
+		cv.text(gx, py+ph+15, t.Format(layout), textColor, a)
+	}
+
+	for i, s := range p.series {
+		ty := func(v float64) float64 { return py + ph - (v-s.min)/(s.max-s.min)*ph }
+		// Axis position: outermost axis furthest away from the plot
+		var ax float64
+		a := anchorEnd
+		if i%2 == 0 {
+			ax = px - float64(i/2)*axisWidth
+		} else {
+			ax = px + pw + float64(i/2)*axisWidth
+			a = anchorStart
+		}
+		cv.line(ax, py, ax, py+ph, s.color, false)
+		for t := 0; t <= 5; t++ {
+			v := s.min + (s.max-s.min)*float64(t)/5
+			gy := ty(v)
+			if i == 0 {
+				cv.line(px, gy, px+pw, gy, gridColor, false)
+			}
+			offset := -4.0
+			if a == anchorStart {
+				offset = 4
+			}
+			cv.text(ax+offset, gy+4, strconv.FormatFloat(v, 'g', 4, 64), s.color, a)
+		}
+		if len(p.series) > 1 {
+			cv.text(ax, py-5, s.signal, s.color, anchorMiddle)
+		}
+		for _, l := range s.limits {
+			ly := ty(l.Value)
+			cv.line(px, ly, px+pw, ly, limitColor, true)
+			cv.text(px+pw-3, ly-3, l.Label, limitColor, anchorEnd)
+		}
+		points := make([][2]float64, len(s.values))
+		for j, v := range s.values {
+			points[j] = [2]float64{tx(s.times[j]), ty(v)}
+		}
+		cv.polyline(points, s.color)
+		if len(s.values) == 0 {
+			cv.text(px+pw/2, py+ph/2, "No data", textColor, anchorMiddle)
+		}
+	}
+
+	for _, m := range markers {
+		if m.Time.Before(from) || m.Time.After(to) {
+			continue
+		}
+		mx := tx(m.Time)
+		cv.line(mx, py, mx, py+ph, markerColor, true)
+		cv.text(mx+3, py+12, m.Label, markerColor, anchorStart)
+	}
+
+	// Frame
+	cv.line(px, py, px+pw, py, frameColor, false)
+	cv.line(px, py+ph, px+pw, py+ph, frameColor, false)
+	cv.line(px, py, px, py+ph, frameColor, false)
+	cv.line(px+pw, py, px+pw, py+ph, frameColor, false)
+}
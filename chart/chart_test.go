@@ -0,0 +1,82 @@
+package chart
+
+import (
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"extruder_web_gui/history"
+	"image/png"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// Renderer with one minute of diameter and temperature samples and a spool change
+func newTestRenderer() *Renderer {
+	rec := history.NewRecorder(config.HistoryConfig{})
+	for i := 0; i < 60; i++ {
+		ts := start.Add(time.Duration(i) * time.Second)
+		rec.Record(data.Update{Signal: "diameter", Point: data.Datapoint{Timestamp: ts, Value: 1.75 + float32(i%5)*0.01, Quality: data.QualityGood}})
+		rec.Record(data.Update{Signal: "temperature", Point: data.Datapoint{Timestamp: ts, Value: 200 + float32(i), Quality: data.QualityGood}})
+	}
+	c := NewRenderer(rec)
+	c.Limits = func(signal string) []Limit {
+		if signal == "diameter" {
+			return []Limit{{Label: "USL", Value: 1.80}}
+		}
+		return nil
+	}
+	c.Markers = func(from, to time.Time) []Marker {
+		return []Marker{{Time: start.Add(30 * time.Second), Label: "spool 1"}}
+	}
+	return c
+}
+
+// Test for SVGHandler: series, limit line and spool marker
+func TestSVGHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newTestRenderer().SVGHandler(rec, httptest.NewRequest("GET", "/chart.svg", nil))
+	body := rec.Body.String()
+	if rec.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Errorf("Expected: image/svg+xml, received: %v", rec.Header().Get("Content-Type"))
+	}
+	for _, expected := range []string{"<polyline", ">USL<", ">spool 1<", "diameter [µm]", "No data"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected SVG to contain %q", expected)
+		}
+	}
+	if n := strings.Count(body, "<polyline"); n != 2 {
+		t.Errorf("Polylines. Expected: %v, received: %v", 2, n)
+	}
+}
+
+// Test for PNGHandler: image size and invalid parameters
+func TestPNGHandler(t *testing.T) {
+	c := newTestRenderer()
+	rec := httptest.NewRecorder()
+	c.PNGHandler(rec, httptest.NewRequest("GET", "/chart.png?signals=diameter,temperature&overlay=1&width=640&height=480", nil))
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("Could not decode PNG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 640 || b.Dy() != 480 {
+		t.Errorf("Size. Expected: 640x480, received: %dx%d", b.Dx(), b.Dy())
+	}
+
+	rec = httptest.NewRecorder()
+	c.PNGHandler(rec, httptest.NewRequest("GET", "/chart.png?width=abc", nil))
+	if rec.Code != 400 {
+		t.Errorf("Invalid width. Expected: %v, received: %v", 400, rec.Code)
+	}
+}
+
+// Test for SVGHandler: resampling interval too small for the default time range
+func TestSVGHandler_IntervalTooSmall(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newTestRenderer().SVGHandler(rec, httptest.NewRequest("GET", "/chart.svg?interval=1ns", nil))
+	if rec.Code != 400 {
+		t.Errorf("Expected: %v, received: %v", 400, rec.Code)
+	}
+}
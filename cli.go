@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"extruder_web_gui/config"
+	"extruder_web_gui/controls"
+	"extruder_web_gui/data"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subcommand of the binary
+type command struct {
+	name string
+	args string
+	help string
+	run  func(args []string) error
+}
+
+// Subcommands, filled in init as the commands refer to the table for their usage
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "[flags]", "Run the web server (default)", serve},
+		{"send", "[flags] <command|id> [value]", "Send a control command via the HTTP control API (needs a running server)", runSend},
+		{"tail", "[flags]", "Decode and print incoming messages from a pipe (server stopped) or TCP peer", runTail},
+		{"replay", "[flags] <file>", "Play back a log of simulator rows or messages (as printed by tail)", runReplay},
+		{"export", "[flags]", "Dump recorded data from a running server", runExport},
+		{"check-config", "[flags]", "Validate the configuration", runCheckConfig},
+	}
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-13s %s\n", c.name, c.help)
+	}
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+// Flag set of a subcommand incl. --config and the config overrides
+func commandFlags(c string) (*flag.FlagSet, *config.Loader) {
+	fs := flag.NewFlagSet(c, flag.ContinueOnError)
+	cmd, _ := findCommand(c)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n%s\n\nFlags:\n", os.Args[0], cmd.name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	return fs, config.RegisterFlags(fs, os.LookupEnv)
+}
+
+// Load config and make it the active one
+func loadConfig(loader *config.Loader) (*config.Config, error) {
+	cfg, err := loader.Load()
+	if err != nil {
+		return nil, err
+	}
+	config.Set(cfg)
+	return cfg, nil
+}
+
+// Send a control command via a running server, e.g. "send screw_rpm 120" or "send 0x04 120".
+// The server applies its emergency stop latch and state guard like for the web UI.
+func runSend(args []string) error {
+	fs, loader := commandFlags("send")
+	server := fs.String("url", "", "Base URL of the server (default http://localhost:<httpPort>)")
+	machineID := fs.String("machine", "", "ID of a further machine (default: the machine of the top level config)")
+	reason := fs.String("reason", "", "Reason of an emergency stop")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return errors.New("Command missing")
+	}
+	id, err := parseCommand(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	name, _ := controls.CommandName(id)
+	path, ok := controls.ControlPath(id)
+	if !ok {
+		return fmt.Errorf("Command %s cannot be sent", name)
+	}
+	var body []byte
+	if _, _, hasValue := controls.CommandRange(name); hasValue {
+		if fs.NArg() != 2 {
+			return fmt.Errorf("Value missing for %s", name)
+		}
+		value, err := strconv.ParseUint(fs.Arg(1), 0, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid value %q", fs.Arg(1))
+		}
+		if err := controls.ValidateCommand(id, uint32(value)); err != nil {
+			return err
+		}
+		body, _ = json.Marshal(controls.ControlData{Value: uint32(value)})
+	} else if fs.NArg() == 2 {
+		return fmt.Errorf("%s has no value", name)
+	} else if *reason != "" {
+		body, _ = json.Marshal(controls.EmergencyStopData{Reason: *reason})
+	}
+	if *server == "" {
+		cfg, err := loader.Load()
+		if cfg == nil {
+			return err
+		}
+		*server = "http://localhost:" + cfg.HttpPort
+	}
+	target := strings.TrimSuffix(*server, "/") + "/control/" + path
+	if *machineID != "" {
+		target = strings.TrimSuffix(*server, "/") + "/machines/" + url.PathEscape(*machineID) + "/control/" + path
+	}
+	resp, err := http.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		fmt.Printf("Sent %s (0x%02x) via %s\n", name, id, *server)
+	case http.StatusAccepted:
+		fmt.Printf("Accepted %s (0x%02x) via %s: %s\n", name, id, *server, strings.TrimSpace(string(reply)))
+	default:
+		return fmt.Errorf("Command failed (%s): %s", resp.Status, strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+// Command by name ("screw_rpm") or ID ("4", "0x04")
+func parseCommand(s string) (byte, error) {
+	if id, ok := controls.CommandID(s); ok {
+		return id, nil
+	}
+	id, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("Unknown command %q", s)
+	}
+	if _, ok := controls.CommandName(byte(id)); !ok {
+		return 0, fmt.Errorf("Unknown command ID 0x%02x", id)
+	}
+	return byte(id), nil
+}
+
+// Formats of incoming data
+const (
+	formatFrames = "frames" // 8 byte binary messages (pipe, reversed byte order)
+	formatHex    = "hex"    // Hex encoded messages, one per line (TCP)
+	formatRows   = "rows"   // Simulator rows
+)
+
+// Print incoming messages; the source defaults to the one of the configured mode.
+// Pipes have a single reader, tail is for use without the server: it refuses to
+// read the configured pipe while the configured HTTP port answers.
+func runTail(args []string) error {
+	fs, loader := commandFlags("tail")
+	pipe := fs.String("pipe", "", "Read 8 byte messages from this pipe")
+	simPipe := fs.String("sim-pipe", "", "Read simulator rows from this pipe")
+	tcpAddress := fs.String("tcp", "", "Read hex messages from this TCP peer (host:port)")
+	count := fs.Int("n", 0, "Stop after n messages (0 = unlimited)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *pipe == "" && *simPipe == "" && *tcpAddress == "" {
+		cfg, err := loadConfig(loader)
+		if err != nil {
+			return err
+		}
+		if (cfg.Mode == "SimMode" || cfg.Mode == "PipeMode") && serverRunning(cfg.HttpPort) {
+			return fmt.Errorf("Server on port %s reads the pipe, tail would take its messages. Stop the server first", cfg.HttpPort)
+		}
+		switch cfg.Mode {
+		case "SimMode":
+			*simPipe = cfg.SimModePipe
+		case "PipeMode":
+			*pipe = cfg.MsgFromSimPipe
+		case "TCPMode":
+			*tcpAddress = cfg.TCPAddress
+		default:
+			return fmt.Errorf("tail is not supported for %s", cfg.Mode)
+		}
+	}
+
+	remaining := *count
+	for {
+		var source io.ReadCloser
+		var format string
+		var err error
+		switch {
+		case *tcpAddress != "":
+			format = formatHex
+			source, err = net.Dial("tcp", *tcpAddress)
+		case *pipe != "":
+			format = formatFrames
+			source, err = os.OpenFile(*pipe, os.O_RDONLY, os.ModeNamedPipe)
+		default:
+			format = formatRows
+			source, err = os.OpenFile(*simPipe, os.O_RDONLY, os.ModeNamedPipe)
+		}
+		if err != nil {
+			return err
+		}
+		n, err := tailMessages(source, format, os.Stdout, remaining)
+		source.Close()
+		if err != nil || format == formatHex {
+			return err // TCP peer closed the connection
+		}
+		if remaining > 0 {
+			if remaining -= n; remaining <= 0 {
+				return nil
+			}
+		}
+		// Writer of the pipe closed it, wait for the next one
+	}
+}
+
+// Check if a server answers on the local HTTP port
+func serverRunning(port string) bool {
+	conn, err := net.DialTimeout("tcp", "localhost:"+port, 500*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Print messages of r until EOF or n messages (n <= 0: unlimited), returns the number printed
+func tailMessages(r io.Reader, format string, w io.Writer, n int) (int, error) {
+	reader := bufio.NewReader(r)
+	printed := 0
+	for n <= 0 || printed < n {
+		var msg []byte
+		switch format {
+		case formatFrames:
+			msg = make([]byte, 8)
+			if _, err := io.ReadFull(reader, msg); err != nil {
+				return printed, ignoreEOF(err)
+			}
+			msg = reverseBytes(msg)
+		default:
+			line, err := reader.ReadString('\n')
+			line = strings.TrimSpace(line)
+			if line == "" {
+				if err != nil {
+					return printed, ignoreEOF(err)
+				}
+				continue
+			}
+			if format == formatRows {
+				fmt.Fprintln(w, line)
+				printed++
+				continue
+			}
+			if msg, err = hex.DecodeString(line); err != nil {
+				fmt.Fprintf(w, "# malformed: %s\n", line)
+				continue
+			}
+		}
+		fmt.Fprintln(w, describeMsg(time.Now(), msg))
+		printed++
+	}
+	return printed, nil
+}
+
+// Message line as read by replay: "<RFC 3339 time> <hex> id=0x02 temperature=215"
+func describeMsg(ts time.Time, msg []byte) string {
+	id, value, signal, err := data.DecodeMsg(msg)
+	if err != nil {
+		return fmt.Sprintf("%s %x # %v", ts.Format(time.RFC3339Nano), msg, err)
+	}
+	if signal == "" {
+		signal = "unknown"
+	}
+	return fmt.Sprintf("%s %x id=0x%02x %s=%d", ts.Format(time.RFC3339Nano), msg, id, signal, value)
+}
+
+func ignoreEOF(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
+
+// Helper function to reverse byte order
+func reverseBytes(s []byte) []byte {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+	return s
+}
+
+// Play back a log: simulator rows go to the sim pipe, messages to the message pipe
+func runReplay(args []string) error {
+	fs, loader := commandFlags("replay")
+	speed := fs.Float64("speed", 1, "Playback speed factor, 0 = as fast as possible")
+	pipe := fs.String("pipe", "", "Pipe for messages (default msgFromSimPipe)")
+	simPipe := fs.String("sim-pipe", "", "Pipe for simulator rows (default simModePipe)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("Log file missing")
+	}
+	cfg, err := loadConfig(loader)
+	if err != nil {
+		return err
+	}
+	if *pipe == "" {
+		*pipe = cfg.MsgFromSimPipe
+	}
+	if *simPipe == "" {
+		*simPipe = cfg.SimModePipe
+	}
+	data.ConfigureTimestamps(cfg.Timestamps.Layouts, cfg.Timestamps.TimeZone)
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out := &replayTargets{rowsPath: *simPipe, framesPath: *pipe}
+	defer out.close()
+	n, err := replay(file, data.TimestampLayouts(), *speed, out, time.Sleep)
+	fmt.Printf("Replayed %d lines\n", n)
+	return err
+}
+
+// Pipes opened on first use, opening blocks until the reader (server) is connected
+type replayTargets struct {
+	rowsPath, framesPath string
+	rows, frames         *os.File
+}
+
+func (t *replayTargets) writer(rows bool) (io.Writer, error) {
+	target, path := &t.frames, t.framesPath
+	if rows {
+		target, path = &t.rows, t.rowsPath
+	}
+	if *target == nil {
+		f, err := os.OpenFile(path, os.O_WRONLY, os.ModeNamedPipe)
+		if err != nil {
+			return nil, err
+		}
+		*target = f
+	}
+	return *target, nil
+}
+
+func (t *replayTargets) close() {
+	for _, f := range []*os.File{t.rows, t.frames} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// Write log lines to the targets keeping the recorded timing, returns the number of lines written
+func replay(r io.Reader, layouts []string, speed float64, out interface {
+	writer(rows bool) (io.Writer, error)
+}, sleep func(time.Duration)) (int, error) {
+	scanner := bufio.NewScanner(r)
+	var last time.Time
+	written := 0
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rows := strings.Contains(line, "|")
+		var ts time.Time
+		var payload []byte
+		if rows {
+			ts = parseRowTime(strings.Split(line, "|")[0], layouts)
+			payload = []byte(line + "\n")
+		} else {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return written, fmt.Errorf("Line %d: expected \"<time> <hex message>\"", lineNo)
+			}
+			ts, _ = time.Parse(time.RFC3339Nano, fields[0])
+			msg, err := hex.DecodeString(fields[1])
+			if err != nil || len(msg) != 8 {
+				return written, fmt.Errorf("Line %d: invalid message %q", lineNo, fields[1])
+			}
+			payload = reverseBytes(msg) // Byte order on the pipe
+		}
+		if speed > 0 && !ts.IsZero() && !last.IsZero() && ts.After(last) {
+			sleep(time.Duration(float64(ts.Sub(last)) / speed))
+		}
+		if !ts.IsZero() {
+			last = ts
+		}
+		w, err := out.writer(rows)
+		if err != nil {
+			return written, err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, scanner.Err()
+}
+
+// Timestamp of a row with the configured layouts, zero if none matches
+func parseRowTime(field string, layouts []string) time.Time {
+	field = strings.TrimSpace(field)
+	for _, candidate := range []string{field, strings.Split(field, " ")[0]} {
+		for _, layout := range layouts {
+			if ts, err := time.Parse(layout, candidate); err == nil {
+				return ts
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// Download recorded data from the /export endpoints of a running server
+func runExport(args []string) error {
+	fs, loader := commandFlags("export")
+	server := fs.String("url", "", "Base URL of the server (default http://localhost:<httpPort>)")
+	format := fs.String("format", "csv", "Format: csv, jsonl or columnar")
+	output := fs.String("o", "", "Output file (default stdout)")
+	params := map[string]*string{}
+	for _, p := range []struct{ name, help string }{
+		{"from", "Start time (RFC 3339)"},
+		{"to", "End time (RFC 3339)"},
+		{"spool", "Spool ID instead of a time range"},
+		{"signals", "Comma separated signal names"},
+		{"interval", "Resampling interval, e.g. 1s"},
+		{"delimiter", "CSV delimiter"},
+		{"decimal", "CSV decimal separator"},
+	} {
+		params[p.name] = fs.String(p.name, "", p.help)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "jsonl" && *format != "columnar" {
+		return fmt.Errorf("Unknown format %q", *format)
+	}
+	if *server == "" {
+		cfg, err := loader.Load()
+		if cfg == nil {
+			return err
+		}
+		*server = "http://localhost:" + cfg.HttpPort
+	}
+	query := url.Values{}
+	for name, v := range params {
+		if *v != "" {
+			query.Set(name, *v)
+		}
+	}
+	resp, err := http.Get(strings.TrimSuffix(*server, "/") + "/export/" + *format + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Export failed (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Validate the layered config, optionally print it
+func runCheckConfig(args []string) error {
+	fs, loader := commandFlags("check-config")
+	print := fs.Bool("print", false, "Print the effective config")
+	schema := fs.Bool("schema", false, "Print the JSON schema of the config file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *schema {
+		_, err := os.Stdout.Write(config.Schema)
+		return err
+	}
+	cfg, err := loader.Load()
+	if *print && cfg != nil {
+		config.Print(os.Stdout, cfg)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Config valid.")
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test for tailMessages: pipe frames are decoded in reversed byte order
+func TestTailFrames(t *testing.T) {
+	// temperature (0x02) = 215, as written by the simulator
+	frame := []byte{0xd7, 0, 0, 0, 0, 0, 0, 0x02}
+	var out bytes.Buffer
+	n, err := tailMessages(bytes.NewReader(append(frame, frame...)), formatFrames, &out, 0)
+	if err != nil || n != 2 {
+		t.Fatalf("Unexpected result. Expected: 2 <nil>, received: %d %v", n, err)
+	}
+	line := strings.Split(out.String(), "\n")[0]
+	if !strings.HasSuffix(line, " 02000000000000d7 id=0x02 temperature=215") {
+		t.Errorf("Unexpected line. Received: %q", line)
+	}
+}
+
+// Test for tailMessages: hex lines stop after n messages, malformed lines are marked
+func TestTailHexLimit(t *testing.T) {
+	input := "zz\n02000000000000d7\n\n0100000000000001\n0100000000000002\n"
+	var out bytes.Buffer
+	n, err := tailMessages(strings.NewReader(input), formatHex, &out, 2)
+	if err != nil || n != 2 {
+		t.Fatalf("Unexpected result. Expected: 2 <nil>, received: %d %v", n, err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || lines[0] != "# malformed: zz" || !strings.HasSuffix(lines[2], "id=0x01 diameter=1") {
+		t.Errorf("Unexpected output. Received: %q", lines)
+	}
+}
+
+// Test for serverRunning: tail refuses the pipe while the HTTP port answers
+func TestServerRunning(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+	if !serverRunning(port) {
+		t.Errorf("Expected: %v, received: %v", true, false)
+	}
+	server.Close()
+	if serverRunning(port) {
+		t.Errorf("Expected: %v, received: %v", false, true)
+	}
+}
+
+// Recording replay target
+type replayBuffers struct {
+	rows, frames bytes.Buffer
+}
+
+func (b *replayBuffers) writer(rows bool) (io.Writer, error) {
+	if rows {
+		return &b.rows, nil
+	}
+	return &b.frames, nil
+}
+
+// Test for replay: rows and frames go to their targets with the recorded timing
+func TestReplay(t *testing.T) {
+	log := strings.Join([]string{
+		"# tail output",
+		"2024-05-01T10:00:00Z 02000000000000d7 id=0x02 temperature=215",
+		"2024-05-01T10:00:02Z 0100000000000001 id=0x01 diameter=1",
+		"10:00:03.000|1.75|215|30|40|50|0",
+		"10:00:04.000|1.76|215|30|40|50|0",
+	}, "\n")
+	var sleeps []time.Duration
+	out := &replayBuffers{}
+	n, err := replay(strings.NewReader(log), []string{"15:04:05.000"}, 2, out, func(d time.Duration) { sleeps = append(sleeps, d) })
+	if err != nil || n != 4 {
+		t.Fatalf("Unexpected result. Expected: 4 <nil>, received: %d %v", n, err)
+	}
+	if got := out.frames.Bytes(); len(got) != 16 || got[0] != 0xd7 || got[7] != 0x02 {
+		t.Errorf("Unexpected frames. Received: %x", got)
+	}
+	if !strings.HasPrefix(out.rows.String(), "10:00:03.000|1.75") || strings.Count(out.rows.String(), "\n") != 2 {
+		t.Errorf("Unexpected rows. Received: %q", out.rows.String())
+	}
+	// 2s between the frames at double speed, rows restart the clock on another day
+	if len(sleeps) != 2 || sleeps[0] != time.Second || sleeps[1] != 500*time.Millisecond {
+		t.Errorf("Unexpected sleeps. Expected: [1s 500ms], received: %v", sleeps)
+	}
+}
+
+// Test for replay: invalid message lines are reported with line number
+func TestReplayInvalid(t *testing.T) {
+	_, err := replay(strings.NewReader("2024-05-01T10:00:00Z 0102\n"), nil, 0, &replayBuffers{}, func(time.Duration) {})
+	if err == nil || !strings.Contains(err.Error(), "Line 1") {
+		t.Errorf("Expected error for line 1, received: %v", err)
+	}
+}
+
+// Test for runSend: commands go to the control API of the server, setpoints need a value
+func TestSend(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.URL.Path+" "+string(body))
+		if r.URL.Path == "/control/heater-pwm" {
+			http.Error(w, "Emergency stop latched", http.StatusConflict)
+		}
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"screw_rpm", "120"}, ""},
+		{[]string{"--machine", "line2", "0x02"}, ""},
+		{[]string{"screw_rpm"}, "Value missing for screw_rpm"},
+		{[]string{"start", "1"}, "start has no value"},
+		{[]string{"heater_pwm", "101"}, "Value 101 for heater_pwm out of range [0, 100]"},
+		{[]string{"heater_pwm", "50"}, "Command failed (409 Conflict): Emergency stop latched"},
+	} {
+		err := runSend(append([]string{"--url", server.URL}, tc.args...))
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("%v: Expected: %q, received: %v", tc.args, tc.err, err)
+		}
+	}
+	expected := []string{`/control/screw-rpm {"value":120}`, "/machines/line2/control/start ", `/control/heater-pwm {"value":50}`}
+	if strings.Join(requests, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected: %v, received: %v", expected, requests)
+	}
+}
@@ -4,51 +4,356 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sync"
 )
 
 // Json config structure
 type Config struct {
-	Mode           string `json:"mode"` //Options "PipeMode", "TCPMode", "SimMode"
-	HttpPort       string `json:"httpPort"`
-	TCPAddress     string `json:"tcpAddress"`
-	SimModePipe    string `json:"simModePipe"`    //Path to SimMode Pipe
-	MsgFromSimPipe string `json:"msgFromSimPipe"` //Path to IN Pipe
-	MsgToSimPipe   string `json:"msgToSimPipe"`   //Path to OUT Pipe
+	Schema         string                `json:"$schema,omitempty"` //Path of the JSON schema for editors
+	MachineName    string                `json:"machineName"`       //Display name of this machine in /machines
+	Mode           string                `json:"mode"`              //Options "PipeMode", "TCPMode", "SimMode"
+	HttpPort       string                `json:"httpPort"`
+	TCPAddress     string                `json:"tcpAddress"`
+	SimModePipe    string                `json:"simModePipe"`    //Path to SimMode Pipe
+	MsgFromSimPipe string                `json:"msgFromSimPipe"` //Path to IN Pipe
+	MsgToSimPipe   string                `json:"msgToSimPipe"`   //Path to OUT Pipe
+	MQTT           MQTTConfig            `json:"mqtt"`
+	ModbusServer   ModbusServerConfig    `json:"modbusServer"`
+	ModbusClient   ModbusClientConfig    `json:"modbusClient"` //Device polled in ModbusMode
+	Timestamps     TimestampConfig       `json:"timestamps"`
+	SignalRanges   map[string][2]float64 `json:"signalRanges"` //Plausible [min, max] per signal, values outside are marked out-of-range
+	Watchdog       WatchdogConfig        `json:"watchdog"`
+	Spool          SpoolConfig           `json:"spool"`
+	SPC            SPCConfig             `json:"spc"`
+	History        HistoryConfig         `json:"history"`
+	WatchConfig    bool                  `json:"watchConfig"` //Reload the config file when it changes
+	Audit          AuditConfig           `json:"audit"`
+	EventLog       EventLogConfig        `json:"eventLog"` //Typed events served by /events
+	Targets        TargetConfig          `json:"targets"`
+	State          StateConfig           `json:"state"`
+	EStop          EStopConfig           `json:"estop"`
+	Sequences      []SequenceConfig      `json:"sequences"`     //Step lists run via /sequences, e.g. startup and shutdown
+	Rules          RulesConfig           `json:"rules"`         //Automations managed via /rules, evaluated on every data update
+	Notifications  NotificationConfig    `json:"notifications"` //Webhooks called on events
+	Machines       []MachineConfig       `json:"machines"`      //Further extruder lines served below /machines/{id}
 }
 
+// Automated step list run by the sequencer
+type SequenceConfig struct {
+	Name    string         `json:"name"`
+	Steps   []SequenceStep `json:"steps"`
+	OnAbort []SequenceStep `json:"onAbort"` //Set steps sent after an abort or a failed step, e.g. heater off
+}
+
+// Step of a sequence
+type SequenceStep struct {
+	Type      string  `json:"type"`      //Options "set", "ramp", "wait", "confirm"
+	Message   string  `json:"message"`   //Shown in the progress, confirm: question to the operator
+	Command   string  `json:"command"`   //set, ramp: command name, e.g. "screw_rpm"
+	Value     uint32  `json:"value"`     //set: value, ramp: target value
+	Duration  int     `json:"duration"`  //ramp: ms from the last sent value to the target
+	Signal    string  `json:"signal"`    //wait: signal name, e.g. "temperature"
+	Condition string  `json:"condition"` //wait: Options ">=", "<=", ">", "<", "=="
+	Threshold float64 `json:"threshold"` //wait: value the signal is compared with
+	Timeout   int     `json:"timeout"`   //ms until the step fails and the sequence is aborted, 0 = none
+}
+
+// Sequence step types and wait conditions
+var (
+	SequenceStepTypes  = []string{"set", "ramp", "wait", "confirm"}
+	SequenceConditions = []string{">=", "<=", ">", "<", "=="}
+)
+
+// Notifications about events, e.g. spool completed or alarm raised
+type NotificationConfig struct {
+	Webhooks    []WebhookConfig `json:"webhooks"`
+	MaxAttempts int             `json:"maxAttempts"` //Attempts per delivery (default 5)
+	Backoff     int             `json:"backoff"`     //ms before the first retry, doubled for every further retry (default 1000)
+	MaxBackoff  int             `json:"maxBackoff"`  //ms (default 60000)
+	Timeout     int             `json:"timeout"`     //ms per request (default 5000)
+	Email       EmailConfig     `json:"email"`
+}
+
+// Mails about events sent via SMTP
+type EmailConfig struct {
+	Server     string              `json:"server"`     //host:port of the SMTP server, empty = no mails
+	TLS        string              `json:"tls"`        //"starttls" (default), "tls" (implicit TLS, usually port 465) or "none"
+	Insecure   bool                `json:"insecure"`   //Skip verification of the server certificate
+	Username   string              `json:"username"`   //Empty = no authentication
+	Password   string              `json:"password"`   //
+	From       string              `json:"from"`       //Sender address
+	Recipients map[string][]string `json:"recipients"` //Addresses per severity ("info", "warning", "critical"), events of a severity without recipients are not mailed
+	Events     []string            `json:"events"`     //Event types mailed, same filter as for webhooks, empty = all
+	Subject    string              `json:"subject"`    //text/template of the subject, empty = default
+	Body       string              `json:"body"`       //text/template of the body, empty = default
+	Batch      int                 `json:"batch"`      //ms events are collected into one mail per severity (default 30000)
+	Cooldown   int                 `json:"cooldown"`   //ms the same event of the same alarm and machine is not mailed again (default 600000), other events are always mailed
+	Timeout    int                 `json:"timeout"`    //ms per connection to the server (default 10000)
+}
+
+// TLS modes of the SMTP connection and severities with recipients
+var (
+	EmailTLSModes   = []string{"starttls", "tls", "none"}
+	EmailSeverities = []string{"info", "warning", "critical"}
+)
+
+// Endpoint receiving events as JSON POST requests
+type WebhookConfig struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"` //Key of the HMAC-SHA256 signature in the X-Extruder-Signature header, empty = unsigned
+	Events []string `json:"events"` //Event types sent, "alarm.*" matches all alarm events, empty = all
+}
+
+// Event types of notifications
+var NotificationEvents = []string{
+	"spool.completed",
+	"alarm.raised",
+	"alarm.cleared",
+	"estop.triggered",
+	"estop.reset",
+	"connection.lost",
+	"connection.restored",
+	"sequence.finished",
+	"test",
+}
+
+// Automation rules managed via /rules
+type RulesConfig struct {
+	File                string `json:"file"`                //Rules are stored in this file, empty = kept in memory only
+	MaxActionsPerMinute int    `json:"maxActionsPerMinute"` //Actions of all rules together (default 30)
+	DefaultCooldown     int    `json:"defaultCooldown"`     //ms between two firings of a rule without own cooldown (default 10000)
+}
+
+// Delivery of the latched emergency stop
+type EStopConfig struct {
+	RetryInterval int      `json:"retryInterval"` //ms between attempts until the machine acknowledges (default 500)
+	AckSignals    []string `json:"ackSignals"`    //Signals reading 0 after the send acknowledge the stop (default heaterPwm, screwRpm, spoolerRpm)
+}
+
+// Process state machine: feedback driving the transitions
+type StateConfig struct {
+	SettleTime         int  `json:"settleTime"`         //ms a state entered by command is kept without confirming feedback (default 10000)
+	ContactSwitchFault bool `json:"contactSwitchFault"` //Open contact switch (0) while running is a fault
+	HistorySize        int  `json:"historySize"`        //Transitions kept for /state (default 200)
+}
+
+// Setpoint and tolerances shown on the fleet dashboard
+type TargetConfig struct {
+	Temperature          float64 `json:"temperature"`          //Temperature setpoint in °C, 0 = none
+	TemperatureTolerance float64 `json:"temperatureTolerance"` //Allowed deviation from the setpoint (+/-)
+	NominalDiameter      float64 `json:"nominalDiameter"`      //0 = spool.nominalDiameter (default machine only)
+	Tolerance            float64 `json:"tolerance"`            //Allowed diameter deviation (+/-), 0 = spool.tolerance (default machine only)
+}
+
+// ID of the machine described by the top level settings
+const DefaultMachineID = "default"
+
+// Further extruder line with its own data source, signal dictionary and history
+type MachineConfig struct {
+	ID             string                `json:"id"`   //Path segment in /machines/{id}/...
+	Name           string                `json:"name"` //Display name, default: ID
+	Mode           string                `json:"mode"` //Options "PipeMode", "TCPMode", "SimMode", "ModbusMode"
+	TCPAddress     string                `json:"tcpAddress"`
+	SimModePipe    string                `json:"simModePipe"`
+	MsgFromSimPipe string                `json:"msgFromSimPipe"`
+	MsgToSimPipe   string                `json:"msgToSimPipe"`
+	ModbusClient   ModbusClientConfig    `json:"modbusClient"`
+	Signals        SignalDictionary      `json:"signals"`      //Empty = assignment of the simulator
+	SignalRanges   map[string][2]float64 `json:"signalRanges"` //Plausible [min, max] per signal
+	History        HistoryConfig         `json:"history"`
+	Targets        TargetConfig          `json:"targets"`
+	State          StateConfig           `json:"state"`
+	EStop          EStopConfig           `json:"estop"`
+	Watchdog       WatchdogConfig        `json:"watchdog"`
+}
+
+// Assignment of message IDs and simulator row columns to signals
+type SignalDictionary struct {
+	MsgIDs  map[string]uint8 `json:"msgIds"`  //Process signal -> message ID
+	Columns map[string]int   `json:"columns"` //Signal -> column of the simulator row (0 = timestamp)
+}
+
+// Audit log of configuration changes and operator actions
+type AuditConfig struct {
+	File string `json:"file"` //Json Lines file the entries are appended to, empty = memory only
+}
+
+// Event log of connections, commands, alarms, state transitions and parse errors
+type EventLogConfig struct {
+	File          string `json:"file"`          //Json Lines file the events are kept in, empty = memory only
+	RetentionDays int    `json:"retentionDays"` //Events older than this are removed (default 7)
+	MaxEvents     int    `json:"maxEvents"`     //Events kept (default 10000)
+}
+
+// In-memory signal history for exports and charts
+type HistoryConfig struct {
+	MaxSamples int `json:"maxSamples"` //Samples kept per signal (default 100000)
+}
+
+// Statistical process control of the filament diameter
+type SPCConfig struct {
+	SubgroupSize      int `json:"subgroupSize"`      //Samples per subgroup (2..10, default 5)
+	BaselineSubgroups int `json:"baselineSubgroups"` //Subgroups per spool used for the control limits (default 25)
+	MaxSubgroups      int `json:"maxSubgroups"`      //Subgroups kept in memory (default 10000)
+}
+
+// Spool tracking, detection rule and quality limits
+type SpoolConfig struct {
+	HistoryFile        string  `json:"historyFile"`        //Json file with the spool history
+	MinWindingDiameter float64 `json:"minWindingDiameter"` //Spool change only if the winding diameter was above (default 12)
+	MinMassDrop        float64 `json:"minMassDrop"`        //Spool change only if the mass dropped by more than this (g)
+	NominalDiameter    float64 `json:"nominalDiameter"`    //Nominal filament diameter (unit of the diameter signal)
+	Tolerance          float64 `json:"tolerance"`          //Allowed deviation from the nominal diameter (+/-)
+	Density            float64 `json:"density"`            //Filament density in g/cm³ for the length estimate (default 1.24, PLA)
+	DiameterScale      float64 `json:"diameterScale"`      //Factor diameter signal -> mm for the length estimate (default 1)
+}
+
+// Stale data detection for input signals
+type WatchdogConfig struct {
+	Enabled        bool           `json:"enabled"`
+	Signals        []string       `json:"signals"`        //Monitored signals, default: all process signals
+	DefaultTimeout int            `json:"defaultTimeout"` //Timeout in ms for signals without own timeout
+	Timeouts       map[string]int `json:"timeouts"`       //Timeout in ms per signal
+	CheckInterval  int            `json:"checkInterval"`  //Check interval in ms
+	SafeAction     []CommandValue `json:"safeAction"`     //Commands sent when the link is lost while running
+}
+
+// Command with value, e.g. {"command": "heater_pwm", "value": 0}
+type CommandValue struct {
+	Command string `json:"command"`
+	Value   uint32 `json:"value"`
+}
+
+// Parsing of simulator row timestamps
+type TimestampConfig struct {
+	Layouts  []string `json:"layouts"`  //Go time layouts, tried in order. Layouts without date are anchored to the session date
+	TimeZone string   `json:"timeZone"` //IANA name, e.g. "Europe/Berlin". Empty = local time
+}
+
+// MQTT bridge settings
+type MQTTConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Broker      string `json:"broker"` //host:port of the broker
+	ClientID    string `json:"clientId"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	TopicPrefix string `json:"topicPrefix"` //e.g. "extruder/line1", signals are published to <prefix>/<signal>
+	KeepAlive   int    `json:"keepAlive"`   //Keep alive interval in seconds
+}
+
+// Modbus TCP server (slave) settings
+type ModbusServerConfig struct {
+	Enabled          bool             `json:"enabled"`
+	Address          string           `json:"address"`   //Listen address, e.g. ":502"
+	UnitID           uint8            `json:"unitId"`    //Unit ID to answer, 0 answers every unit ID
+	ByteOrder        string           `json:"byteOrder"` //Order of 32 bit values: "ABCD", "CDAB", "BADC", "DCBA"
+	InputRegisters   []ModbusRegister `json:"inputRegisters"`
+	HoldingRegisters []ModbusRegister `json:"holdingRegisters"`
+	Coils            []ModbusCoil     `json:"coils"`
+}
+
+// Modbus TCP client settings for ModbusMode
+type ModbusClientConfig struct {
+	Address      string           `json:"address"` //host:port of the PLC
+	UnitID       uint8            `json:"unitId"`
+	ByteOrder    string           `json:"byteOrder"`    //Order of 32 bit values: "ABCD", "CDAB", "BADC", "DCBA"
+	PollInterval int              `json:"pollInterval"` //Poll interval in ms
+	Timeout      int              `json:"timeout"`      //Request timeout in ms
+	Retries      int              `json:"retries"`      //Retries per request after a failure
+	MaxGap       int              `json:"maxGap"`       //Unmapped registers read to merge two signals into one request, 0 = adjacent only
+	Signals      []ModbusRegister `json:"signals"`      //Registers polled into process signals
+	Setpoints    []ModbusRegister `json:"setpoints"`    //Holding registers written by commands
+	Coils        []ModbusCoil     `json:"coils"`        //Coils written by commands
+}
+
+// Register mapping: signal (read) or command (write) at a register address
+type ModbusRegister struct {
+	Address uint16 `json:"address"`
+	Signal  string `json:"signal,omitempty"`  //Signal name as in /data
+	Command string `json:"command,omitempty"` //Command name, e.g. "screw_rpm"
+	Type    string `json:"type"`              //"float32" (default), "uint32", "uint16", "int16"
+	Table   string `json:"table,omitempty"`   //Modbus client: "input" (default) or "holding"
+}
+
+// Coil mapping: command sent when the coil is written
+type ModbusCoil struct {
+	Address uint16 `json:"address"`
+	Command string `json:"command"` //e.g. "mode_switch", "start", "emergency_stop"
+}
+
+// Active config. Code running concurrently to a reload reads it via Current.
 var Cfg *Config
 
-// Load config from json file
+var cfgMu sync.RWMutex
+
+// Return the active config
+func Current() *Config {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return Cfg
+}
+
+// Replace the active config, e.g. on reload
+func Set(config *Config) {
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+	Cfg = config
+}
+
+// Default values, overridden by file, environment and command line
+func Defaults() *Config {
+	return &Config{
+		Mode:           "PipeMode",
+		TCPAddress:     "localhost:8081",
+		SimModePipe:    "/tmp/simulator",
+		MsgFromSimPipe: "/tmp/msgFromSim",
+		MsgToSimPipe:   "/tmp/msgToSim",
+		HttpPort:       "8080",
+	}
+}
+
+// Load config from json file merged onto the defaults, apply environment variables and validate
 func LoadConfig(filePath string) error {
+	config := Defaults()
+	if err := loadFile(config, filePath); err != nil {
+		return err
+	}
+	if err := applyEnv(config, os.LookupEnv); err != nil {
+		return err
+	}
+	if err := Validate(config); err != nil {
+		return err
+	}
+	Set(config)
+	log.Println("Config loaded.")
+	return nil
+}
+
+// Decode json file onto config, a missing file keeps the values
+func loadFile(config *Config, filePath string) error {
 	file, err := os.Open(filePath)
 	//Check if file exists
 	if errors.Is(err, os.ErrNotExist) {
 		log.Printf("Warning: File not found (%s). Loading default values.", filePath)
-		// Set default values
-		Cfg = &Config{
-			Mode:           "PipeMode",
-			TCPAddress:     "localhost:8081",
-			SimModePipe:    "/tmp/simulator",
-			MsgFromSimPipe: "/tmp/msgFromSim",
-			MsgToSimPipe:   "/tmp/msgToSim",
-			HttpPort:       "8080",
-		}
 		return nil
-
 	} else if err != nil {
 		//Check for other errors
 		return fmt.Errorf("Error opening file: %w", err)
 	}
 	defer file.Close()
-	//Decode json --> config struct
-	decoder := json.NewDecoder(file)
-	var config Config
-	if err := decoder.Decode(&config); err != nil {
+	return decode(config, file)
+}
+
+// Decode json onto config, unknown keys are typos
+func decode(config *Config, r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
 		return fmt.Errorf("Error decoding .json-File: %w", err)
 	}
-	Cfg = &config
-	log.Println("Config loaded.")
 	return nil
 }
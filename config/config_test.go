@@ -1,7 +1,12 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -70,3 +75,202 @@ func TestLoadConfig_InvalidJSON(t *testing.T) {
 		t.Errorf("Expected error, but no error thrown.")
 	}
 }
+
+// Test for LoadConfig: Missing keys keep their default values
+func TestLoadConfig_DefaultsMerged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"mode": "TCPMode", "tcpAddress": "localhost:9000"}`), 0644)
+	if err := LoadConfig(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if Cfg.HttpPort != "8080" {
+		t.Errorf("HttpPort wasn't set to default value. Expected: %v, received: %v", "8080", Cfg.HttpPort)
+	}
+}
+
+// Test for LoadConfig: Unknown keys are rejected
+func TestLoadConfig_UnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"mode": "TCPMode", "httpPorts": "8080"}`), 0644)
+	if err := LoadConfig(path); err == nil {
+		t.Errorf("Expected error, but no error thrown.")
+	}
+}
+
+// Test for Load: Environment overrides file, flags override environment
+func TestLoad_Layers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"mode": "TCPMode", "httpPort": "8000", "tcpAddress": "localhost:9000"}`), 0644)
+	env := map[string]string{"EXTRUDER_HTTP_PORT": "8100", "EXTRUDER_TCP_ADDRESS": "10.0.0.1:9000"}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	cfg, opts, err := Load([]string{"--config", path, "--http-port", "8200", "--mqtt-enabled", "--mqtt-broker", "broker:1883"}, lookup)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.File != path {
+		t.Errorf("Config file. Expected: %v, received: %v", path, opts.File)
+	}
+	if cfg.HttpPort != "8200" || cfg.TCPAddress != "10.0.0.1:9000" || cfg.Mode != "TCPMode" {
+		t.Errorf("Unexpected layering result: port %v, address %v, mode %v", cfg.HttpPort, cfg.TCPAddress, cfg.Mode)
+	}
+	if !cfg.MQTT.Enabled || cfg.MQTT.Broker != "broker:1883" {
+		t.Errorf("MQTT flags not applied: %+v", cfg.MQTT)
+	}
+
+	env["EXTRUDER_MQTT_ENABLED"] = "maybe"
+	if _, _, err := Load([]string{"--config", path}, lookup); err == nil || !strings.Contains(err.Error(), "EXTRUDER_MQTT_ENABLED") {
+		t.Errorf("Expected error for invalid environment value, received: %v", err)
+	}
+}
+
+// Test for Validate: All problems are reported
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Defaults()
+	cfg.Mode = "PipeMode"
+	cfg.HttpPort = "http"
+	cfg.SimModePipe = filepath.Join(dir, "missing", "simulator")
+	cfg.MsgFromSimPipe = dir // Directory instead of pipe
+	cfg.MsgToSimPipe = filepath.Join(dir, "msgToSim")
+	cfg.ModbusServer = ModbusServerConfig{Enabled: true, Address: ":5020", ByteOrder: "XYZW"}
+	err := Validate(cfg)
+	if err == nil {
+		t.Fatalf("Expected error, but no error thrown.")
+	}
+	for _, field := range []string{"httpPort", "simModePipe", "msgFromSimPipe", "modbusServer.byteOrder"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Expected error for %s, received: %v", field, err)
+		}
+	}
+	if strings.Contains(err.Error(), "msgToSimPipe") {
+		t.Errorf("Unexpected error for msgToSimPipe: %v", err)
+	}
+
+	cfg = Defaults()
+	cfg.Mode = "TCPMode"
+	cfg.TCPAddress = "localhost"
+	if err := Validate(cfg); err == nil || !strings.Contains(err.Error(), "tcpAddress") {
+		t.Errorf("Expected error for tcpAddress, received: %v", err)
+	}
+}
+
+// Test for Validate: machine IDs must be unique path segments, transports are checked per machine
+func TestValidate_Machines(t *testing.T) {
+	cfg := Defaults()
+	cfg.Mode = "TCPMode"
+	cfg.Machines = []MachineConfig{
+		{ID: "line2", Mode: "TCPMode", TCPAddress: "10.0.0.2:8081"},
+		{ID: "line2", Mode: "TCPMode", TCPAddress: "10.0.0.3:8081"},
+		{ID: "default", Mode: "TCPMode", TCPAddress: "10.0.0.4:8081"},
+		{ID: "line/5", Mode: "ModbusMode", ModbusClient: ModbusClientConfig{Address: ":502"}},
+	}
+	err := Validate(cfg)
+	if err == nil {
+		t.Fatalf("Expected error, but no error thrown.")
+	}
+	for _, field := range []string{"machines[1].id", "machines[2].id", "machines[3].id", "machines[3].modbusClient.address"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Expected error for %s, received: %v", field, err)
+		}
+	}
+	if strings.Contains(err.Error(), "machines[0]") {
+		t.Errorf("Unexpected error for machines[0]: %v", err)
+	}
+}
+
+// Test for Validate: sequence names, step types and wait conditions
+func TestValidate_Sequences(t *testing.T) {
+	cfg := Defaults()
+	cfg.Mode = "TCPMode"
+	cfg.Sequences = []SequenceConfig{
+		{Name: "startup", Steps: []SequenceStep{
+			{Type: "set", Command: "heater_pwm", Value: 80},
+			{Type: "wait", Signal: "temperature", Condition: ">=", Threshold: 200, Timeout: 600000},
+			{Type: "confirm", Message: "Filament path clear?"},
+		}},
+		{Name: "startup", Steps: []SequenceStep{
+			{Type: "jump"},
+			{Type: "wait", Signal: "temperature", Condition: "=>"},
+			{Type: "ramp", Duration: -1},
+		}, OnAbort: []SequenceStep{{Type: "confirm"}}},
+	}
+	err := Validate(cfg)
+	if err == nil {
+		t.Fatalf("Expected error, but no error thrown.")
+	}
+	for _, field := range []string{"sequences[1].name", "sequences[1].steps[0].type", "sequences[1].steps[1].condition",
+		"sequences[1].steps[2].command", "sequences[1].steps[2].duration", "sequences[1].onAbort[0].type"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Expected error for %s, received: %v", field, err)
+		}
+	}
+	if strings.Contains(err.Error(), "sequences[0]") {
+		t.Errorf("Unexpected error for sequences[0]: %v", err)
+	}
+}
+
+// Test for Validate and Print: webhooks and email are checked, secrets masked and restored by Unmask
+func TestNotifications(t *testing.T) {
+	cfg := Defaults()
+	cfg.Mode = "TCPMode"
+	cfg.Notifications.Webhooks = []WebhookConfig{
+		{Name: "ops", URL: "https://example.com/hook", Secret: "s3cret", Events: []string{"alarm.*", "spool.completed"}},
+		{Name: "ops", URL: "ftp://example.com", Events: []string{"spool.started"}},
+	}
+	cfg.Notifications.Email = EmailConfig{Server: "smtp.example.com", TLS: "ssl", From: "extruder", Password: "pw",
+		Recipients: map[string][]string{"urgent": {"ops@example.com"}}, Subject: "{{.Severity"}
+	err := Validate(cfg)
+	if err == nil {
+		t.Fatalf("Expected error, but no error thrown.")
+	}
+	for _, field := range []string{"notifications.webhooks[1].name", "notifications.webhooks[1].url", "notifications.webhooks[1].events",
+		"notifications.email.server", "notifications.email.tls", "notifications.email.from", "notifications.email.recipients.urgent", "notifications.email.subject"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected error for %s, received: %v", field, err)
+		}
+	}
+	if strings.Contains(err.Error(), "webhooks[0]") {
+		t.Errorf("Unexpected error for webhooks[0]: %v", err)
+	}
+
+	cfg.Notifications.Webhooks = cfg.Notifications.Webhooks[:1]
+	cfg.Notifications.Email = EmailConfig{Password: "pw"}
+	var buf bytes.Buffer
+	if err := Print(&buf, cfg); err != nil || strings.Contains(buf.String(), "s3cret") || strings.Contains(buf.String(), `"pw"`) {
+		t.Fatalf("Secret not masked: %s (%v)", buf.String(), err)
+	}
+	var printed Config
+	if err := json.Unmarshal(buf.Bytes(), &printed); err != nil {
+		t.Fatal(err)
+	}
+	Unmask(&printed, cfg)
+	if secret := printed.Notifications.Webhooks[0].Secret; secret != "s3cret" || printed.Notifications.Email.Password != "pw" {
+		t.Errorf("Expected: %v, received: %v", "s3cret", secret)
+	}
+}
+
+// Test for Schema: Every json key of the config structs is described
+func TestSchema_CoversConfig(t *testing.T) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(Schema, &schema); err != nil {
+		t.Fatalf("Invalid schema: %v", err)
+	}
+	var walk func(typ reflect.Type, props map[string]interface{}, path string)
+	walk = func(typ reflect.Type, props map[string]interface{}, path string) {
+		for i := 0; i < typ.NumField(); i++ {
+			key := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+			prop, ok := props[key].(map[string]interface{})
+			if !ok {
+				t.Errorf("Schema misses %s%s", path, key)
+				continue
+			}
+			if sub, ok := prop["properties"].(map[string]interface{}); ok && typ.Field(i).Type.Kind() == reflect.Struct {
+				walk(typ.Field(i).Type, sub, path+key+".")
+			}
+		}
+	}
+	walk(reflect.TypeOf(Config{}), schema["properties"].(map[string]interface{}), "")
+}
@@ -0,0 +1,240 @@
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// JSON schema of the config file
+//
+//go:embed schema.json
+var Schema []byte
+
+// Setting that can be overridden by environment variable and command line flag
+type setting struct {
+	flag   string
+	env    string
+	help   string
+	isBool bool
+	set    func(c *Config, v string) error
+}
+
+func stringSetting(flag, env, help string, field func(c *Config) *string) setting {
+	return setting{flag: flag, env: env, help: help, set: func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}}
+}
+
+func boolSetting(flag, env, help string, field func(c *Config) *bool) setting {
+	return setting{flag: flag, env: env, help: help, isBool: true, set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+// Overridable settings in order of application
+var settings = []setting{
+	stringSetting("mode", "EXTRUDER_MODE", "Data source: SimMode, PipeMode, TCPMode, ModbusMode", func(c *Config) *string { return &c.Mode }),
+	stringSetting("http-port", "EXTRUDER_HTTP_PORT", "HTTP port of the web UI", func(c *Config) *string { return &c.HttpPort }),
+	stringSetting("tcp-address", "EXTRUDER_TCP_ADDRESS", "host:port of the extruder in TCPMode", func(c *Config) *string { return &c.TCPAddress }),
+	stringSetting("sim-mode-pipe", "EXTRUDER_SIM_MODE_PIPE", "Path of the simulator pipe", func(c *Config) *string { return &c.SimModePipe }),
+	stringSetting("msg-from-sim-pipe", "EXTRUDER_MSG_FROM_SIM_PIPE", "Path of the incoming message pipe", func(c *Config) *string { return &c.MsgFromSimPipe }),
+	stringSetting("msg-to-sim-pipe", "EXTRUDER_MSG_TO_SIM_PIPE", "Path of the outgoing message pipe", func(c *Config) *string { return &c.MsgToSimPipe }),
+	boolSetting("mqtt-enabled", "EXTRUDER_MQTT_ENABLED", "Enable MQTT bridge", func(c *Config) *bool { return &c.MQTT.Enabled }),
+	stringSetting("mqtt-broker", "EXTRUDER_MQTT_BROKER", "host:port of the MQTT broker", func(c *Config) *string { return &c.MQTT.Broker }),
+	stringSetting("mqtt-username", "EXTRUDER_MQTT_USERNAME", "MQTT user name", func(c *Config) *string { return &c.MQTT.Username }),
+	stringSetting("mqtt-password", "EXTRUDER_MQTT_PASSWORD", "MQTT password", func(c *Config) *string { return &c.MQTT.Password }),
+	stringSetting("smtp-username", "EXTRUDER_SMTP_USERNAME", "SMTP user name of the email notifications", func(c *Config) *string { return &c.Notifications.Email.Username }),
+	stringSetting("smtp-password", "EXTRUDER_SMTP_PASSWORD", "SMTP password of the email notifications", func(c *Config) *string { return &c.Notifications.Email.Password }),
+	boolSetting("modbus-server-enabled", "EXTRUDER_MODBUS_SERVER_ENABLED", "Enable Modbus TCP server", func(c *Config) *bool { return &c.ModbusServer.Enabled }),
+	stringSetting("modbus-server-address", "EXTRUDER_MODBUS_SERVER_ADDRESS", "Listen address of the Modbus TCP server", func(c *Config) *string { return &c.ModbusServer.Address }),
+	stringSetting("modbus-client-address", "EXTRUDER_MODBUS_CLIENT_ADDRESS", "host:port of the PLC in ModbusMode", func(c *Config) *string { return &c.ModbusClient.Address }),
+	stringSetting("spool-history-file", "EXTRUDER_SPOOL_HISTORY_FILE", "Json file with the spool history", func(c *Config) *string { return &c.Spool.HistoryFile }),
+}
+
+// Command line options besides the config overrides
+type Options struct {
+	File           string
+	PrintConfig    bool
+	ValidateConfig bool
+	PrintSchema    bool
+}
+
+// Apply environment variables to config
+func applyEnv(config *Config, lookupEnv func(string) (string, bool)) error {
+	for _, s := range settings {
+		if v, ok := lookupEnv(s.env); ok {
+			if err := s.set(config, v); err != nil {
+				return fmt.Errorf("Invalid value for %s: %w", s.env, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Loader resolving the layered config: defaults, json file, environment variables, command line flags.
+// It keeps the parsed flags, so the config can be resolved again on reload.
+type Loader struct {
+	opts      Options
+	lookupEnv func(string) (string, bool)
+	overrides []func(c *Config) error
+}
+
+// Parse command line flags incl. the options to print or validate the config
+func NewLoader(args []string, lookupEnv func(string) (string, bool)) (*Loader, error) {
+	fs := flag.NewFlagSet("extruder_web_gui", flag.ContinueOnError)
+	l := RegisterFlags(fs, lookupEnv)
+	fs.BoolVar(&l.opts.PrintConfig, "print-config", false, "Print the effective config and exit")
+	fs.BoolVar(&l.opts.ValidateConfig, "validate-config", false, "Validate the config and exit")
+	fs.BoolVar(&l.opts.PrintSchema, "print-schema", false, "Print the JSON schema of the config file and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Register --config and the override flags on fs, the loader can be used after fs.Parse
+func RegisterFlags(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) *Loader {
+	l := &Loader{lookupEnv: lookupEnv}
+	fs.StringVar(&l.opts.File, "config", "ExtruderUIConfig.json", "Path of the json config file")
+	for _, s := range settings {
+		s := s
+		apply := func(v string) error {
+			l.overrides = append(l.overrides, func(c *Config) error {
+				if err := s.set(c, v); err != nil {
+					return fmt.Errorf("Invalid value for --%s: %w", s.flag, err)
+				}
+				return nil
+			})
+			return nil
+		}
+		usage := fmt.Sprintf("%s (env %s)", s.help, s.env)
+		if s.isBool {
+			fs.BoolFunc(s.flag, usage, apply)
+		} else {
+			fs.Func(s.flag, usage, apply)
+		}
+	}
+	return l
+}
+
+// Return parsed command line options
+func (l *Loader) Options() Options {
+	return l.opts
+}
+
+// Resolve config from the config file. The config is returned even if invalid (e.g. for --print-config).
+func (l *Loader) Load() (*Config, error) {
+	config := Defaults()
+	if err := loadFile(config, l.opts.File); err != nil {
+		return nil, err
+	}
+	return config, l.finish(config)
+}
+
+// Resolve config with r as file layer, e.g. a config uploaded via API
+func (l *Loader) Decode(r io.Reader) (*Config, error) {
+	config := Defaults()
+	if err := decode(config, r); err != nil {
+		return nil, err
+	}
+	return config, l.finish(config)
+}
+
+// Apply environment and flags, then validate
+func (l *Loader) finish(config *Config) error {
+	if err := applyEnv(config, l.lookupEnv); err != nil {
+		return err
+	}
+	for _, override := range l.overrides {
+		if err := override(config); err != nil {
+			return err
+		}
+	}
+	return Validate(config)
+}
+
+// Load layered config and set Cfg if it is valid
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, Options, error) {
+	l, err := NewLoader(args, lookupEnv)
+	if err != nil {
+		return nil, Options{}, err
+	}
+	config, err := l.Load()
+	if err == nil {
+		Set(config)
+	}
+	return config, l.opts, err
+}
+
+// Shown instead of passwords and secrets
+const Masked = "***"
+
+// Print config as json, the MQTT and SMTP passwords and webhook secrets are masked
+func Print(w io.Writer, config *Config) error {
+	masked := *config
+	if masked.MQTT.Password != "" {
+		masked.MQTT.Password = Masked
+	}
+	if masked.Notifications.Email.Password != "" {
+		masked.Notifications.Email.Password = Masked
+	}
+	masked.Notifications.Webhooks = append([]WebhookConfig{}, config.Notifications.Webhooks...)
+	for i := range masked.Notifications.Webhooks {
+		if masked.Notifications.Webhooks[i].Secret != "" {
+			masked.Notifications.Webhooks[i].Secret = Masked
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	return encoder.Encode(masked)
+}
+
+// Replace masked values of a config received from Print by the values of the current config.
+// Webhook secrets are matched by webhook name.
+func Unmask(config *Config, current *Config) {
+	if config.MQTT.Password == Masked {
+		config.MQTT.Password = current.MQTT.Password
+	}
+	if config.Notifications.Email.Password == Masked {
+		config.Notifications.Email.Password = current.Notifications.Email.Password
+	}
+	secrets := map[string]string{}
+	for _, hook := range current.Notifications.Webhooks {
+		secrets[hook.Name] = hook.Secret
+	}
+	for i, hook := range config.Notifications.Webhooks {
+		if hook.Secret == Masked {
+			config.Notifications.Webhooks[i].Secret = secrets[hook.Name]
+		}
+	}
+}
+
+// File and pipe paths the server opens for writing, by setting name
+func FilePaths(c *Config) map[string]string {
+	paths := map[string]string{
+		"simModePipe":       c.SimModePipe,
+		"msgFromSimPipe":    c.MsgFromSimPipe,
+		"msgToSimPipe":      c.MsgToSimPipe,
+		"audit.file":        c.Audit.File,
+		"eventLog.file":     c.EventLog.File,
+		"rules.file":        c.Rules.File,
+		"spool.historyFile": c.Spool.HistoryFile,
+	}
+	for _, m := range c.Machines {
+		prefix := fmt.Sprintf("machines[%s].", m.ID)
+		paths[prefix+"simModePipe"] = m.SimModePipe
+		paths[prefix+"msgFromSimPipe"] = m.MsgFromSimPipe
+		paths[prefix+"msgToSimPipe"] = m.MsgToSimPipe
+	}
+	return paths
+}
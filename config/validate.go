@@ -0,0 +1,313 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Supported data source modes
+var Modes = []string{"SimMode", "PipeMode", "TCPMode", "ModbusMode"}
+
+// IDs of machines are used as URL path segment
+var machineIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Supported word orders of 32 bit Modbus values, empty = ABCD
+var byteOrders = []string{"", "ABCD", "CDAB", "BADC", "DCBA"}
+
+// Check config for invalid values, all problems are reported at once
+func Validate(c *Config) error {
+	var errs []error
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+		}
+	}
+
+	check("mode", oneOf(c.Mode, Modes))
+	check("httpPort", validatePort(c.HttpPort))
+	validateTransport(check, "", c.Mode, c.TCPAddress, c.SimModePipe, c.MsgFromSimPipe, c.MsgToSimPipe, c.ModbusClient)
+	if c.MQTT.Enabled {
+		check("mqtt.broker", validateAddress(c.MQTT.Broker, true))
+		check("mqtt.keepAlive", nonNegative(c.MQTT.KeepAlive))
+	}
+	if c.ModbusServer.Enabled {
+		check("modbusServer.address", validateAddress(c.ModbusServer.Address, false))
+		check("modbusServer.byteOrder", oneOf(c.ModbusServer.ByteOrder, byteOrders))
+	}
+	if c.Timestamps.TimeZone != "" {
+		_, err := time.LoadLocation(c.Timestamps.TimeZone)
+		check("timestamps.timeZone", err)
+	}
+	for name, r := range c.SignalRanges {
+		if r[0] > r[1] {
+			check("signalRanges."+name, errors.New("min > max"))
+		}
+	}
+	validateWatchdog(check, "watchdog.", c.Watchdog)
+	if c.Spool.Tolerance < 0 {
+		check("spool.tolerance", errors.New("must not be negative"))
+	}
+	if c.Spool.Density < 0 {
+		check("spool.density", errors.New("must not be negative"))
+	}
+	if n := c.SPC.SubgroupSize; n != 0 && (n < 2 || n > 10) {
+		check("spc.subgroupSize", fmt.Errorf("%d not in range 2..10", n))
+	}
+	check("spc.baselineSubgroups", nonNegative(c.SPC.BaselineSubgroups))
+	check("spc.maxSubgroups", nonNegative(c.SPC.MaxSubgroups))
+	check("history.maxSamples", nonNegative(c.History.MaxSamples))
+	check("eventLog.retentionDays", nonNegative(c.EventLog.RetentionDays))
+	check("eventLog.maxEvents", nonNegative(c.EventLog.MaxEvents))
+	validateTargets(check, "targets.", c.Targets)
+	validateState(check, "state.", c.State)
+	check("estop.retryInterval", nonNegative(c.EStop.RetryInterval))
+	check("rules.maxActionsPerMinute", nonNegative(c.Rules.MaxActionsPerMinute))
+	check("rules.defaultCooldown", nonNegative(c.Rules.DefaultCooldown))
+	validateNotifications(check, c.Notifications)
+	names := map[string]bool{}
+	for i, seq := range c.Sequences {
+		prefix := fmt.Sprintf("sequences[%d].", i)
+		if seq.Name == "" {
+			check(prefix+"name", errors.New("must not be empty"))
+		} else if names[seq.Name] {
+			check(prefix+"name", fmt.Errorf("duplicate name %q", seq.Name))
+		}
+		names[seq.Name] = true
+		for j, step := range seq.Steps {
+			validateSequenceStep(check, fmt.Sprintf("%ssteps[%d].", prefix, j), step)
+		}
+		for j, step := range seq.OnAbort {
+			stepPrefix := fmt.Sprintf("%sonAbort[%d].", prefix, j)
+			if step.Type != "set" {
+				check(stepPrefix+"type", fmt.Errorf("only set steps are run on abort, got %q", step.Type))
+			}
+			validateSequenceStep(check, stepPrefix, step)
+		}
+	}
+	ids := map[string]bool{DefaultMachineID: true}
+	for i, m := range c.Machines {
+		prefix := fmt.Sprintf("machines[%d].", i)
+		if !machineIDPattern.MatchString(m.ID) {
+			check(prefix+"id", fmt.Errorf("invalid id %q, expected letters, digits, '-' or '_'", m.ID))
+		} else if ids[m.ID] {
+			check(prefix+"id", fmt.Errorf("duplicate id %q", m.ID))
+		}
+		ids[m.ID] = true
+		check(prefix+"mode", oneOf(m.Mode, Modes))
+		validateTransport(check, prefix, m.Mode, m.TCPAddress, m.SimModePipe, m.MsgFromSimPipe, m.MsgToSimPipe, m.ModbusClient)
+		for name, r := range m.SignalRanges {
+			if r[0] > r[1] {
+				check(prefix+"signalRanges."+name, errors.New("min > max"))
+			}
+		}
+		check(prefix+"history.maxSamples", nonNegative(m.History.MaxSamples))
+		validateTargets(check, prefix+"targets.", m.Targets)
+		validateState(check, prefix+"state.", m.State)
+		check(prefix+"estop.retryInterval", nonNegative(m.EStop.RetryInterval))
+		validateWatchdog(check, prefix+"watchdog.", m.Watchdog)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Invalid config:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Timeouts and check interval of a watchdog
+func validateWatchdog(check func(string, error), prefix string, c WatchdogConfig) {
+	check(prefix+"defaultTimeout", nonNegative(c.DefaultTimeout))
+	check(prefix+"checkInterval", nonNegative(c.CheckInterval))
+	for name, timeout := range c.Timeouts {
+		check(prefix+"timeouts."+name, nonNegative(timeout))
+	}
+}
+
+// Pipes and addresses used by the data source of a mode
+func validateTransport(check func(string, error), prefix, mode, tcpAddress, simModePipe, msgFromSimPipe, msgToSimPipe string, modbus ModbusClientConfig) {
+	switch mode {
+	case "SimMode":
+		check(prefix+"simModePipe", validatePipe(simModePipe))
+		check(prefix+"msgToSimPipe", validatePipe(msgToSimPipe))
+	case "PipeMode":
+		check(prefix+"simModePipe", validatePipe(simModePipe))
+		check(prefix+"msgFromSimPipe", validatePipe(msgFromSimPipe))
+		check(prefix+"msgToSimPipe", validatePipe(msgToSimPipe))
+	case "TCPMode":
+		check(prefix+"tcpAddress", validateAddress(tcpAddress, true))
+	case "ModbusMode":
+		check(prefix+"modbusClient.address", validateAddress(modbus.Address, true))
+		check(prefix+"modbusClient.byteOrder", oneOf(modbus.ByteOrder, byteOrders))
+		check(prefix+"modbusClient.pollInterval", nonNegative(modbus.PollInterval))
+		check(prefix+"modbusClient.timeout", nonNegative(modbus.Timeout))
+		check(prefix+"modbusClient.retries", nonNegative(modbus.Retries))
+		check(prefix+"modbusClient.maxGap", nonNegative(modbus.MaxGap))
+	}
+}
+
+func validateTargets(check func(string, error), prefix string, t TargetConfig) {
+	for field, v := range map[string]float64{"temperature": t.Temperature, "temperatureTolerance": t.TemperatureTolerance, "nominalDiameter": t.NominalDiameter, "tolerance": t.Tolerance} {
+		if v < 0 {
+			check(prefix+field, errors.New("must not be negative"))
+		}
+	}
+}
+
+func validateState(check func(string, error), prefix string, s StateConfig) {
+	check(prefix+"settleTime", nonNegative(s.SettleTime))
+	check(prefix+"historySize", nonNegative(s.HistorySize))
+}
+
+func validateSequenceStep(check func(string, error), prefix string, step SequenceStep) {
+	check(prefix+"type", oneOf(step.Type, SequenceStepTypes))
+	switch step.Type {
+	case "set", "ramp":
+		if step.Command == "" {
+			check(prefix+"command", errors.New("must not be empty"))
+		}
+	case "wait":
+		if step.Signal == "" {
+			check(prefix+"signal", errors.New("must not be empty"))
+		}
+		check(prefix+"condition", oneOf(step.Condition, SequenceConditions))
+	}
+	check(prefix+"duration", nonNegative(step.Duration))
+	check(prefix+"timeout", nonNegative(step.Timeout))
+}
+
+func oneOf(v string, allowed []string) error {
+	for _, a := range allowed {
+		if v == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown value %q, expected one of %q", v, allowed)
+}
+
+func nonNegative(v int) error {
+	if v < 0 {
+		return fmt.Errorf("%d must not be negative", v)
+	}
+	return nil
+}
+
+// Port number 1..65535
+func validatePort(port string) error {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %q, expected 1..65535", port)
+	}
+	return nil
+}
+
+// host:port, listen addresses may omit the host (":502")
+func validateAddress(addr string, hostRequired bool) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q, expected host:port", addr)
+	}
+	if hostRequired && host == "" {
+		return fmt.Errorf("host missing in %q", addr)
+	}
+	return validatePort(port)
+}
+
+// Pipe may be created later by the simulator, but its directory must exist
+func validatePipe(path string) error {
+	if path == "" {
+		return errors.New("path missing")
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		return fmt.Errorf("directory of %q does not exist", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("%q exists but is not a named pipe", path)
+	}
+	return nil
+}
+
+// Check webhooks and delivery settings
+func validateNotifications(check func(string, error), c NotificationConfig) {
+	check("notifications.maxAttempts", nonNegative(c.MaxAttempts))
+	check("notifications.backoff", nonNegative(c.Backoff))
+	check("notifications.maxBackoff", nonNegative(c.MaxBackoff))
+	check("notifications.timeout", nonNegative(c.Timeout))
+	names := map[string]bool{}
+	for i, hook := range c.Webhooks {
+		prefix := fmt.Sprintf("notifications.webhooks[%d].", i)
+		if hook.Name == "" {
+			check(prefix+"name", errors.New("must not be empty"))
+		} else if names[hook.Name] {
+			check(prefix+"name", fmt.Errorf("duplicate name %q", hook.Name))
+		}
+		names[hook.Name] = true
+		if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			check(prefix+"url", fmt.Errorf("%q is no http(s) URL", hook.URL))
+		}
+		for j, event := range hook.Events {
+			check(fmt.Sprintf("%sevents[%d]", prefix, j), eventFilter(event))
+		}
+	}
+	validateEmail(check, "notifications.email.", c.Email)
+}
+
+// Check SMTP server, addresses, templates and batching of the email notifications
+func validateEmail(check func(string, error), prefix string, c EmailConfig) {
+	check(prefix+"batch", nonNegative(c.Batch))
+	check(prefix+"cooldown", nonNegative(c.Cooldown))
+	check(prefix+"timeout", nonNegative(c.Timeout))
+	for j, event := range c.Events {
+		check(fmt.Sprintf("%sevents[%d]", prefix, j), eventFilter(event))
+	}
+	for _, field := range []struct{ name, text string }{{"subject", c.Subject}, {"body", c.Body}} {
+		if _, err := template.New(field.name).Parse(field.text); err != nil {
+			check(prefix+field.name, err)
+		}
+	}
+	if c.Server == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		check(prefix+"server", fmt.Errorf("%q is no host:port", c.Server))
+	}
+	if c.TLS != "" {
+		check(prefix+"tls", oneOf(c.TLS, EmailTLSModes))
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		check(prefix+"from", fmt.Errorf("invalid address %q", c.From))
+	}
+	if len(c.Recipients) == 0 {
+		check(prefix+"recipients", errors.New("no recipients for any severity"))
+	}
+	for severity, addresses := range c.Recipients {
+		check(prefix+"recipients."+severity, oneOf(severity, EmailSeverities))
+		for _, address := range addresses {
+			if _, err := mail.ParseAddress(address); err != nil {
+				check(prefix+"recipients."+severity, fmt.Errorf("invalid address %q", address))
+			}
+		}
+	}
+}
+
+// Check event filter: known event type or "<prefix>.*"
+func eventFilter(filter string) error {
+	for _, event := range NotificationEvents {
+		if event == filter || (strings.HasSuffix(filter, ".*") && strings.HasPrefix(event, strings.TrimSuffix(filter, "*"))) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q matches no event, options: %s", filter, strings.Join(NotificationEvents, ", "))
+}
@@ -1,11 +1,23 @@
 package controls
 
 import (
+	"cmp"
 	"encoding/json"
+	"errors"
+	"extruder_web_gui/audit"
 	"extruder_web_gui/config"
+	"extruder_web_gui/eventlog"
+	"extruder_web_gui/metrics"
+	"extruder_web_gui/modbus"
 	"extruder_web_gui/pipes"
+	"extruder_web_gui/ramp"
 	"extruder_web_gui/tcp"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // Assign IDs to outgoing msgs
@@ -16,8 +28,98 @@ const screw_rpm_id byte = 0x04
 const heater_pwm_id byte = 0x05
 const emergency_stop_id byte = 0x06
 
+// Command names used as metric labels
+var commandNames = map[byte]string{
+	man_auto_switch_id: "mode_switch",
+	auto_start_id:      "start",
+	spooler_rpm_id:     "spooler_rpm",
+	screw_rpm_id:       "screw_rpm",
+	heater_pwm_id:      "heater_pwm",
+	emergency_stop_id:  "emergency_stop",
+}
+
+// Valid value range per command (inclusive), see input limits in index.html
+var commandRanges = map[byte][2]uint32{
+	man_auto_switch_id: {0, 1},
+	spooler_rpm_id:     {0, 1000},
+	screw_rpm_id:       {0, 1000},
+	heater_pwm_id:      {0, 100},
+}
+
+// Last value sent per command ID
+var (
+	lastSentMu sync.Mutex
+	lastSent   = map[byte]uint32{}
+)
+
+// Ramps of the setpoints of the default machine
+var Ramps = ramp.NewManager(SendCommandByName, LastCommandValue)
+
+var commandsSentCounter = metrics.NewCounterVec("extruder_commands_sent_total", "Control commands sent per command type.", "command")
+
+// Check of commands against the process state, notified of every command sent
+type Guard interface {
+	Allow(command string, val uint32) error
+	Sent(command string, val uint32)
+}
+
+// Guard of the default machine, nil = every valid command is sent
+var guard Guard
+
+// Set guard of the commands of the default machine
+func SetGuard(g Guard) {
+	guard = g
+}
+
+// Command refused by the guard, answered with 409 Conflict
+type RejectedError struct {
+	Err error
+}
+
+func (e *RejectedError) Error() string { return e.Err.Error() }
+func (e *RejectedError) Unwrap() error { return e.Err }
+
+// Priority path of the emergency stop of the default machine, nil = sent like other commands
+var emergencyStop func(actor string, reason string) error
+
+// Set priority path of the emergency stop, e.g. a latch sending on every transport
+func SetEmergencyStop(fn func(actor string, reason string) error) {
+	emergencyStop = fn
+}
+
+// Trigger emergency stop of the default machine on behalf of actor
+func EmergencyStop(actor string, reason string) error {
+	if emergencyStop != nil {
+		return emergencyStop(actor, reason)
+	}
+	return sendCommand(emergency_stop_id, 1)
+}
+
+// Ask guard if the command may be sent
+func allow(g Guard, id byte, val uint32) error {
+	if g == nil {
+		return nil
+	}
+	if err := g.Allow(commandNames[id], val); err != nil {
+		return &RejectedError{Err: err}
+	}
+	return nil
+}
+
+// Answer failed command: 409 if rejected in the current state, 400 otherwise
+func commandError(w http.ResponseWriter, err error) {
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
 type ControlData struct {
-	Value uint32 `json:"value"`
+	Value    uint32  `json:"value"`
+	Rate     float64 `json:"rate,omitempty"`     // Optional ramp to Value: units per second
+	Duration int     `json:"duration,omitempty"` // Optional ramp to Value: ms
 }
 
 // Process json input and call function to send data via Pipe or TCP/IP Socket
@@ -27,13 +129,359 @@ func handleControlRequest(w http.ResponseWriter, r *http.Request, id byte) {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-	if config.Cfg.Mode == "TCPMode" {
-		tcp.SendTCPData(id, data.Value)
-	} else {
-		pipes.ToUserPipe(config.Cfg.MsgToSimPipe, id, data.Value)
+	control(w, id, data, SendCommand, Check, Ramps)
+}
+
+// Send the value of a control request, or start a ramp to it if a rate or duration is given.
+// A new value for a setpoint replaces its running ramp.
+func control(w http.ResponseWriter, id byte, data ControlData, send func(id byte, val uint32) error, check func(id byte, val uint32) error, ramps *ramp.Manager) {
+	name := commandNames[id]
+	if data.Rate == 0 && data.Duration == 0 {
+		if ramps != nil {
+			ramps.Cancel(name)
+		}
+		if err := send(id, data.Value); err != nil {
+			commandError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status": "success"}`))
+		return
+	}
+	if data.Rate < 0 || data.Duration < 0 || (data.Rate > 0 && data.Duration > 0) {
+		http.Error(w, "Either rate or duration must be set for a ramp", http.StatusBadRequest)
+		return
+	}
+	if !Rampable(name) || ramps == nil {
+		http.Error(w, name+" cannot be ramped", http.StatusBadRequest)
+		return
+	}
+	if err := check(id, data.Value); err != nil {
+		commandError(w, err)
+		return
+	}
+	duration := time.Duration(data.Duration) * time.Millisecond
+	if data.Rate > 0 {
+		duration = ramp.ForRate(ramps.From(name), data.Value, data.Rate)
+	}
+	progress := ramps.Start(name, data.Value, duration)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(progress)
+}
+
+// Report if a command is a setpoint that can be ramped
+func Rampable(name string) bool {
+	id, ok := CommandID(name)
+	if !ok || id == man_auto_switch_id {
+		return false
+	}
+	_, ok = commandRanges[id]
+	return ok
+}
+
+// Optional body of a ramp cancel request
+type CancelRampData struct {
+	Command string `json:"command"` // Empty = all ramps
+}
+
+// Handler for /ramps: GET running and last ramps per command, POST cancels ramps
+func RampsHandler(ramps *ramp.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ramps.Status())
+		case http.MethodPost:
+			var data CancelRampData
+			if r.ContentLength != 0 && r.Body != nil {
+				if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+					http.Error(w, "Invalid JSON", http.StatusBadRequest)
+					return
+				}
+			}
+			if data.Command == "" {
+				ramps.CancelAll()
+			} else if !ramps.Cancel(data.Command) {
+				http.Error(w, "No ramp running for "+data.Command, http.StatusNotFound)
+				return
+			}
+			audit.Record(audit.Entry{Actor: audit.Actor(r), Action: "ramp.cancel", Result: audit.ResultOK, Message: "Ramp cancelled: " + cmp.Or(data.Command, "all")})
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"status": "success"}`))
+		default:
+			http.Error(w, "Nur GET- und POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Return command ID for a command name (e.g. "screw_rpm")
+func CommandID(name string) (byte, bool) {
+	for id, cmdName := range commandNames {
+		if cmdName == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// Return command name for a command ID
+func CommandName(id byte) (string, bool) {
+	name, ok := commandNames[id]
+	return name, ok
+}
+
+// Return allowed value range of a command name, ok is false for commands without value
+func CommandRange(name string) (min uint32, max uint32, ok bool) {
+	id, known := CommandID(name)
+	if !known {
+		return 0, 0, false
+	}
+	limits, ok := commandRanges[id]
+	return limits[0], limits[1], ok
+}
+
+// Check if command ID is known and value is within the allowed range
+func ValidateCommand(id byte, val uint32) error {
+	if _, ok := commandNames[id]; !ok {
+		return fmt.Errorf("Unknown command ID 0x%02x", id)
+	}
+	if limits, ok := commandRanges[id]; ok && (val < limits[0] || val > limits[1]) {
+		return fmt.Errorf("Value %d for %s out of range [%d, %d]", val, commandNames[id], limits[0], limits[1])
+	}
+	return nil
+}
+
+// Validate and send command, used by integrations outside of the HTTP handlers
+func SendCommand(id byte, val uint32) error {
+	if err := ValidateCommand(id, val); err != nil {
+		return err
+	}
+	return sendCommand(id, val)
+}
+
+// Validate command and ask the guard without sending it, used before a ramp starts
+func Check(id byte, val uint32) error {
+	if err := ValidateCommand(id, val); err != nil {
+		return err
+	}
+	return allow(guard, id, val)
+}
+
+// Validate and send command by name (e.g. "screw_rpm")
+func SendCommandByName(name string, val uint32) error {
+	id, ok := CommandID(name)
+	if !ok {
+		return fmt.Errorf("Unknown command: %s", name)
+	}
+	return SendCommand(id, val)
+}
+
+// Return last value sent for a command name
+func LastCommandValue(name string) (uint32, bool) {
+	id, ok := CommandID(name)
+	if !ok {
+		return 0, false
+	}
+	lastSentMu.Lock()
+	defer lastSentMu.Unlock()
+	val, ok := lastSent[id]
+	return val, ok
+}
+
+// Send command via Pipe, TCP/IP Socket or Modbus depending on mode, if the guard allows it.
+// Emergency stops take the priority path if one is set.
+func sendCommand(id byte, val uint32) error {
+	if id == emergency_stop_id && emergencyStop != nil {
+		return emergencyStop("integration", "Command "+commandNames[id])
+	}
+	if err := allow(guard, id, val); err != nil {
+		commandEvent("", id, val, err)
+		return err
+	}
+	if err := Transmit(id, val); err != nil {
+		log.Printf("Failed to send %s: %v", commandNames[id], err)
+		commandEvent("", id, val, err)
+		return err
+	}
+	if guard != nil {
+		guard.Sent(commandNames[id], val)
+	}
+	commandEvent("", id, val, nil)
+	return nil
+}
+
+// Record command of a machine in the event log: sent commands as debug, rejected and failed ones as warning
+func commandEvent(source string, id byte, val uint32, err error) {
+	name := commandNames[id]
+	e := eventlog.Event{
+		Category: eventlog.CategoryCommand,
+		Severity: eventlog.SeverityDebug,
+		Source:   source,
+		Message:  fmt.Sprintf("Command %s = %d sent", name, val),
+		Fields:   map[string]string{"command": name, "value": strconv.FormatUint(uint64(val), 10)},
+	}
+	if err != nil {
+		var rejected *RejectedError
+		result := "failed"
+		if errors.As(err, &rejected) {
+			result = "rejected"
+		}
+		e.Severity, e.Message = eventlog.SeverityWarning, fmt.Sprintf("Command %s = %d %s: %v", name, val, result, err)
+		e.Fields["error"] = err.Error()
+	}
+	eventlog.Record(e)
+}
+
+// Send command via the transport of the active mode without guard, used by the emergency stop
+func Transmit(id byte, val uint32) error {
+	cfg := config.Current()
+	var err error
+	switch cfg.Mode {
+	case "TCPMode":
+		err = tcp.SendTCPData(id, val)
+	case "ModbusMode":
+		if err = modbus.SendCommand(commandNames[id], val); err != nil {
+			err = fmt.Errorf("Failed to send %s via Modbus: %w", commandNames[id], err)
+		}
+	default:
+		err = pipes.ToUserPipe(cfg.MsgToSimPipe, id, val)
+	}
+	if err != nil {
+		return err
+	}
+	commandsSentCounter.Inc(commandNames[id])
+	lastSentMu.Lock()
+	lastSent[id] = val
+	lastSentMu.Unlock()
+	return nil
+}
+
+// Transport of a further machine, commands of the default machine are sent via the active config
+type Target struct {
+	Source       string // Machine ID of the command events
+	Mode         string
+	MsgToSimPipe string
+	TCP          *tcp.ConnectionManager
+	Modbus       *modbus.Transport
+	Guard        Guard                                   // Optional check against the process state of the machine
+	EStop        func(actor string, reason string) error // Optional priority path of the emergency stop
+
+	mu       sync.Mutex
+	lastSent map[byte]uint32
+}
+
+// Validate and send command to the target
+func (t *Target) Send(id byte, val uint32) error {
+	if err := ValidateCommand(id, val); err != nil {
+		return err
+	}
+	if id == emergency_stop_id && t.EStop != nil {
+		return t.EStop("integration", "Command "+commandNames[id])
+	}
+	if err := allow(t.Guard, id, val); err != nil {
+		commandEvent(t.Source, id, val, err)
+		return err
+	}
+	if err := t.Transmit(id, val); err != nil {
+		commandEvent(t.Source, id, val, err)
+		return err
+	}
+	if t.Guard != nil {
+		t.Guard.Sent(commandNames[id], val)
+	}
+	commandEvent(t.Source, id, val, nil)
+	return nil
+}
+
+// Validate command and ask the guard of the target without sending it
+func (t *Target) Check(id byte, val uint32) error {
+	if err := ValidateCommand(id, val); err != nil {
+		return err
+	}
+	return allow(t.Guard, id, val)
+}
+
+// Send command via the transport of the target without guard, used by the emergency stop
+func (t *Target) Transmit(id byte, val uint32) error {
+	var err error
+	switch t.Mode {
+	case "TCPMode":
+		err = t.TCP.Send(id, val)
+	case "ModbusMode":
+		if err = t.Modbus.Send(commandNames[id], val); err != nil {
+			err = fmt.Errorf("Failed to send %s via Modbus: %w", commandNames[id], err)
+		}
+	default:
+		err = pipes.ToUserPipe(t.MsgToSimPipe, id, val)
+	}
+	if err != nil {
+		return err
+	}
+	commandsSentCounter.Inc(commandNames[id])
+	t.mu.Lock()
+	if t.lastSent == nil {
+		t.lastSent = map[byte]uint32{}
+	}
+	t.lastSent[id] = val
+	t.mu.Unlock()
+	return nil
+}
+
+// Return last value sent to the target for a command name
+func (t *Target) LastCommandValue(name string) (uint32, bool) {
+	id, ok := CommandID(name)
+	if !ok {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	val, ok := t.lastSent[id]
+	return val, ok
+}
+
+// Control endpoints below /control/ and their command IDs
+var controlPaths = map[string]byte{
+	"start":       auto_start_id,
+	"stop":        emergency_stop_id,
+	"screw-rpm":   screw_rpm_id,
+	"spooler-rpm": spooler_rpm_id,
+	"heater-pwm":  heater_pwm_id,
+	"mode":        man_auto_switch_id,
+}
+
+// Return path below /control/ of a command ID, e.g. "screw-rpm"
+func ControlPath(id byte) (string, bool) {
+	for path, pathID := range controlPaths {
+		if pathID == id {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// Handler for /machines/{id}/control/{command}: same requests as /control/..., sent via send.
+// Ramps are checked via check and run by ramps.
+func MachineHandler(send func(id byte, val uint32) error, check func(id byte, val uint32) error, ramps *ramp.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+			return
+		}
+		id, ok := controlPaths[r.PathValue("command")]
+		if !ok {
+			http.Error(w, "Unknown command: "+r.PathValue("command"), http.StatusNotFound)
+			return
+		}
+		data := ControlData{Value: 1} // Start and stop have no body
+		if _, hasValue := commandRanges[id]; hasValue {
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+		}
+		control(w, id, data, send, check, ramps)
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status": "success"}`))
 }
 
 // Handler for Screw RPM Input
@@ -54,10 +502,9 @@ func HeaterPwmHandler(w http.ResponseWriter, r *http.Request) {
 // Handler for Automatic Mode: Start Button
 func ButtonStartHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
-		if config.Cfg.Mode == "TCPMode" {
-			tcp.SendTCPData(auto_start_id, 1)
-		} else {
-			pipes.ToUserPipe(config.Cfg.MsgToSimPipe, auto_start_id, 1)
+		if err := sendCommand(auto_start_id, 1); err != nil {
+			commandError(w, err)
+			return
 		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Aktion erfolgreich ausgeführt"))
@@ -68,16 +515,36 @@ func ButtonStartHandler(w http.ResponseWriter, r *http.Request) {
 
 // Handler for Emergency Stop Button
 func ButtonEmergencyStopHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
-		if config.Cfg.Mode == "TCPMode" {
-			tcp.SendTCPData(emergency_stop_id, 1)
-		} else {
-			pipes.ToUserPipe(config.Cfg.MsgToSimPipe, emergency_stop_id, 1)
+	EmergencyStopHandler(EmergencyStop)(w, r)
+}
+
+// Optional body of an emergency stop request
+type EmergencyStopData struct {
+	Reason string `json:"reason"`
+}
+
+// Handler triggering an emergency stop via stop on behalf of the requesting operator.
+// 202 Accepted if the stop is latched but could not be delivered yet.
+func EmergencyStopHandler(stop func(actor string, reason string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+			return
+		}
+		data := EmergencyStopData{Reason: "Emergency stop button"}
+		if r.Body != nil {
+			json.NewDecoder(r.Body).Decode(&data) // Body is optional, the button sends {"value": null}
+		}
+		if data.Reason == "" {
+			data.Reason = "Emergency stop button"
+		}
+		if err := stop(audit.Actor(r), data.Reason); err != nil {
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(err.Error()))
+			return
 		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Aktion erfolgreich ausgeführt"))
-	} else {
-		http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -3,12 +3,32 @@ package controls
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"extruder_web_gui/config"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
 
+// Use a regular file as stand-in for the (Web UI -> User Program) pipe
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "controls_test")
+	if err != nil {
+		panic(err)
+	}
+	pipePath := filepath.Join(dir, "msgToSim")
+	if err := os.WriteFile(pipePath, nil, 0644); err != nil {
+		panic(err)
+	}
+	config.Cfg = &config.Config{Mode: "PipeMode", MsgToSimPipe: pipePath}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func TestHandleControlRequest(t *testing.T) {
 	testCases := []struct {
 		name           string
@@ -127,3 +147,123 @@ func TestButtonHandlers(t *testing.T) {
 		}
 	})
 }
+
+// Test for sendCommand: commands are counted per type
+func TestSendCommand_CountsCommands(t *testing.T) {
+	before := commandsSentCounter.Value("screw_rpm")
+	sendCommand(screw_rpm_id, 100)
+	if got := commandsSentCounter.Value("screw_rpm"); got != before+1 {
+		t.Errorf("Command counter wasn't incremented. Expected: %v, received: %v", before+1, got)
+	}
+}
+
+// Test for ValidateCommand: ranges and unknown IDs
+func TestValidateCommand(t *testing.T) {
+	testCases := []struct {
+		name      string
+		id        byte
+		value     uint32
+		expectErr bool
+	}{
+		{name: "Screw RPM in range", id: screw_rpm_id, value: 1000},
+		{name: "Screw RPM too high", id: screw_rpm_id, value: 1001, expectErr: true},
+		{name: "Heater PWM too high", id: heater_pwm_id, value: 101, expectErr: true},
+		{name: "Mode switch invalid", id: man_auto_switch_id, value: 2, expectErr: true},
+		{name: "Start", id: auto_start_id, value: 1},
+		{name: "Unknown ID", id: 0x42, value: 1, expectErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateCommand(tc.id, tc.value)
+			if (err != nil) != tc.expectErr {
+				t.Errorf("Unexpected validation result. Expected error: %v, received: %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+// Test for handleControlRequest: out of range value is rejected
+func TestHandleControlRequest_OutOfRange(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/control", strings.NewReader(`{"value": 150}`))
+	w := httptest.NewRecorder()
+	HeaterPwmHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+// Guard rejecting every command except the emergency stop, records sent commands
+type testGuard struct {
+	sent []string
+}
+
+func (g *testGuard) Allow(command string, val uint32) error {
+	if command == "emergency_stop" {
+		return nil
+	}
+	return errors.New("Not allowed in test")
+}
+
+func (g *testGuard) Sent(command string, val uint32) {
+	g.sent = append(g.sent, command)
+}
+
+// Test for Guard: rejected commands answer 409 and are not sent
+func TestGuard_RejectsCommand(t *testing.T) {
+	g := &testGuard{}
+	SetGuard(g)
+	defer SetGuard(nil)
+
+	w := httptest.NewRecorder()
+	HeaterPwmHandler(w, httptest.NewRequest("POST", "/control/heater-pwm", strings.NewReader(`{"value": 50}`)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+	w = httptest.NewRecorder()
+	ButtonEmergencyStopHandler(w, httptest.NewRequest("POST", "/control/stop", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if len(g.sent) != 1 || g.sent[0] != "emergency_stop" {
+		t.Errorf("Guard notified of wrong commands. Expected: %v, received: %v", []string{"emergency_stop"}, g.sent)
+	}
+}
+
+// Test for ramps on the control endpoints: accepted, rejected by the guard or invalid
+func TestHandleControlRequest_Ramp(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  func(http.ResponseWriter, *http.Request)
+		body     string
+		guard    Guard
+		expected int
+	}{
+		{"Duration", SpoolerRpmHandler, `{"value": 40, "duration": 60000}`, nil, http.StatusAccepted},
+		{"Rate", ScrewRpmHandler, `{"value": 40, "rate": 2}`, nil, http.StatusAccepted},
+		{"Rate and duration", ScrewRpmHandler, `{"value": 40, "rate": 2, "duration": 1000}`, nil, http.StatusBadRequest},
+		{"Mode", ModeSwitchHandler, `{"value": 1, "duration": 1000}`, nil, http.StatusBadRequest},
+		{"Out of range", HeaterPwmHandler, `{"value": 400, "duration": 1000}`, nil, http.StatusBadRequest},
+		{"Rejected", HeaterPwmHandler, `{"value": 50, "duration": 1000}`, &testGuard{}, http.StatusConflict},
+	}
+	defer Ramps.CancelAll()
+	for _, tc := range tests {
+		SetGuard(tc.guard)
+		w := httptest.NewRecorder()
+		tc.handler(w, httptest.NewRequest("POST", "/control", strings.NewReader(tc.body)))
+		if w.Code != tc.expected {
+			t.Errorf("%s: Expected status %d, got %d (%s)", tc.name, tc.expected, w.Code, w.Body.String())
+		}
+	}
+	SetGuard(nil)
+
+	status := Ramps.Status()
+	if status["spooler_rpm"].To != 40 || status["spooler_rpm"].Duration != 60000 {
+		t.Errorf("Unexpected spooler ramp: %+v", status["spooler_rpm"])
+	}
+	// Plain value replaces the running ramp
+	w := httptest.NewRecorder()
+	SpoolerRpmHandler(w, httptest.NewRequest("POST", "/control", strings.NewReader(`{"value": 5}`)))
+	if s := Ramps.Status()["spooler_rpm"]; w.Code != http.StatusOK || s.Status == "running" {
+		t.Errorf("Ramp not replaced: %d %+v", w.Code, s)
+	}
+}
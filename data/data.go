@@ -1,12 +1,14 @@
 package data
 
 import (
+	"extruder_web_gui/eventlog"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 )
 
@@ -14,6 +16,7 @@ import (
 type Datapoint struct {
 	Timestamp time.Time
 	Value     float32
+	Quality   Quality
 }
 type Dataset struct {
 	Temperature   Datapoint
@@ -31,176 +34,307 @@ type SpoolStats struct {
 	FilamentMass    Datapoint
 }
 
-var curSpoolStats SpoolStats
-var prevSpoolStats SpoolStats
-var currentData Dataset
+var timestampLayout string = "15:04:05.000"
 
-// SimMode: Assign columns to parameter
-var colMap = map[int]*Datapoint{
-	5: &currentData.Diameter,
-	6: &currentData.Temperature,
-	3: &currentData.SpoolerRpm,
-	2: &currentData.ScrewRpm,
-	4: &currentData.HeaterPwm,
-	7: &currentData.ContactSwitch,
+func DataHandler(w http.ResponseWriter, r *http.Request) {
+	Default.DataHandler(w, r)
 }
 
-var statsColMap = map[int]*Datapoint{
-	8:  &curSpoolStats.WindingDiameter,
-	9:  &curSpoolStats.AvgFilDiameter,
-	10: &curSpoolStats.NbrOfWindings,
-	11: &curSpoolStats.FilamentMass,
+// Handler for the current values of the store
+func (s *Store) DataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := SignalNames()
+	fmt.Fprint(w, "{\n")
+	for i, name := range names {
+		dp, _ := s.valueLocked(name)
+		separator := ","
+		if i == len(names)-1 {
+			separator = ""
+		}
+		fmt.Fprintf(w, "\t\t\"%s\": {\"timestamp\": \"%s\", \"value\": %.2f, \"quality\": \"%s\"}%s\n",
+			name, dp.Timestamp.Format(time.RFC3339Nano), dp.Value, dp.QualityOrStale(), separator)
+	}
+	fmt.Fprint(w, "\t}")
 }
 
-// MsgMode: Assign IDs of incoming messages to parameter
-var msgInMap = map[byte]*Datapoint{
-	0x01: &currentData.Diameter,
-	0x02: &currentData.Temperature,
-	0x03: &currentData.SpoolerRpm,
-	0x04: &currentData.ScrewRpm,
-	0x05: &currentData.HeaterPwm,
-	0x06: &currentData.ContactSwitch,
+func MessagesHandler(w http.ResponseWriter, r *http.Request) {
+	Default.MessagesHandler(w, r)
 }
 
-var messageChannel = make(chan string, 10)
+// Handler for the events of the store as text lines, including the incoming rows and messages
+func (s *Store) MessagesHandler(w http.ResponseWriter, r *http.Request) {
+	eventlog.Default.TextStreamHandler(s.Source)(w, r)
+}
 
-var timestampLayout string = "15:04:05.000"
+// Record event of the data source of the store, e.g. a lost connection or a malformed message
+func (s *Store) RecordEvent(category string, severity string, message string, fields map[string]string) {
+	eventlog.Record(eventlog.Event{Category: category, Severity: severity, Source: s.Source, Message: message, Fields: fields})
+}
 
-func DataHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{
-		"diameter": {"timestamp": "%s", "value": %.2f},
-		"temperature": {"timestamp": "%s", "value": %.2f},
-		"spoolerRpm": {"timestamp": "%s", "value": %.2f},
-		"screwRpm": {"timestamp": "%s", "value": %.2f},
-		"heaterPwm": {"timestamp": "%s", "value": %.2f},
-		"contactSwitch": {"timestamp": "%s", "value": %.2f},
-		"windingDiameter": {"timestamp": "%s", "value": %.2f},
-		"avgFilDiameter": {"timestamp": "%s", "value": %.2f},
-		"nbrOfWindings": {"timestamp": "%s", "value": %.2f},
-		"filamentMass": {"timestamp": "%s", "value": %.2f},
-		"prevWindingDiameter": {"timestamp": "%s", "value": %.2f},
-		"prevAvgFilDiameter": {"timestamp": "%s", "value": %.2f},
-		"prevNbrOfWindings": {"timestamp": "%s", "value": %.2f},
-		"prevFilamentMass": {"timestamp": "%s", "value": %.2f}
-	}`,
-		currentData.Diameter.Timestamp.Format(time.RFC3339Nano), currentData.Diameter.Value,
-		currentData.Temperature.Timestamp.Format(time.RFC3339Nano), currentData.Temperature.Value,
-		currentData.SpoolerRpm.Timestamp.Format(time.RFC3339Nano), currentData.SpoolerRpm.Value,
-		currentData.ScrewRpm.Timestamp.Format(time.RFC3339Nano), currentData.ScrewRpm.Value,
-		currentData.HeaterPwm.Timestamp.Format(time.RFC3339Nano), currentData.HeaterPwm.Value,
-		currentData.ContactSwitch.Timestamp.Format(time.RFC3339Nano), currentData.ContactSwitch.Value,
-		curSpoolStats.WindingDiameter.Timestamp.Format(time.RFC3339Nano), curSpoolStats.WindingDiameter.Value,
-		curSpoolStats.AvgFilDiameter.Timestamp.Format(time.RFC3339Nano), curSpoolStats.AvgFilDiameter.Value,
-		curSpoolStats.NbrOfWindings.Timestamp.Format(time.RFC3339Nano), curSpoolStats.NbrOfWindings.Value,
-		curSpoolStats.FilamentMass.Timestamp.Format(time.RFC3339Nano), curSpoolStats.FilamentMass.Value,
-		prevSpoolStats.WindingDiameter.Timestamp.Format(time.RFC3339Nano), prevSpoolStats.WindingDiameter.Value,
-		prevSpoolStats.AvgFilDiameter.Timestamp.Format(time.RFC3339Nano), prevSpoolStats.AvgFilDiameter.Value,
-		prevSpoolStats.NbrOfWindings.Timestamp.Format(time.RFC3339Nano), prevSpoolStats.NbrOfWindings.Value,
-		prevSpoolStats.FilamentMass.Timestamp.Format(time.RFC3339Nano), prevSpoolStats.FilamentMass.Value,
-	)
+// Parse errors of one kind are recorded at most once per interval, the others are counted
+const parseEventInterval = time.Minute
+
+// Recorded and suppressed parse errors of one kind
+type parseLimit struct {
+	recorded   time.Time
+	suppressed int
 }
 
-func MessagesHandler(w http.ResponseWriter, r *http.Request) {
-	// Set headers for SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	// Flush writer to send initial headers
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+// Record parse error of the data source, e.g. kind "timestamp". Errors of a kind recorded within
+// parseEventInterval are only counted and reported with the next recorded one.
+func (s *Store) ParseError(kind string, message string, fields map[string]string) {
+	now := time.Now()
+	s.parseMu.Lock()
+	limit := s.parseLimits[kind]
+	if limit == nil {
+		limit = &parseLimit{}
+		s.parseLimits[kind] = limit
+	}
+	if now.Sub(limit.recorded) < parseEventInterval {
+		limit.suppressed++
+		s.parseMu.Unlock()
 		return
 	}
+	suppressed := limit.suppressed
+	limit.recorded, limit.suppressed = now, 0
+	s.parseMu.Unlock()
 
-	for message := range messageChannel {
-		fmt.Fprintf(w, "data: %s\n\n", message)
-		flusher.Flush()
+	if suppressed > 0 {
+		message = fmt.Sprintf("%s (%d similar suppressed)", message, suppressed)
+		fields["suppressed"] = strconv.Itoa(suppressed)
 	}
+	fields["kind"] = kind
+	s.RecordEvent(eventlog.CategoryParse, eventlog.SeverityWarning, message, fields)
+}
+
+// Record raw row or message if a stream asks for it
+func (s *Store) traffic(message string, fields map[string]string) {
+	if eventlog.Wants(eventlog.CategoryTraffic) {
+		s.RecordEvent(eventlog.CategoryTraffic, eventlog.SeverityDebug, message, fields)
+	}
+}
+
+// Data of the main view template
+type MainView struct {
+	Dataset
+	Base string // Path prefix of data, control and message endpoints, e.g. "/machines/line2"
+	Name string // Machine name in the title, empty for the default machine
 }
 
 // Handler - Update main view schematics
 func MainViewHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("index.html"))
-	tmpl.Execute(w, currentData)
+	if err := Default.RenderMainView(w, "", ""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Render main view with the values of the store, endpoints are below base
+func (s *Store) RenderMainView(w io.Writer, base string, name string) error {
+	tmpl, err := template.ParseFiles("index.html")
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	view := MainView{Dataset: s.data, Base: base, Name: name}
+	s.mu.RUnlock()
+	return tmpl.Execute(w, view)
 }
 
 // SimMode: Function to get Values from Simulator Pipe row
 func GetValuesFromRow(line string, separator string) {
+	Default.GetValuesFromRow(line, separator)
+}
+
+// SimMode: Get values of the store from a simulator row
+func (s *Store) GetValuesFromRow(line string, separator string) {
+	if parsedTime, err := s.ParseRowTime(line, separator); err == nil {
+		s.GetValuesFromRowAt(line, separator, parsedTime)
+	}
+}
+
+// SimMode: Get values of the store from a simulator row with its already parsed timestamp
+func (s *Store) GetValuesFromRowAt(line string, separator string, parsedTime time.Time) {
 	strArr := strings.Split(line, separator)
 	if len(strArr) > 3 {
 		for idx, str := range strArr {
 			strArr[idx] = strings.TrimSpace(str)
 		}
-		timeStr := strings.Split(strArr[0], " ")[0]
-		parsedTime, err := time.Parse(timestampLayout, timeStr)
-		if err != nil {
-			log.Println("Error parsing timestamp:", err)
-			return
-		}
-		for key, val := range colMap {
+		var updates []Update
+		var parseErrors []string
+		s.mu.Lock()
+		for key, val := range s.colMap {
 			if key < len(strArr) { // Ensure key is within bounds of strArr
-				val64, _ := strconv.ParseFloat(strArr[key], 32)
-				val.Value = float32(val64)
-				val.Timestamp = parsedTime
+				val64, err := strconv.ParseFloat(strArr[key], 32)
+				if err != nil {
+					// Keep last good value, only mark it as bad
+					markBad(val, QualityBadParse)
+					parseErrors = append(parseErrors, fmt.Sprintf("%s (column %d): %q", s.pointNames[val], key, strArr[key]))
+				} else {
+					s.setPoint(s.pointNames[val], val, float32(val64), parsedTime)
+				}
+				updates = append(updates, Update{Signal: s.pointNames[val], Point: *val})
 			}
 		}
+		s.mu.Unlock()
+		s.notifyUpdates(updates)
+		s.rowErrors(parseErrors, line)
 	}
-	messageChannel <- line
+	s.traffic(line, map[string]string{"type": "row"})
 }
 
 // Function to get Winding Stats from Simulator Pipe row
 func GetStatsFromRow(line string, separator string) {
+	Default.GetStatsFromRow(line, separator)
+}
+
+// Get spool stats of the store from a simulator row
+func (s *Store) GetStatsFromRow(line string, separator string) {
+	if parsedTime, err := s.ParseRowTime(line, separator); err == nil {
+		s.GetStatsFromRowAt(line, separator, parsedTime)
+	}
+}
+
+// Get spool stats of the store from a simulator row with its already parsed timestamp
+func (s *Store) GetStatsFromRowAt(line string, separator string, parsedTime time.Time) {
 	strArr := strings.Split(line, separator)
 	if len(strArr) > 2 {
 		for idx, str := range strArr {
 			strArr[idx] = strings.TrimSpace(str)
 		}
-		timeStr := strings.Split(strArr[0], " ")[0]
-		parsedTime, err := time.Parse(timestampLayout, timeStr)
-		if err != nil {
-			log.Println("Error parsing timestamp:", err)
-			return
-		}
-		var tempStats SpoolStats = curSpoolStats
-		for key, val := range statsColMap {
+		var updates []Update
+		var parseErrors []string
+		s.mu.Lock()
+		var tempStats SpoolStats = s.curSpool
+		for key, val := range s.statsColMap {
 			if key < len(strArr) { // Ensure key is within bounds of strArr
-				val64, _ := strconv.ParseFloat(strArr[key], 32)
-				val.Value = float32(val64)
-				val.Timestamp = parsedTime
+				val64, err := strconv.ParseFloat(strArr[key], 32)
+				if err != nil {
+					// Keep last good value, only mark it as bad
+					markBad(val, QualityBadParse)
+					parseErrors = append(parseErrors, fmt.Sprintf("%s (column %d): %q", s.pointNames[val], key, strArr[key]))
+				} else {
+					s.setPoint(s.pointNames[val], val, float32(val64), parsedTime)
+				}
+				updates = append(updates, Update{Signal: s.pointNames[val], Point: *val})
+			}
+		}
+		// Replace the previous spool stats if the spool change rule matches
+		spoolCompleted := false
+		completed := s.sinceBaseline(tempStats)
+		if s.massBaseline > 0 && s.curSpool.FilamentMass.Value < tempStats.FilamentMass.Value {
+			// Mass dropped after a manual completion: shortly after it or with too little mass since
+			// the baseline it is the machine resetting the counter, otherwise a spool filled since then
+			if time.Since(s.baselineTime) > manualResetWindow && s.spoolChangeRule(completed, s.curSpool) {
+				s.prevSpool = completed
+				spoolCompleted = true
 			}
+			s.massBaseline = 0
+		} else if s.spoolChangeRule(tempStats, s.curSpool) {
+			s.prevSpool = completed
+			spoolCompleted = true
 		}
-		// Condition for replacing the previous spool stats: FilamentMass has been reset (smaller then prev. value) & New run is active (WindingDiameter Value)
-		if tempStats.FilamentMass.Value > curSpoolStats.FilamentMass.Value && tempStats.WindingDiameter.Value > 12 {
-			prevSpoolStats = tempStats
+		s.mu.Unlock()
+		s.notifyUpdates(updates)
+		s.rowErrors(parseErrors, line)
+		if spoolCompleted {
+			s.notifySpoolCompleted(completed)
 		}
+	}
+	s.traffic(line, map[string]string{"type": "stats"})
+}
+
+// SimMode: Parse the timestamp of a simulator row once for stats and values. Rows
+// without values carry no timestamp and return the zero time.
+func (s *Store) ParseRowTime(line string, separator string) (time.Time, error) {
+	strArr := strings.Split(line, separator)
+	if len(strArr) <= 2 {
+		return time.Time{}, nil
+	}
+	parsedTime, err := s.timestamps.parse(strings.TrimSpace(strArr[0]))
+	if err != nil {
+		log.Println("Error parsing timestamp:", err)
+		s.ParseError("timestamp", "Invalid timestamp: "+err.Error(), map[string]string{"row": line})
+	}
+	return parsedTime, err
+}
 
+// Record the values of a row that could not be parsed
+func (s *Store) rowErrors(parseErrors []string, line string) {
+	if len(parseErrors) > 0 {
+		s.ParseError("values", "Invalid values: "+strings.Join(parseErrors, ", "), map[string]string{"row": line})
 	}
-	messageChannel <- line
 }
 
 func GetValueFromMsg(msg []byte) {
+	Default.GetValueFromMsg(msg)
+}
+
+// MsgMode: Get value of the store from an 8 byte message
+func (s *Store) GetValueFromMsg(msg []byte) {
 	//Check if msg length is valid
 	if len(msg) != 8 {
 		log.Printf("Expected 8 bytes, got %d bytes", len(msg))
+		malformedCounter.Inc()
+		s.ParseError("length", fmt.Sprintf("Expected 8 bytes, got %d bytes", len(msg)), map[string]string{"message": fmt.Sprintf("%x", msg)})
 		return // Skip this message
 	}
 
-	//Decode id from first byte
-	id := msg[0]
-	//Decode value from the last 4 bytes
-	value := (uint32(msg[4]) << 24) | (uint32(msg[5]) << 16) | (uint32(msg[6]) << 8) | uint32(msg[7])
+	id, value := decodeMsg(msg)
+	msgReceivedCounter.Inc(fmt.Sprintf("0x%02x", id))
 
 	//Check if id matches metric and assign value
-	if datapoint, ok := msgInMap[id]; ok {
-		datapoint.Value = float32(value)
-		datapoint.Timestamp = time.Now() // Set the current time as the timestamp. Change to msg timestamp!
+	s.mu.Lock()
+	if datapoint, ok := s.msgInMap[id]; ok {
+		s.setPoint(s.pointNames[datapoint], datapoint, float32(value), time.Now()) // Set the current time as the timestamp. Change to msg timestamp!
+		update := Update{Signal: s.pointNames[datapoint], Point: *datapoint}
+		s.mu.Unlock()
+		s.notifyUpdates([]Update{update})
 	} else {
+		s.mu.Unlock()
 		log.Printf("No matching ID %d for incoming message\n", id)
+		unknownIDCounter.Inc()
+		s.ParseError("unknownID", fmt.Sprintf("No matching ID 0x%02x for incoming message", id), map[string]string{"message": fmt.Sprintf("%x", msg)})
 		return // Skip this message
 	}
 
-	message := fmt.Sprintf("%s: %x", time.Now().Format("15:04:05"), msg)
-	messageChannel <- message
+	s.traffic(fmt.Sprintf("%x", msg), map[string]string{"type": "message", "id": fmt.Sprintf("0x%02x", id), "value": strconv.FormatUint(uint64(value), 10)})
+}
+
+// Id from the first byte, value from the last 4 bytes
+func decodeMsg(msg []byte) (byte, uint32) {
+	return msg[0], (uint32(msg[4]) << 24) | (uint32(msg[5]) << 16) | (uint32(msg[6]) << 8) | uint32(msg[7])
+}
+
+// Decode 8 byte message without storing it, signal is empty for unknown IDs
+func DecodeMsg(msg []byte) (id byte, value uint32, signal string, err error) {
+	if len(msg) != 8 {
+		return 0, 0, "", fmt.Errorf("Expected 8 bytes, got %d bytes", len(msg))
+	}
+	id, value = decodeMsg(msg)
+	if datapoint, ok := Default.msgInMap[id]; ok {
+		signal = Default.pointNames[datapoint]
+	}
+	return id, value, signal, nil
+}
+
+// Function to set a process signal by name (e.g. from a polled device)
+func SetValue(name string, value float32, timestamp time.Time) error {
+	return Default.SetValue(name, value, timestamp)
+}
+
+// Set a process signal of the store by name
+func (s *Store) SetValue(name string, value float32, timestamp time.Time) error {
+	s.mu.Lock()
+	datapoint := processPoint(&s.data, name)
+	if datapoint == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("Unknown process signal: %s", name)
+	}
+	s.setPoint(name, datapoint, value, timestamp)
+	update := Update{Signal: name, Point: *datapoint}
+	s.mu.Unlock()
+	s.notifyUpdates([]Update{update})
+	return nil
 }
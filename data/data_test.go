@@ -1,7 +1,12 @@
 package data
 
 import (
+	"encoding/json"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/eventlog"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 // Test for GetValuesFromRow: Valid input line
@@ -18,12 +23,12 @@ func TestGetValuesFromRow_ValidLine(t *testing.T) {
 	expectedDiameter := float32(1.7)
 
 	// Check if values have changed to target values
-	if currentData.Temperature.Value != expectedTemperature {
-		t.Errorf("Temperature wasn't updated correctly. Expected: %v, received: %v", expectedTemperature, currentData.Temperature.Value)
+	if Default.data.Temperature.Value != expectedTemperature {
+		t.Errorf("Temperature wasn't updated correctly. Expected: %v, received: %v", expectedTemperature, Default.data.Temperature.Value)
 	}
 
-	if currentData.Diameter.Value != expectedDiameter {
-		t.Errorf("Diameter wasn't updated correctly. Expected: %v, received: %v", expectedDiameter, currentData.Diameter.Value)
+	if Default.data.Diameter.Value != expectedDiameter {
+		t.Errorf("Diameter wasn't updated correctly. Expected: %v, received: %v", expectedDiameter, Default.data.Diameter.Value)
 	}
 }
 
@@ -32,21 +37,29 @@ func TestGetValuesFromRow_InvalidValues(t *testing.T) {
 	// Invalid data line
 	invalidLine := "12:00:00.000 | 1.0 | 2.5 | 50 | 100 | 2.0 | X | 0 | 50 | 2 | 50 | 100"
 
+	Default.data.Temperature.Value = float32(201.1)
+
 	// Call GetValuesFromRow with right formatting but invalid data
-	// Expected result: invalid value in data struct not changed
+	// Expected result: invalid value keeps last good value and is marked bad
 	GetValuesFromRow(invalidLine, "|")
 
 	// Expected values
-	expectedTemperature := float32(0) //Initial value
+	expectedTemperature := float32(201.1) //Last good value
 	expectedDiameter := float32(2)
 
 	// Check if values have changed to target values
-	if currentData.Temperature.Value != expectedTemperature {
-		t.Errorf("Temperature wasn't updated correctly. Expected: %v, received: %v", expectedTemperature, currentData.Temperature.Value)
+	if Default.data.Temperature.Value != expectedTemperature {
+		t.Errorf("Temperature wasn't updated correctly. Expected: %v, received: %v", expectedTemperature, Default.data.Temperature.Value)
+	}
+	if Default.data.Temperature.Quality != QualityBadParse {
+		t.Errorf("Temperature quality wrong. Expected: %v, received: %v", QualityBadParse, Default.data.Temperature.Quality)
+	}
+	if Default.data.Diameter.Quality != QualityGood {
+		t.Errorf("Diameter quality wrong. Expected: %v, received: %v", QualityGood, Default.data.Diameter.Quality)
 	}
 
-	if currentData.Diameter.Value != expectedDiameter {
-		t.Errorf("Diameter wasn't updated correctly. Expected: %v, received: %v", expectedDiameter, currentData.Diameter.Value)
+	if Default.data.Diameter.Value != expectedDiameter {
+		t.Errorf("Diameter wasn't updated correctly. Expected: %v, received: %v", expectedDiameter, Default.data.Diameter.Value)
 	}
 }
 
@@ -55,8 +68,8 @@ func TestGetValuesFromRow_InvalidFormat(t *testing.T) {
 	// Invalid data line
 	invalidLine := "12:00:00.000 | 1.0 | 100 "
 
-	currentData.ScrewRpm.Value = float32(30)
-	currentData.Diameter.Value = float32(0)
+	Default.data.ScrewRpm.Value = float32(30)
+	Default.data.Diameter.Value = float32(0)
 
 	// Call GetValuesFromRow with right formatting but invalid data
 	// Expected result: No change in data struct if input string has less then 3 "|" separators
@@ -67,12 +80,12 @@ func TestGetValuesFromRow_InvalidFormat(t *testing.T) {
 	expectedDiameter := float32(0)
 
 	// Check if values have changed to target values
-	if currentData.ScrewRpm.Value != expectedScrewRpm {
-		t.Errorf("ScrewRpm wasn't updated correctly. Expected: %v, received: %v", expectedScrewRpm, currentData.ScrewRpm.Value)
+	if Default.data.ScrewRpm.Value != expectedScrewRpm {
+		t.Errorf("ScrewRpm wasn't updated correctly. Expected: %v, received: %v", expectedScrewRpm, Default.data.ScrewRpm.Value)
 	}
 
-	if currentData.Diameter.Value != expectedDiameter {
-		t.Errorf("Diameter wasn't updated correctly. Expected: %v, received: %v", expectedDiameter, currentData.Diameter.Value)
+	if Default.data.Diameter.Value != expectedDiameter {
+		t.Errorf("Diameter wasn't updated correctly. Expected: %v, received: %v", expectedDiameter, Default.data.Diameter.Value)
 	}
 }
 
@@ -90,11 +103,11 @@ func TestGetStatsFromRow_ValidLine(t *testing.T) {
 	expectedFilamentMass := float32(200)
 
 	// Check if values have changed to target values
-	if curSpoolStats.WindingDiameter.Value != expectedWindingDiameter {
-		t.Errorf("WindingDiameter wasn't updated correctly. Expected: %v, received: %v", expectedWindingDiameter, curSpoolStats.WindingDiameter.Value)
+	if Default.curSpool.WindingDiameter.Value != expectedWindingDiameter {
+		t.Errorf("WindingDiameter wasn't updated correctly. Expected: %v, received: %v", expectedWindingDiameter, Default.curSpool.WindingDiameter.Value)
 	}
-	if curSpoolStats.FilamentMass.Value != expectedFilamentMass {
-		t.Errorf("FilamentMass wasn't updated correctly. Expected: %v, received: %v", expectedFilamentMass, curSpoolStats.FilamentMass.Value)
+	if Default.curSpool.FilamentMass.Value != expectedFilamentMass {
+		t.Errorf("FilamentMass wasn't updated correctly. Expected: %v, received: %v", expectedFilamentMass, Default.curSpool.FilamentMass.Value)
 	}
 }
 
@@ -103,20 +116,52 @@ func TestGetStatsFromRow_InvalidLine(t *testing.T) {
 	// Invalid data line
 	invalidLine := "12:00:00.000 | X | 1.2 | X | 100 | 1 | 220.5 | 0 | 70| 32 | X | X"
 
+	Default.curSpool.FilamentMass.Value = float32(200)
+
 	// Call GetStatsFromRow with invalid data
-	// Expected result: Data unchanged
+	// Expected result: Invalid values keep last good value
 	GetStatsFromRow(invalidLine, "|")
 
 	// Expected values
 	expectedWindingDiameter := float32(70)
-	expectedFilamentMass := float32(0) //Initial value
+	expectedFilamentMass := float32(200) //Last good value
 
 	// Check if values have changed to target values with 2 examples
-	if curSpoolStats.WindingDiameter.Value != expectedWindingDiameter {
-		t.Errorf("WindingDiameter wasn't updated correctly. Expected: %v, received: %v", expectedWindingDiameter, curSpoolStats.WindingDiameter.Value)
+	if Default.curSpool.WindingDiameter.Value != expectedWindingDiameter {
+		t.Errorf("WindingDiameter wasn't updated correctly. Expected: %v, received: %v", expectedWindingDiameter, Default.curSpool.WindingDiameter.Value)
+	}
+	if Default.curSpool.FilamentMass.Value != expectedFilamentMass {
+		t.Errorf("FilamentMass wasn't updated correctly. Expected: %v, received: %v", expectedFilamentMass, Default.curSpool.FilamentMass.Value)
 	}
-	if curSpoolStats.FilamentMass.Value != expectedFilamentMass {
-		t.Errorf("FilamentMass wasn't updated correctly. Expected: %v, received: %v", expectedFilamentMass, curSpoolStats.FilamentMass.Value)
+	if Default.curSpool.FilamentMass.Quality != QualityBadParse {
+		t.Errorf("FilamentMass quality wrong. Expected: %v, received: %v", QualityBadParse, Default.curSpool.FilamentMass.Quality)
+	}
+}
+
+// Test for CompleteSpool: the reset right after a manual completion is swallowed, a later drop completes the mass since the baseline
+func TestCompleteSpool_Baseline(t *testing.T) {
+	s, _ := NewStore(DefaultDictionary())
+	var completed []float32
+	s.SubscribeSpoolCompleted(func(stats SpoolStats) { completed = append(completed, stats.FilamentMass.Value) })
+
+	s.GetStatsFromRow("12:00:00.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 60 | 1.75 | 100 | 500", "|")
+	s.CompleteSpool()
+	s.GetStatsFromRow("12:00:01.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 60 | 1.75 | 100 | 0", "|")
+	if len(completed) != 1 {
+		t.Errorf("Reset after manual completion. Expected: %v, received: %v", []float32{500}, completed)
+	}
+
+	// Machine doesn't reset its counter at the manual change, the next drop is a real spool end
+	s.GetStatsFromRow("12:00:02.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 60 | 1.75 | 100 | 500", "|")
+	s.CompleteSpool()
+	s.baselineTime = s.baselineTime.Add(-2 * manualResetWindow)
+	s.GetStatsFromRow("12:00:03.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 60 | 1.75 | 100 | 900", "|")
+	if mass := s.CurrentSpool().FilamentMass.Value; mass != 400 {
+		t.Errorf("Expected: %v, received: %v", 400, mass)
+	}
+	s.GetStatsFromRow("12:00:04.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 10 | 1.75 | 0 | 0", "|")
+	if len(completed) != 3 || completed[2] != 400 {
+		t.Errorf("Expected: %v, received: %v", []float32{500, 500, 400}, completed)
 	}
 }
 
@@ -132,21 +177,21 @@ func TestGetValueFromMsg_ValidMsg(t *testing.T) {
 	expectedValue := float32(100)
 
 	// Check if temperature value was updated
-	if currentData.Temperature.Value != expectedValue {
-		t.Errorf("Value wasn't updated correctly. Expected: %v, received: %v", expectedValue, currentData.Temperature.Value)
+	if Default.data.Temperature.Value != expectedValue {
+		t.Errorf("Value wasn't updated correctly. Expected: %v, received: %v", expectedValue, Default.data.Temperature.Value)
 	}
 }
 
 // Test for GetValueFromMsg: Msg not 8bytes long
 func TestGetValueFromMsg_ShortMsg(t *testing.T) {
 	prevValue := float32(50)
-	currentData.Temperature.Value = prevValue
+	Default.data.Temperature.Value = prevValue
 	//Msg with invalid length
 	invalidLenMsg := []byte{0x02, 0x00, 0x00}
 	// Call function with msg of invalid number of bytes
 	//Expected result: temperature value in data struct unchanged
 	GetValueFromMsg(invalidLenMsg)
-	if currentData.Temperature.Value != prevValue {
+	if Default.data.Temperature.Value != prevValue {
 		t.Errorf("Invalid message shouldn't change current data value.")
 	}
 }
@@ -156,12 +201,191 @@ func TestGetValueFromMsg_UnknownID(t *testing.T) {
 	//Msg with undefined msg ID
 	invalidIDMsg := []byte{0x99, 0x00, 0x00, 0x00, 0xDC, 0x00, 0x00, 0x00}
 	// Save previous data content
-	oldData := currentData
+	oldData := Default.data
 	// Call function with invalid ID msg
 	//Expected result: temperature value in data struct unchanged
 	GetValueFromMsg(invalidIDMsg)
 	//Check if values have changed
-	if currentData != oldData {
-		t.Errorf("Invalid message changed values! Expected: %v, received: %v", oldData, currentData)
+	if Default.data != oldData {
+		t.Errorf("Invalid message changed values! Expected: %v, received: %v", oldData, Default.data)
+	}
+}
+
+// Test for GetValueFromMsg: unknown msg ID recorded as parse warning, repeated errors are rate limited
+func TestGetValueFromMsg_ParseEvent(t *testing.T) {
+	Default.parseMu.Lock()
+	Default.parseLimits = map[string]*parseLimit{}
+	Default.parseMu.Unlock()
+	events, stop := eventlog.Default.Subscribe(eventlog.Filter{Categories: []string{eventlog.CategoryParse}})
+	defer stop()
+	for i := 0; i < 3; i++ {
+		GetValueFromMsg([]byte{0x99, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10})
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected: %v, received: %v events", 1, len(events))
+	}
+	if e := <-events; e.Severity != eventlog.SeverityWarning || e.Fields["message"] != "9900000000000010" || e.Fields["kind"] != "unknownID" {
+		t.Errorf("Unexpected event: %+v", e)
+	}
+
+	// Next error after the interval reports the suppressed ones
+	Default.parseMu.Lock()
+	Default.parseLimits["unknownID"].recorded = time.Now().Add(-parseEventInterval)
+	Default.parseMu.Unlock()
+	GetValueFromMsg([]byte{0x99, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10})
+	if e := <-events; e.Fields["suppressed"] != "2" {
+		t.Errorf("Expected: %v suppressed, received: %+v", 2, e)
+	}
+}
+
+// Test for GetValueFromMsg: received, malformed and unknown ID counters
+func TestGetValueFromMsg_Counters(t *testing.T) {
+	receivedBefore := msgReceivedCounter.Value("0x02")
+	malformedBefore := malformedCounter.Value()
+	unknownBefore := unknownIDCounter.Value()
+
+	GetValueFromMsg([]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10})
+	GetValueFromMsg([]byte{0x02, 0x00})
+	GetValueFromMsg([]byte{0x99, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10})
+
+	if got := msgReceivedCounter.Value("0x02"); got != receivedBefore+1 {
+		t.Errorf("Received counter wrong. Expected: %v, received: %v", receivedBefore+1, got)
+	}
+	if got := malformedCounter.Value(); got != malformedBefore+1 {
+		t.Errorf("Malformed counter wrong. Expected: %v, received: %v", malformedBefore+1, got)
+	}
+	if got := unknownIDCounter.Value(); got != unknownBefore+1 {
+		t.Errorf("Unknown ID counter wrong. Expected: %v, received: %v", unknownBefore+1, got)
+	}
+}
+
+// Test for setPoint: values outside the configured range are marked
+func TestSetValue_OutOfRange(t *testing.T) {
+	ConfigureRanges(map[string][2]float64{"temperature": {0, 400}})
+	defer ConfigureRanges(map[string][2]float64{})
+
+	SetValue("temperature", 450, time.Now())
+	if Default.data.Temperature.Quality != QualityOutOfRange || Default.data.Temperature.Value != 450 {
+		t.Errorf("Expected out-of-range value 450, received: %+v", Default.data.Temperature)
+	}
+	SetValue("temperature", 210, time.Now())
+	if Default.data.Temperature.Quality != QualityGood {
+		t.Errorf("Expected good quality, received: %v", Default.data.Temperature.Quality)
+	}
+}
+
+// Test for qualityAlarms: bad-parse and out-of-range raise a warning per signal, a good value clears it
+func TestQualityAlarms(t *testing.T) {
+	s, err := NewStore(DefaultDictionary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Source = "line2"
+	s.ConfigureRanges(map[string][2]float64{"temperature": {0, 400}})
+	id := "quality:line2:temperature"
+	t.Cleanup(func() { alarms.Clear(id) })
+
+	s.GetValuesFromRow("12:00:00.000 | 1.0 | 2.5 | 50 | 100 | 2.0 | X | 0 | 50 | 2 | 50 | 100", "|")
+	if a, ok := activeAlarm(id); !ok || a.Severity != alarms.SeverityWarning || a.Fields["quality"] != string(QualityBadParse) || a.Fields["machine"] != "line2" {
+		t.Errorf("Expected bad-parse warning, received: %+v", a)
+	}
+	if _, ok := activeAlarm("quality:line2:diameter"); ok {
+		t.Errorf("Diameter is good, no alarm expected")
+	}
+
+	s.SetValue("temperature", 450, time.Now())
+	if a, _ := activeAlarm(id); a.Fields["quality"] != string(QualityOutOfRange) {
+		t.Errorf("Expected: %v, received: %v", QualityOutOfRange, a.Fields["quality"])
+	}
+
+	s.SetValue("temperature", 210, time.Now())
+	if alarms.IsActive(id) {
+		t.Errorf("Alarm should be cleared by a good value")
+	}
+}
+
+// Return active alarm by ID
+func activeAlarm(id string) (alarms.Alarm, bool) {
+	for _, a := range alarms.Active() {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return alarms.Alarm{}, false
+}
+
+// Test for Substitute and DataHandler: quality is part of /data
+func TestDataHandler_Quality(t *testing.T) {
+	Substitute("screwRpm", 12)
+
+	w := httptest.NewRecorder()
+	DataHandler(w, httptest.NewRequest("GET", "/data", nil))
+	var result map[string]struct {
+		Value   float64 `json:"value"`
+		Quality string  `json:"quality"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("/data is no valid json: %v", err)
+	}
+	if result["screwRpm"].Quality != string(QualitySubstituted) || result["screwRpm"].Value != 12 {
+		t.Errorf("Unexpected screwRpm entry: %+v", result["screwRpm"])
+	}
+	if len(result) != 14 {
+		t.Errorf("Expected 14 signals, received: %d", len(result))
+	}
+}
+
+// Test for NewStore: own signal dictionary, values are not shared with the default store
+func TestNewStore_Dictionary(t *testing.T) {
+	store, err := NewStore(Dictionary{
+		MsgIDs:  map[byte]string{0x10: "temperature"},
+		Columns: map[int]string{1: "diameter", 2: "filamentMass"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := Value("diameter")
+	store.GetValueFromMsg([]byte{0x10, 0, 0, 0, 0, 0, 0, 0xbe})
+	store.GetValuesFromRow("12:00:00.000 | 1.8 | 250 | 0", "|")
+	store.GetStatsFromRow("12:00:00.000 | 1.8 | 250 | 0", "|")
+	if dp, _ := store.Value("temperature"); dp.Value != 190 {
+		t.Errorf("Temperature wasn't updated correctly. Expected: 190, received: %v", dp.Value)
+	}
+	if dp, _ := store.Value("diameter"); dp.Value != 1.8 {
+		t.Errorf("Diameter wasn't updated correctly. Expected: 1.8, received: %v", dp.Value)
+	}
+	if dp, _ := store.Value("filamentMass"); dp.Value != 250 {
+		t.Errorf("FilamentMass wasn't updated correctly. Expected: 250, received: %v", dp.Value)
+	}
+	if after, _ := Value("diameter"); after != before {
+		t.Errorf("Default store changed. Expected: %v, received: %v", before, after)
+	}
+	if store.LastReceived().IsZero() {
+		t.Errorf("Expected receive time to be set")
+	}
+	if src := store.SignalSource("temperature"); src.MsgID != 0x10 || src.Column != 0 {
+		t.Errorf("Unexpected source. Expected: {16 0}, received: %v", src)
+	}
+
+	if _, err := NewStore(Dictionary{MsgIDs: map[byte]string{0x01: "filamentMass"}}); err == nil {
+		t.Errorf("Expected error for spool signal as message, but no error thrown.")
+	}
+}
+
+// Test for ParseRowTime: stats and values of a row share one timestamp sample
+func TestParseRowTime_OncePerRow(t *testing.T) {
+	s, _ := NewStore(DefaultDictionary())
+	line := "12:00:00.000 | 1.0 | 2.5 | 50 | 100 | 1.7 | 201.1 | 0 | 50 | 2 | 50 | 100"
+	parsedTime, err := s.ParseRowTime(line, "|")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s.GetStatsFromRowAt(line, "|", parsedTime)
+	s.GetValuesFromRowAt(line, "|", parsedTime)
+	if samples := s.timestamps.clockStatus().Samples; samples != 1 {
+		t.Errorf("Expected: %v, received: %v", 1, samples)
+	}
+	if dp, _ := s.Value("temperature"); !dp.Timestamp.Equal(parsedTime) {
+		t.Errorf("Expected: %v, received: %v", parsedTime, dp.Timestamp)
 	}
 }
@@ -0,0 +1,137 @@
+package data
+
+import "time"
+
+// Update of a single process or spool signal
+type Update struct {
+	Signal string // Signal name as used in /data
+	Point  Datapoint
+}
+
+// Spool listeners are called in order of registration
+type spoolListener struct {
+	id int
+	fn func(SpoolStats)
+}
+
+// Register function called for every signal update, returns function to unsubscribe.
+// Listeners are called synchronously from the parsing goroutine and must not block.
+func Subscribe(fn func(Update)) func() {
+	return Default.Subscribe(fn)
+}
+
+// Register function called for every signal update of the store, returns function to unsubscribe
+func (s *Store) Subscribe(fn func(Update)) func() {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	s.nextListenerID++
+	id := s.nextListenerID
+	s.updateListeners[id] = fn
+	return func() {
+		s.listenerMu.Lock()
+		defer s.listenerMu.Unlock()
+		delete(s.updateListeners, id)
+	}
+}
+
+// Register function called with the final stats when a spool is completed, returns function to unsubscribe
+func SubscribeSpoolCompleted(fn func(SpoolStats)) func() {
+	return Default.SubscribeSpoolCompleted(fn)
+}
+
+// Register function called when a spool of the store is completed, returns function to unsubscribe
+func (s *Store) SubscribeSpoolCompleted(fn func(SpoolStats)) func() {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	s.nextListenerID++
+	id := s.nextListenerID
+	s.spoolListeners = append(s.spoolListeners, spoolListener{id: id, fn: fn})
+	return func() {
+		s.listenerMu.Lock()
+		defer s.listenerMu.Unlock()
+		for i, l := range s.spoolListeners {
+			if l.id == id {
+				s.spoolListeners = append(s.spoolListeners[:i:i], s.spoolListeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Call update listeners (mu must not be held)
+func (s *Store) notifyUpdates(updates []Update) {
+	s.qualityAlarms(updates)
+	s.listenerMu.RLock()
+	defer s.listenerMu.RUnlock()
+	for _, u := range updates {
+		for _, fn := range s.updateListeners {
+			fn(u)
+		}
+	}
+}
+
+// Call spool listeners (mu must not be held)
+func (s *Store) notifySpoolCompleted(stats SpoolStats) {
+	s.listenerMu.RLock()
+	defer s.listenerMu.RUnlock()
+	for _, l := range s.spoolListeners {
+		l.fn(stats)
+	}
+}
+
+// Rule detecting a spool change from the stats before and after a row.
+// Default: FilamentMass has been reset (smaller then prev. value) & New run is active (WindingDiameter Value)
+func defaultSpoolChangeRule(prev SpoolStats, cur SpoolStats) bool {
+	return prev.FilamentMass.Value > cur.FilamentMass.Value && prev.WindingDiameter.Value > 12
+}
+
+// Replace the spool change rule (called before data is received)
+func SetSpoolChangeRule(rule func(prev SpoolStats, cur SpoolStats) bool) {
+	Default.SetSpoolChangeRule(rule)
+}
+
+// Replace the spool change rule of the store
+func (s *Store) SetSpoolChangeRule(rule func(prev SpoolStats, cur SpoolStats) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spoolChangeRule = rule
+}
+
+// Complete the current spool manually: current stats become the previous spool stats
+func CompleteSpool() SpoolStats {
+	return Default.CompleteSpool()
+}
+
+// A mass drop within this time after a manual completion is the machine resetting its counter
+const manualResetWindow = time.Minute
+
+// Complete the current spool of the store manually. The machine keeps counting the mass until it
+// resets it, so the mass at completion becomes the baseline of the change rule until then.
+func (s *Store) CompleteSpool() SpoolStats {
+	s.mu.Lock()
+	stats := s.sinceBaseline(s.curSpool)
+	s.prevSpool = stats
+	s.massBaseline = s.curSpool.FilamentMass.Value
+	s.baselineTime = time.Now()
+	s.mu.Unlock()
+	s.notifySpoolCompleted(stats)
+	return stats
+}
+
+// Return stats of the current spool, the mass counted since the last manual completion
+func CurrentSpool() SpoolStats {
+	return Default.CurrentSpool()
+}
+
+// Return stats of the current spool of the store, the mass counted since the last manual completion
+func (s *Store) CurrentSpool() SpoolStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sinceBaseline(s.curSpool)
+}
+
+// Spool stats with the mass counted since the last manual completion (caller holds mu)
+func (s *Store) sinceBaseline(stats SpoolStats) SpoolStats {
+	stats.FilamentMass.Value -= s.massBaseline
+	return stats
+}
@@ -0,0 +1,207 @@
+package data
+
+import (
+	"encoding/json"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/metrics"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Quality of a datapoint
+type Quality string
+
+const (
+	QualityGood        Quality = "good"
+	QualityBadParse    Quality = "bad-parse"    //Source value could not be parsed, last good value kept
+	QualityOutOfRange  Quality = "out-of-range" //Value outside the plausible range of the signal
+	QualityStale       Quality = "stale"        //No update within the expected interval (or never received)
+	QualitySubstituted Quality = "substituted"  //Value set manually instead of measured
+)
+
+// Quality of the datapoint, points that never received a value are stale
+func (dp Datapoint) QualityOrStale() Quality {
+	if dp.Quality == "" {
+		return QualityStale
+	}
+	return dp.Quality
+}
+
+var qualityCounter = metrics.NewCounterVec("extruder_bad_quality_values_total", "Values received with a quality other than good.", "quality")
+
+// Configure plausible ranges per signal, e.g. {"temperature": [0, 400]}
+func ConfigureRanges(ranges map[string][2]float64) error {
+	return Default.ConfigureRanges(ranges)
+}
+
+// Configure plausible ranges of the store
+func (s *Store) ConfigureRanges(ranges map[string][2]float64) error {
+	for name, r := range ranges {
+		if _, ok := SignalInfo(name); !ok {
+			return fmt.Errorf("Range for unknown signal: %s", name)
+		}
+		if r[0] > r[1] {
+			return fmt.Errorf("Invalid range for %s: min > max", name)
+		}
+	}
+	s.rangesMu.Lock()
+	s.ranges = ranges
+	s.rangesMu.Unlock()
+	return nil
+}
+
+// Return plausible range of a signal if configured
+func SignalRange(name string) ([2]float64, bool) {
+	return Default.SignalRange(name)
+}
+
+// Return plausible range of a signal of the store if configured
+func (s *Store) SignalRange(name string) ([2]float64, bool) {
+	s.rangesMu.RLock()
+	defer s.rangesMu.RUnlock()
+	r, ok := s.ranges[name]
+	return r, ok
+}
+
+// Set value and timestamp, quality depends on the plausible range (caller holds mu)
+func (s *Store) setPoint(name string, dp *Datapoint, value float32, timestamp time.Time) {
+	dp.Value = value
+	dp.Timestamp = timestamp
+	dp.Quality = QualityGood
+	s.received = time.Now()
+	if r, ok := s.SignalRange(name); ok && (float64(value) < r[0] || float64(value) > r[1]) {
+		dp.Quality = QualityOutOfRange
+		qualityCounter.Inc(string(QualityOutOfRange))
+	}
+}
+
+// Mark datapoint as bad, keeping its value (callers hold Store.mu)
+func markBad(dp *Datapoint, quality Quality) {
+	dp.Quality = quality
+	qualityCounter.Inc(string(quality))
+}
+
+// Alarm ID of a signal with bad quality, e.g. "quality:temperature" or "quality:line2:temperature"
+func (s *Store) qualityAlarmID(name string) string {
+	if s.Source == "" {
+		return "quality:" + name
+	}
+	return "quality:" + s.Source + ":" + name
+}
+
+// Raise a warning when a signal turns bad-parse or out-of-range, clear it with the next good value
+func (s *Store) qualityAlarms(updates []Update) {
+	for _, u := range updates {
+		quality := u.Point.Quality
+		s.alarmMu.Lock()
+		prev, alarmed := s.badQualities[u.Signal]
+		switch {
+		case quality == QualityBadParse || quality == QualityOutOfRange:
+			s.badQualities[u.Signal] = quality
+		case quality == QualityGood:
+			delete(s.badQualities, u.Signal)
+		}
+		s.alarmMu.Unlock()
+
+		id := s.qualityAlarmID(u.Signal)
+		switch {
+		case (quality == QualityBadParse || quality == QualityOutOfRange) && prev != quality:
+			if alarmed {
+				alarms.Clear(id) // Raised again with the new quality
+			}
+			fields := map[string]string{"signal": u.Signal, "quality": string(quality)}
+			if s.Source != "" {
+				fields["machine"] = s.Source
+			}
+			alarms.Raise(alarms.Alarm{
+				ID:       id,
+				Severity: alarms.SeverityWarning,
+				Source:   "quality",
+				Message:  fmt.Sprintf("Signal %s: %s", u.Signal, quality),
+				Fields:   fields,
+			})
+		case quality == QualityGood && alarmed:
+			alarms.Clear(id)
+		}
+	}
+}
+
+// Change quality of a signal (e.g. stale) and notify listeners if it changed
+func SetQuality(name string, quality Quality) error {
+	return Default.SetQuality(name, quality)
+}
+
+// Change quality of a signal of the store and notify listeners if it changed
+func (s *Store) SetQuality(name string, quality Quality) error {
+	s.mu.Lock()
+	dp := processPoint(&s.data, name)
+	if dp == nil {
+		dp = spoolPoint(&s.curSpool, name)
+	}
+	if dp == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("Unknown signal: %s", name)
+	}
+	if dp.Quality == quality {
+		s.mu.Unlock()
+		return nil
+	}
+	markBad(dp, quality)
+	update := Update{Signal: name, Point: *dp}
+	s.mu.Unlock()
+	s.notifyUpdates([]Update{update})
+	return nil
+}
+
+// Substitute value of a process signal manually (e.g. broken sensor)
+func Substitute(name string, value float32) error {
+	return Default.Substitute(name, value)
+}
+
+// Substitute value of a process signal of the store manually
+func (s *Store) Substitute(name string, value float32) error {
+	s.mu.Lock()
+	dp := processPoint(&s.data, name)
+	if dp == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("Unknown process signal: %s", name)
+	}
+	dp.Value = value
+	dp.Timestamp = time.Now()
+	markBad(dp, QualitySubstituted)
+	update := Update{Signal: name, Point: *dp}
+	s.mu.Unlock()
+	s.notifyUpdates([]Update{update})
+	return nil
+}
+
+// Request body of /data/substitute
+type substituteRequest struct {
+	Signal string  `json:"signal"`
+	Value  float32 `json:"value"`
+}
+
+// Handler for manual substitution of a process signal
+func SubstituteHandler(w http.ResponseWriter, r *http.Request) {
+	Default.SubstituteHandler(w, r)
+}
+
+// Handler for manual substitution of a process signal of the store
+func (s *Store) SubstituteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		return
+	}
+	var req substituteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := s.Substitute(req.Signal, req.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "success"}`))
+}
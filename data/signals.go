@@ -0,0 +1,217 @@
+package data
+
+import (
+	"extruder_web_gui/metrics"
+	"strings"
+)
+
+// Description of a process or spool signal
+type Signal struct {
+	Name   string // Key in /data json
+	Metric string // Prometheus metric name incl. unit
+	Unit   string
+	Help   string
+}
+
+// Process signals (Dataset) in /data order
+var processSignals = []Signal{
+	{Name: "diameter", Metric: "extruder_diameter_micrometers", Unit: "µm", Help: "Filament diameter."},
+	{Name: "temperature", Metric: "extruder_temperature_celsius", Unit: "°C", Help: "Extruder temperature."},
+	{Name: "spoolerRpm", Metric: "extruder_spooler_rpm", Unit: "1/min", Help: "Spooler speed."},
+	{Name: "screwRpm", Metric: "extruder_screw_rpm", Unit: "1/min", Help: "Screw speed."},
+	{Name: "heaterPwm", Metric: "extruder_heater_pwm_percent", Unit: "%", Help: "Heater PWM duty cycle."},
+	{Name: "contactSwitch", Metric: "extruder_contact_switch_state", Unit: "", Help: "Contact switch state (0/1)."},
+}
+
+// Spool signals (SpoolStats), available for current and previous spool
+var spoolSignals = []Signal{
+	{Name: "windingDiameter", Metric: "spool_winding_diameter_millimeters", Unit: "mm", Help: "Winding diameter of the spool."},
+	{Name: "avgFilDiameter", Metric: "spool_avg_filament_diameter_millimeters", Unit: "mm", Help: "Average filament diameter on the spool."},
+	{Name: "nbrOfWindings", Metric: "spool_windings", Unit: "", Help: "Number of windings on the spool."},
+	{Name: "filamentMass", Metric: "spool_filament_mass_grams", Unit: "g", Help: "Filament mass on the spool."},
+}
+
+// Return datapoint of a process signal by name
+func processPoint(d *Dataset, name string) *Datapoint {
+	switch name {
+	case "diameter":
+		return &d.Diameter
+	case "temperature":
+		return &d.Temperature
+	case "spoolerRpm":
+		return &d.SpoolerRpm
+	case "screwRpm":
+		return &d.ScrewRpm
+	case "heaterPwm":
+		return &d.HeaterPwm
+	case "contactSwitch":
+		return &d.ContactSwitch
+	}
+	return nil
+}
+
+// Return datapoint of a spool signal by name
+func spoolPoint(s *SpoolStats, name string) *Datapoint {
+	switch name {
+	case "windingDiameter":
+		return &s.WindingDiameter
+	case "avgFilDiameter":
+		return &s.AvgFilDiameter
+	case "nbrOfWindings":
+		return &s.NbrOfWindings
+	case "filamentMass":
+		return &s.FilamentMass
+	}
+	return nil
+}
+
+// Counters for incoming traffic
+var (
+	msgReceivedCounter = metrics.NewCounterVec("extruder_messages_received_total", "Messages received per message ID.", "id")
+	malformedCounter   = metrics.NewCounter("extruder_malformed_frames_total", "Frames dropped because of invalid length or encoding.")
+	unknownIDCounter   = metrics.NewCounter("extruder_unknown_id_messages_total", "Messages dropped because of an unknown message ID.")
+)
+
+// Register gauges for all process and spool signals
+func init() {
+	for _, sig := range processSignals {
+		name := sig.Name
+		metrics.NewGaugeFunc(sig.Metric, sig.Help, "", func() map[string]float64 {
+			dp, _ := Default.Value(name)
+			return map[string]float64{"": float64(dp.Value)}
+		})
+	}
+	metrics.NewGaugeFunc("extruder_signal_quality_good", "1 if the current value of the signal has good quality.", "signal", func() map[string]float64 {
+		Default.mu.RLock()
+		defer Default.mu.RUnlock()
+		values := map[string]float64{}
+		for _, sig := range append(append([]Signal{}, processSignals...), spoolSignals...) {
+			dp, _ := Default.valueLocked(sig.Name)
+			values[sig.Name] = 0
+			if dp.Quality == QualityGood {
+				values[sig.Name] = 1
+			}
+		}
+		return values
+	})
+	for _, sig := range spoolSignals {
+		name := sig.Name
+		metrics.NewGaugeFunc(sig.Metric, sig.Help, "spool", func() map[string]float64 {
+			Default.mu.RLock()
+			defer Default.mu.RUnlock()
+			return map[string]float64{
+				"current":  float64(spoolPoint(&Default.curSpool, name).Value),
+				"previous": float64(spoolPoint(&Default.prevSpool, name).Value),
+			}
+		})
+	}
+}
+
+// Count malformed frame (invalid length or encoding)
+func CountMalformedFrame() {
+	malformedCounter.Inc()
+}
+
+// Names of all signals served by /data (process, current and previous spool)
+func SignalNames() []string {
+	var names []string
+	for _, sig := range processSignals {
+		names = append(names, sig.Name)
+	}
+	for _, sig := range spoolSignals {
+		names = append(names, sig.Name)
+	}
+	for _, sig := range spoolSignals {
+		names = append(names, prevPrefix(sig.Name))
+	}
+	return names
+}
+
+// Return current datapoint of a signal by its /data name
+func Value(name string) (Datapoint, bool) {
+	return Default.Value(name)
+}
+
+// Return current datapoint of a signal of the store by its /data name
+func (s *Store) Value(name string) (Datapoint, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.valueLocked(name)
+}
+
+// Return current datapoint of a signal (caller holds mu)
+func (s *Store) valueLocked(name string) (Datapoint, bool) {
+	if dp := processPoint(&s.data, name); dp != nil {
+		return *dp, true
+	}
+	if dp := spoolPoint(&s.curSpool, name); dp != nil {
+		return *dp, true
+	}
+	for _, sig := range spoolSignals {
+		if prevPrefix(sig.Name) == name {
+			return *spoolPoint(&s.prevSpool, sig.Name), true
+		}
+	}
+	return Datapoint{}, false
+}
+
+// Name of previous spool signal, e.g. "filamentMass" -> "prevFilamentMass"
+func prevPrefix(name string) string {
+	return "prev" + strings.ToUpper(name[:1]) + name[1:]
+}
+
+// Origin of a signal: message ID (PipeMode/TCPMode) and row column (SimMode)
+type Source struct {
+	MsgID  int `json:"msgId,omitempty"`  //0 if not received as message
+	Column int `json:"column,omitempty"` //0 if not part of simulator rows
+}
+
+// Return source message ID and column of a signal from msgInMap / colMap / statsColMap
+func SignalSource(name string) Source {
+	return Default.SignalSource(name)
+}
+
+// Return source message ID and column of a signal in the dictionary of the store
+func (s *Store) SignalSource(name string) Source {
+	var src Source
+	for id, dp := range s.msgInMap {
+		if s.pointNames[dp] == name {
+			src.MsgID = int(id)
+		}
+	}
+	for col, dp := range s.colMap {
+		if s.pointNames[dp] == name {
+			src.Column = col
+		}
+	}
+	for col, dp := range s.statsColMap {
+		if s.pointNames[dp] == name {
+			src.Column = col
+		}
+	}
+	return src
+}
+
+// Return description of a signal by name (previous spool signals share the current ones)
+func SignalInfo(name string) (Signal, bool) {
+	for _, sig := range processSignals {
+		if sig.Name == name {
+			return sig, true
+		}
+	}
+	for _, sig := range spoolSignals {
+		if sig.Name == name || prevPrefix(sig.Name) == name {
+			return sig, true
+		}
+	}
+	return Signal{}, false
+}
+
+// Names of the process signals (Dataset)
+func ProcessSignalNames() []string {
+	var names []string
+	for _, sig := range processSignals {
+		names = append(names, sig.Name)
+	}
+	return names
+}
@@ -0,0 +1,146 @@
+package data
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Assignment of message IDs and simulator row columns to signals
+type Dictionary struct {
+	MsgIDs  map[byte]string // Message ID -> process signal (PipeMode/TCPMode)
+	Columns map[int]string  // Row column -> process or spool signal (SimMode)
+}
+
+// Assignment used by the simulator and the extruder firmware
+func DefaultDictionary() Dictionary {
+	return Dictionary{
+		MsgIDs: map[byte]string{
+			0x01: "diameter",
+			0x02: "temperature",
+			0x03: "spoolerRpm",
+			0x04: "screwRpm",
+			0x05: "heaterPwm",
+			0x06: "contactSwitch",
+		},
+		Columns: map[int]string{
+			2:  "screwRpm",
+			3:  "spoolerRpm",
+			4:  "heaterPwm",
+			5:  "diameter",
+			6:  "temperature",
+			7:  "contactSwitch",
+			8:  "windingDiameter",
+			9:  "avgFilDiameter",
+			10: "nbrOfWindings",
+			11: "filamentMass",
+		},
+	}
+}
+
+// Process data of one machine: current values, spool stats, plausible ranges and listeners
+type Store struct {
+	Source string // Machine ID of the events recorded for the store, empty = default machine
+
+	mu              sync.RWMutex // Guards data, spool stats and the spool change rule
+	data            Dataset
+	curSpool        SpoolStats
+	prevSpool       SpoolStats
+	spoolChangeRule func(prev SpoolStats, cur SpoolStats) bool
+	massBaseline    float32   // Mass of the machine counter at the last manual completion, until the machine resets it
+	baselineTime    time.Time // Server time of the last manual completion
+	received        time.Time // Server time of the last value from the data source
+
+	colMap      map[int]*Datapoint  // SimMode: columns of process signals
+	statsColMap map[int]*Datapoint  // SimMode: columns of spool signals
+	msgInMap    map[byte]*Datapoint // MsgMode: IDs of incoming messages
+	pointNames  map[*Datapoint]string
+
+	rangesMu sync.RWMutex
+	ranges   map[string][2]float64
+
+	timestamps *timestampParser
+
+	parseMu     sync.Mutex
+	parseLimits map[string]*parseLimit // Rate limit of the parse events per kind
+
+	alarmMu      sync.Mutex
+	badQualities map[string]Quality // Signals with an active quality alarm
+
+	listenerMu      sync.RWMutex
+	nextListenerID  int
+	updateListeners map[int]func(Update)
+	spoolListeners  []spoolListener
+}
+
+// Store of the machine described by the top level config, used by the package functions
+var Default = mustStore(DefaultDictionary(), rowTimestamps)
+
+// Create store for a machine with its own signal dictionary
+func NewStore(dict Dictionary) (*Store, error) {
+	rowTimestamps.mu.Lock()
+	parser := newTimestampParser(rowTimestamps.layouts, rowTimestamps.location)
+	rowTimestamps.mu.Unlock()
+	return newStore(dict, parser)
+}
+
+func mustStore(dict Dictionary, parser *timestampParser) *Store {
+	s, err := newStore(dict, parser)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func newStore(dict Dictionary, parser *timestampParser) (*Store, error) {
+	s := &Store{
+		spoolChangeRule: defaultSpoolChangeRule,
+		colMap:          map[int]*Datapoint{},
+		statsColMap:     map[int]*Datapoint{},
+		msgInMap:        map[byte]*Datapoint{},
+		pointNames:      map[*Datapoint]string{},
+		ranges:          map[string][2]float64{},
+		timestamps:      parser,
+		parseLimits:     map[string]*parseLimit{},
+		badQualities:    map[string]Quality{},
+		updateListeners: map[int]func(Update){},
+	}
+	for _, sig := range processSignals {
+		s.pointNames[processPoint(&s.data, sig.Name)] = sig.Name
+	}
+	for _, sig := range spoolSignals {
+		s.pointNames[spoolPoint(&s.curSpool, sig.Name)] = sig.Name
+	}
+	for id, name := range dict.MsgIDs {
+		dp := processPoint(&s.data, name)
+		if dp == nil {
+			return nil, fmt.Errorf("Message ID 0x%02x: unknown process signal %q", id, name)
+		}
+		s.msgInMap[id] = dp
+	}
+	for col, name := range dict.Columns {
+		if col < 1 {
+			return nil, fmt.Errorf("Column %d of %s: column 0 is the timestamp", col, name)
+		}
+		if dp := processPoint(&s.data, name); dp != nil {
+			s.colMap[col] = dp
+		} else if dp := spoolPoint(&s.curSpool, name); dp != nil {
+			s.statsColMap[col] = dp
+		} else {
+			return nil, fmt.Errorf("Column %d: unknown signal %q", col, name)
+		}
+	}
+	return s, nil
+}
+
+// Configure layouts and time zone of the row timestamps of this store
+func (s *Store) ConfigureTimestamps(layouts []string, timeZone string) error {
+	return s.timestamps.configure(layouts, timeZone)
+}
+
+// Server time of the last value received from the data source, zero if nothing was received
+func (s *Store) LastReceived() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.received
+}
@@ -0,0 +1,241 @@
+package data
+
+import (
+	"encoding/json"
+	"extruder_web_gui/metrics"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layouts tried for row timestamps if none are configured. Layouts without
+// a date are anchored to the session date.
+var defaultTimestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.000",
+	"2006-01-02T15:04:05.000",
+	"02.01.2006 15:04:05.000",
+	timestampLayout,
+}
+
+// Drift (change of the offset since the first row) that is logged as warning
+const maxClockDrift = 2 * time.Second
+
+// State of the source clock compared to the server clock
+type ClockStatus struct {
+	Offset        time.Duration //Server time - source time of last row
+	InitialOffset time.Duration //Offset of the first row
+	Drift         time.Duration //Offset - InitialOffset
+	MinOffset     time.Duration
+	MaxOffset     time.Duration
+	Rollovers     int //Midnight rollovers of time-only rows
+	Samples       int
+	LastSource    time.Time
+	LastServer    time.Time
+}
+
+// Parser for row timestamps with date anchoring and clock tracking
+type timestampParser struct {
+	mu           sync.Mutex
+	layouts      []string
+	location     *time.Location
+	lastResolved time.Time // Last resolved source time
+	lastReceived time.Time // Server time of last row
+	driftWarned  bool
+	status       ClockStatus
+	now          func() time.Time
+	gauges       bool // Export offset and drift as metrics (parser of the default store)
+}
+
+var rowTimestamps = &timestampParser{layouts: defaultTimestampLayouts, location: time.Local, now: time.Now, gauges: true}
+
+var (
+	clockOffsetGauge = metrics.NewGauge("extruder_source_clock_offset_seconds", "Server clock minus source clock of the last row.")
+	clockDriftGauge  = metrics.NewGauge("extruder_source_clock_drift_seconds", "Change of the source clock offset since the first row.")
+)
+
+func newTimestampParser(layouts []string, location *time.Location) *timestampParser {
+	return &timestampParser{layouts: layouts, location: location, now: time.Now}
+}
+
+// Configure layouts and time zone of row timestamps (empty values keep the defaults)
+func ConfigureTimestamps(layouts []string, timeZone string) error {
+	return rowTimestamps.configure(layouts, timeZone)
+}
+
+func (p *timestampParser) configure(layouts []string, timeZone string) error {
+	location := time.Local
+	if timeZone != "" {
+		var err error
+		if location, err = time.LoadLocation(timeZone); err != nil {
+			return fmt.Errorf("Invalid time zone %q: %w", timeZone, err)
+		}
+	}
+	if len(layouts) == 0 {
+		layouts = defaultTimestampLayouts
+	}
+	// Keep the parser, rows may be parsed concurrently (config reload)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.layouts = layouts
+	p.location = location
+	return nil
+}
+
+// Return the configured row timestamp layouts
+func TimestampLayouts() []string {
+	rowTimestamps.mu.Lock()
+	defer rowTimestamps.mu.Unlock()
+	return append([]string{}, rowTimestamps.layouts...)
+}
+
+// Reference time to find the date fields of a layout, no field has its zero value
+var layoutProbe = time.Date(2001, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+// Return which date fields a layout contains: year, and month or day
+// (e.g. "01-02 15:04:05" or time.Stamp have a date but no year)
+func layoutDate(layout string) (year bool, date bool) {
+	parsed, err := time.Parse(layout, layoutProbe.Format(layout))
+	if err != nil {
+		return false, false
+	}
+	return parsed.Year() == layoutProbe.Year(), parsed.Month() != time.January || parsed.Day() != 1
+}
+
+// Parse timestamp field of a row: try the whole field, then the first word
+func (p *timestampParser) parse(field string) (time.Time, error) {
+	field = strings.TrimSpace(field)
+	candidates := []string{field}
+	if first := strings.Split(field, " ")[0]; first != field {
+		candidates = append(candidates, first)
+	}
+	p.mu.Lock()
+	layouts, location := p.layouts, p.location
+	p.mu.Unlock()
+	for _, candidate := range candidates {
+		for _, layout := range layouts {
+			parsed, err := time.ParseInLocation(layout, candidate, location)
+			if err != nil {
+				continue
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			received := p.now()
+			switch year, date := layoutDate(layout); {
+			case !date:
+				parsed = p.anchor(parsed, received)
+			case !year:
+				parsed = p.anchorYear(parsed, received)
+			}
+			p.track(parsed, received)
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("No layout matches timestamp %q", field)
+}
+
+// Anchor time-only value to the date closest to the expected source time
+// (last row advanced by the elapsed server time). Going back more than
+// 12 hours is treated as midnight rollover.
+func (p *timestampParser) anchor(parsed time.Time, received time.Time) time.Time {
+	reference := received
+	if !p.lastResolved.IsZero() {
+		reference = p.lastResolved.Add(received.Sub(p.lastReceived))
+	}
+	ref := reference.In(p.location)
+	best := time.Time{}
+	for _, dayOffset := range []int{-1, 0, 1} {
+		day := ref.AddDate(0, 0, dayOffset)
+		candidate := time.Date(day.Year(), day.Month(), day.Day(), parsed.Hour(), parsed.Minute(), parsed.Second(), parsed.Nanosecond(), p.location)
+		if best.IsZero() || absDuration(candidate.Sub(reference)) < absDuration(best.Sub(reference)) {
+			best = candidate
+		}
+	}
+	if !p.lastResolved.IsZero() && best.YearDay() != p.lastResolved.In(p.location).YearDay() && best.After(p.lastResolved) {
+		p.status.Rollovers++
+		log.Println("Row timestamps crossed midnight, new session date:", best.Format("2006-01-02"))
+	}
+	return best
+}
+
+// Anchor value without year to the year closest to the server time (turn of the year)
+func (p *timestampParser) anchorYear(parsed time.Time, received time.Time) time.Time {
+	ref := received.In(p.location)
+	best := time.Time{}
+	for _, year := range []int{ref.Year() - 1, ref.Year(), ref.Year() + 1} {
+		candidate := time.Date(year, parsed.Month(), parsed.Day(), parsed.Hour(), parsed.Minute(), parsed.Second(), parsed.Nanosecond(), p.location)
+		if best.IsZero() || absDuration(candidate.Sub(ref)) < absDuration(best.Sub(ref)) {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// Update offset and drift between source and server clock
+func (p *timestampParser) track(source time.Time, received time.Time) {
+	offset := received.Sub(source)
+	s := &p.status
+	if s.Samples == 0 {
+		s.InitialOffset, s.MinOffset, s.MaxOffset = offset, offset, offset
+	}
+	s.Samples++
+	s.Offset = offset
+	s.Drift = offset - s.InitialOffset
+	if offset < s.MinOffset {
+		s.MinOffset = offset
+	}
+	if offset > s.MaxOffset {
+		s.MaxOffset = offset
+	}
+	s.LastSource, s.LastServer = source, received
+	p.lastResolved, p.lastReceived = source, received
+
+	if p.gauges {
+		clockOffsetGauge.Set(offset.Seconds())
+		clockDriftGauge.Set(s.Drift.Seconds())
+	}
+	if absDuration(s.Drift) > maxClockDrift && !p.driftWarned {
+		log.Printf("Warning: Source clock drifted by %v since first row", s.Drift)
+		p.driftWarned = true
+	} else if absDuration(s.Drift) <= maxClockDrift {
+		p.driftWarned = false
+	}
+}
+
+func (p *timestampParser) clockStatus() ClockStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// Handler for source clock status (offset / drift in seconds)
+func ClockHandler(w http.ResponseWriter, r *http.Request) {
+	Default.ClockHandler(w, r)
+}
+
+// Handler for source clock status of the store
+func (st *Store) ClockHandler(w http.ResponseWriter, r *http.Request) {
+	s := st.timestamps.clockStatus()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"offsetSeconds":        s.Offset.Seconds(),
+		"initialOffsetSeconds": s.InitialOffset.Seconds(),
+		"driftSeconds":         s.Drift.Seconds(),
+		"minOffsetSeconds":     s.MinOffset.Seconds(),
+		"maxOffsetSeconds":     s.MaxOffset.Seconds(),
+		"rollovers":            s.Rollovers,
+		"samples":              s.Samples,
+		"lastSource":           s.LastSource.Format(time.RFC3339Nano),
+		"lastServer":           s.LastServer.Format(time.RFC3339Nano),
+	})
+}
@@ -0,0 +1,100 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+// Parser with fixed server clock for tests
+func testParser(now time.Time) *timestampParser {
+	p := newTimestampParser(defaultTimestampLayouts, time.UTC)
+	p.now = func() time.Time { return now }
+	return p
+}
+
+// Test for timestampParser: time-only rows are anchored to the session date
+func TestTimestamp_TimeOnly(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 1, 0, time.UTC)
+	parsed, err := testParser(now).parse("12:00:00.000 some text")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if !parsed.Equal(expected) {
+		t.Errorf("Timestamp wasn't anchored correctly. Expected: %v, received: %v", expected, parsed)
+	}
+}
+
+// Test for timestampParser: full dates with time zone
+func TestTimestamp_FullDate(t *testing.T) {
+	p := testParser(time.Now())
+	parsed, err := p.parse("2024-05-01T12:00:00.5+02:00")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !parsed.Equal(time.Date(2024, 5, 1, 10, 0, 0, 500000000, time.UTC)) {
+		t.Errorf("Timestamp with time zone parsed wrong: %v", parsed)
+	}
+	if parsed, _ := p.parse("2024-05-01 23:00:00.000"); parsed.Day() != 1 || parsed.Hour() != 23 {
+		t.Errorf("Timestamp with date parsed wrong: %v", parsed)
+	}
+	if _, err := p.parse("yesterday"); err == nil {
+		t.Errorf("Expected error for invalid timestamp")
+	}
+}
+
+// Test for timestampParser: rows crossing midnight move to the next day
+func TestTimestamp_MidnightRollover(t *testing.T) {
+	now := time.Date(2024, 5, 1, 23, 59, 59, 0, time.UTC)
+	p := testParser(now)
+	before, _ := p.parse("23:59:59.000")
+	p.now = func() time.Time { return now.Add(2 * time.Second) }
+	after, _ := p.parse("00:00:01.000")
+
+	if !after.After(before) || after.Day() != 2 {
+		t.Errorf("Rollover not detected. Before: %v, after: %v", before, after)
+	}
+	if p.clockStatus().Rollovers != 1 {
+		t.Errorf("Expected 1 rollover, received: %d", p.clockStatus().Rollovers)
+	}
+}
+
+// Test for timestampParser: offset and drift between source and server clock
+func TestTimestamp_Drift(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 1, 0, time.UTC)
+	p := testParser(now)
+	p.parse("2024-05-01 12:00:00.000")
+	p.now = func() time.Time { return now.Add(10 * time.Second) }
+	p.parse("2024-05-01 12:00:07.000")
+
+	status := p.clockStatus()
+	if status.InitialOffset != time.Second || status.Offset != 4*time.Second || status.Drift != 3*time.Second {
+		t.Errorf("Unexpected clock status: %+v", status)
+	}
+}
+
+// Test for layoutDate: month and day without year are a date, not time-only
+func TestTimestamp_LayoutDate(t *testing.T) {
+	tests := []struct {
+		layout     string
+		year, date bool
+	}{
+		{"15:04:05.000", false, false},
+		{"01-02 15:04:05", false, true},
+		{time.Stamp, false, true},
+		{"2006-01-02 15:04:05.000", true, true},
+	}
+	for _, tc := range tests {
+		if year, date := layoutDate(tc.layout); year != tc.year || date != tc.date {
+			t.Errorf("%q. Expected: %v/%v, received: %v/%v", tc.layout, tc.year, tc.date, year, date)
+		}
+	}
+
+	// Dates without year get the year closest to the server time
+	p := testParser(time.Date(2025, 1, 1, 0, 0, 1, 0, time.UTC))
+	p.layouts = []string{time.StampMilli}
+	parsed, err := p.parse("Dec 31 23:59:59.000")
+	if expected := time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC); err != nil || !parsed.Equal(expected) {
+		t.Errorf("Expected: %v, received: %v (%v)", expected, parsed, err)
+	}
+}
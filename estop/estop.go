@@ -0,0 +1,420 @@
+package estop
+
+import (
+	"encoding/json"
+	"errors"
+	"extruder_web_gui/audit"
+	"extruder_web_gui/config"
+	"extruder_web_gui/controls"
+	"extruder_web_gui/data"
+	"extruder_web_gui/pipes"
+	"extruder_web_gui/state"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Emergency stop events kept for /estop
+const historySize = 50
+
+// Reset rejected: nothing latched, confirmation missing or stop not acknowledged
+var ErrReset = errors.New("Reset not possible")
+
+// Transport an emergency stop can be sent on
+type Transport struct {
+	Name string
+	Send func() error // Send emergency stop command
+}
+
+// Recorded emergency stop with context
+type Event struct {
+	ID         int                `json:"id"`
+	Time       time.Time          `json:"time"`
+	Actor      string             `json:"actor"`
+	Reason     string             `json:"reason"`
+	State      state.State        `json:"state,omitempty"` //Process state when triggered
+	Values     map[string]float32 `json:"values"`          //Last process values when triggered
+	Attempts   int                `json:"attempts"`
+	Transports map[string]string  `json:"transports"` //Result of the last attempt per transport: "ok" or error
+	Delivered  *time.Time         `json:"delivered,omitempty"`
+	Acked      *time.Time         `json:"acked,omitempty"` //Machine feedback confirmed the stop
+	Reset      *time.Time         `json:"reset,omitempty"`
+	ResetBy    string             `json:"resetBy,omitempty"`
+}
+
+// Latch status for /estop
+type Status struct {
+	Latched bool    `json:"latched"`
+	Current *Event  `json:"current,omitempty"` //Latest event while latched
+	Events  []Event `json:"events"`            //Newest last
+}
+
+// Latched emergency stop of one machine: sent on every transport and retried until acknowledged,
+// every other command is rejected until an operator resets it
+type Latch struct {
+	mu         sync.Mutex
+	cfg        config.EStopConfig
+	store      *data.Store
+	state      *state.Machine
+	transports func() []Transport
+	latched    bool
+	resetting  bool // Reset in progress: the latch still blocks commands, only the state reset may pass
+	events     []Event
+	nextID     int
+	stop       chan struct{} // Closed to end the delivery loop, nil if none runs
+	now        func() time.Time
+
+	// Optional function called with the event after a trigger and after a reset, e.g. notifications
+	OnEvent func(e Event)
+}
+
+// Create latch for the machine of store, state may be nil
+func New(cfg config.EStopConfig, store *data.Store, st *state.Machine, transports func() []Transport) *Latch {
+	l := &Latch{store: store, state: st, now: time.Now}
+	l.Configure(cfg, transports)
+	if st != nil {
+		st.Interlock = l.interlock
+	}
+	return l
+}
+
+// Apply changed config and transports, a running delivery keeps its interval until the next trigger
+func (l *Latch) Configure(cfg config.EStopConfig, transports func() []Transport) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cfg.RetryInterval == 0 {
+		cfg.RetryInterval = 500
+	}
+	if len(cfg.AckSignals) == 0 {
+		cfg.AckSignals = []string{"heaterPwm", "screwRpm", "spoolerRpm"}
+	}
+	l.cfg = cfg
+	if transports != nil {
+		l.transports = transports
+	}
+}
+
+// Use the store of a machine rebuilt on a config reload, the latch and its events are kept
+func (l *Latch) Attach(store *data.Store) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.store = store
+}
+
+// Store of the machine
+func (l *Latch) currentStore() *data.Store {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.store
+}
+
+// Transports of a machine: the transport of its mode and the simulator pipe if it is open in another mode
+func Transports(mode string, msgToSimPipe string, transmit func(id byte, val uint32) error) []Transport {
+	id, _ := controls.CommandID("emergency_stop")
+	list := []Transport{{Name: mode, Send: func() error { return transmit(id, 1) }}}
+	if mode != "SimMode" && mode != "PipeMode" && msgToSimPipe != "" {
+		if info, err := os.Stat(msgToSimPipe); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+			list = append(list, Transport{Name: "pipe", Send: func() error { return pipes.ToUserPipe(msgToSimPipe, id, 1) }})
+		}
+	}
+	return list
+}
+
+// Latch the emergency stop and send it on every transport. The first attempt is made before returning,
+// an error means it failed on every transport and is retried.
+func (l *Latch) Trigger(actor string, reason string) error {
+	e := Event{Time: l.now(), Actor: actor, Reason: reason, Values: map[string]float32{}, Transports: map[string]string{}}
+	store := l.currentStore()
+	for _, name := range data.ProcessSignalNames() {
+		if dp, ok := store.Value(name); ok {
+			e.Values[name] = dp.Value
+		}
+	}
+	if l.state != nil {
+		e.State = l.state.State()
+	}
+	l.mu.Lock()
+	l.nextID++
+	e.ID = l.nextID
+	l.latched = true
+	l.events = append(l.events, e)
+	if len(l.events) > historySize {
+		l.events = l.events[len(l.events)-historySize:]
+	}
+	start := l.stop == nil
+	if start {
+		l.stop = make(chan struct{})
+	}
+	stop, interval := l.stop, time.Duration(l.cfg.RetryInterval)*time.Millisecond
+	l.mu.Unlock()
+
+	log.Printf("Emergency stop by %s: %s", actor, reason)
+	fields := map[string]string{"reason": reason, "state": string(e.State)}
+	for name, v := range e.Values {
+		fields[name] = fmt.Sprint(v)
+	}
+	audit.Record(audit.Entry{Actor: actor, Action: "estop.trigger", Result: audit.ResultOK, Message: reason, Fields: fields})
+	if l.state != nil {
+		l.state.Sent("emergency_stop", 1)
+	}
+	if l.OnEvent != nil {
+		l.OnEvent(e)
+	}
+	err := l.attempt()
+	if start {
+		go l.deliver(stop, interval)
+	}
+	if err != nil {
+		return fmt.Errorf("Emergency stop latched, delivery is retried: %w", err)
+	}
+	return nil
+}
+
+// Send on every transport once and record the results, error if no transport accepted the command
+func (l *Latch) attempt() error {
+	l.mu.Lock()
+	transports := l.transports
+	l.mu.Unlock()
+	results := map[string]string{}
+	var errs []error
+	for _, t := range transports() {
+		if err := t.Send(); err != nil {
+			results[t.Name] = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+			continue
+		}
+		results[t.Name] = "ok"
+	}
+	delivered := len(errs) < len(results)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) > 0 {
+		e := &l.events[len(l.events)-1]
+		e.Attempts++
+		e.Transports = results
+		if delivered && e.Delivered == nil {
+			now := l.now()
+			e.Delivered = &now
+		}
+	}
+	if delivered {
+		return nil
+	}
+	if len(errs) == 0 {
+		return errors.New("No transport available")
+	}
+	return errors.Join(errs...)
+}
+
+// Repeat attempts until the machine acknowledges the stop or the latch is reset
+func (l *Latch) deliver(stop chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if l.acknowledge() {
+			l.mu.Lock()
+			if l.stop == stop {
+				l.stop = nil
+			}
+			l.mu.Unlock()
+			return
+		}
+		if err := l.attempt(); err != nil {
+			log.Printf("Emergency stop not delivered: %v", err)
+		}
+	}
+}
+
+// Check machine feedback: data received after the delivery and all ack signals at 0
+func (l *Latch) acknowledge() bool {
+	l.mu.Lock()
+	if len(l.events) == 0 {
+		l.mu.Unlock()
+		return false
+	}
+	delivered, signals, store := l.events[len(l.events)-1].Delivered, l.cfg.AckSignals, l.store
+	l.mu.Unlock()
+	if delivered == nil || !store.LastReceived().After(*delivered) {
+		return false
+	}
+	for _, name := range signals {
+		if dp, ok := store.Value(name); !ok || dp.Value != 0 {
+			return false
+		}
+	}
+
+	l.mu.Lock()
+	now := l.now()
+	for i := range l.events {
+		if l.events[i].Acked == nil && l.events[i].Reset == nil {
+			l.events[i].Acked = &now
+		}
+	}
+	attempts := l.events[len(l.events)-1].Attempts
+	l.mu.Unlock()
+	audit.Record(audit.Entry{Actor: "estop", Action: "estop.ack", Result: audit.ResultOK, Message: fmt.Sprintf("Emergency stop acknowledged after %d attempt(s)", attempts)})
+	return true
+}
+
+// Latched emergency stop blocks the reset of the process state, unless the latch itself is being reset
+func (l *Latch) interlock() error {
+	l.mu.Lock()
+	blocked := l.latched && !l.resetting
+	l.mu.Unlock()
+	if blocked {
+		return errors.New("Emergency stop latched, reset it via /estop/reset")
+	}
+	return nil
+}
+
+// Return true while the emergency stop is latched
+func (l *Latch) Latched() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.latched
+}
+
+// Reject every command but the emergency stop while latched, otherwise ask the process state
+func (l *Latch) Allow(command string, val uint32) error {
+	if command != "emergency_stop" && l.Latched() {
+		return fmt.Errorf("Emergency stop latched, %s blocked until reset", command)
+	}
+	if l.state != nil {
+		return l.state.Allow(command, val)
+	}
+	return nil
+}
+
+// Pass sent commands on to the process state
+func (l *Latch) Sent(command string, val uint32) {
+	if l.state != nil {
+		l.state.Sent(command, val)
+	}
+}
+
+// Release the latch on behalf of operator. Not acknowledged stops need force.
+// Commands stay blocked until the process state has been reset as well.
+func (l *Latch) Reset(operator string, force bool) error {
+	l.mu.Lock()
+	if !l.latched {
+		l.mu.Unlock()
+		return fmt.Errorf("%w: emergency stop not latched", ErrReset)
+	}
+	if l.resetting {
+		l.mu.Unlock()
+		return fmt.Errorf("%w: reset already in progress", ErrReset)
+	}
+	if e := l.events[len(l.events)-1]; e.Acked == nil && !force {
+		l.mu.Unlock()
+		return fmt.Errorf("%w: emergency stop not acknowledged by the machine, reset with force", ErrReset)
+	}
+	l.resetting = true
+	id := l.nextID
+	l.mu.Unlock()
+
+	var err error
+	if l.state != nil {
+		if st := l.state.State(); st == state.EStop || st == state.Fault {
+			err = l.state.Reset("Emergency stop reset by " + operator)
+		}
+	}
+
+	l.mu.Lock()
+	l.resetting = false
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	if l.nextID != id {
+		l.mu.Unlock()
+		if l.state != nil {
+			l.state.Sent("emergency_stop", 1) // Back to e-stop after the state reset
+		}
+		return fmt.Errorf("%w: emergency stop triggered again during the reset", ErrReset)
+	}
+	l.latched = false
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	now := l.now()
+	for i := range l.events {
+		if l.events[i].Reset == nil {
+			l.events[i].Reset, l.events[i].ResetBy = &now, operator
+		}
+	}
+	last := l.events[len(l.events)-1]
+	l.mu.Unlock()
+	if l.OnEvent != nil {
+		l.OnEvent(last)
+	}
+	return nil
+}
+
+// Latch state with the recorded events
+func (l *Latch) Status() Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := Status{Latched: l.latched, Events: append([]Event{}, l.events...)}
+	if l.latched {
+		current := s.Events[len(s.Events)-1]
+		s.Current = &current
+	}
+	return s
+}
+
+// Handler for /estop: latch state and recorded emergency stops
+func (l *Latch) Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.Status())
+}
+
+// Reset request, the operator has to confirm explicitly
+type ResetData struct {
+	Operator string `json:"operator"` //Name of the operator, default: X-Operator header
+	Confirm  bool   `json:"confirm"`
+	Force    bool   `json:"force"` //Reset even if the machine did not acknowledge the stop
+}
+
+// Handler for /estop/reset: release the latch, recorded in the audit log
+func (l *Latch) ResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ResetData
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Operator == "" {
+		req.Operator = r.Header.Get("X-Operator")
+	}
+	entry := audit.Entry{Actor: audit.Actor(r), Action: "estop.reset", Result: audit.ResultOK, Fields: map[string]string{"operator": req.Operator, "force": fmt.Sprint(req.Force)}}
+	if strings.TrimSpace(req.Operator) == "" || !req.Confirm {
+		entry.Result, entry.Message = audit.ResultRejected, "Operator and confirmation required"
+		audit.Record(entry)
+		http.Error(w, entry.Message, http.StatusBadRequest)
+		return
+	}
+	entry.Actor = req.Operator
+	if err := l.Reset(req.Operator, req.Force); err != nil {
+		entry.Result, entry.Message = audit.ResultRejected, err.Error()
+		audit.Record(entry)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	entry.Message = "Emergency stop reset"
+	audit.Record(entry)
+	l.Handler(w, r)
+}
@@ -0,0 +1,189 @@
+package estop
+
+import (
+	"errors"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"extruder_web_gui/state"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Transport counting attempts, fails while failing is set
+type testTransport struct {
+	mu       sync.Mutex
+	attempts int
+	failing  bool
+}
+
+func (t *testTransport) send() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts++
+	if t.failing {
+		return errors.New("Pipe closed")
+	}
+	return nil
+}
+
+func (t *testTransport) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.attempts
+}
+
+// Latch with retry interval of 5 ms on a new store and state machine
+func testLatch(t *testing.T, transport *testTransport) (*Latch, *data.Store, *state.Machine) {
+	store, err := data.NewStore(data.DefaultDictionary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := state.New(config.StateConfig{}, func() (float64, float64) { return 0, 0 })
+	l := New(config.EStopConfig{RetryInterval: 5}, store, st, func() []Transport {
+		return []Transport{{Name: "test", Send: transport.send}}
+	})
+	return l, store, st
+}
+
+// Wait until cond is true or fail after a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Test for Latch: trigger records context, blocks commands and retries until acknowledged
+func TestLatch_TriggerUntilAcknowledged(t *testing.T) {
+	transport := &testTransport{}
+	l, store, st := testLatch(t, transport)
+	store.SetValue("screwRpm", 40, time.Now())
+
+	if err := l.Trigger("operator1", "Filament jam"); err != nil {
+		t.Fatalf("Trigger failed: %v", err)
+	}
+	if !l.Latched() || st.State() != state.EStop {
+		t.Fatalf("Expected latched e-stop, received: latched=%v state=%v", l.Latched(), st.State())
+	}
+	e := l.Status().Current
+	if e == nil || e.Actor != "operator1" || e.Reason != "Filament jam" || e.Values["screwRpm"] != 40 {
+		t.Errorf("Unexpected event context: %+v", e)
+	}
+	for _, cmd := range []string{"mode_switch", "screw_rpm", "start"} {
+		if err := l.Allow(cmd, 0); err == nil {
+			t.Errorf("%s should be blocked while latched", cmd)
+		}
+	}
+	if err := l.Allow("emergency_stop", 1); err != nil {
+		t.Errorf("Emergency stop should be allowed while latched: %v", err)
+	}
+
+	// Retried while the machine still reports a turning screw
+	waitFor(t, "retries", func() bool { return transport.count() >= 3 })
+	if l.Status().Current.Acked != nil {
+		t.Fatalf("Stop acknowledged without feedback")
+	}
+	store.SetValue("screwRpm", 0, time.Now().Add(time.Millisecond))
+	waitFor(t, "acknowledge", func() bool { return l.Status().Current.Acked != nil })
+	attempts := transport.count()
+	time.Sleep(20 * time.Millisecond)
+	if transport.count() != attempts {
+		t.Errorf("Attempts after acknowledge. Expected: %v, received: %v", attempts, transport.count())
+	}
+	if err := st.Reset("test"); !errors.Is(err, state.ErrInvalid) {
+		t.Errorf("State reset should be blocked while latched, received: %v", err)
+	}
+}
+
+// Test for Latch: failed delivery keeps the latch and is retried
+func TestLatch_FailedDelivery(t *testing.T) {
+	transport := &testTransport{failing: true}
+	l, _, _ := testLatch(t, transport)
+	if err := l.Trigger("watchdog", "Link lost"); err == nil {
+		t.Fatalf("Trigger should report failed delivery")
+	}
+	if !l.Latched() {
+		t.Fatalf("E-stop should be latched even if not delivered")
+	}
+	waitFor(t, "retries", func() bool { return transport.count() >= 2 })
+	transport.mu.Lock()
+	transport.failing = false
+	transport.mu.Unlock()
+	waitFor(t, "delivery", func() bool { return l.Status().Current.Delivered != nil })
+	if r := l.Status().Current.Transports["test"]; r != "ok" {
+		t.Errorf("Transport result. Expected: %v, received: %v", "ok", r)
+	}
+	if err := l.Reset("operator1", false); !errors.Is(err, ErrReset) {
+		t.Errorf("Reset of unacknowledged stop without force should be rejected, received: %v", err)
+	}
+	if err := l.Reset("operator1", true); err != nil {
+		t.Errorf("Forced reset failed: %v", err)
+	}
+}
+
+// Test for ResetHandler: operator confirmation required, reset releases latch and state
+func TestResetHandler(t *testing.T) {
+	transport := &testTransport{}
+	l, _, st := testLatch(t, transport)
+	l.Trigger("operator1", "Test")
+
+	tests := []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{"Not confirmed", `{"operator": "operator2"}`, http.StatusBadRequest},
+		{"Operator missing", `{"confirm": true}`, http.StatusBadRequest},
+		{"Not acknowledged", `{"operator": "operator2", "confirm": true}`, http.StatusConflict},
+		{"Forced", `{"operator": "operator2", "confirm": true, "force": true}`, http.StatusOK},
+		{"Not latched", `{"operator": "operator2", "confirm": true}`, http.StatusConflict},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		l.ResetHandler(rec, httptest.NewRequest(http.MethodPost, "/estop/reset", strings.NewReader(tc.body)))
+		if rec.Code != tc.expected {
+			t.Errorf("%s: Expected: %v, received: %v (%s)", tc.name, tc.expected, rec.Code, rec.Body.String())
+		}
+	}
+	if l.Latched() || st.State() != state.Idle {
+		t.Errorf("Expected released latch in Idle, received: latched=%v state=%v", l.Latched(), st.State())
+	}
+	if e := l.Status().Events[0]; e.ResetBy != "operator2" || e.Reset == nil {
+		t.Errorf("Reset not recorded: %+v", e)
+	}
+	if err := l.Allow("mode_switch", 1); err != nil {
+		t.Errorf("Commands should be allowed after reset: %v", err)
+	}
+}
+
+// Test for Reset: commands stay blocked until the state reset succeeded, a failed state reset keeps the latch
+func TestReset_StateFirst(t *testing.T) {
+	l, _, st := testLatch(t, &testTransport{})
+	l.Trigger("operator1", "Test")
+
+	st.Alarm(alarms.Alarm{ID: "temp-high", Severity: alarms.SeverityCritical, Message: "Temperature high", Active: true})
+	if err := l.Reset("operator2", true); err == nil {
+		t.Errorf("Reset should fail while a critical alarm is active")
+	}
+	if !l.Latched() || l.Allow("heater_pwm", 50) == nil {
+		t.Errorf("Failed reset released the latch")
+	}
+
+	st.Alarm(alarms.Alarm{ID: "temp-high", Severity: alarms.SeverityCritical})
+	var blocked bool
+	st.OnTransition = func(state.Transition) { blocked = l.Latched() }
+	if err := l.Reset("operator2", true); err != nil {
+		t.Fatal(err)
+	}
+	if !blocked || l.Latched() {
+		t.Errorf("Expected latch held during the state reset and released after it, held: %v, latched: %v", blocked, l.Latched())
+	}
+}
@@ -0,0 +1,308 @@
+package eventlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"extruder_web_gui/config"
+	"extruder_web_gui/metrics"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Categories of events
+const (
+	CategoryConnection = "connection" //Link to the machine, its pipes, TCP socket or Modbus device
+	CategoryCommand    = "command"    //Commands sent, rejected or failed
+	CategoryAlarm      = "alarm"      //Alarms raised and cleared
+	CategoryState      = "state"      //Process state transitions
+	CategoryParse      = "parse"      //Malformed rows and messages
+	CategoryRule       = "rule"       //Log actions of automation rules
+	CategoryTraffic    = "traffic"    //Raw rows and messages, only streamed to clients asking for it and never stored
+)
+
+// Categories in display order
+var Categories = []string{CategoryConnection, CategoryCommand, CategoryAlarm, CategoryState, CategoryParse, CategoryRule, CategoryTraffic}
+
+// Severities in ascending order
+const (
+	SeverityDebug    = "debug"
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+var Severities = []string{SeverityDebug, SeverityInfo, SeverityWarning, SeverityCritical}
+
+// Defaults if not configured
+const (
+	defaultRetention = 7 * 24 * time.Hour
+	defaultMaxEvents = 10000
+)
+
+// Events buffered per stream client before further events are dropped
+const streamBuffer = 100
+
+var (
+	streamClientsGauge = metrics.NewGauge("extruder_sse_clients", "Connected event stream clients (/events/stream and /messages).")
+	droppedCounter     = metrics.NewCounter("extruder_sse_dropped_messages_total", "Events dropped because a stream client was not reading.")
+)
+
+// Entry of the event log
+type Event struct {
+	ID       int64             `json:"id"`
+	Time     time.Time         `json:"time"`
+	Category string            `json:"category"`
+	Severity string            `json:"severity"`
+	Source   string            `json:"source"` //Machine ID, the default machine if not set
+	Message  string            `json:"message"`
+	Fields   map[string]string `json:"fields,omitempty"`
+}
+
+// Event log kept in memory and optionally in a Json Lines file, pruned by age and count
+type Log struct {
+	mu          sync.Mutex
+	cfg         config.EventLogConfig
+	events      []Event // Oldest first, traffic is never stored
+	nextID      int64
+	file        *os.File
+	written     int // Lines appended since the file was last rewritten
+	subscribers map[chan Event]Filter
+	traffic     int // Subscribers asking for raw traffic
+
+	now func() time.Time
+}
+
+// Create log kept in memory only
+func New() *Log {
+	return &Log{subscribers: map[chan Event]Filter{}, now: time.Now}
+}
+
+// Event log of the application
+var Default = New()
+
+// Apply config of the default log
+func Configure(cfg config.EventLogConfig) error {
+	return Default.Configure(cfg)
+}
+
+// Record event in the default log
+func Record(e Event) Event {
+	return Default.Record(e)
+}
+
+// Report if events of the category are wanted by the default log, see Log.Wants
+func Wants(category string) bool {
+	return Default.Wants(category)
+}
+
+// Apply config. Events of a new file are loaded and followed by the events recorded so far.
+func (l *Log) Configure(cfg config.EventLogConfig) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	previous := l.cfg.File
+	l.cfg = cfg
+	if cfg.File == previous && (l.file != nil || cfg.File == "") {
+		l.prune()
+		return nil
+	}
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	if cfg.File == "" {
+		return nil
+	}
+	loaded, err := load(cfg.File)
+	if err != nil {
+		return fmt.Errorf("Error loading event log: %w", err)
+	}
+	var last int64
+	if len(loaded) > 0 {
+		last = loaded[len(loaded)-1].ID
+	}
+	for _, e := range l.events {
+		last++
+		e.ID = last
+		loaded = append(loaded, e)
+	}
+	l.events, l.nextID = loaded, last
+	l.prune()
+	return l.rewrite()
+}
+
+// Read events of a Json Lines file, a missing file is empty, broken lines are skipped
+func load(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && (len(events) == 0 || e.ID > events[len(events)-1].ID) {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// Replace the file by the events in memory and keep it open for appending (caller holds mu)
+func (l *Log) rewrite() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.cfg.File), filepath.Base(l.cfg.File)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("Error writing event log: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(w)
+	for _, e := range l.events {
+		encoder.Encode(e)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Error writing event log: %w", err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), l.cfg.File); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Error writing event log: %w", err)
+	}
+	f, err := os.OpenFile(l.cfg.File, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening event log: %w", err)
+	}
+	l.file, l.written = f, 0
+	return nil
+}
+
+// Remove events older than the retention and beyond the maximum count (caller holds mu)
+func (l *Log) prune() {
+	retention := time.Duration(l.cfg.RetentionDays) * 24 * time.Hour
+	if retention == 0 {
+		retention = defaultRetention
+	}
+	maxEvents := l.cfg.MaxEvents
+	if maxEvents == 0 {
+		maxEvents = defaultMaxEvents
+	}
+	cutoff := l.now().Add(-retention)
+	drop := max(len(l.events)-maxEvents, 0)
+	for drop < len(l.events) && l.events[drop].Time.Before(cutoff) {
+		drop++
+	}
+	l.events = l.events[drop:]
+}
+
+// Record event and send it to the matching streams, returns it with ID and time set.
+// The severity defaults to info.
+func (l *Log) Record(e Event) Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	e.ID = l.nextID
+	if e.Time.IsZero() {
+		e.Time = l.now()
+	}
+	if e.Severity == "" {
+		e.Severity = SeverityInfo
+	}
+	if e.Source == "" {
+		e.Source = config.DefaultMachineID
+	}
+	if e.Category != CategoryTraffic {
+		l.store(e)
+	}
+	for ch, f := range l.subscribers {
+		if !f.Match(e) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			droppedCounter.Inc()
+		}
+	}
+	return e
+}
+
+// Keep event in memory and append it to the file (caller holds mu)
+func (l *Log) store(e Event) {
+	l.events = append(l.events, e)
+	l.prune()
+	if l.file == nil {
+		return
+	}
+	line, _ := json.Marshal(e)
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Println("Error writing event log:", err)
+		return
+	}
+	// Rewrite the file once it holds about twice the kept events
+	l.written++
+	if l.written > max(len(l.events), 1000) {
+		if err := l.rewrite(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Report if recording events of the category is of use, raw traffic only while a stream asks for it
+func (l *Log) Wants(category string) bool {
+	if category != CategoryTraffic {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.traffic > 0
+}
+
+// Stored events matching the filter, oldest first. The newest events are returned if the limit is exceeded.
+func (l *Log) Query(f Filter) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var list []Event
+	for i := len(l.events) - 1; i >= 0 && (f.Limit == 0 || len(list) < f.Limit); i-- {
+		if f.Match(l.events[i]) {
+			list = append(list, l.events[i])
+		}
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list
+}
+
+// Receive new events matching the filter until the returned function is called
+func (l *Log) Subscribe(f Filter) (<-chan Event, func()) {
+	ch := make(chan Event, streamBuffer)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers[ch] = f
+	if f.wantsTraffic() {
+		l.traffic++
+	}
+	return ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, ok := l.subscribers[ch]; ok {
+			delete(l.subscribers, ch)
+			if f.wantsTraffic() {
+				l.traffic--
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package eventlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"extruder_web_gui/config"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Log with a manual clock
+func testLog(t *testing.T, cfg config.EventLogConfig) (*Log, *time.Time) {
+	now := time.Date(2026, 5, 4, 10, 0, 0, 0, time.UTC)
+	l := New()
+	l.now = func() time.Time { return now }
+	if err := l.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return l, &now
+}
+
+// Test for Query: filter by category, severity, source, text and limit
+func TestLog_Query(t *testing.T) {
+	l, _ := testLog(t, config.EventLogConfig{})
+	l.Record(Event{Category: CategoryConnection, Severity: SeverityWarning, Message: "TCP connection lost"})
+	l.Record(Event{Category: CategoryCommand, Severity: SeverityDebug, Source: "line2", Message: "Command screw_rpm = 50 sent"})
+	l.Record(Event{Category: CategoryAlarm, Severity: SeverityCritical, Source: "line2", Message: "Alarm raised: Temperature high"})
+	l.Record(Event{Category: CategoryTraffic, Message: "0100000000000032"})
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		expected []int64
+	}{
+		{"All but traffic", Filter{}, []int64{1, 2, 3}},
+		{"Category", Filter{Categories: []string{CategoryCommand, CategoryAlarm}}, []int64{2, 3}},
+		{"Severity", Filter{Severity: SeverityWarning}, []int64{1, 3}},
+		{"Source", Filter{Sources: []string{config.DefaultMachineID}}, []int64{1}},
+		{"Text", Filter{Text: "temperature"}, []int64{3}},
+		{"After", Filter{After: 2}, []int64{3}},
+		{"Limit keeps newest", Filter{Limit: 2}, []int64{2, 3}},
+		{"Traffic never stored", Filter{Categories: []string{CategoryTraffic}}, nil},
+	}
+	for _, tc := range tests {
+		var ids []int64
+		for _, e := range l.Query(tc.filter) {
+			ids = append(ids, e.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tc.expected) {
+			t.Errorf("%s: Expected: %v, received: %v", tc.name, tc.expected, ids)
+		}
+	}
+}
+
+// Test for Subscribe and Wants: raw traffic only for streams asking for it
+func TestLog_Subscribe(t *testing.T) {
+	l, _ := testLog(t, config.EventLogConfig{})
+	all, stopAll := l.Subscribe(Filter{})
+	defer stopAll()
+	if l.Wants(CategoryTraffic) {
+		t.Errorf("Traffic wanted without subscriber")
+	}
+	traffic, stopTraffic := l.Subscribe(Filter{Categories: []string{CategoryTraffic}})
+	if !l.Wants(CategoryTraffic) {
+		t.Errorf("Traffic not wanted by subscriber")
+	}
+	l.Record(Event{Category: CategoryTraffic, Message: "raw"})
+	l.Record(Event{Category: CategoryParse, Severity: SeverityWarning, Message: "Invalid timestamp"})
+	if e := <-all; e.Category != CategoryParse {
+		t.Errorf("Expected: %v, received: %v", CategoryParse, e.Category)
+	}
+	if e := <-traffic; e.Message != "raw" || len(traffic) != 0 {
+		t.Errorf("Unexpected traffic event: %+v", e)
+	}
+	stopTraffic()
+	if l.Wants(CategoryTraffic) {
+		t.Errorf("Traffic wanted after unsubscribe")
+	}
+}
+
+// Test for Configure and Record: events persisted, loaded after a restart and pruned by age and count
+func TestLog_Persistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "events.jsonl")
+	l, now := testLog(t, config.EventLogConfig{File: file, RetentionDays: 1, MaxEvents: 3})
+	l.Record(Event{Category: CategoryState, Message: "old"})
+	*now = now.Add(25 * time.Hour)
+	for _, msg := range []string{"a", "b", "c", "d"} {
+		l.Record(Event{Category: CategoryState, Message: msg})
+	}
+
+	restarted, restartNow := testLog(t, config.EventLogConfig{})
+	*restartNow = *now
+	restarted.Record(Event{Category: CategoryConnection, Message: "started"})
+	if err := restarted.Configure(config.EventLogConfig{File: file, RetentionDays: 1, MaxEvents: 3}); err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, e := range restarted.Query(Filter{}) {
+		messages = append(messages, e.Message)
+	}
+	if strings.Join(messages, ",") != "c,d,started" {
+		t.Errorf("Expected: %v, received: %v", "c,d,started", messages)
+	}
+	if e := restarted.Record(Event{Category: CategoryState, Message: "e"}); e.ID != 7 {
+		t.Errorf("IDs should continue after the loaded events, received: %d", e.ID)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); lines++ {
+		var e Event
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			t.Errorf("Invalid line: %s", scanner.Text())
+		}
+	}
+	if lines != 4 {
+		t.Errorf("Expected: %v, received: %v lines", 4, lines)
+	}
+}
+
+// Test for Handler and StreamHandler: query parameters, invalid filters and replay after an ID
+func TestHandlers(t *testing.T) {
+	l, _ := testLog(t, config.EventLogConfig{})
+	l.Record(Event{Category: CategoryCommand, Severity: SeverityWarning, Message: "Command heater_pwm = 80 rejected"})
+	l.Record(Event{Category: CategoryAlarm, Severity: SeverityCritical, Message: "Alarm raised: Temperature high"})
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		count int
+	}{
+		{"", http.StatusOK, 2},
+		{"?category=alarm&severity=critical", http.StatusOK, 1},
+		{"?category=spool", http.StatusBadRequest, 0},
+		{"?since=yesterday", http.StatusBadRequest, 0},
+		{"?limit=0", http.StatusBadRequest, 0},
+	} {
+		w := httptest.NewRecorder()
+		l.Handler(w, httptest.NewRequest("GET", "/events"+tc.query, nil))
+		var events []Event
+		json.Unmarshal(w.Body.Bytes(), &events)
+		if w.Code != tc.code || len(events) != tc.count {
+			t.Errorf("%s: Expected: %d %d, received: %d %d", tc.query, tc.code, tc.count, w.Code, len(events))
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(l.StreamHandler))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "?after=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	l.Record(Event{Category: CategoryState, Message: "State idle -> heating"})
+	reader := bufio.NewReader(resp.Body)
+	var received []string
+	for len(received) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: "); ok {
+			var e Event
+			json.Unmarshal([]byte(data), &e)
+			received = append(received, e.Message)
+		}
+	}
+	if received[0] != "Alarm raised: Temperature high" || received[1] != "State idle -> heating" {
+		t.Errorf("Unexpected stream: %v", received)
+	}
+}
@@ -0,0 +1,104 @@
+package eventlog
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events returned by /events if no limit is given, and the largest limit
+const (
+	defaultLimit = 100
+	maxLimit     = 10000
+)
+
+// Selection of events, zero values match everything except raw traffic
+type Filter struct {
+	Categories []string  // Empty = all categories but traffic
+	Severity   string    // Minimum severity, empty = all
+	Sources    []string  // Empty = all sources
+	Since      time.Time // Events at or after, zero = no limit
+	Until      time.Time // Events before, zero = no limit
+	After      int64     // Events with a larger ID
+	Text       string    // Case insensitive part of the message
+	Limit      int       // Newest events returned by Query, 0 = all
+}
+
+// Report if the event passes the filter
+func (f Filter) Match(e Event) bool {
+	if len(f.Categories) == 0 && e.Category == CategoryTraffic {
+		return false
+	}
+	if len(f.Categories) > 0 && !slices.Contains(f.Categories, e.Category) {
+		return false
+	}
+	if f.Severity != "" && slices.Index(Severities, e.Severity) < slices.Index(Severities, f.Severity) {
+		return false
+	}
+	if len(f.Sources) > 0 && !slices.Contains(f.Sources, e.Source) {
+		return false
+	}
+	if (!f.Since.IsZero() && e.Time.Before(f.Since)) || (!f.Until.IsZero() && !e.Time.Before(f.Until)) {
+		return false
+	}
+	if e.ID <= f.After {
+		return false
+	}
+	return f.Text == "" || strings.Contains(strings.ToLower(e.Message), strings.ToLower(f.Text))
+}
+
+func (f Filter) wantsTraffic() bool {
+	return slices.Contains(f.Categories, CategoryTraffic)
+}
+
+// Filter from query parameters: category and source (comma separated), severity (minimum),
+// since and until (RFC 3339), after (event ID), q (text) and limit (default 100)
+func ParseFilter(q url.Values) (Filter, error) {
+	f := Filter{Severity: q.Get("severity"), Text: q.Get("q"), Limit: defaultLimit}
+	for _, c := range split(q.Get("category")) {
+		if !slices.Contains(Categories, c) {
+			return f, fmt.Errorf("Unknown category %q, options: %s", c, strings.Join(Categories, ", "))
+		}
+		f.Categories = append(f.Categories, c)
+	}
+	if f.Severity != "" && !slices.Contains(Severities, f.Severity) {
+		return f, fmt.Errorf("Unknown severity %q, options: %s", f.Severity, strings.Join(Severities, ", "))
+	}
+	f.Sources = split(q.Get("source"))
+	var err error
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if v := q.Get(p.name); v != "" {
+			if *p.t, err = time.Parse(time.RFC3339, v); err != nil {
+				return f, fmt.Errorf("Invalid %s: %q is no RFC 3339 time", p.name, v)
+			}
+		}
+	}
+	if v := q.Get("after"); v != "" {
+		if f.After, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return f, fmt.Errorf("Invalid after: %q is no event ID", v)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 1 || f.Limit > maxLimit {
+			return f, fmt.Errorf("Invalid limit: %q, expected 1..%d", v, maxLimit)
+		}
+	}
+	return f, nil
+}
+
+// Non-empty parts of a comma separated list
+func split(list string) []string {
+	var parts []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
@@ -0,0 +1,108 @@
+package eventlog
+
+import (
+	"cmp"
+	"encoding/json"
+	"extruder_web_gui/config"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Handler for /events of the default log
+func Handler(w http.ResponseWriter, r *http.Request) {
+	Default.Handler(w, r)
+}
+
+// Handler for /events/stream of the default log
+func StreamHandler(w http.ResponseWriter, r *http.Request) {
+	Default.StreamHandler(w, r)
+}
+
+// Handler for stored events matching the query parameters, see ParseFilter
+func (l *Log) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Nur GET-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.Query(f))
+}
+
+// Handler for new events matching the query parameters via SSE. Stored events after the ID
+// of the after parameter or the Last-Event-ID header are sent first. Raw traffic is only sent
+// if requested with category=traffic.
+func (l *Log) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	l.stream(w, r, func(e Event) string {
+		payload, _ := json.Marshal(e)
+		return string(payload)
+	})
+}
+
+// Handler for the events of a source (machine ID) as text lines via SSE, raw traffic included unless other categories are requested
+func (l *Log) TextStreamHandler(source string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		q.Set("source", cmp.Or(source, config.DefaultMachineID))
+		if q.Get("category") == "" {
+			q.Set("category", strings.Join(Categories, ","))
+		}
+		r.URL.RawQuery = q.Encode()
+		l.stream(w, r, func(e Event) string {
+			return fmt.Sprintf("%s [%s] %s", e.Time.Format("15:04:05"), e.Category, e.Message)
+		})
+	}
+}
+
+// Send events matching the query parameters in the given format until the client disconnects
+func (l *Log) stream(w http.ResponseWriter, r *http.Request, format func(Event) string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		q.Set("after", id)
+	}
+	f, err := ParseFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	streamClientsGauge.Add(1)
+	defer streamClientsGauge.Add(-1)
+	events, unsubscribe := l.Subscribe(Filter{Categories: f.Categories, Severity: f.Severity, Sources: f.Sources, Text: f.Text})
+	defer unsubscribe()
+	last := f.After
+	if q.Has("after") {
+		for _, e := range l.Query(f) {
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.ID, format(e))
+			last = e.ID
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-events:
+			if e.ID <= last {
+				continue // Already sent from the stored events
+			}
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.ID, format(e))
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package history
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"extruder_web_gui/data"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upper limit of resampled rows per request
+const maxResampledRows = 1000000
+
+// Magic and version of the columnar binary export
+var columnarMagic = [4]byte{'E', 'X', 'T', 'C'}
+
+const columnarVersion = 2
+
+// Quality codes of the columnar binary export, 0 for missing values
+var columnarQualities = []data.Quality{"", data.QualityGood, data.QualityBadParse, data.QualityOutOfRange, data.QualityStale, data.QualitySubstituted}
+
+// History request: signals, time range and resampling interval
+type Query struct {
+	Signals  []string
+	From, To time.Time
+	Interval time.Duration
+}
+
+// Parse common history parameters, signals default to the given list:
+// signals=diameter,temperature  from/to (RFC 3339) or spool=ID  interval=1s
+func (r *Recorder) ParseQuery(req *http.Request, signals []string) (Query, error) {
+	params := req.URL.Query()
+	q := Query{Signals: signals}
+	if s := params.Get("signals"); s != "" {
+		q.Signals = strings.Split(s, ",")
+		for _, name := range q.Signals {
+			if _, ok := data.SignalInfo(name); !ok {
+				return q, fmt.Errorf("Unknown signal: %s", name)
+			}
+		}
+	}
+	var err error
+	if s := params.Get("spool"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return q, fmt.Errorf("Invalid spool: %s", s)
+		}
+		ok := false
+		if r.SpoolRange != nil {
+			q.From, q.To, ok = r.SpoolRange(id)
+		}
+		if !ok {
+			return q, fmt.Errorf("Unknown spool: %d", id)
+		}
+	}
+	if s := params.Get("from"); s != "" {
+		if q.From, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, fmt.Errorf("Invalid from: %w", err)
+		}
+	}
+	if s := params.Get("to"); s != "" {
+		if q.To, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, fmt.Errorf("Invalid to: %w", err)
+		}
+	}
+	if s := params.Get("interval"); s != "" {
+		if q.Interval, err = time.ParseDuration(s); err != nil || q.Interval <= 0 {
+			return q, fmt.Errorf("Invalid interval: %s", s)
+		}
+	}
+	return q, nil
+}
+
+// Handler for CSV export: /export/csv?delimiter=;&decimal=,
+func (r *Recorder) CSVHandler(w http.ResponseWriter, req *http.Request) {
+	q, err := r.ParseQuery(req, data.SignalNames())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	delimiter, decimal, err := csvFormat(req.URL.Query().Get("delimiter"), req.URL.Query().Get("decimal"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := r.Table(q.Signals, q.From, q.To, q.Interval)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="extruder_export.csv"`)
+	WriteCSV(w, q.Signals, rows, delimiter, decimal)
+}
+
+// Delimiter and decimal separator, German Excel uses ";" and ","
+func csvFormat(delimiter, decimal string) (rune, string, error) {
+	if decimal == "" {
+		decimal = "."
+	}
+	if decimal != "." && decimal != "," {
+		return 0, "", fmt.Errorf("Invalid decimal separator: %s", decimal)
+	}
+	switch delimiter {
+	case "":
+		if decimal == "," {
+			return ';', decimal, nil
+		}
+		return ',', decimal, nil
+	case "tab", "\t":
+		return '\t', decimal, nil
+	}
+	if len([]rune(delimiter)) != 1 || delimiter == decimal || delimiter == "\"" {
+		return 0, "", fmt.Errorf("Invalid delimiter: %s", delimiter)
+	}
+	return []rune(delimiter)[0], decimal, nil
+}
+
+// Write table as CSV with header row and a quality column after every signal, missing values stay empty
+func WriteCSV(w io.Writer, signals []string, rows []Row, delimiter rune, decimal string) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = delimiter
+	header := []string{"timestamp"}
+	for _, name := range signals {
+		header = append(header, name, name+"_quality")
+	}
+	cw.Write(header)
+	record := make([]string, 2*len(signals)+1)
+	for _, row := range rows {
+		record[0] = row.Time.Format(time.RFC3339Nano)
+		for i, v := range row.Values {
+			record[2*i+1] = ""
+			if !math.IsNaN(v) {
+				record[2*i+1] = strings.Replace(formatValue(v), ".", decimal, 1)
+			}
+			record[2*i+2] = string(row.Qualities[i])
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Shortest representation of the float32 source value
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 32)
+}
+
+// Handler for JSON Lines export, one object per row with the qualities of the signals in "quality"
+func (r *Recorder) JSONLinesHandler(w http.ResponseWriter, req *http.Request) {
+	q, err := r.ParseQuery(req, data.SignalNames())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := r.Table(q.Signals, q.From, q.To, q.Interval)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="extruder_export.jsonl"`)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	names := make([]string, len(q.Signals))
+	for i, name := range q.Signals {
+		quoted, _ := json.Marshal(name)
+		names[i] = string(quoted)
+	}
+	for _, row := range rows {
+		fmt.Fprintf(bw, "{\"timestamp\":\"%s\"", row.Time.Format(time.RFC3339Nano))
+		for i, v := range row.Values {
+			value := "null"
+			if !math.IsNaN(v) {
+				value = formatValue(v)
+			}
+			fmt.Fprintf(bw, ",%s:%s", names[i], value)
+		}
+		bw.WriteString(",\"quality\":{")
+		for i, quality := range row.Qualities {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			value := "null"
+			if quality != "" {
+				value = strconv.Quote(string(quality))
+			}
+			fmt.Fprintf(bw, "%s:%s", names[i], value)
+		}
+		bw.WriteString("}}\n")
+	}
+}
+
+// Handler for the columnar binary export.
+// Layout (little endian): magic "EXTC", uint8 version, uint32 rows, uint16 signals,
+// per signal uint16 name length + name, then the timestamp column as int64 Unix nanoseconds,
+// one float32 column per signal (NaN for missing values) and one uint8 quality column per signal
+// (0 missing, 1 good, 2 bad-parse, 3 out-of-range, 4 stale, 5 substituted).
+func (r *Recorder) ColumnarHandler(w http.ResponseWriter, req *http.Request) {
+	q, err := r.ParseQuery(req, data.SignalNames())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := r.Table(q.Signals, q.From, q.To, q.Interval)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="extruder_export.extc"`)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	WriteColumnar(bw, q.Signals, rows)
+}
+
+// Write table in the columnar binary format
+func WriteColumnar(w *bufio.Writer, signals []string, rows []Row) error {
+	w.Write(columnarMagic[:])
+	w.WriteByte(columnarVersion)
+	binary.Write(w, binary.LittleEndian, uint32(len(rows)))
+	binary.Write(w, binary.LittleEndian, uint16(len(signals)))
+	for _, name := range signals {
+		binary.Write(w, binary.LittleEndian, uint16(len(name)))
+		w.WriteString(name)
+	}
+	for _, row := range rows {
+		binary.Write(w, binary.LittleEndian, row.Time.UnixNano())
+	}
+	for i := range signals {
+		for _, row := range rows {
+			binary.Write(w, binary.LittleEndian, math.Float32bits(float32(row.Values[i])))
+		}
+	}
+	for i := range signals {
+		for _, row := range rows {
+			w.WriteByte(byte(max(slices.Index(columnarQualities, row.Qualities[i]), 0)))
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,245 @@
+package history
+
+import (
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Recorded value of a signal
+type Sample struct {
+	Time    time.Time
+	Value   float32
+	Quality data.Quality
+}
+
+// Row of a table over several signals, missing values are NaN with an empty quality
+type Row struct {
+	Time      time.Time
+	Values    []float64
+	Qualities []data.Quality
+}
+
+// Recorder keeping the latest samples of every signal in memory
+type Recorder struct {
+	mu         sync.RWMutex
+	maxSamples int
+	series     map[string][]Sample
+	stop       []func() // Unsubscribe from the store
+
+	// Time range of a spool by ID, set by main
+	SpoolRange func(id int) (from time.Time, to time.Time, ok bool)
+	// Recorded machine, data.Default if nil
+	Store *data.Store
+}
+
+// Create recorder, cfg.MaxSamples limits the samples kept per signal
+func NewRecorder(cfg config.HistoryConfig) *Recorder {
+	if cfg.MaxSamples <= 0 {
+		cfg.MaxSamples = 100000
+	}
+	return &Recorder{maxSamples: cfg.MaxSamples, series: map[string][]Sample{}}
+}
+
+// Subscribe to signal updates and completed spools
+func (r *Recorder) Start() {
+	store := r.Store
+	if store == nil {
+		store = data.Default
+	}
+	unsubscribe := []func(){store.Subscribe(r.Record), store.SubscribeSpoolCompleted(r.recordPrevious)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stop = append(r.stop, unsubscribe...)
+}
+
+// Unsubscribe from the store, recorded samples are kept
+func (r *Recorder) Stop() {
+	r.mu.Lock()
+	stop := r.stop
+	r.stop = nil
+	r.mu.Unlock()
+	for _, fn := range stop {
+		fn()
+	}
+}
+
+// Record a single signal update
+func (r *Recorder) Record(u data.Update) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.append(u.Signal, Sample{Time: u.Point.Timestamp, Value: u.Point.Value, Quality: u.Point.QualityOrStale()})
+}
+
+// Previous spool stats change only on spool completion
+func (r *Recorder) recordPrevious(stats data.SpoolStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, dp := range map[string]data.Datapoint{
+		"prevWindingDiameter": stats.WindingDiameter,
+		"prevAvgFilDiameter":  stats.AvgFilDiameter,
+		"prevNbrOfWindings":   stats.NbrOfWindings,
+		"prevFilamentMass":    stats.FilamentMass,
+	} {
+		r.append(name, Sample{Time: time.Now(), Value: dp.Value, Quality: dp.QualityOrStale()})
+	}
+}
+
+// Append sample and drop the oldest ones above the limit (caller holds mu)
+func (r *Recorder) append(name string, s Sample) {
+	series := append(r.series[name], s)
+	if len(series) > r.maxSamples {
+		series = append([]Sample(nil), series[len(series)-r.maxSamples:]...)
+	}
+	r.series[name] = series
+}
+
+// Return samples of a signal within [from, to], zero times are open ends
+func (r *Recorder) Series(name string, from, to time.Time) []Sample {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []Sample
+	for _, s := range r.series[name] {
+		if inRange(s.Time, from, to) {
+			out = append(out, s)
+		}
+	}
+	// Sources may deliver timestamps out of order
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
+
+func inRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || !t.After(to))
+}
+
+// Build a table of the signals within [from, to]. Without interval there is one row per
+// distinct timestamp and values are carried forward, with interval values are averaged per bucket.
+// Fails if the interval would produce more than maxResampledRows rows.
+func (r *Recorder) Table(signals []string, from, to time.Time, interval time.Duration) ([]Row, error) {
+	series := make([][]Sample, len(signals))
+	for i, name := range signals {
+		series[i] = r.Series(name, from, to)
+	}
+	if interval > 0 {
+		return resample(series, from, to, interval)
+	}
+	return merge(series), nil
+}
+
+// One row per distinct timestamp, last known value per signal
+func merge(series [][]Sample) []Row {
+	var times []time.Time
+	for _, s := range series {
+		for _, sample := range s {
+			times = append(times, sample.Time)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	rows := []Row{}
+	pos := make([]int, len(series))
+	last := nan(len(series))
+	quality := make([]data.Quality, len(series))
+	for i, t := range times {
+		if i > 0 && t.Equal(times[i-1]) {
+			continue
+		}
+		for j, s := range series {
+			for pos[j] < len(s) && !s[pos[j]].Time.After(t) {
+				last[j] = float64(s[pos[j]].Value)
+				quality[j] = s[pos[j]].Quality
+				pos[j]++
+			}
+		}
+		rows = append(rows, Row{Time: t, Values: append([]float64(nil), last...), Qualities: append([]data.Quality(nil), quality...)})
+	}
+	return rows
+}
+
+// Mean value per signal in buckets [t, t+interval), open ends of the range are taken from the data.
+// Bad-parse, out-of-range and stale samples are left out of the mean. A bucket holding only such
+// samples has no value and the quality of its last sample.
+func resample(series [][]Sample, from, to time.Time, interval time.Duration) ([]Row, error) {
+	if from.IsZero() || to.IsZero() {
+		first, last := bounds(series)
+		if first.IsZero() {
+			return []Row{}, nil
+		}
+		if from.IsZero() {
+			from = first.Truncate(interval)
+		}
+		if to.IsZero() {
+			to = last
+		}
+	}
+	if to.Sub(from)/interval > maxResampledRows {
+		return nil, fmt.Errorf("Interval too small for time range")
+	}
+	rows := []Row{}
+	pos := make([]int, len(series))
+	for t := from; !t.After(to); t = t.Add(interval) {
+		row := Row{Time: t, Values: nan(len(series)), Qualities: make([]data.Quality, len(series))}
+		end := t.Add(interval)
+		for j, s := range series {
+			var sum float64
+			var n int
+			for ; pos[j] < len(s) && s[pos[j]].Time.Before(end); pos[j]++ {
+				sample := s[pos[j]]
+				if sample.Time.Before(t) {
+					continue
+				}
+				if !usable(sample.Quality) {
+					if n == 0 {
+						row.Qualities[j] = sample.Quality
+					}
+					continue
+				}
+				// Substituted values mark the whole bucket
+				if n == 0 || sample.Quality == data.QualitySubstituted {
+					row.Qualities[j] = sample.Quality
+				}
+				sum += float64(sample.Value)
+				n++
+			}
+			if n > 0 {
+				row.Values[j] = sum / float64(n)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Samples averaged by resample
+func usable(q data.Quality) bool {
+	return q == data.QualityGood || q == data.QualitySubstituted
+}
+
+// Time of the first and last sample over all series
+func bounds(series [][]Sample) (first, last time.Time) {
+	for _, s := range series {
+		if len(s) == 0 {
+			continue
+		}
+		if first.IsZero() || s[0].Time.Before(first) {
+			first = s[0].Time
+		}
+		if s[len(s)-1].Time.After(last) {
+			last = s[len(s)-1].Time
+		}
+	}
+	return first, last
+}
+
+func nan(n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = math.NaN()
+	}
+	return values
+}
@@ -0,0 +1,158 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// Recorder with diameter and temperature samples one second apart
+func newTestRecorder() *Recorder {
+	r := NewRecorder(config.HistoryConfig{MaxSamples: 3})
+	for i, v := range []float32{1.70, 1.72, 1.74, 1.76} {
+		r.Record(data.Update{Signal: "diameter", Point: data.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second), Value: v, Quality: data.QualityGood}})
+	}
+	r.Record(data.Update{Signal: "temperature", Point: data.Datapoint{Timestamp: start.Add(1500 * time.Millisecond), Value: 210.5, Quality: data.QualityGood}})
+	return r
+}
+
+// Test for Recorder: sample limit and carried forward values
+func TestRecorder_Table(t *testing.T) {
+	r := newTestRecorder()
+	if n := len(r.Series("diameter", time.Time{}, time.Time{})); n != 3 {
+		t.Errorf("Samples kept. Expected: %v, received: %v", 3, n)
+	}
+	rows, _ := r.Table([]string{"diameter", "temperature"}, time.Time{}, time.Time{}, 0)
+	if len(rows) != 4 {
+		t.Fatalf("Rows. Expected: %v, received: %v", 4, len(rows))
+	}
+	if !math.IsNaN(rows[0].Values[1]) || rows[2].Values[1] != 210.5 || rows[3].Values[1] != 210.5 {
+		t.Errorf("Unexpected temperature column: %v", rows)
+	}
+}
+
+// Test for Recorder: resampling averages per bucket
+func TestRecorder_Resample(t *testing.T) {
+	r := newTestRecorder()
+	rows, _ := r.Table([]string{"diameter"}, start, start.Add(3*time.Second), 2*time.Second)
+	if len(rows) != 2 {
+		t.Fatalf("Rows. Expected: %v, received: %v", 2, len(rows))
+	}
+	if math.Abs(rows[0].Values[0]-1.72) > 1e-6 || math.Abs(rows[1].Values[0]-1.75) > 1e-6 {
+		t.Errorf("Expected: [1.72 1.75], received: %v %v", rows[0].Values[0], rows[1].Values[0])
+	}
+}
+
+// Test for Recorder: bad samples are left out of the mean and mark empty buckets
+func TestRecorder_ResampleQuality(t *testing.T) {
+	r := NewRecorder(config.HistoryConfig{})
+	for i, sample := range []Sample{
+		{Value: 1.70, Quality: data.QualityGood},
+		{Value: 0, Quality: data.QualityBadParse},
+		{Value: 9.99, Quality: data.QualityOutOfRange},
+		{Value: 0, Quality: data.QualityStale},
+	} {
+		r.Record(data.Update{Signal: "diameter", Point: data.Datapoint{Timestamp: start.Add(time.Duration(i) * time.Second), Value: sample.Value, Quality: sample.Quality}})
+	}
+	rows, err := r.Table([]string{"diameter"}, start, start.Add(3*time.Second), 2*time.Second)
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("Rows. Expected: %v, received: %v %v", 2, len(rows), err)
+	}
+	if rows[0].Values[0] != float64(float32(1.70)) || rows[0].Qualities[0] != data.QualityGood {
+		t.Errorf("First bucket. Expected: 1.7 good, received: %v %v", rows[0].Values[0], rows[0].Qualities[0])
+	}
+	if !math.IsNaN(rows[1].Values[0]) || rows[1].Qualities[0] != data.QualityStale {
+		t.Errorf("Second bucket. Expected: NaN stale, received: %v %v", rows[1].Values[0], rows[1].Qualities[0])
+	}
+}
+
+// Test for export handlers: row limit also applies to open time ranges
+func TestExport_IntervalTooSmall(t *testing.T) {
+	r := newTestRecorder()
+	for _, target := range []string{
+		"/export/csv?interval=1ns",
+		"/export/jsonl?interval=1ns&from=2024-05-01T12:00:00Z",
+		"/export/columnar?interval=1ns&to=2024-05-01T12:00:03Z",
+	} {
+		rec := httptest.NewRecorder()
+		switch {
+		case strings.HasPrefix(target, "/export/csv"):
+			r.CSVHandler(rec, httptest.NewRequest("GET", target, nil))
+		case strings.HasPrefix(target, "/export/jsonl"):
+			r.JSONLinesHandler(rec, httptest.NewRequest("GET", target, nil))
+		default:
+			r.ColumnarHandler(rec, httptest.NewRequest("GET", target, nil))
+		}
+		if rec.Code != 400 {
+			t.Errorf("%s: Expected: %v, received: %v", target, 400, rec.Code)
+		}
+	}
+}
+
+// Test for CSVHandler: German delimiter and decimal separator
+func TestCSVHandler(t *testing.T) {
+	r := newTestRecorder()
+	rec := httptest.NewRecorder()
+	r.CSVHandler(rec, httptest.NewRequest("GET", "/export/csv?signals=diameter,temperature&decimal=,", nil))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if expected := "timestamp;diameter;diameter_quality;temperature;temperature_quality"; lines[0] != expected {
+		t.Errorf("Header. Expected: %v, received: %v", expected, lines[0])
+	}
+	if expected := "2024-05-01T12:00:01.5Z;1,72;good;210,5;good"; lines[2] != expected {
+		t.Errorf("Row. Expected: %v, received: %v", expected, lines[2])
+	}
+
+	rec = httptest.NewRecorder()
+	r.CSVHandler(rec, httptest.NewRequest("GET", "/export/csv?signals=unknown", nil))
+	if rec.Code != 400 {
+		t.Errorf("Unknown signal. Expected: %v, received: %v", 400, rec.Code)
+	}
+}
+
+// Test for JSONLinesHandler: missing values are null
+func TestJSONLinesHandler(t *testing.T) {
+	r := newTestRecorder()
+	rec := httptest.NewRecorder()
+	r.JSONLinesHandler(rec, httptest.NewRequest("GET", "/export/jsonl?signals=diameter,temperature", nil))
+	first := strings.SplitN(rec.Body.String(), "\n", 2)[0]
+	if expected := `{"timestamp":"2024-05-01T12:00:01Z","diameter":1.72,"temperature":null,"quality":{"diameter":"good","temperature":null}}`; first != expected {
+		t.Errorf("Expected: %v, received: %v", expected, first)
+	}
+}
+
+// Test for WriteColumnar: header and column layout
+func TestWriteColumnar(t *testing.T) {
+	var buf bytes.Buffer
+	rows := []Row{
+		{Time: start, Values: []float64{1.5}, Qualities: []data.Quality{data.QualityGood}},
+		{Time: start.Add(time.Second), Values: []float64{math.NaN()}, Qualities: []data.Quality{data.QualityStale}},
+	}
+	WriteColumnar(bufio.NewWriter(&buf), []string{"diameter"}, rows)
+	b := buf.Bytes()
+	if string(b[:4]) != "EXTC" || b[4] != columnarVersion {
+		t.Fatalf("Unexpected header: %x", b[:5])
+	}
+	if n := binary.LittleEndian.Uint32(b[5:9]); n != 2 {
+		t.Errorf("Rows. Expected: %v, received: %v", 2, n)
+	}
+	// 9 + 2 (signal count) + 2 + 8 (name) + 2*8 (timestamps)
+	values := b[37:]
+	if v := math.Float32frombits(binary.LittleEndian.Uint32(values)); v != 1.5 {
+		t.Errorf("Value. Expected: %v, received: %v", 1.5, v)
+	}
+	if v := math.Float32frombits(binary.LittleEndian.Uint32(values[4:])); !math.IsNaN(float64(v)) {
+		t.Errorf("Missing value. Expected: NaN, received: %v", v)
+	}
+	if qualities := values[8:]; len(qualities) != 2 || qualities[0] != 1 || qualities[1] != 4 {
+		t.Errorf("Qualities. Expected: [1 4], received: %v", qualities)
+	}
+}
@@ -0,0 +1,172 @@
+package machine
+
+import (
+	"encoding/json"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/data"
+	"extruder_web_gui/state"
+	"html/template"
+	"math"
+	"net/http"
+)
+
+// Setpoint and tolerances of a machine, 0 = not configured
+type Targets struct {
+	TemperatureSetpoint  float64
+	TemperatureTolerance float64
+	NominalDiameter      float64
+	DiameterTolerance    float64
+}
+
+// Status of a value compared to its target
+const (
+	StatusOK      = "ok"
+	StatusLow     = "low"
+	StatusHigh    = "high"
+	StatusUnknown = "unknown" //No target configured or value not measured with good quality
+)
+
+// Measured value with setpoint and tolerance band
+type Gauge struct {
+	Value    float32      `json:"value"`
+	Quality  data.Quality `json:"quality"`
+	Setpoint float64      `json:"setpoint,omitempty"`
+	Min      float64      `json:"min,omitempty"` //Lower tolerance limit
+	Max      float64      `json:"max,omitempty"` //Upper tolerance limit
+	Status   string       `json:"status"`
+}
+
+// Tile of a machine on the fleet dashboard
+type Tile struct {
+	Summary
+	Running     bool           `json:"running"`          //Heater, screw or spooler are driven
+	State       state.State    `json:"state,omitempty"`  //Process state, empty without state machine
+	Manual      *bool          `json:"manual,omitempty"` //Mode switch as last sent, nil until sent
+	HeaterPwm   *uint32        `json:"heaterPwm,omitempty"`
+	Temperature Gauge          `json:"temperature"`
+	Diameter    Gauge          `json:"diameter"`
+	SpoolMass   float32        `json:"spoolMass"` //Filament mass of the current spool in g
+	Alarms      []alarms.Alarm `json:"alarms"`
+	Link        string         `json:"link"` //Detail view
+}
+
+// Compare value with setpoint +/- tolerance
+func gauge(dp data.Datapoint, setpoint float64, tolerance float64) Gauge {
+	g := Gauge{Value: dp.Value, Quality: dp.QualityOrStale(), Status: StatusUnknown}
+	if setpoint <= 0 {
+		return g
+	}
+	g.Setpoint, g.Min, g.Max = setpoint, setpoint-tolerance, setpoint+tolerance
+	if g.Quality != data.QualityGood && g.Quality != data.QualityOutOfRange {
+		return g
+	}
+	switch v := float64(dp.Value); {
+	case tolerance > 0 && v < g.Min:
+		g.Status = StatusLow
+	case tolerance > 0 && v > g.Max:
+		g.Status = StatusHigh
+	default:
+		g.Status = StatusOK
+	}
+	return g
+}
+
+// Machine counts as running while heater, screw or spooler are driven
+func (m *Machine) Running() bool {
+	for _, name := range []string{"heaterPwm", "screwRpm", "spoolerRpm"} {
+		if dp, _ := m.Store.Value(name); dp.Value > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Alarms of the machine: alarms with field "machine" = ID, alarms without machine belong to the default machine
+func (m *Machine) Alarms() []alarms.Alarm {
+	list := []alarms.Alarm{}
+	for _, a := range alarms.Active() {
+		if m.owns(a) {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+func (m *Machine) owns(a alarms.Alarm) bool {
+	owner := a.Fields["machine"]
+	return owner == m.ID || (owner == "" && m == defaultMachine())
+}
+
+func defaultMachine() *Machine {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultLine
+}
+
+// Dashboard tile of the machine
+func (m *Machine) Tile() Tile {
+	t := Tile{Summary: m.Summary(), Running: m.Running(), Alarms: m.Alarms(), Link: "/machines/" + m.ID + "/"}
+	if m.State != nil {
+		t.State = m.State.State()
+	}
+	if m.LastCommand != nil {
+		if v, ok := m.LastCommand("mode_switch"); ok {
+			manual := v == 1
+			t.Manual = &manual
+		}
+		if v, ok := m.LastCommand("heater_pwm"); ok {
+			t.HeaterPwm = &v
+		}
+	}
+	var targets Targets
+	if m.Targets != nil {
+		targets = m.Targets()
+	}
+	temperature, _ := m.Store.Value("temperature")
+	diameter, _ := m.Store.Value("diameter")
+	mass, _ := m.Store.Value("filamentMass")
+	t.Temperature = gauge(temperature, targets.TemperatureSetpoint, targets.TemperatureTolerance)
+	t.Diameter = gauge(diameter, targets.NominalDiameter, targets.DiameterTolerance)
+	t.SpoolMass = mass.Value
+	return t
+}
+
+// Tiles of all machines, the default machine first
+func Tiles() []Tile {
+	tiles := []Tile{}
+	for _, m := range All() {
+		tiles = append(tiles, m.Tile())
+	}
+	return tiles
+}
+
+// Handler for /fleet/data: aggregate of all machines for the dashboard
+func FleetDataHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Tiles())
+}
+
+var fleetFuncs = template.FuncMap{
+	"deref": func(b *bool) bool { return *b },
+	"round": func(v float32, digits int) float64 {
+		p := math.Pow(10, float64(digits))
+		return math.Round(float64(v)*p) / p
+	},
+}
+
+// Handler for /fleet: dashboard with one tile per machine, refreshed from /fleet/data
+func FleetHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.New("fleet.html").Funcs(fleetFuncs).ParseFiles("fleet.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, Tiles())
+}
+
+// Handler for /machines/{id}/: main view of the machine
+var DetailHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	if err := m.Store.RenderMainView(w, "/machines/"+m.ID, m.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+})
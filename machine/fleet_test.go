@@ -0,0 +1,85 @@
+package machine
+
+import (
+	"encoding/json"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test for gauge: status against setpoint and tolerance
+func TestGauge(t *testing.T) {
+	good := func(v float32) data.Datapoint { return data.Datapoint{Value: v, Quality: data.QualityGood} }
+	for _, tc := range []struct {
+		dp                  data.Datapoint
+		setpoint, tolerance float64
+		status              string
+	}{
+		{good(1.75), 0, 0, StatusUnknown},
+		{good(1.75), 1.75, 0.05, StatusOK},
+		{good(1.69), 1.75, 0.05, StatusLow},
+		{good(1.81), 1.75, 0.05, StatusHigh},
+		{good(300), 210, 0, StatusOK},
+		{data.Datapoint{Value: 1.9, Quality: data.QualityStale}, 1.75, 0.05, StatusUnknown},
+	} {
+		if g := gauge(tc.dp, tc.setpoint, tc.tolerance); g.Status != tc.status {
+			t.Errorf("gauge(%v, %v, %v): Expected: %s, received: %s", tc.dp.Value, tc.setpoint, tc.tolerance, tc.status, g.Status)
+		}
+	}
+}
+
+// Test for Tiles: state, mode, targets and alarms per machine
+func TestTiles(t *testing.T) {
+	addr, _ := startExtruder(t, "02000000000000dc", "0500000000000032") // temperature 220, heater PWM 50
+	stop, err := Start([]config.MachineConfig{{ID: "line2", Mode: "TCPMode", TCPAddress: addr,
+		Targets: config.TargetConfig{Temperature: 210, TemperatureTolerance: 5}}}, config.TimestampConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	line2, _ := Get("line2")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && !line2.Running() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := line2.Send(0x01, 1); err != nil {
+		t.Fatal(err)
+	}
+	alarms.Raise(alarms.Alarm{ID: "test:line2", Severity: alarms.SeverityWarning, Message: "Line 2 alarm", Fields: map[string]string{"machine": "line2"}})
+	defer alarms.Clear("test:line2")
+
+	w := httptest.NewRecorder()
+	FleetDataHandler(w, httptest.NewRequest("GET", "/fleet/data", nil))
+	var tiles []Tile
+	if err := json.Unmarshal(w.Body.Bytes(), &tiles); err != nil || len(tiles) != 1 {
+		t.Fatalf("Unexpected /fleet/data: %v %s", err, w.Body.String())
+	}
+	tile := tiles[0]
+	if !tile.Running || tile.Manual == nil || !*tile.Manual || tile.Link != "/machines/line2/" {
+		t.Errorf("Unexpected state. Expected: running manual /machines/line2/, received: %v %v %s", tile.Running, tile.Manual, tile.Link)
+	}
+	if tile.Temperature.Status != StatusHigh || tile.Temperature.Max != 215 {
+		t.Errorf("Unexpected temperature. Expected: high with max 215, received: %+v", tile.Temperature)
+	}
+	if len(tile.Alarms) != 1 || tile.Alarms[0].ID != "test:line2" {
+		t.Errorf("Unexpected alarms. Expected: [test:line2], received: %+v", tile.Alarms)
+	}
+
+	// Template is rendered from the repository root
+	wd, _ := os.Getwd()
+	os.Chdir("..")
+	defer os.Chdir(wd)
+	w = httptest.NewRecorder()
+	FleetHandler(w, httptest.NewRequest("GET", "/fleet", nil))
+	body := w.Body.String()
+	for _, expected := range []string{`id="tile-line2"`, `href="/machines/line2/"`, "220 °C / 210 °C", "manual", "running", "Line 2 alarm"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in /fleet, received: %s", expected, body)
+		}
+	}
+}
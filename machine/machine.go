@@ -0,0 +1,457 @@
+package machine
+
+import (
+	"encoding/json"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/controls"
+	"extruder_web_gui/data"
+	"extruder_web_gui/estop"
+	"extruder_web_gui/eventlog"
+	"extruder_web_gui/history"
+	"extruder_web_gui/modbus"
+	"extruder_web_gui/notify"
+	"extruder_web_gui/pipes"
+	"extruder_web_gui/ramp"
+	"extruder_web_gui/state"
+	"extruder_web_gui/tcp"
+	"extruder_web_gui/watchdog"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Machines without a value for this long are shown offline
+const OnlineTimeout = 10 * time.Second
+
+// Extruder line served below /machines/{id}
+type Machine struct {
+	ID          string
+	Name        string
+	Store       *data.Store
+	Recorder    *history.Recorder
+	State       *state.Machine                   // Process state, guards the commands sent via Send
+	EStop       *estop.Latch                     // Latched emergency stop, blocks commands until reset
+	Mode        func() string                    // Active data source mode
+	Send        func(id byte, val uint32) error  // Validate and send a command to the machine
+	Check       func(id byte, val uint32) error  // Validate a command and ask the guard without sending
+	Ramps       *ramp.Manager                    // Setpoint ramps sent via Send
+	LastCommand func(name string) (uint32, bool) // Last value sent for a command name
+	Targets     func() Targets                   // Setpoint and tolerances shown on the fleet dashboard
+	Watchdog    *watchdog.Watchdog               // Stale signals and link loss of further machines, nil if disabled
+
+	cfg    config.MachineConfig // Config of further machines, zero for the default machine
+	detach []func()             // Unsubscribe history, state and notifications from the store
+}
+
+var (
+	mu          sync.RWMutex
+	defaultLine *Machine
+	configured  []*Machine // In config order
+	alarmsOnce  sync.Once
+)
+
+// Register the machine described by the top level config, it is listed first
+func RegisterDefault(m *Machine) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultLine = m
+	alarmsOnce.Do(func() { alarms.Subscribe(dispatchAlarm) })
+}
+
+// Pass critical alarms to the state machine of the owning machine
+func dispatchAlarm(a alarms.Alarm) {
+	for _, m := range All() {
+		if m.State != nil && m.owns(a) {
+			m.State.Alarm(a)
+		}
+	}
+}
+
+// Return all machines, the default machine first
+func All() []*Machine {
+	mu.RLock()
+	defer mu.RUnlock()
+	var all []*Machine
+	if defaultLine != nil {
+		all = append(all, defaultLine)
+	}
+	return append(all, configured...)
+}
+
+// Return machine by ID
+func Get(id string) (*Machine, bool) {
+	for _, m := range All() {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// Start data sources of the configured machines, returns function stopping them.
+// Store and history of a machine are kept over restarts unless its signal dictionary changed,
+// process state and emergency stop are always kept.
+func Start(cfgs []config.MachineConfig, timestamps config.TimestampConfig) (func(), error) {
+	previous := map[string]*Machine{}
+	for _, m := range All() {
+		previous[m.ID] = m
+	}
+	var machines []*Machine
+	var stops []func()
+	stopAll := func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+	fail := func(id string, err error) (func(), error) {
+		stopAll()
+		// Previous machines stay in use, drop the stores created for the new config
+		for _, m := range machines {
+			if prev := previous[m.ID]; prev == nil || prev.Store != m.Store {
+				m.release()
+				if prev != nil {
+					prev.EStop.Attach(prev.Store)
+				}
+			}
+		}
+		return nil, fmt.Errorf("Machine %s: %w", id, err)
+	}
+	for _, c := range cfgs {
+		m, err := prepare(c, previous[c.ID], timestamps)
+		if err != nil {
+			return fail(c.ID, err)
+		}
+		machines = append(machines, m)
+		target, stop, err := startTransport(c, m.Store)
+		if err != nil {
+			return fail(c.ID, err)
+		}
+		mode, pipe := c.Mode, c.MsgToSimPipe
+		m.EStop.Configure(c.EStop, func() []estop.Transport { return estop.Transports(mode, pipe, target.Transmit) })
+		target.Guard, target.EStop = m.EStop, m.EStop.Trigger
+		m.Send, m.Check, m.LastCommand = target.Send, target.Check, target.LastCommandValue
+		sendByName := func(name string, val uint32) error {
+			id, ok := controls.CommandID(name)
+			if !ok {
+				return fmt.Errorf("Unknown command: %s", name)
+			}
+			return target.Send(id, val)
+		}
+		m.Ramps = ramp.NewManager(sendByName, target.LastCommandValue)
+		stops = append(stops, m.Ramps.CancelAll, stop)
+		if c.Watchdog.Enabled {
+			m.Watchdog = watchdog.New(c.Watchdog, m.Store, c.Mode, c.ModbusClient.PollInterval)
+			m.Watchdog.Send, m.Watchdog.EmergencyStop = sendByName, m.EStop.Trigger
+			stopWatchdog := make(chan struct{})
+			go m.Watchdog.Run(stopWatchdog)
+			stops = append(stops, func() { close(stopWatchdog) })
+		}
+	}
+	mu.Lock()
+	configured = machines
+	mu.Unlock()
+	kept := map[*data.Store]bool{}
+	for _, m := range machines {
+		kept[m.Store] = true
+	}
+	for _, prev := range previous {
+		if !kept[prev.Store] {
+			prev.release()
+		}
+	}
+	alarmsOnce.Do(func() { alarms.Subscribe(dispatchAlarm) })
+	return stopAll, nil
+}
+
+// Unsubscribe from the store of the machine
+func (m *Machine) release() {
+	for _, fn := range m.detach {
+		fn()
+	}
+	m.detach = nil
+}
+
+// Create machine or reuse store and history of the previous run. A rebuilt store keeps the
+// process state and emergency stop of the previous run, so a reload never lifts a latched stop.
+func prepare(c config.MachineConfig, prev *Machine, timestamps config.TimestampConfig) (*Machine, error) {
+	name := c.Name
+	if name == "" {
+		name = c.ID
+	}
+	mode := c.Mode
+	targets := Targets{
+		TemperatureSetpoint:  c.Targets.Temperature,
+		TemperatureTolerance: c.Targets.TemperatureTolerance,
+		NominalDiameter:      c.Targets.NominalDiameter,
+		DiameterTolerance:    c.Targets.Tolerance,
+	}
+	m := &Machine{ID: c.ID, Name: name, Mode: func() string { return mode }, Targets: func() Targets { return targets }, cfg: c}
+	setpoint := func() (float64, float64) { return targets.TemperatureSetpoint, targets.TemperatureTolerance }
+	if prev != nil && prev.Store != nil && reflect.DeepEqual(prev.cfg.Signals, c.Signals) && prev.cfg.History == c.History {
+		m.Store, m.Recorder, m.State, m.EStop, m.detach = prev.Store, prev.Recorder, prev.State, prev.EStop, prev.detach
+		m.State.Configure(c.State, setpoint)
+	} else {
+		dict, err := dictionary(c.Signals)
+		if err != nil {
+			return nil, err
+		}
+		if m.Store, err = data.NewStore(dict); err != nil {
+			return nil, err
+		}
+		m.Store.Source = c.ID
+		m.Recorder = history.NewRecorder(c.History)
+		m.Recorder.Store = m.Store
+		m.Recorder.Start()
+		if prev != nil && prev.State != nil && prev.EStop != nil {
+			m.State, m.EStop = prev.State, prev.EStop
+			m.State.Configure(c.State, setpoint)
+			m.EStop.Attach(m.Store)
+		} else {
+			m.State = state.New(c.State, setpoint)
+			m.State.OnTransition = TransitionEvents(c.ID)
+			m.EStop = estop.New(c.EStop, m.Store, m.State, func() []estop.Transport { return nil })
+			m.EStop.OnEvent = func(e estop.Event) { notify.Publish(notify.EStopEvent(c.ID, e)) }
+		}
+		m.detach = []func(){
+			m.Recorder.Stop,
+			m.State.Attach(m.Store),
+			m.Store.SubscribeSpoolCompleted(func(stats data.SpoolStats) { notify.Publish(notify.SpoolEvent(c.ID, stats)) }),
+		}
+	}
+	if err := m.Store.ConfigureTimestamps(timestamps.Layouts, timestamps.TimeZone); err != nil {
+		return nil, err
+	}
+	if err := m.Store.ConfigureRanges(c.SignalRanges); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Signal dictionary of a machine, parts that are not configured keep the default assignment
+func dictionary(c config.SignalDictionary) (data.Dictionary, error) {
+	dict := data.DefaultDictionary()
+	if len(c.MsgIDs) > 0 {
+		dict.MsgIDs = map[byte]string{}
+		for name, id := range c.MsgIDs {
+			if other, ok := dict.MsgIDs[id]; ok {
+				return dict, fmt.Errorf("Message ID 0x%02x used by %s and %s", id, other, name)
+			}
+			dict.MsgIDs[id] = name
+		}
+	}
+	if len(c.Columns) > 0 {
+		dict.Columns = map[int]string{}
+		for name, col := range c.Columns {
+			if other, ok := dict.Columns[col]; ok {
+				return dict, fmt.Errorf("Column %d used by %s and %s", col, other, name)
+			}
+			dict.Columns[col] = name
+		}
+	}
+	return dict, nil
+}
+
+// Start data source of the mode, returns the command target and function stopping the source
+func startTransport(c config.MachineConfig, store *data.Store) (*controls.Target, func(), error) {
+	stop := make(chan struct{})
+	target := &controls.Target{Source: c.ID, Mode: c.Mode, MsgToSimPipe: c.MsgToSimPipe}
+	switch c.Mode {
+	case "SimMode":
+		go pipes.FromSimPipeHandler(c.SimModePipe, true, store, stop)
+	case "PipeMode":
+		go pipes.FromSimPipeHandler(c.SimModePipe, false, store, stop)
+		go pipes.FromUserPipeHandler(c.MsgFromSimPipe, store, stop)
+	case "TCPMode":
+		target.TCP = tcp.NewConnectionManager(c.TCPAddress)
+		go tcp.TCPDataHandler(c.TCPAddress, store, stop)
+		return target, func() {
+			close(stop)
+			target.TCP.CloseConnection()
+		}, nil
+	case "ModbusMode":
+		transport, err := modbus.NewTransport(c.ModbusClient)
+		if err != nil {
+			return target, nil, fmt.Errorf("Modbus client config invalid: %w", err)
+		}
+		transport.Set, transport.Source = store.SetValue, c.ID
+		target.Modbus = transport
+		go transport.Run(stop)
+	default:
+		return target, nil, fmt.Errorf("Mode unknown: %s", c.Mode)
+	}
+	log.Printf("Machine %s started in mode %s", c.ID, c.Mode)
+	return target, func() { close(stop) }, nil
+}
+
+// Current value and quality of a signal
+type Value struct {
+	Value   float32      `json:"value"`
+	Quality data.Quality `json:"quality"`
+}
+
+// Overview entry of a machine
+type Summary struct {
+	ID           string           `json:"id"`
+	Name         string           `json:"name"`
+	Mode         string           `json:"mode"`
+	Online       bool             `json:"online"`                 //A value was received within OnlineTimeout
+	LastReceived *time.Time       `json:"lastReceived,omitempty"` //Server time of the last value
+	BadSignals   int              `json:"badSignals"`             //Process signals with quality other than good
+	Values       map[string]Value `json:"values"`                 //Process signals and mass of the current spool
+}
+
+// Summarize current state of the machine
+func (m *Machine) Summary() Summary {
+	s := Summary{ID: m.ID, Name: m.Name, Mode: m.Mode(), Values: map[string]Value{}}
+	if received := m.Store.LastReceived(); !received.IsZero() {
+		s.LastReceived = &received
+		s.Online = time.Since(received) < OnlineTimeout
+	}
+	for _, name := range append(data.ProcessSignalNames(), "filamentMass") {
+		dp, _ := m.Store.Value(name)
+		s.Values[name] = Value{Value: dp.Value, Quality: dp.QualityOrStale()}
+		if dp.QualityOrStale() != data.QualityGood && name != "filamentMass" {
+			s.BadSignals++
+		}
+	}
+	return s
+}
+
+// Handler for /machines: summary of all lines
+func OverviewHandler(w http.ResponseWriter, r *http.Request) {
+	summaries := []Summary{}
+	for _, m := range All() {
+		summaries = append(summaries, m.Summary())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// Wrap handler of a machine addressed by the {id} path segment
+func withMachine(h func(m *Machine, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m, ok := Get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "Unknown machine: "+r.PathValue("id"), http.StatusNotFound)
+			return
+		}
+		h(m, w, r)
+	}
+}
+
+// Handler for /machines/{id}/data
+var DataHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	m.Store.DataHandler(w, r)
+})
+
+// Handler for /machines/{id}/data/substitute
+var SubstituteHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	m.Store.SubstituteHandler(w, r)
+})
+
+// Handler for /machines/{id}/messages
+var MessagesHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	m.Store.MessagesHandler(w, r)
+})
+
+// Handler for /machines/{id}/events: stored events of the machine, see eventlog.ParseFilter
+var EventsHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	eventlog.Handler(w, withSource(r, m.ID))
+})
+
+// Handler for /machines/{id}/events/stream
+var EventStreamHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	eventlog.StreamHandler(w, withSource(r, m.ID))
+})
+
+// Restrict the event filter of a request to one machine
+func withSource(r *http.Request, id string) *http.Request {
+	q := r.URL.Query()
+	q.Set("source", id)
+	r.URL.RawQuery = q.Encode()
+	return r
+}
+
+// Record the state transitions of a machine in the event log, transitions to Fault and EStop as critical
+func TransitionEvents(id string) func(t state.Transition) {
+	return func(t state.Transition) {
+		severity := eventlog.SeverityInfo
+		if t.To == state.Fault || t.To == state.EStop {
+			severity = eventlog.SeverityCritical
+		}
+		eventlog.Record(eventlog.Event{
+			Category: eventlog.CategoryState,
+			Severity: severity,
+			Source:   id,
+			Time:     t.Time,
+			Message:  fmt.Sprintf("State %s -> %s (%s): %s", t.From, t.To, t.Cause, t.Reason),
+			Fields:   map[string]string{"from": string(t.From), "to": string(t.To), "cause": t.Cause},
+		})
+	}
+}
+
+// Handler for /machines/{id}/clock
+var ClockHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	m.Store.ClockHandler(w, r)
+})
+
+// Handler for /machines/{id}/control/{command}
+var ControlHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("command") == "stop" && m.EStop != nil {
+		controls.EmergencyStopHandler(m.EStop.Trigger)(w, r)
+		return
+	}
+	controls.MachineHandler(m.Send, m.Check, m.Ramps)(w, r)
+})
+
+// Handler for /machines/{id}/ramps
+var RampsHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	controls.RampsHandler(m.Ramps)(w, r)
+})
+
+// Handler for /machines/{id}/estop
+var EStopHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	m.EStop.Handler(w, r)
+})
+
+// Handler for /machines/{id}/estop/reset
+var EStopResetHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	m.EStop.ResetHandler(w, r)
+})
+
+// Handler for /machines/{id}/watchdog
+var WatchdogHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	if m.Watchdog == nil {
+		http.Error(w, "Watchdog disabled", http.StatusNotFound)
+		return
+	}
+	m.Watchdog.Handler(w, r)
+})
+
+// Handler for /machines/{id}/state
+var StateHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	m.State.Handler(w, r)
+})
+
+// Handler for /machines/{id}/state/reset
+var StateResetHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	m.State.ResetHandler(w, r)
+})
+
+// Handler for /machines/{id}/export/{format}
+var ExportHandler = withMachine(func(m *Machine, w http.ResponseWriter, r *http.Request) {
+	switch r.PathValue("format") {
+	case "csv":
+		m.Recorder.CSVHandler(w, r)
+	case "jsonl":
+		m.Recorder.JSONLinesHandler(w, r)
+	case "columnar":
+		m.Recorder.ColumnarHandler(w, r)
+	default:
+		http.Error(w, "Unknown format: "+r.PathValue("format"), http.StatusNotFound)
+	}
+})
@@ -0,0 +1,252 @@
+package machine
+
+import (
+	"encoding/json"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"extruder_web_gui/watchdog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fake extruder: sends hex messages and collects received commands
+func startExtruder(t *testing.T, lines ...string) (string, chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for _, line := range lines {
+					conn.Write([]byte(line + "\n"))
+				}
+				buf := make([]byte, 8)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					received <- append([]byte{}, buf...)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func testMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/machines", OverviewHandler)
+	mux.HandleFunc("/machines/{id}/data", DataHandler)
+	mux.HandleFunc("/machines/{id}/control/{command}", ControlHandler)
+	mux.HandleFunc("/machines/{id}/export/{format}", ExportHandler)
+	mux.HandleFunc("/machines/{id}/state", StateHandler)
+	return mux
+}
+
+// Test for Start: machines have separate stores, routes are namespaced by machine ID
+func TestStart_TCPMachines(t *testing.T) {
+	// temperature 0x02 = 215 on line2, 0x02 = 190 on line3 with temperature mapped to ID 0x10
+	addr2, received := startExtruder(t, "02000000000000d7")
+	addr3, _ := startExtruder(t, "10000000000000be")
+	stop, err := Start([]config.MachineConfig{
+		{ID: "line2", Name: "Line 2", Mode: "TCPMode", TCPAddress: addr2},
+		{ID: "line3", Mode: "TCPMode", TCPAddress: addr3, Signals: config.SignalDictionary{MsgIDs: map[string]uint8{"temperature": 0x10}}},
+	}, config.TimestampConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	line2, _ := Get("line2")
+	line3, _ := Get("line3")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && (line2.Store.LastReceived().IsZero() || line3.Store.LastReceived().IsZero()) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	testMux().ServeHTTP(w, httptest.NewRequest("GET", "/machines", nil))
+	var overview []Summary
+	if err := json.Unmarshal(w.Body.Bytes(), &overview); err != nil {
+		t.Fatalf("Invalid overview: %v", err)
+	}
+	if len(overview) != 2 || overview[0].Name != "Line 2" || overview[1].Name != "line3" {
+		t.Fatalf("Unexpected overview: %+v", overview)
+	}
+	if v := overview[0].Values["temperature"]; v.Value != 215 || !overview[0].Online {
+		t.Errorf("Unexpected line2 temperature. Expected: 215 online, received: %+v online=%v", v, overview[0].Online)
+	}
+	if v := overview[1].Values["temperature"]; v.Value != 190 {
+		t.Errorf("Unexpected line3 temperature. Expected: 190, received: %+v", v)
+	}
+	if dp, _ := data.Value("temperature"); dp.Value == 215 || dp.Value == 190 {
+		t.Errorf("Default machine received values of another line: %v", dp.Value)
+	}
+
+	w = httptest.NewRecorder()
+	testMux().ServeHTTP(w, httptest.NewRequest("GET", "/machines/line3/data", nil))
+	if !strings.Contains(w.Body.String(), `"temperature": {"timestamp"`) || !strings.Contains(w.Body.String(), `"value": 190.00`) {
+		t.Errorf("Unexpected /machines/line3/data: %s", w.Body.String())
+	}
+
+	// Control goes to the TCP peer of line2 only, setpoints need manual mode
+	for _, path := range []string{"mode", "screw-rpm"} {
+		body := map[string]string{"mode": `{"value": 1}`, "screw-rpm": `{"value": 120}`}[path]
+		w = httptest.NewRecorder()
+		testMux().ServeHTTP(w, httptest.NewRequest("POST", "/machines/line2/control/"+path, strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Control %s failed: %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	if msg := <-received; msg[7] != 0x01 {
+		t.Errorf("Unexpected command. Expected: id 0x01, received: %x", msg)
+	}
+	select {
+	case msg := <-received:
+		if msg[7] != 0x04 || msg[0] != 120 {
+			t.Errorf("Unexpected command. Expected: id 0x04 value 120, received: %x", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Command not received")
+	}
+}
+
+// Test for Start: a reload rebuilding the store keeps a latched emergency stop and releases the old store
+func TestStart_ReloadKeepsEStop(t *testing.T) {
+	cfg := config.MachineConfig{ID: "line5", Mode: "TCPMode", TCPAddress: "127.0.0.1:1"}
+	stop, err := Start([]config.MachineConfig{cfg}, config.TimestampConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := Get("line5")
+	old.EStop.Trigger("operator1", "Filament jam")
+	stop()
+
+	cfg.Signals = config.SignalDictionary{MsgIDs: map[string]uint8{"temperature": 0x10}}
+	stop, err = Start([]config.MachineConfig{cfg}, config.TimestampConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	m, _ := Get("line5")
+	if m.Store == old.Store || m.EStop != old.EStop || m.State != old.State {
+		t.Fatalf("Expected new store with the previous state and emergency stop")
+	}
+	if !m.EStop.Latched() {
+		t.Errorf("Emergency stop lifted by the reload")
+	}
+	old.Store.SetValue("temperature", 200, time.Now())
+	if n := len(old.Recorder.Series("temperature", time.Time{}, time.Time{})); n != 0 {
+		t.Errorf("Old recorder still subscribed. Expected: 0 samples, received: %v", n)
+	}
+}
+
+// Test for Start: watchdog of a further machine marks its signals stale and raises alarms with its ID
+func TestStart_Watchdog(t *testing.T) {
+	cfgs := []config.MachineConfig{{ID: "line6", Mode: "TCPMode", TCPAddress: "127.0.0.1:1",
+		Watchdog: config.WatchdogConfig{Enabled: true, Signals: []string{"temperature"}, DefaultTimeout: 20, CheckInterval: 5}}}
+	stop, err := Start(cfgs, config.TimestampConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		alarms.Clear("stale:line6:temperature")
+		alarms.Clear(watchdog.CommLostAlarm + ":line6")
+	})
+	m, _ := Get("line6")
+	m.Store.SetValue("temperature", 200, time.Now())
+
+	// Restarted watchdog monitors the value already in the kept store
+	stop()
+	if stop, err = Start(cfgs, config.TimestampConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	m, _ = Get("line6")
+	deadline := time.Now().Add(time.Second)
+	for !alarms.IsActive(watchdog.CommLostAlarm+":line6") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !alarms.IsActive("stale:line6:temperature") || alarms.IsActive("stale:temperature") {
+		t.Errorf("Unexpected alarms: %+v", alarms.Active())
+	}
+	if dp, _ := m.Store.Value("temperature"); dp.Quality != data.QualityStale {
+		t.Errorf("Expected: %v, received: %v", data.QualityStale, dp.Quality)
+	}
+	if a := m.Alarms(); len(a) < 2 {
+		t.Errorf("Alarms of the machine. Expected: 2, received: %+v", a)
+	}
+}
+
+// Test for handlers: unknown machine, command and invalid value
+func TestHandlers_Errors(t *testing.T) {
+	stop, err := Start([]config.MachineConfig{{ID: "line4", Mode: "TCPMode", TCPAddress: "127.0.0.1:1"}}, config.TimestampConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/machines/line9/data", "", http.StatusNotFound},
+		{"POST", "/machines/line4/control/unknown", "", http.StatusNotFound},
+		{"GET", "/machines/line4/control/start", "", http.StatusMethodNotAllowed},
+		{"POST", "/machines/line4/control/heater-pwm", `{"value": 101}`, http.StatusBadRequest},
+		{"POST", "/machines/line4/control/heater-pwm", `{"value": 50}`, http.StatusConflict}, // Auto mode
+		{"GET", "/machines/line4/state", "", http.StatusOK},
+		{"GET", "/machines/line4/export/xml", "", http.StatusNotFound},
+		{"GET", "/machines/line4/export/csv", "", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		testMux().ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if w.Code != tc.code {
+			t.Errorf("%s %s: Expected: %d, received: %d (%s)", tc.method, tc.path, tc.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Test for Start: invalid dictionaries fail the start, store and history are kept on restart
+func TestStart_Dictionary(t *testing.T) {
+	_, err := Start([]config.MachineConfig{{ID: "line2", Mode: "TCPMode", TCPAddress: "127.0.0.1:1",
+		Signals: config.SignalDictionary{MsgIDs: map[string]uint8{"temperature": 1, "diameter": 1}}}}, config.TimestampConfig{})
+	if err == nil || !strings.Contains(err.Error(), "Message ID 0x01 used by") {
+		t.Errorf("Expected duplicate ID error, received: %v", err)
+	}
+	_, err = Start([]config.MachineConfig{{ID: "line2", Mode: "TCPMode", TCPAddress: "127.0.0.1:1",
+		Signals: config.SignalDictionary{Columns: map[string]int{"pressure": 3}}}}, config.TimestampConfig{})
+	if err == nil || !strings.Contains(err.Error(), `unknown signal "pressure"`) {
+		t.Errorf("Expected unknown signal error, received: %v", err)
+	}
+
+	cfg := []config.MachineConfig{{ID: "line2", Mode: "TCPMode", TCPAddress: "127.0.0.1:1"}}
+	stop, err := Start(cfg, config.TimestampConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := Get("line2")
+	stop()
+	cfg[0].Name = "Renamed"
+	stop, err = Start(cfg, config.TimestampConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	second, _ := Get("line2")
+	if second.Store != first.Store || second.Name != "Renamed" {
+		t.Errorf("Expected store kept and name changed, received: same store=%v name=%s", second.Store == first.Store, second.Name)
+	}
+}
@@ -1,45 +1,369 @@
 package main
 
 import (
+	"errors"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/audit"
+	"extruder_web_gui/chart"
 	"extruder_web_gui/config"
 	"extruder_web_gui/controls"
 	"extruder_web_gui/data"
-	"extruder_web_gui/pipes"
-	"extruder_web_gui/tcp"
-	"log"
+	"extruder_web_gui/estop"
+	"extruder_web_gui/eventlog"
+	"extruder_web_gui/history"
+	"extruder_web_gui/machine"
+	"extruder_web_gui/metrics"
+	"extruder_web_gui/notify"
+	"extruder_web_gui/profile"
+	"extruder_web_gui/rules"
+	"extruder_web_gui/sequence"
+	"extruder_web_gui/spc"
+	"extruder_web_gui/spool"
+	"extruder_web_gui/state"
+	"extruder_web_gui/supervisor"
+	"extruder_web_gui/tags"
+	"extruder_web_gui/watchdog"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
 func main() {
-	config.LoadConfig("ExtruderUIConfig.json")
-
-	switch config.Cfg.Mode {
-	case "SimMode":
-		log.Println("Starting in mode: Sim-Pipe")
-		go pipes.FromSimPipeHandler()
-	case "PipeMode":
-		log.Println("Starting in mode: Msg-Pipe")
-		go pipes.FromSimPipeHandler()
-		go pipes.FromUserPipeHandler()
-	case "TCPMode":
-		manager := tcp.GetConnectionManager(config.Cfg.TCPAddress)
-		defer manager.CloseConnection()
-		log.Println("Starting in mode: TCP/IP-Socket")
-		go tcp.TCPDataHandler(config.Cfg.TCPAddress)
-	default:
-		log.Println("Mode unknown:", config.Cfg.Mode)
+	// First argument selects the subcommand, without one the server is started
+	args := os.Args[1:]
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := findCommand(name)
+	if !ok {
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// Run web server
+func serve(args []string) error {
+	loader, err := config.NewLoader(args, os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	opts := loader.Options()
+	cfg, err := loader.Load()
+	switch {
+	case opts.PrintSchema:
+		os.Stdout.Write(config.Schema)
+		return nil
+	case opts.PrintConfig:
+		if cfg != nil {
+			config.Print(os.Stdout, cfg)
+		}
+		return err
+	case opts.ValidateConfig:
+		if err == nil {
+			fmt.Println("Config valid.")
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	// Process state of the default machine, guards its commands
+	processState = state.New(cfg.State, defaultSetpoint)
+	processState.OnTransition = machine.TransitionEvents(config.DefaultMachineID)
+	processState.Attach(data.Default)
+	emergencyStop = estop.New(cfg.EStop, data.Default, processState, defaultEStopTransports)
+	controls.SetGuard(emergencyStop)
+	controls.SetEmergencyStop(emergencyStop.Trigger)
+	sequencer = sequence.New(data.Default)
+	sequencer.Interlock = sequenceInterlock
+	profiles = profile.New()
+	profiles.Interlock = sequenceInterlock
+	sequencer.Conflict = profileRunning
+	profiles.Conflict = sequenceRunning
+	ruleEngine = rules.New(data.Default)
+	subscribeEventLog()
+	if spools, err = spool.NewTracker(cfg.Spool); err != nil {
+		return err
+	}
+	lsl, usl := specLimits(cfg.Spool)
+	spcMonitor = spc.NewMonitor(cfg.SPC, lsl, usl, spools.CurrentID)
+
+	// Data sources and interfaces are restarted when their config changes
+	var sup *supervisor.Supervisor
+	sup = supervisor.New(loader, services(func() *supervisor.Supervisor { return sup }))
+	if err := sup.Start(cfg); err != nil {
+		return err
+	}
+
+	spools.Start()
+	ruleEngine.Start()
+	subscribeNotifications()
+	spcMonitor.Start()
+	recorder := history.NewRecorder(cfg.History)
+	recorder.SpoolRange = func(id int) (time.Time, time.Time, bool) {
+		s, ok := spools.Get(id)
+		if !ok {
+			return time.Time{}, time.Time{}, false
+		}
+		return s.Start, s.End, true
+	}
+	recorder.Start()
+	machine.RegisterDefault(&machine.Machine{
+		ID:          config.DefaultMachineID,
+		Name:        defaultMachineName(),
+		Store:       data.Default,
+		Recorder:    recorder,
+		State:       processState,
+		EStop:       emergencyStop,
+		Mode:        func() string { return config.Current().Mode },
+		Send:        controls.SendCommand,
+		Check:       controls.Check,
+		Ramps:       controls.Ramps,
+		LastCommand: controls.LastCommandValue,
+		Targets:     defaultTargets,
+	})
+	charts := chart.NewRenderer(recorder)
+	charts.Limits = chartLimits
+	charts.Markers = func(from, to time.Time) []chart.Marker {
+		return spoolMarkers(spools, from, to)
 	}
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 	http.HandleFunc("/", data.MainViewHandler)
 	http.HandleFunc("/data", data.DataHandler)
+	http.HandleFunc("/data/substitute", data.SubstituteHandler)
 	http.HandleFunc("/control/start", controls.ButtonStartHandler)
 	http.HandleFunc("/control/stop", controls.ButtonEmergencyStopHandler)
 	http.HandleFunc("/control/screw-rpm", controls.ScrewRpmHandler)
 	http.HandleFunc("/control/spooler-rpm", controls.SpoolerRpmHandler)
 	http.HandleFunc("/control/heater-pwm", controls.HeaterPwmHandler)
 	http.HandleFunc("/control/mode", controls.ModeSwitchHandler)
+	http.HandleFunc("/ramps", controls.RampsHandler(controls.Ramps))
 
 	http.HandleFunc("/messages", data.MessagesHandler)
+	http.HandleFunc("/events", eventlog.Handler)
+	http.HandleFunc("/events/stream", eventlog.StreamHandler)
+	http.HandleFunc("/metrics", metrics.Handler)
+	http.HandleFunc("/clock", data.ClockHandler)
+	http.HandleFunc("/alarms", alarms.Handler)
+	http.HandleFunc("/state", processState.Handler)
+	http.HandleFunc("/state/reset", processState.ResetHandler)
+	http.HandleFunc("/estop", emergencyStop.Handler)
+	http.HandleFunc("/estop/reset", emergencyStop.ResetHandler)
+	http.HandleFunc("/sequences", sequencer.Handler)
+	http.HandleFunc("/sequences/{name}/start", sequencer.StartHandler)
+	http.HandleFunc("/sequences/abort", sequencer.AbortHandler)
+	http.HandleFunc("/sequences/confirm", sequencer.ConfirmHandler)
+	http.HandleFunc("/sequences/events", sequencer.EventsHandler)
+	http.HandleFunc("/profiles", profiles.Handler)
+	http.HandleFunc("/profiles/{name}/start", profiles.StartHandler)
+	http.HandleFunc("/profiles/pause", profiles.PauseHandler)
+	http.HandleFunc("/profiles/resume", profiles.ResumeHandler)
+	http.HandleFunc("/profiles/cancel", profiles.CancelHandler)
+	http.HandleFunc("/rules", ruleEngine.Handler)
+	http.HandleFunc("/rules/{name}", ruleEngine.RuleHandler)
+	http.HandleFunc("/notifications", notify.Default.Handler)
+	http.HandleFunc("/notifications/test", notify.Default.TestHandler)
+	http.HandleFunc("/watchdog", watchdogHandler)
+	http.HandleFunc("/config", sup.ConfigHandler)
+	http.HandleFunc("/config/reload", sup.ReloadHandler)
+	http.HandleFunc("/audit", audit.Handler)
+	http.HandleFunc("/spools", spools.ListHandler)
+	http.HandleFunc("/spools/new", spools.NewSpoolHandler)
+	http.HandleFunc("/spools/report", spools.ReportHandler)
+	http.HandleFunc("/spc", spcMonitor.Handler)
+	http.HandleFunc("/export/csv", recorder.CSVHandler)
+	http.HandleFunc("/export/jsonl", recorder.JSONLinesHandler)
+	http.HandleFunc("/export/columnar", recorder.ColumnarHandler)
+	http.HandleFunc("/chart.svg", charts.SVGHandler)
+	http.HandleFunc("/chart.png", charts.PNGHandler)
+	http.HandleFunc("/fleet", machine.FleetHandler)
+	http.HandleFunc("/fleet/data", machine.FleetDataHandler)
+	http.HandleFunc("/machines", machine.OverviewHandler)
+	http.HandleFunc("/machines/{id}/{$}", machine.DetailHandler)
+	http.HandleFunc("/machines/{id}/data", machine.DataHandler)
+	http.HandleFunc("/machines/{id}/data/substitute", machine.SubstituteHandler)
+	http.HandleFunc("/machines/{id}/messages", machine.MessagesHandler)
+	http.HandleFunc("/machines/{id}/events", machine.EventsHandler)
+	http.HandleFunc("/machines/{id}/events/stream", machine.EventStreamHandler)
+	http.HandleFunc("/machines/{id}/clock", machine.ClockHandler)
+	http.HandleFunc("/machines/{id}/control/{command}", machine.ControlHandler)
+	http.HandleFunc("/machines/{id}/ramps", machine.RampsHandler)
+	http.HandleFunc("/machines/{id}/state", machine.StateHandler)
+	http.HandleFunc("/machines/{id}/state/reset", machine.StateResetHandler)
+	http.HandleFunc("/machines/{id}/estop", machine.EStopHandler)
+	http.HandleFunc("/machines/{id}/estop/reset", machine.EStopResetHandler)
+	http.HandleFunc("/machines/{id}/watchdog", machine.WatchdogHandler)
+	http.HandleFunc("/machines/{id}/export/{format}", machine.ExportHandler)
+	http.HandleFunc("/tags", tags.BrowseHandler)
+	http.HandleFunc("/tags/read", tags.ReadHandler)
+	http.HandleFunc("/tags/write", tags.WriteHandler)
+	http.HandleFunc("/tags/subscribe", tags.SubscribeHandler)
 
-	log.Fatal(http.ListenAndServe(":"+config.Cfg.HttpPort, nil))
+	return http.ListenAndServe(":"+config.Current().HttpPort, nil)
+}
+
+// Process state, latched emergency stop and automation of the default machine
+var (
+	processState  *state.Machine
+	emergencyStop *estop.Latch
+	sequencer     *sequence.Sequencer
+	profiles      *profile.Runner
+	ruleEngine    *rules.Engine
+	spools        *spool.Tracker
+	spcMonitor    *spc.Monitor
+)
+
+// Specification limits of the diameter from the nominal diameter and tolerance of the spool config
+func specLimits(s config.SpoolConfig) (lsl float64, usl float64) {
+	return s.NominalDiameter - s.Tolerance, s.NominalDiameter + s.Tolerance
+}
+
+// Sequences and profiles stop when the emergency stop is latched or the process is in fault
+func sequenceInterlock() error {
+	if emergencyStop.Latched() {
+		return errors.New("Emergency stop latched")
+	}
+	if st := processState.State(); st == state.Fault {
+		return fmt.Errorf("Process state %s", st)
+	}
+	return nil
+}
+
+// Sequences and profiles write the same setpoints, only one of them may run
+func profileRunning() error {
+	if p := profiles.Active(); p != nil {
+		return fmt.Errorf("Profile %s is running", p.Profile)
+	}
+	return nil
+}
+
+func sequenceRunning() error {
+	if p := sequencer.Active(); p != nil {
+		return fmt.Errorf("Sequence %s is running", p.Sequence)
+	}
+	return nil
+}
+
+// Record raised and cleared alarms of all machines in the event log, the machine link as connection event
+func subscribeEventLog() {
+	alarms.Subscribe(func(a alarms.Alarm) {
+		e := eventlog.Event{Category: eventlog.CategoryAlarm, Severity: string(a.Severity), Source: a.Fields["machine"], Message: "Alarm raised: " + a.Message, Fields: map[string]string{"alarm": a.ID, "source": a.Source}}
+		if watchdog.IsCommLost(a) {
+			e.Category = eventlog.CategoryConnection
+		}
+		if !a.Active {
+			e.Severity, e.Message = eventlog.SeverityInfo, "Alarm cleared: "+a.Message
+		}
+		eventlog.Record(e)
+	})
+}
+
+// Send spool, e-stop and sequence events of the default machine and the alarms of all machines as notifications
+func subscribeNotifications() {
+	notify.Default.Email.Values = lastValues
+	data.SubscribeSpoolCompleted(func(stats data.SpoolStats) {
+		notify.Publish(notify.SpoolEvent(config.DefaultMachineID, stats))
+	})
+	alarms.Subscribe(func(a alarms.Alarm) {
+		for _, e := range notify.AlarmEvents(a) {
+			notify.Publish(e)
+		}
+	})
+	emergencyStop.OnEvent = func(e estop.Event) {
+		notify.Publish(notify.EStopEvent(config.DefaultMachineID, e))
+	}
+	progress, _ := sequencer.Subscribe()
+	go func() {
+		for p := range progress {
+			if p.Finished != nil {
+				notify.Publish(notify.SequenceEvent(p))
+			}
+		}
+	}()
+}
+
+// Current process values of a machine shown in notification mails
+func lastValues(id string) map[string]float64 {
+	m, ok := machine.Get(id)
+	if !ok {
+		return nil
+	}
+	values := map[string]float64{}
+	for _, name := range data.ProcessSignalNames() {
+		if dp, ok := m.Store.Value(name); ok && !dp.Timestamp.IsZero() {
+			values[name] = float64(dp.Value)
+		}
+	}
+	return values
+}
+
+// Emergency stop transports of the default machine in the active mode
+func defaultEStopTransports() []estop.Transport {
+	cfg := config.Current()
+	return estop.Transports(cfg.Mode, cfg.MsgToSimPipe, controls.Transmit)
+}
+
+// Temperature setpoint and tolerance of the default machine for the state machine
+func defaultSetpoint() (float64, float64) {
+	t := config.Current().Targets
+	return t.Temperature, t.TemperatureTolerance
+}
+
+// Display name of the machine described by the top level config
+func defaultMachineName() string {
+	if name := config.Current().MachineName; name != "" {
+		return name
+	}
+	return config.DefaultMachineID
+}
+
+// Fleet dashboard targets of the default machine, the diameter falls back to the spool tolerance
+func defaultTargets() machine.Targets {
+	cfg := config.Current()
+	t := machine.Targets{
+		TemperatureSetpoint:  cfg.Targets.Temperature,
+		TemperatureTolerance: cfg.Targets.TemperatureTolerance,
+		NominalDiameter:      cfg.Targets.NominalDiameter,
+		DiameterTolerance:    cfg.Targets.Tolerance,
+	}
+	if t.NominalDiameter == 0 {
+		t.NominalDiameter, t.DiameterTolerance = cfg.Spool.NominalDiameter, cfg.Spool.Tolerance
+	}
+	return t
+}
+
+// Limit lines of a chart: plausible range and diameter tolerance of the spool
+func chartLimits(signal string) []chart.Limit {
+	var limits []chart.Limit
+	if r, ok := data.SignalRange(signal); ok {
+		limits = append(limits, chart.Limit{Label: "min", Value: r[0]}, chart.Limit{Label: "max", Value: r[1]})
+	}
+	if s := config.Current().Spool; signal == "diameter" && s.Tolerance > 0 {
+		lsl, usl := specLimits(s)
+		limits = append(limits,
+			chart.Limit{Label: "LSL", Value: lsl},
+			chart.Limit{Label: "nominal", Value: s.NominalDiameter},
+			chart.Limit{Label: "USL", Value: usl})
+	}
+	return limits
+}
+
+// Spool changes as chart markers
+func spoolMarkers(spools *spool.Tracker, from, to time.Time) []chart.Marker {
+	var markers []chart.Marker
+	for _, s := range spools.History() {
+		if !s.End.Before(from) && !s.End.After(to) {
+			markers = append(markers, chart.Marker{Time: s.End, Label: fmt.Sprintf("spool %d", s.ID)})
+		}
+	}
+	return markers
 }
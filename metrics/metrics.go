@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Sample of a metric family: rendered label set and value
+type sample struct {
+	labels string
+	value  float64
+}
+
+// Metric family as exposed in the Prometheus text format
+type family struct {
+	name    string
+	help    string
+	kind    string // "counter" or "gauge"
+	collect func() []sample
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*family
+)
+
+// Add metric family to the default registry
+func register(f *family) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, existing := range registry {
+		if existing.name == f.name {
+			panic("metrics: duplicate metric name " + f.name)
+		}
+	}
+	registry = append(registry, f)
+}
+
+// Counter with a single label dimension (e.g. message ID, transport)
+type CounterVec struct {
+	mu     sync.Mutex
+	label  string
+	values map[string]float64
+}
+
+// Create and register a labeled counter
+func NewCounterVec(name string, help string, label string) *CounterVec {
+	c := &CounterVec{label: label, values: make(map[string]float64)}
+	register(&family{name: name, help: help, kind: "counter", collect: c.collect})
+	return c
+}
+
+// Increment counter for label value
+func (c *CounterVec) Inc(labelValue string) {
+	c.mu.Lock()
+	c.values[labelValue]++
+	c.mu.Unlock()
+}
+
+// Return current counter value for label value
+func (c *CounterVec) Value(labelValue string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *CounterVec) collect() []sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	samples := make([]sample, 0, len(keys))
+	for _, k := range keys {
+		samples = append(samples, sample{labels: formatLabels(c.label, k), value: c.values[k]})
+	}
+	return samples
+}
+
+// Counter without labels
+type Counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+// Create and register a counter
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{}
+	register(&family{name: name, help: help, kind: "counter", collect: func() []sample {
+		return []sample{{value: c.Value()}}
+	}})
+	return c
+}
+
+// Increment counter by one
+func (c *Counter) Inc() {
+	c.mu.Lock()
+	c.value++
+	c.mu.Unlock()
+}
+
+// Return current counter value
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+// Gauge holding a value that is set by the owner
+type Gauge struct {
+	mu    sync.Mutex
+	value float64
+}
+
+// Create and register a gauge
+func NewGauge(name string, help string) *Gauge {
+	g := &Gauge{}
+	register(&family{name: name, help: help, kind: "gauge", collect: func() []sample {
+		return []sample{{value: g.Value()}}
+	}})
+	return g
+}
+
+// Set gauge to value
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.value = v
+	g.mu.Unlock()
+}
+
+// Add delta to gauge (negative values decrease)
+func (g *Gauge) Add(delta float64) {
+	g.mu.Lock()
+	g.value += delta
+	g.mu.Unlock()
+}
+
+// Return current gauge value
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+// Register a labeled gauge whose values are read at scrape time.
+// fn returns the current value for every label value.
+func NewGaugeFunc(name string, help string, label string, fn func() map[string]float64) {
+	register(&family{name: name, help: help, kind: "gauge", collect: func() []sample {
+		values := fn()
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		samples := make([]sample, 0, len(keys))
+		for _, k := range keys {
+			samples = append(samples, sample{labels: formatLabels(label, k), value: values[k]})
+		}
+		return samples
+	}})
+}
+
+// Render label pair in Prometheus syntax
+func formatLabels(label string, value string) string {
+	if label == "" {
+		return ""
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return fmt.Sprintf(`{%s="%s"}`, label, escaped)
+}
+
+// Handler for Prometheus scrapes (text exposition format 0.0.4)
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	registryMu.Lock()
+	families := append([]*family(nil), registry...)
+	registryMu.Unlock()
+
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+		for _, s := range f.collect() {
+			fmt.Fprintf(w, "%s%s %g\n", f.name, s.labels, s.value)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Remove the metrics registered by the test when it ends, so tests can run repeatedly
+func restoreRegistry(t *testing.T) {
+	registryMu.Lock()
+	n := len(registry)
+	registryMu.Unlock()
+	t.Cleanup(func() {
+		registryMu.Lock()
+		registry = registry[:n]
+		registryMu.Unlock()
+	})
+}
+
+// Test for Handler: counters, gauges and gauge funcs in text format
+func TestHandler_TextFormat(t *testing.T) {
+	restoreRegistry(t)
+	counter := NewCounterVec("test_frames_total", "Frames per id.", "id")
+	counter.Inc("0x01")
+	counter.Inc("0x01")
+	gauge := NewGauge("test_clients", "Clients.")
+	gauge.Add(3)
+	gauge.Add(-1)
+	NewGaugeFunc("test_temperature_celsius", "Temperature.", "", func() map[string]float64 {
+		return map[string]float64{"": 201.5}
+	})
+
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	expectedLines := []string{
+		"# TYPE test_frames_total counter",
+		`test_frames_total{id="0x01"} 2`,
+		"# TYPE test_clients gauge",
+		"test_clients 2",
+		"test_temperature_celsius 201.5",
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected line %q in output, received:\n%s", line, body)
+		}
+	}
+}
+
+// Test for register: duplicate names are rejected
+func TestRegister_Duplicate(t *testing.T) {
+	restoreRegistry(t)
+	NewCounter("test_duplicate_total", "Duplicate.")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic for duplicate metric name")
+		}
+	}()
+	NewCounter("test_duplicate_total", "Duplicate.")
+}
@@ -0,0 +1,160 @@
+package modbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Modbus TCP client with timeout, retries and automatic reconnect
+type Client struct {
+	address string
+	unitID  byte
+	timeout time.Duration
+	retries int
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	txID   uint16
+}
+
+// Create client, the connection is established on the first request
+func NewClient(address string, unitID byte, timeout time.Duration, retries int) *Client {
+	return &Client{address: address, unitID: unitID, timeout: timeout, retries: retries}
+}
+
+// Read input registers (function 0x04)
+func (c *Client) ReadInputRegisters(start uint16, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(fcReadInputRegisters, start, quantity)
+}
+
+// Read holding registers (function 0x03)
+func (c *Client) ReadHoldingRegisters(start uint16, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(fcReadHoldingRegisters, start, quantity)
+}
+
+// Write holding registers (function 0x06 for one register, 0x10 for more)
+func (c *Client) WriteRegisters(start uint16, values []uint16) error {
+	var pdu []byte
+	if len(values) == 1 {
+		pdu = binary.BigEndian.AppendUint16([]byte{fcWriteSingleRegister}, start)
+		pdu = binary.BigEndian.AppendUint16(pdu, values[0])
+	} else {
+		if len(values) == 0 || len(values) > maxWriteRegisters {
+			return fmt.Errorf("Invalid number of registers: %d", len(values))
+		}
+		pdu = binary.BigEndian.AppendUint16([]byte{fcWriteMultipleRegisters}, start)
+		pdu = binary.BigEndian.AppendUint16(pdu, uint16(len(values)))
+		pdu = append(pdu, byte(2*len(values)))
+		for _, v := range values {
+			pdu = binary.BigEndian.AppendUint16(pdu, v)
+		}
+	}
+	_, err := c.do(pdu)
+	return err
+}
+
+// Write single coil (function 0x05)
+func (c *Client) WriteCoil(address uint16, on bool) error {
+	var value uint16
+	if on {
+		value = 0xFF00
+	}
+	pdu := binary.BigEndian.AppendUint16([]byte{fcWriteSingleCoil}, address)
+	pdu = binary.BigEndian.AppendUint16(pdu, value)
+	_, err := c.do(pdu)
+	return err
+}
+
+// Close connection, the next request reconnects
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeConn()
+}
+
+func (c *Client) readRegisters(fc byte, start uint16, quantity uint16) ([]uint16, error) {
+	if quantity == 0 || quantity > maxReadRegisters {
+		return nil, fmt.Errorf("Invalid number of registers: %d", quantity)
+	}
+	pdu := binary.BigEndian.AppendUint16([]byte{fc}, start)
+	pdu = binary.BigEndian.AppendUint16(pdu, quantity)
+	resp, err := c.do(pdu)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != 2+2*int(quantity) || int(resp[1]) != 2*int(quantity) {
+		return nil, fmt.Errorf("Unexpected response length %d", len(resp))
+	}
+	regs := make([]uint16, quantity)
+	for i := range regs {
+		regs[i] = binary.BigEndian.Uint16(resp[2+2*i:])
+	}
+	return regs, nil
+}
+
+// Send request, retry on connection errors and timeouts (not on exceptions)
+func (c *Client) do(pdu []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		var resp []byte
+		resp, err = c.transact(pdu)
+		if err == nil {
+			return resp, nil
+		}
+		var ex *Exception
+		if errors.As(err, &ex) {
+			return nil, err
+		}
+		c.closeConn()
+	}
+	return nil, err
+}
+
+// Single request / response on the current connection (caller holds mu)
+func (c *Client) transact(pdu []byte) ([]byte, error) {
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Error connecting to Modbus device %s: %w", c.address, err)
+		}
+		c.conn = conn
+		c.reader = bufio.NewReader(conn)
+	}
+	c.txID++
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := writeFrame(c.conn, header{transactionID: c.txID, unitID: c.unitID}, pdu); err != nil {
+		return nil, err
+	}
+	for {
+		h, resp, err := readFrame(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if h.transactionID != c.txID {
+			continue // Late answer to a timed out request
+		}
+		if resp[0] == pdu[0]|0x80 && len(resp) >= 2 {
+			return nil, &Exception{Function: pdu[0], Code: resp[1]}
+		}
+		if resp[0] != pdu[0] {
+			return nil, fmt.Errorf("Unexpected function code 0x%02x in response", resp[0])
+		}
+		return resp, nil
+	}
+}
+
+func (c *Client) closeConn() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.reader = nil
+	}
+}
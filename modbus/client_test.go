@@ -0,0 +1,124 @@
+package modbus
+
+import (
+	"extruder_web_gui/config"
+	"net"
+	"testing"
+	"time"
+)
+
+// Start Modbus server as stand-in for the PLC, return its address
+func startDevice(t *testing.T, sent map[string]uint32) string {
+	cfg := config.ModbusServerConfig{ByteOrder: "CDAB"}
+	DefaultServerMap(&cfg, []string{"diameter", "temperature"})
+	device, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("Could not create device: %v", err)
+	}
+	device.ReadSignal = func(name string) (float64, bool) {
+		return map[string]float64{"diameter": 1.75, "temperature": 210}[name], true
+	}
+	device.Send = func(command string, value uint32) error {
+		sent[command] = value
+		return nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	go device.Serve(listener)
+	t.Cleanup(device.Close)
+	return listener.Addr().String()
+}
+
+func testClientConfig(address string) config.ModbusClientConfig {
+	return config.ModbusClientConfig{
+		Address:   address,
+		ByteOrder: "CDAB",
+		Timeout:   500,
+		Retries:   1,
+		Signals: []config.ModbusRegister{
+			{Address: 2, Signal: "temperature", Type: "float32"},
+			{Address: 0, Signal: "diameter", Type: "float32"},
+		},
+		Setpoints: []config.ModbusRegister{{Address: 1, Command: "spooler_rpm", Type: "uint16"}},
+		Coils:     []config.ModbusCoil{{Address: 2, Command: "emergency_stop"}},
+	}
+}
+
+// Test for Transport: poll signals and write setpoints / coils
+func TestTransport_PollAndSend(t *testing.T) {
+	sent := map[string]uint32{}
+	transport, err := NewTransport(testClientConfig(startDevice(t, sent)))
+	if err != nil {
+		t.Fatalf("Could not create transport: %v", err)
+	}
+	defer transport.client.Close()
+	if len(transport.blocks) != 1 {
+		t.Errorf("Contiguous registers should be read in one block, received %d blocks", len(transport.blocks))
+	}
+
+	values := map[string]float32{}
+	err = transport.Poll(func(signal string, value float32, timestamp time.Time) error {
+		values[signal] = value
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if values["diameter"] != 1.75 || values["temperature"] != 210 {
+		t.Errorf("Unexpected polled values: %v", values)
+	}
+
+	if err := transport.Send("spooler_rpm", 300); err != nil || sent["spooler_rpm"] != 300 {
+		t.Errorf("Setpoint not written: %v, %v", err, sent)
+	}
+	if err := transport.Send("emergency_stop", 1); err != nil || sent["emergency_stop"] != 1 {
+		t.Errorf("Coil not written: %v, %v", err, sent)
+	}
+	if err := transport.Send("heater_pwm", 1); err == nil {
+		t.Errorf("Expected error for unmapped command")
+	}
+}
+
+// Test for buildBlocks: gaps above maxGap split blocks, overlapping entries never shrink a block
+func TestBuildBlocks(t *testing.T) {
+	entries := func() []mappedRegister {
+		return []mappedRegister{
+			{ModbusRegister: config.ModbusRegister{Address: 0, Signal: "diameter"}, count: 4},
+			{ModbusRegister: config.ModbusRegister{Address: 1, Signal: "temperature"}, count: 1},
+			{ModbusRegister: config.ModbusRegister{Address: 10, Signal: "screwRpm"}, count: 2},
+		}
+	}
+	blocks := buildBlocks("input", entries(), 0)
+	if len(blocks) != 2 || blocks[0].count != 4 || blocks[1].start != 10 || blocks[1].count != 2 {
+		t.Errorf("Unexpected blocks without gaps: %+v", blocks)
+	}
+	blocks = buildBlocks("input", entries(), 6)
+	if len(blocks) != 1 || blocks[0].count != 12 {
+		t.Errorf("Unexpected blocks with gap 6: %+v", blocks)
+	}
+}
+
+// Test for Client: exception responses are returned as Exception
+func TestClient_Exception(t *testing.T) {
+	client := NewClient(startDevice(t, map[string]uint32{}), 0, 500*time.Millisecond, 2)
+	defer client.Close()
+	err := client.WriteRegisters(99, []uint16{1})
+	ex, ok := err.(*Exception)
+	if !ok || ex.Code != exIllegalDataAddress {
+		t.Errorf("Expected illegal data address exception, received: %v", err)
+	}
+}
+
+// Test for Client: unreachable device fails after retries
+func TestClient_Unreachable(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := listener.Addr().String()
+	listener.Close()
+
+	client := NewClient(address, 0, 100*time.Millisecond, 1)
+	if _, err := client.ReadInputRegisters(0, 2); err == nil {
+		t.Errorf("Expected error for unreachable device")
+	}
+}
@@ -0,0 +1,210 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Function codes
+const (
+	fcReadCoils              byte = 0x01
+	fcReadHoldingRegisters   byte = 0x03
+	fcReadInputRegisters     byte = 0x04
+	fcWriteSingleCoil        byte = 0x05
+	fcWriteSingleRegister    byte = 0x06
+	fcWriteMultipleCoils     byte = 0x0F
+	fcWriteMultipleRegisters byte = 0x10
+)
+
+// Exception codes
+const (
+	exIllegalFunction    byte = 0x01
+	exIllegalDataAddress byte = 0x02
+	exIllegalDataValue   byte = 0x03
+	exDeviceFailure      byte = 0x04
+)
+
+// Protocol limits per request
+const (
+	maxReadRegisters  = 125
+	maxWriteRegisters = 123
+	maxReadCoils      = 2000
+	maxWriteCoils     = 1968
+)
+
+// MBAP header of a Modbus TCP frame
+type header struct {
+	transactionID uint16
+	protocolID    uint16
+	unitID        byte
+}
+
+// Read Modbus TCP frame, return header and PDU (function code + data)
+func readFrame(r io.Reader) (header, []byte, error) {
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return header{}, nil, err
+	}
+	h := header{
+		transactionID: binary.BigEndian.Uint16(buf[0:2]),
+		protocolID:    binary.BigEndian.Uint16(buf[2:4]),
+		unitID:        buf[6],
+	}
+	length := int(binary.BigEndian.Uint16(buf[4:6]))
+	if length < 2 || length > 254 {
+		return h, nil, fmt.Errorf("Invalid MBAP length %d", length)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(r, pdu); err != nil {
+		return h, nil, err
+	}
+	return h, pdu, nil
+}
+
+// Write Modbus TCP frame
+func writeFrame(w io.Writer, h header, pdu []byte) error {
+	buf := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(buf[0:2], h.transactionID)
+	binary.BigEndian.PutUint16(buf[2:4], h.protocolID)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(pdu)+1))
+	buf[6] = h.unitID
+	_, err := w.Write(append(buf, pdu...))
+	return err
+}
+
+// Exception response PDU
+func exceptionPDU(fc byte, code byte) []byte {
+	return []byte{fc | 0x80, code}
+}
+
+// Error returned for exception responses
+type Exception struct {
+	Function byte
+	Code     byte
+}
+
+func (e *Exception) Error() string {
+	return fmt.Sprintf("Modbus exception 0x%02x for function 0x%02x", e.Code, e.Function)
+}
+
+// Byte order of 32 bit values in two registers.
+// A is the most significant byte: "ABCD" = big endian, "CDAB" = word swap,
+// "BADC" = byte swap, "DCBA" = little endian.
+type ByteOrder string
+
+const (
+	OrderABCD ByteOrder = "ABCD"
+	OrderCDAB ByteOrder = "CDAB"
+	OrderBADC ByteOrder = "BADC"
+	OrderDCBA ByteOrder = "DCBA"
+)
+
+// Parse byte order from config, empty string means ABCD
+func ParseByteOrder(s string) (ByteOrder, error) {
+	order := ByteOrder(strings.ToUpper(s))
+	switch order {
+	case "":
+		return OrderABCD, nil
+	case OrderABCD, OrderCDAB, OrderBADC, OrderDCBA:
+		return order, nil
+	}
+	return "", fmt.Errorf("Invalid byte order %q (ABCD, CDAB, BADC, DCBA)", s)
+}
+
+// Split 32 bit value into two registers
+func Uint32ToRegisters(v uint32, order ByteOrder) [2]uint16 {
+	hi, lo := uint16(v>>16), uint16(v)
+	switch order {
+	case OrderCDAB:
+		return [2]uint16{lo, hi}
+	case OrderBADC:
+		return [2]uint16{swapBytes(hi), swapBytes(lo)}
+	case OrderDCBA:
+		return [2]uint16{swapBytes(lo), swapBytes(hi)}
+	}
+	return [2]uint16{hi, lo}
+}
+
+// Join two registers into 32 bit value
+func RegistersToUint32(regs [2]uint16, order ByteOrder) uint32 {
+	var hi, lo uint16
+	switch order {
+	case OrderCDAB:
+		hi, lo = regs[1], regs[0]
+	case OrderBADC:
+		hi, lo = swapBytes(regs[0]), swapBytes(regs[1])
+	case OrderDCBA:
+		hi, lo = swapBytes(regs[1]), swapBytes(regs[0])
+	default:
+		hi, lo = regs[0], regs[1]
+	}
+	return uint32(hi)<<16 | uint32(lo)
+}
+
+// Encode float32 into two registers
+func Float32ToRegisters(v float32, order ByteOrder) [2]uint16 {
+	return Uint32ToRegisters(math.Float32bits(v), order)
+}
+
+// Decode float32 from two registers
+func RegistersToFloat32(regs [2]uint16, order ByteOrder) float32 {
+	return math.Float32frombits(RegistersToUint32(regs, order))
+}
+
+func swapBytes(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// Number of registers used by a value type
+func registerCount(valueType string) (int, error) {
+	switch valueType {
+	case "", "float32", "uint32":
+		return 2, nil
+	case "uint16", "int16":
+		return 1, nil
+	}
+	return 0, fmt.Errorf("Invalid register type %q (float32, uint32, uint16, int16)", valueType)
+}
+
+// Encode value into registers according to type
+func encodeValue(v float64, valueType string, order ByteOrder) []uint16 {
+	switch valueType {
+	case "uint16":
+		return []uint16{uint16(clamp(math.Round(v), 0, math.MaxUint16))}
+	case "int16":
+		return []uint16{uint16(int16(clamp(math.Round(v), math.MinInt16, math.MaxInt16)))}
+	case "uint32":
+		regs := Uint32ToRegisters(uint32(clamp(math.Round(v), 0, math.MaxUint32)), order)
+		return regs[:]
+	}
+	regs := Float32ToRegisters(float32(v), order)
+	return regs[:]
+}
+
+// Decode value from registers according to type
+func decodeValue(regs []uint16, valueType string, order ByteOrder) (float64, error) {
+	n, err := registerCount(valueType)
+	if err != nil {
+		return 0, err
+	}
+	if len(regs) < n {
+		return 0, errors.New("Not enough registers for value")
+	}
+	switch valueType {
+	case "uint16":
+		return float64(regs[0]), nil
+	case "int16":
+		return float64(int16(regs[0])), nil
+	case "uint32":
+		return float64(RegistersToUint32([2]uint16{regs[0], regs[1]}, order)), nil
+	}
+	return float64(RegistersToFloat32([2]uint16{regs[0], regs[1]}, order)), nil
+}
+
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
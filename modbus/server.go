@@ -0,0 +1,418 @@
+package modbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"extruder_web_gui/config"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// Register entry of the server map with resolved size
+type mappedRegister struct {
+	config.ModbusRegister
+	count int
+}
+
+// Modbus TCP server exposing signals as input registers, setpoints as
+// holding registers and the mode switch / start / stop as coils
+type Server struct {
+	cfg     config.ModbusServerConfig
+	order   ByteOrder
+	inputs  []mappedRegister
+	holding []mappedRegister
+
+	// Read signal value by name (input registers)
+	ReadSignal func(name string) (float64, bool)
+	// Read last sent value of a command (holding registers, coils)
+	ReadSetpoint func(command string) (uint32, bool)
+	// Send command, called for writes to holding registers and coils
+	Send func(command string, value uint32) error
+	// Optional check of a command without sending it, every command of a request is checked before the first is sent
+	Check func(command string, value uint32) error
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+}
+
+// Default map: all /data signals as float32 input registers, setpoints as
+// uint16 holding registers, mode switch / start / emergency stop as coils
+func DefaultServerMap(cfg *config.ModbusServerConfig, signals []string) {
+	if len(cfg.InputRegisters) == 0 {
+		for i, name := range signals {
+			cfg.InputRegisters = append(cfg.InputRegisters, config.ModbusRegister{Address: uint16(2 * i), Signal: name, Type: "float32"})
+		}
+	}
+	if len(cfg.HoldingRegisters) == 0 {
+		for i, name := range []string{"screw_rpm", "spooler_rpm", "heater_pwm"} {
+			cfg.HoldingRegisters = append(cfg.HoldingRegisters, config.ModbusRegister{Address: uint16(i), Command: name, Type: "uint16"})
+		}
+	}
+	if len(cfg.Coils) == 0 {
+		for i, name := range []string{"mode_switch", "start", "emergency_stop"} {
+			cfg.Coils = append(cfg.Coils, config.ModbusCoil{Address: uint16(i), Command: name})
+		}
+	}
+}
+
+// Create server and validate register map
+func NewServer(cfg config.ModbusServerConfig) (*Server, error) {
+	order, err := ParseByteOrder(cfg.ByteOrder)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{cfg: cfg, order: order, conns: make(map[net.Conn]struct{})}
+	if s.inputs, err = resolveMap(cfg.InputRegisters, "signal"); err != nil {
+		return nil, fmt.Errorf("Invalid input register map: %w", err)
+	}
+	if s.holding, err = resolveMap(cfg.HoldingRegisters, "command"); err != nil {
+		return nil, fmt.Errorf("Invalid holding register map: %w", err)
+	}
+	seen := map[uint16]bool{}
+	for _, coil := range cfg.Coils {
+		if seen[coil.Address] {
+			return nil, fmt.Errorf("Coil %d mapped twice", coil.Address)
+		}
+		seen[coil.Address] = true
+	}
+	return s, nil
+}
+
+// Resolve register sizes and check for overlapping entries
+func resolveMap(entries []config.ModbusRegister, key string) ([]mappedRegister, error) {
+	used := map[int]bool{}
+	var out []mappedRegister
+	for _, e := range entries {
+		if (key == "signal" && e.Signal == "") || (key == "command" && e.Command == "") {
+			return nil, fmt.Errorf("Register %d has no %s", e.Address, key)
+		}
+		n, err := registerCount(e.Type)
+		if err != nil {
+			return nil, err
+		}
+		for a := int(e.Address); a < int(e.Address)+n; a++ {
+			if used[a] || a > 0xFFFF {
+				return nil, fmt.Errorf("Register %d overlaps or exceeds address space", a)
+			}
+			used[a] = true
+		}
+		out = append(out, mappedRegister{ModbusRegister: e, count: n})
+	}
+	return out, nil
+}
+
+// Listen on configured address and serve clients until Close is called
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.cfg.Address)
+	if err != nil {
+		return fmt.Errorf("Error starting Modbus server on %s: %w", s.cfg.Address, err)
+	}
+	return s.Serve(listener)
+}
+
+// Serve clients on listener until Close is called
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	log.Println("Modbus server listening on", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.handleConn(conn)
+	}
+}
+
+// Stop listener and close client connections
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Answer requests of one client
+func (s *Server) handleConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		h, pdu, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		if h.protocolID != 0 {
+			return
+		}
+		if s.cfg.UnitID != 0 && h.unitID != s.cfg.UnitID {
+			continue // Request for another unit, no answer
+		}
+		if err := writeFrame(conn, h, s.handlePDU(pdu)); err != nil {
+			return
+		}
+	}
+}
+
+// Process request PDU and build response PDU
+func (s *Server) handlePDU(pdu []byte) []byte {
+	fc := pdu[0]
+	req := pdu[1:]
+	switch fc {
+	case fcReadInputRegisters, fcReadHoldingRegisters:
+		if len(req) != 4 {
+			return exceptionPDU(fc, exIllegalDataValue)
+		}
+		start, quantity := binary.BigEndian.Uint16(req[0:2]), binary.BigEndian.Uint16(req[2:4])
+		if quantity == 0 || quantity > maxReadRegisters || int(start)+int(quantity) > 0x10000 {
+			return exceptionPDU(fc, exIllegalDataValue)
+		}
+		var regs []uint16
+		if fc == fcReadInputRegisters {
+			regs = s.readRegisters(s.inputs, start, quantity, s.signalValue)
+		} else {
+			regs = s.readRegisters(s.holding, start, quantity, s.setpointValue)
+		}
+		resp := []byte{fc, byte(2 * quantity)}
+		for _, r := range regs {
+			resp = binary.BigEndian.AppendUint16(resp, r)
+		}
+		return resp
+
+	case fcReadCoils:
+		if len(req) != 4 {
+			return exceptionPDU(fc, exIllegalDataValue)
+		}
+		start, quantity := binary.BigEndian.Uint16(req[0:2]), binary.BigEndian.Uint16(req[2:4])
+		if quantity == 0 || quantity > maxReadCoils || int(start)+int(quantity) > 0x10000 {
+			return exceptionPDU(fc, exIllegalDataValue)
+		}
+		bits := make([]byte, (quantity+7)/8)
+		for i := uint16(0); i < quantity; i++ {
+			if s.coilValue(start + i) {
+				bits[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append([]byte{fc, byte(len(bits))}, bits...)
+
+	case fcWriteSingleCoil:
+		if len(req) != 4 {
+			return exceptionPDU(fc, exIllegalDataValue)
+		}
+		address, value := binary.BigEndian.Uint16(req[0:2]), binary.BigEndian.Uint16(req[2:4])
+		if value != 0xFF00 && value != 0x0000 {
+			return exceptionPDU(fc, exIllegalDataValue)
+		}
+		if code := s.writeCoils(address, []bool{value == 0xFF00}); code != 0 {
+			return exceptionPDU(fc, code)
+		}
+		return pdu
+
+	case fcWriteMultipleCoils:
+		if len(req) < 5 {
+			return exceptionPDU(fc, exIllegalDataValue)
+		}
+		start, quantity := binary.BigEndian.Uint16(req[0:2]), binary.BigEndian.Uint16(req[2:4])
+		if quantity == 0 || quantity > maxWriteCoils || int(req[4]) != int(quantity+7)/8 || len(req) != 5+int(req[4]) {
+			return exceptionPDU(fc, exIllegalDataValue)
+		}
+		if int(start)+int(quantity) > 0x10000 {
+			return exceptionPDU(fc, exIllegalDataAddress)
+		}
+		on := make([]bool, quantity)
+		for i := range on {
+			on[i] = req[5+i/8]&(1<<(i%8)) != 0
+		}
+		if code := s.writeCoils(start, on); code != 0 {
+			return exceptionPDU(fc, code)
+		}
+		return pdu[:5]
+
+	case fcWriteSingleRegister:
+		if len(req) != 4 {
+			return exceptionPDU(fc, exIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(req[0:2])
+		if code := s.writeRegisters(address, []uint16{binary.BigEndian.Uint16(req[2:4])}); code != 0 {
+			return exceptionPDU(fc, code)
+		}
+		return pdu
+
+	case fcWriteMultipleRegisters:
+		if len(req) < 5 {
+			return exceptionPDU(fc, exIllegalDataValue)
+		}
+		start, quantity := binary.BigEndian.Uint16(req[0:2]), binary.BigEndian.Uint16(req[2:4])
+		if quantity == 0 || quantity > maxWriteRegisters || int(req[4]) != 2*int(quantity) || len(req) != 5+int(req[4]) {
+			return exceptionPDU(fc, exIllegalDataValue)
+		}
+		if int(start)+int(quantity) > 0x10000 {
+			return exceptionPDU(fc, exIllegalDataAddress)
+		}
+		values := make([]uint16, quantity)
+		for i := range values {
+			values[i] = binary.BigEndian.Uint16(req[5+2*i:])
+		}
+		if code := s.writeRegisters(start, values); code != 0 {
+			return exceptionPDU(fc, code)
+		}
+		return pdu[:5]
+	}
+	return exceptionPDU(fc, exIllegalFunction)
+}
+
+// Build register image for address range, unmapped registers read as 0
+func (s *Server) readRegisters(entries []mappedRegister, start uint16, quantity uint16, value func(mappedRegister) float64) []uint16 {
+	regs := make([]uint16, quantity)
+	end := int(start) + int(quantity)
+	for _, e := range entries {
+		if int(e.Address)+e.count <= int(start) || int(e.Address) >= end {
+			continue
+		}
+		encoded := encodeValue(value(e), e.Type, s.order)
+		for i, r := range encoded {
+			a := int(e.Address) + i
+			if a >= int(start) && a < end {
+				regs[a-int(start)] = r
+			}
+		}
+	}
+	return regs
+}
+
+// Command of a register or coil write
+type write struct {
+	address uint16
+	command string
+	value   uint32
+}
+
+// Write register values: every mapped entry has to be written completely
+func (s *Server) writeRegisters(start uint16, values []uint16) byte {
+	end := int(start) + len(values)
+	written := 0
+	var writes []write
+	for _, e := range s.holding {
+		if int(e.Address)+e.count <= int(start) || int(e.Address) >= end {
+			continue
+		}
+		if int(e.Address) < int(start) || int(e.Address)+e.count > end {
+			return exIllegalDataAddress // Partial write of a 32 bit value
+		}
+		offset := int(e.Address) - int(start)
+		v, err := decodeValue(values[offset:offset+e.count], e.Type, s.order)
+		if err != nil || v < 0 {
+			return exIllegalDataValue
+		}
+		writes = append(writes, write{address: e.Address, command: e.Command, value: uint32(v)})
+		written += e.count
+	}
+	if written != len(values) {
+		return exIllegalDataAddress
+	}
+	return s.apply(writes)
+}
+
+// Write coils from start: on sends 1, off sends 0 (mode switch) or nothing (start / stop).
+// Every coil has to be mapped.
+func (s *Server) writeCoils(start uint16, on []bool) byte {
+	var writes []write
+	for i, value := range on {
+		address := start + uint16(i)
+		coil, ok := s.coil(address)
+		if !ok {
+			return exIllegalDataAddress
+		}
+		if !value && coil.Command != "mode_switch" {
+			continue // Releasing a push button coil
+		}
+		w := write{address: address, command: coil.Command}
+		if value {
+			w.value = 1
+		}
+		writes = append(writes, w)
+	}
+	return s.apply(writes)
+}
+
+// Mapped coil of an address
+func (s *Server) coil(address uint16) (config.ModbusCoil, bool) {
+	for _, coil := range s.cfg.Coils {
+		if coil.Address == address {
+			return coil, true
+		}
+	}
+	return config.ModbusCoil{}, false
+}
+
+// Check every command of a request, then send them
+func (s *Server) apply(writes []write) byte {
+	if s.Check != nil {
+		for _, w := range writes {
+			if err := s.Check(w.command, w.value); err != nil {
+				log.Printf("Modbus write to %d rejected: %v", w.address, err)
+				return exIllegalDataValue
+			}
+		}
+	}
+	for _, w := range writes {
+		if err := s.send(w.command, w.value); err != nil {
+			log.Printf("Modbus write to %d rejected: %v", w.address, err)
+			return exIllegalDataValue
+		}
+	}
+	return 0
+}
+
+// Coil state: last sent mode switch value, push buttons read as off
+func (s *Server) coilValue(address uint16) bool {
+	for _, coil := range s.cfg.Coils {
+		if coil.Address == address && coil.Command == "mode_switch" && s.ReadSetpoint != nil {
+			v, _ := s.ReadSetpoint(coil.Command)
+			return v != 0
+		}
+	}
+	return false
+}
+
+func (s *Server) signalValue(e mappedRegister) float64 {
+	if s.ReadSignal == nil {
+		return 0
+	}
+	v, _ := s.ReadSignal(e.Signal)
+	return v
+}
+
+func (s *Server) setpointValue(e mappedRegister) float64 {
+	if s.ReadSetpoint == nil {
+		return 0
+	}
+	v, _ := s.ReadSetpoint(e.Command)
+	return float64(v)
+}
+
+func (s *Server) send(command string, value uint32) error {
+	if s.Send == nil {
+		return errors.New("No send function configured")
+	}
+	return s.Send(command, value)
+}
@@ -0,0 +1,190 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"extruder_web_gui/config"
+	"net"
+	"testing"
+)
+
+// Start server on a free port with test callbacks, return connection to it
+func startTestServer(t *testing.T, cfg config.ModbusServerConfig, sent map[string]uint32) net.Conn {
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	server.ReadSignal = func(name string) (float64, bool) {
+		return map[string]float64{"temperature": 201.5, "filamentMass": 12}[name], true
+	}
+	server.ReadSetpoint = func(command string) (uint32, bool) {
+		v, ok := sent[command]
+		return v, ok
+	}
+	server.Send = func(command string, value uint32) error {
+		sent[command] = value
+		return nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Close)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Send request PDU and return response PDU
+func request(t *testing.T, conn net.Conn, pdu []byte) []byte {
+	if err := writeFrame(conn, header{transactionID: 7, unitID: 1}, pdu); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	h, resp, err := readFrame(conn)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if h.transactionID != 7 {
+		t.Errorf("Transaction ID not echoed. Expected: 7, received: %d", h.transactionID)
+	}
+	return resp
+}
+
+func testServerConfig() config.ModbusServerConfig {
+	cfg := config.ModbusServerConfig{ByteOrder: "CDAB"}
+	DefaultServerMap(&cfg, []string{"diameter", "temperature"})
+	cfg.InputRegisters = append(cfg.InputRegisters, config.ModbusRegister{Address: 10, Signal: "filamentMass", Type: "uint16"})
+	return cfg
+}
+
+// Test for Server: float32 input registers with configured word order
+func TestServer_ReadInputRegisters(t *testing.T) {
+	conn := startTestServer(t, testServerConfig(), map[string]uint32{})
+
+	resp := request(t, conn, []byte{fcReadInputRegisters, 0x00, 0x02, 0x00, 0x02})
+	if len(resp) != 6 || resp[0] != fcReadInputRegisters || resp[1] != 4 {
+		t.Fatalf("Unexpected response: %x", resp)
+	}
+	regs := [2]uint16{binary.BigEndian.Uint16(resp[2:]), binary.BigEndian.Uint16(resp[4:])}
+	if v := RegistersToFloat32(regs, OrderCDAB); v != 201.5 {
+		t.Errorf("Temperature wrong. Expected: 201.5, received: %v", v)
+	}
+
+	resp = request(t, conn, []byte{fcReadInputRegisters, 0x00, 0x0A, 0x00, 0x01})
+	if v := binary.BigEndian.Uint16(resp[2:]); v != 12 {
+		t.Errorf("Filament mass wrong. Expected: 12, received: %v", v)
+	}
+}
+
+// Test for Server: holding register and coil writes are routed to Send
+func TestServer_Writes(t *testing.T) {
+	sent := map[string]uint32{}
+	conn := startTestServer(t, testServerConfig(), sent)
+
+	// Write screw RPM (holding register 0)
+	resp := request(t, conn, []byte{fcWriteSingleRegister, 0x00, 0x00, 0x01, 0xF4})
+	if resp[0] != fcWriteSingleRegister || sent["screw_rpm"] != 500 {
+		t.Errorf("Screw RPM not sent. Response: %x, sent: %v", resp, sent)
+	}
+	// Read back setpoint
+	resp = request(t, conn, []byte{fcReadHoldingRegisters, 0x00, 0x00, 0x00, 0x01})
+	if v := binary.BigEndian.Uint16(resp[2:]); v != 500 {
+		t.Errorf("Setpoint read back wrong. Expected: 500, received: %v", v)
+	}
+	// Switch to manual mode (coil 0) and press start (coil 1)
+	request(t, conn, []byte{fcWriteSingleCoil, 0x00, 0x00, 0xFF, 0x00})
+	request(t, conn, []byte{fcWriteSingleCoil, 0x00, 0x01, 0xFF, 0x00})
+	if sent["mode_switch"] != 1 || sent["start"] != 1 {
+		t.Errorf("Coil writes not sent: %v", sent)
+	}
+	resp = request(t, conn, []byte{fcReadCoils, 0x00, 0x00, 0x00, 0x03})
+	if resp[2] != 0x01 {
+		t.Errorf("Coil state wrong. Expected: 01, received: %02x", resp[2])
+	}
+}
+
+// Test for Server: exceptions for unmapped writes and unknown functions
+func TestServer_Exceptions(t *testing.T) {
+	conn := startTestServer(t, testServerConfig(), map[string]uint32{})
+
+	resp := request(t, conn, []byte{fcWriteSingleRegister, 0x00, 0x63, 0x00, 0x01})
+	if resp[0] != fcWriteSingleRegister|0x80 || resp[1] != exIllegalDataAddress {
+		t.Errorf("Expected illegal data address, received: %x", resp)
+	}
+	resp = request(t, conn, []byte{0x2B, 0x0E})
+	if resp[0] != 0x2B|0x80 || resp[1] != exIllegalFunction {
+		t.Errorf("Expected illegal function, received: %x", resp)
+	}
+}
+
+// Test for handlePDU: multiple writes past the address space, to unmapped coils or with a rejected command send nothing
+func TestServer_WriteMultipleAtomic(t *testing.T) {
+	server, err := NewServer(testServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := map[string]uint32{}
+	server.Send = func(command string, value uint32) error {
+		sent[command] = value
+		return nil
+	}
+	server.Check = func(command string, value uint32) error {
+		if command == "heater_pwm" && value > 100 {
+			return errors.New("heater_pwm out of range")
+		}
+		return nil
+	}
+	tests := []struct {
+		name     string
+		pdu      []byte
+		expected byte
+	}{
+		{"Coils past 0xFFFF", []byte{fcWriteMultipleCoils, 0xFF, 0xFF, 0x00, 0x02, 0x01, 0x03}, exIllegalDataAddress},
+		{"Unmapped coil", []byte{fcWriteMultipleCoils, 0x00, 0x00, 0x00, 0x04, 0x01, 0x0B}, exIllegalDataAddress},
+		{"Registers past 0xFFFF", []byte{fcWriteMultipleRegisters, 0xFF, 0xFF, 0x00, 0x02, 0x04, 0x00, 0x01, 0x00, 0x01}, exIllegalDataAddress},
+		{"Rejected register", []byte{fcWriteMultipleRegisters, 0x00, 0x00, 0x00, 0x03, 0x06, 0x00, 0x64, 0x00, 0x32, 0x01, 0xF4}, exIllegalDataValue},
+	}
+	for _, tc := range tests {
+		resp := server.handlePDU(tc.pdu)
+		if resp[0] != tc.pdu[0]|0x80 || resp[1] != tc.expected {
+			t.Errorf("%s: Expected exception %v, received: %x", tc.name, tc.expected, resp)
+		}
+	}
+	if len(sent) != 0 {
+		t.Errorf("Commands sent by rejected requests: %v", sent)
+	}
+}
+
+// Test for NewServer: overlapping registers are rejected
+func TestNewServer_Overlap(t *testing.T) {
+	cfg := config.ModbusServerConfig{InputRegisters: []config.ModbusRegister{
+		{Address: 0, Signal: "diameter", Type: "float32"},
+		{Address: 1, Signal: "temperature", Type: "float32"},
+	}}
+	if _, err := NewServer(cfg); err == nil {
+		t.Errorf("Expected error for overlapping registers")
+	}
+}
+
+// Test for 32 bit byte orders: round trip and register layout
+func TestByteOrders(t *testing.T) {
+	expected := map[ByteOrder][2]uint16{
+		OrderABCD: {0x1122, 0x3344},
+		OrderCDAB: {0x3344, 0x1122},
+		OrderBADC: {0x2211, 0x4433},
+		OrderDCBA: {0x4433, 0x2211},
+	}
+	for order, regs := range expected {
+		if got := Uint32ToRegisters(0x11223344, order); got != regs {
+			t.Errorf("%s: Expected: %04x, received: %04x", order, regs, got)
+		}
+		if got := RegistersToUint32(regs, order); got != 0x11223344 {
+			t.Errorf("%s: Round trip failed, received: %08x", order, got)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package modbus
+
+import (
+	"errors"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"extruder_web_gui/eventlog"
+	"extruder_web_gui/metrics"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	pollErrorCounter = metrics.NewCounter("extruder_modbus_poll_errors_total", "Failed Modbus poll cycles.")
+	transport        *Transport
+	transportMu      sync.Mutex
+)
+
+// Contiguous block of registers read with one request
+type readBlock struct {
+	table   string
+	start   uint16
+	count   uint16
+	entries []mappedRegister
+}
+
+// Transport polling process signals from a Modbus device and writing setpoints
+type Transport struct {
+	cfg    config.ModbusClientConfig
+	order  ByteOrder
+	client *Client
+	blocks []readBlock
+	writes []mappedRegister
+
+	// Receiver of polled values, data.SetValue if nil
+	Set func(signal string, value float32, timestamp time.Time) error
+	// Machine ID of the connection events, empty = default machine
+	Source string
+}
+
+// Create transport and validate register map
+func NewTransport(cfg config.ModbusClientConfig) (*Transport, error) {
+	order, err := ParseByteOrder(cfg.ByteOrder)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 500
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 1000
+	}
+	t := &Transport{
+		cfg:    cfg,
+		order:  order,
+		client: NewClient(cfg.Address, cfg.UnitID, time.Duration(cfg.Timeout)*time.Millisecond, cfg.Retries),
+	}
+	var inputs, holding []config.ModbusRegister
+	for _, r := range cfg.Signals {
+		switch r.Table {
+		case "", "input":
+			inputs = append(inputs, r)
+		case "holding":
+			holding = append(holding, r)
+		default:
+			return nil, fmt.Errorf("Invalid table %q for signal %s", r.Table, r.Signal)
+		}
+	}
+	for _, group := range []struct {
+		table   string
+		entries []config.ModbusRegister
+	}{{"input", inputs}, {"holding", holding}} {
+		mapped, err := resolveMap(group.entries, "signal")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid signal map: %w", err)
+		}
+		t.blocks = append(t.blocks, buildBlocks(group.table, mapped, cfg.MaxGap)...)
+	}
+	if t.writes, err = resolveMap(cfg.Setpoints, "command"); err != nil {
+		return nil, fmt.Errorf("Invalid setpoint map: %w", err)
+	}
+	return t, nil
+}
+
+// Group sorted registers into blocks of at most maxReadRegisters. Registers are merged into the
+// previous block if at most maxGap unmapped registers lie between them, strict PLCs reject reading those.
+func buildBlocks(table string, entries []mappedRegister, maxGap int) []readBlock {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Address < entries[j].Address })
+	var blocks []readBlock
+	for _, e := range entries {
+		end := int(e.Address) + e.count
+		if n := len(blocks); n > 0 {
+			b := &blocks[n-1]
+			blockEnd := int(b.start) + int(b.count)
+			if int(e.Address)-blockEnd <= maxGap && max(blockEnd, end)-int(b.start) <= maxReadRegisters {
+				b.count = uint16(max(blockEnd, end) - int(b.start))
+				b.entries = append(b.entries, e)
+				continue
+			}
+		}
+		blocks = append(blocks, readBlock{table: table, start: e.Address, count: uint16(e.count), entries: []mappedRegister{e}})
+	}
+	return blocks
+}
+
+// Read all mapped signals once and pass them to set
+func (t *Transport) Poll(set func(signal string, value float32, timestamp time.Time) error) error {
+	for _, block := range t.blocks {
+		var regs []uint16
+		var err error
+		if block.table == "holding" {
+			regs, err = t.client.ReadHoldingRegisters(block.start, block.count)
+		} else {
+			regs, err = t.client.ReadInputRegisters(block.start, block.count)
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, e := range block.entries {
+			offset := int(e.Address - block.start)
+			v, err := decodeValue(regs[offset:offset+e.count], e.Type, t.order)
+			if err != nil {
+				return err
+			}
+			if err := set(e.Signal, float32(v), now); err != nil {
+				log.Println("Modbus:", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Write command value to its holding register or coil
+func (t *Transport) Send(command string, value uint32) error {
+	for _, e := range t.writes {
+		if e.Command == command {
+			return t.client.WriteRegisters(e.Address, encodeValue(float64(value), e.Type, t.order))
+		}
+	}
+	for _, coil := range t.cfg.Coils {
+		if coil.Command == command {
+			return t.client.WriteCoil(coil.Address, value != 0)
+		}
+	}
+	return fmt.Errorf("No Modbus register mapped for command %s", command)
+}
+
+// Poll device in configured interval until stop is closed
+func (t *Transport) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(t.cfg.PollInterval) * time.Millisecond)
+	defer ticker.Stop()
+	defer t.client.Close()
+	set := t.Set
+	if set == nil {
+		set = data.SetValue
+	}
+	failing := false
+	for {
+		if err := t.Poll(set); err != nil {
+			pollErrorCounter.Inc()
+			if !failing {
+				log.Println("Modbus poll failed:", err)
+				t.connectionEvent(eventlog.SeverityWarning, "Modbus poll failed: "+err.Error())
+			}
+			failing = true
+		} else if failing {
+			log.Println("Modbus device reachable again:", t.cfg.Address)
+			t.connectionEvent(eventlog.SeverityInfo, "Modbus device reachable again")
+			failing = false
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Record change of the device link
+func (t *Transport) connectionEvent(severity string, message string) {
+	eventlog.Record(eventlog.Event{Category: eventlog.CategoryConnection, Severity: severity, Source: t.Source, Message: message, Fields: map[string]string{"address": t.cfg.Address}})
+}
+
+// ModbusMode: create transport used by SendCommand and poll device until stop is closed
+func StartTransport(cfg config.ModbusClientConfig, stop <-chan struct{}) error {
+	t, err := NewTransport(cfg)
+	if err != nil {
+		return fmt.Errorf("Modbus client config invalid: %w", err)
+	}
+	transportMu.Lock()
+	transport = t
+	transportMu.Unlock()
+	log.Println("Polling Modbus device:", cfg.Address)
+	go func() {
+		t.Run(stop)
+		transportMu.Lock()
+		if transport == t {
+			transport = nil
+		}
+		transportMu.Unlock()
+	}()
+	return nil
+}
+
+// Send command via the active Modbus transport
+func SendCommand(command string, value uint32) error {
+	transportMu.Lock()
+	t := transport
+	transportMu.Unlock()
+	if t == nil {
+		return errors.New("Modbus transport not started")
+	}
+	return t.Send(command, value)
+}
@@ -0,0 +1,196 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"extruder_web_gui/config"
+	"extruder_web_gui/controls"
+	"extruder_web_gui/data"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outgoing message queued by data listeners
+type outgoing struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+// Bridge between data/controls and an MQTT broker
+type Bridge struct {
+	cfg    config.MQTTConfig
+	prefix string
+	queue  chan outgoing
+	stop   chan struct{}
+
+	unsubscribe []func()
+}
+
+// Create bridge and subscribe to data updates
+func NewBridge(cfg config.MQTTConfig) *Bridge {
+	prefix := strings.TrimSuffix(cfg.TopicPrefix, "/")
+	if prefix == "" {
+		prefix = "extruder/line1"
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "extruder_web_gui"
+	}
+	if cfg.KeepAlive == 0 {
+		cfg.KeepAlive = 30
+	}
+	b := &Bridge{
+		cfg:    cfg,
+		prefix: prefix,
+		queue:  make(chan outgoing, 256),
+		stop:   make(chan struct{}),
+	}
+	b.unsubscribe = []func(){data.Subscribe(b.onUpdate), data.SubscribeSpoolCompleted(b.onSpoolCompleted)}
+	return b
+}
+
+// Json payload of a signal topic
+type signalPayload struct {
+	Timestamp time.Time    `json:"timestamp"`
+	Value     float32      `json:"value"`
+	Quality   data.Quality `json:"quality"`
+}
+
+// Queue signal update as retained message on <prefix>/<signal>
+func (b *Bridge) onUpdate(u data.Update) {
+	payload, _ := json.Marshal(signalPayload{Timestamp: u.Point.Timestamp, Value: u.Point.Value, Quality: u.Point.QualityOrStale()})
+	b.enqueue(outgoing{topic: b.prefix + "/" + u.Signal, payload: payload, retain: true})
+}
+
+// Queue spool completed event on <prefix>/events/spool-completed
+func (b *Bridge) onSpoolCompleted(stats data.SpoolStats) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"timestamp":       time.Now(),
+		"windingDiameter": stats.WindingDiameter.Value,
+		"avgFilDiameter":  stats.AvgFilDiameter.Value,
+		"nbrOfWindings":   stats.NbrOfWindings.Value,
+		"filamentMass":    stats.FilamentMass.Value,
+	})
+	b.enqueue(outgoing{topic: b.prefix + "/events/spool-completed", payload: payload, qos: 1})
+}
+
+// Add message to queue, drop it if the broker can't keep up
+func (b *Bridge) enqueue(msg outgoing) {
+	select {
+	case b.queue <- msg:
+	default:
+		log.Println("MQTT queue full, dropping message for", msg.topic)
+	}
+}
+
+// Connect to broker and forward messages, reconnect on connection loss
+func (b *Bridge) Run() {
+	var delayReconnect time.Duration = 2 * time.Second
+	for {
+		client, err := Connect(Options{
+			Broker:      b.cfg.Broker,
+			ClientID:    b.cfg.ClientID,
+			Username:    b.cfg.Username,
+			Password:    b.cfg.Password,
+			KeepAlive:   time.Duration(b.cfg.KeepAlive) * time.Second,
+			WillTopic:   b.prefix + "/status",
+			WillPayload: []byte("offline"),
+			WillRetain:  true,
+			OnMessage:   b.onCommand,
+		})
+		if err != nil {
+			log.Printf("MQTT: %v", err)
+			select {
+			case <-time.After(delayReconnect):
+				continue
+			case <-b.stop:
+				return
+			}
+		}
+		log.Println("MQTT connected to broker:", b.cfg.Broker)
+		b.serve(client)
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+		log.Println("MQTT connection lost. Reconnecting...")
+	}
+}
+
+// Stop bridge and disconnect from broker
+func (b *Bridge) Stop() {
+	for _, unsubscribe := range b.unsubscribe {
+		unsubscribe()
+	}
+	close(b.stop)
+}
+
+// Publish queued messages until the connection is lost or the bridge is stopped
+func (b *Bridge) serve(client *Client) {
+	defer client.Close()
+	client.Publish(b.prefix+"/status", []byte("online"), 0, true)
+	if err := client.Subscribe(b.prefix + "/cmd/+"); err != nil {
+		log.Println("MQTT subscribe failed:", err)
+		return
+	}
+	for {
+		select {
+		case msg := <-b.queue:
+			if err := client.Publish(msg.topic, msg.payload, msg.qos, msg.retain); err != nil {
+				log.Println("MQTT publish failed:", err)
+				return
+			}
+		case <-client.Done():
+			return
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Handle message on <prefix>/cmd/<command> and report result on <prefix>/cmd/<command>/result.
+// Retained commands are ignored, the broker would execute them again on every (re)subscribe.
+func (b *Bridge) onCommand(topic string, payload []byte, retained bool) {
+	name := strings.TrimPrefix(topic, b.prefix+"/cmd/")
+	if name == topic {
+		return
+	}
+	if retained {
+		log.Printf("MQTT command %s ignored: retained message", name)
+		return
+	}
+	result := map[string]string{"status": "success"}
+	if err := b.executeCommand(name, payload); err != nil {
+		log.Printf("MQTT command %s rejected: %v", name, err)
+		result = map[string]string{"status": "error", "error": err.Error()}
+	}
+	response, _ := json.Marshal(result)
+	b.enqueue(outgoing{topic: topic + "/result", payload: response})
+}
+
+// Decode payload (plain number or {"value": n}) and send command via controls
+func (b *Bridge) executeCommand(name string, payload []byte) error {
+	if _, ok := controls.CommandID(name); !ok {
+		return fmt.Errorf("Unknown command: %s", name)
+	}
+	var value uint32 = 1 // Start / stop carry no value
+	text := strings.TrimSpace(string(payload))
+	if strings.HasPrefix(text, "{") {
+		var cmd controls.ControlData
+		if err := json.Unmarshal([]byte(text), &cmd); err != nil {
+			return err
+		}
+		value = cmd.Value
+	} else if text != "" {
+		parsed, err := strconv.ParseUint(text, 10, 32)
+		if err != nil {
+			return err
+		}
+		value = uint32(parsed)
+	}
+	return controls.SendCommandByName(name, value)
+}
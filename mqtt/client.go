@@ -0,0 +1,199 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connection options for the MQTT client
+type Options struct {
+	Broker    string //host:port
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	// Last will, published by the broker if the connection is lost
+	WillTopic   string
+	WillPayload []byte
+	WillRetain  bool
+	// Called for every incoming PUBLISH (from the read goroutine), retained if the broker redelivers a stored message
+	OnMessage func(topic string, payload []byte, retained bool)
+}
+
+// Minimal MQTT 3.1.1 client (QoS 0 subscribe, QoS 0/1 publish)
+type Client struct {
+	conn      net.Conn
+	writeMu   sync.Mutex
+	nextID    uint16
+	onMessage func(topic string, payload []byte, retained bool)
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Connect to broker and wait for CONNACK
+func Connect(opts Options) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", opts.Broker, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to MQTT broker %s: %w", opts.Broker, err)
+	}
+
+	// Variable header: protocol name, level 4 (3.1.1), flags, keep alive
+	body := encodeString("MQTT")
+	body = append(body, 4)
+	var flags byte = 0x02 // Clean session
+	if opts.WillTopic != "" {
+		flags |= 0x04
+		if opts.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		if opts.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(opts.KeepAlive/time.Second))
+	// Payload: client id, will, credentials
+	body = append(body, encodeString(opts.ClientID)...)
+	if opts.WillTopic != "" {
+		body = append(body, encodeString(opts.WillTopic)...)
+		body = append(body, encodeString(string(opts.WillPayload))...)
+	}
+	if opts.Username != "" {
+		body = append(body, encodeString(opts.Username)...)
+		if opts.Password != "" {
+			body = append(body, encodeString(opts.Password)...)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writePacket(conn, packet{kind: packetConnect, body: body}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error sending CONNECT: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	ack, err := readPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error reading CONNACK: %w", err)
+	}
+	if ack.kind != packetConnack || len(ack.body) < 2 {
+		conn.Close()
+		return nil, fmt.Errorf("Unexpected packet type %d instead of CONNACK", ack.kind)
+	}
+	if ack.body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("Connection refused by broker, return code %d", ack.body[1])
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &Client{conn: conn, onMessage: opts.OnMessage, done: make(chan struct{})}
+	go c.readLoop(reader)
+	if opts.KeepAlive > 0 {
+		go c.keepAlive(opts.KeepAlive)
+	}
+	return c, nil
+}
+
+// Publish message. QoS 1 messages are sent with a packet ID, the PUBACK is not awaited.
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var id uint16
+	if qos > 0 {
+		id = c.packetID()
+	}
+	return writePacket(c.conn, publishPacket(topic, payload, qos, retain, id))
+}
+
+// Subscribe to topic filter with QoS 0
+func (c *Client) Subscribe(filter string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	body := binary.BigEndian.AppendUint16(nil, c.packetID())
+	body = append(body, encodeString(filter)...)
+	body = append(body, 0)
+	return writePacket(c.conn, packet{kind: packetSubscribe, flags: 0x02, body: body})
+}
+
+// Send DISCONNECT and close connection
+func (c *Client) Close() error {
+	c.writeMu.Lock()
+	writePacket(c.conn, packet{kind: packetDisconnect})
+	c.writeMu.Unlock()
+	c.shutdown()
+	return nil
+}
+
+// Channel closed when the connection is lost or closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) shutdown() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+// Next packet ID, never 0 (caller holds writeMu)
+func (c *Client) packetID() uint16 {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	return c.nextID
+}
+
+// Handle incoming packets until the connection is closed
+func (c *Client) readLoop(reader *bufio.Reader) {
+	defer c.shutdown()
+	for {
+		p, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+		if p.kind != packetPublish {
+			continue // SUBACK, PUBACK, PINGRESP need no action
+		}
+		topic, id, payload, err := parsePublish(p)
+		if err != nil {
+			return
+		}
+		if (p.flags>>1)&0x03 == 1 {
+			c.writeMu.Lock()
+			writePacket(c.conn, packet{kind: packetPuback, body: binary.BigEndian.AppendUint16(nil, id)})
+			c.writeMu.Unlock()
+		}
+		if c.onMessage != nil {
+			c.onMessage(topic, payload, p.flags&0x01 == 1)
+		}
+	}
+}
+
+// Send PINGREQ in keep alive interval
+func (c *Client) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.writeMu.Lock()
+			err := writePacket(c.conn, packet{kind: packetPingreq})
+			c.writeMu.Unlock()
+			if err != nil {
+				c.shutdown()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
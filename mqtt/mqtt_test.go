@@ -0,0 +1,168 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Received PUBLISH on the fake broker
+type published struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+// In-process stand-in for an MQTT broker: acknowledges CONNECT/SUBSCRIBE,
+// records PUBLISH packets and sends the commands once the client subscribed.
+func fakeBroker(t *testing.T, commands ...packet) (string, chan published) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not start fake broker: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan published, 100)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			p, err := readPacket(reader)
+			if err != nil {
+				return
+			}
+			switch p.kind {
+			case packetConnect:
+				writePacket(conn, packet{kind: packetConnack, body: []byte{0, 0}})
+			case packetSubscribe:
+				writePacket(conn, packet{kind: packetSuback, body: append(p.body[:2:2], 0)})
+				for _, command := range commands {
+					writePacket(conn, command)
+				}
+			case packetPublish:
+				topic, _, payload, _ := parsePublish(p)
+				received <- published{topic: topic, payload: string(payload), retain: p.flags&0x01 == 1}
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+// Wait for PUBLISH on topic
+func waitForTopic(t *testing.T, received chan published, topic string) published {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case msg := <-received:
+			if msg.topic == topic {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("No message received on topic %s", topic)
+		}
+	}
+}
+
+// Test for Bridge: signal publishing and command subscription
+func TestBridge_PublishAndCommand(t *testing.T) {
+	// Regular file as stand-in for the (Web UI -> User Program) pipe
+	pipePath := filepath.Join(t.TempDir(), "msgToSim")
+	os.WriteFile(pipePath, nil, 0644)
+	config.Cfg = &config.Config{Mode: "PipeMode", MsgToSimPipe: pipePath}
+
+	command := publishPacket("extruder/test/cmd/screw_rpm", []byte("250"), 0, false, 0)
+	broker, received := fakeBroker(t, command)
+
+	bridge := NewBridge(config.MQTTConfig{Broker: broker, TopicPrefix: "extruder/test"})
+	go bridge.Run()
+	defer bridge.Stop()
+
+	// Command result is published after the command was written to the pipe
+	result := waitForTopic(t, received, "extruder/test/cmd/screw_rpm/result")
+	if result.payload != `{"status":"success"}` {
+		t.Errorf("Unexpected command result: %s", result.payload)
+	}
+	written, _ := os.ReadFile(pipePath)
+	expected := make([]byte, 8)
+	binary.LittleEndian.PutUint32(expected, 250)
+	expected[7] = 0x04
+	if !bytes.Equal(written, expected) {
+		t.Errorf("Unexpected pipe message. Expected: %x, received: %x", expected, written)
+	}
+
+	// Decoded signal is published retained
+	data.GetValueFromMsg([]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xC8})
+	msg := waitForTopic(t, received, "extruder/test/temperature")
+	if !msg.retain {
+		t.Errorf("Signal message should be retained")
+	}
+	if !bytes.Contains([]byte(msg.payload), []byte(`"value":200`)) {
+		t.Errorf("Unexpected signal payload: %s", msg.payload)
+	}
+}
+
+// Test for onCommand: retained commands redelivered on subscribe are not executed
+func TestBridge_RetainedCommand(t *testing.T) {
+	pipePath := filepath.Join(t.TempDir(), "msgToSim")
+	os.WriteFile(pipePath, nil, 0644)
+	config.Cfg = &config.Config{Mode: "PipeMode", MsgToSimPipe: pipePath}
+
+	retained := publishPacket("extruder/test/cmd/heater_pwm", []byte("50"), 0, true, 0)
+	command := publishPacket("extruder/test/cmd/screw_rpm", []byte("250"), 0, false, 0)
+	broker, received := fakeBroker(t, retained, command)
+
+	bridge := NewBridge(config.MQTTConfig{Broker: broker, TopicPrefix: "extruder/test"})
+	go bridge.Run()
+	defer bridge.Stop()
+
+	// Results are published in order, the retained command would have been answered first
+	timeout := time.After(2 * time.Second)
+	for done := false; !done; {
+		select {
+		case msg := <-received:
+			if msg.topic == "extruder/test/cmd/heater_pwm/result" {
+				t.Errorf("Retained command was executed: %s", msg.payload)
+			}
+			done = msg.topic == "extruder/test/cmd/screw_rpm/result"
+		case <-timeout:
+			t.Fatalf("No result for the command received")
+		}
+	}
+	if written, _ := os.ReadFile(pipePath); len(written) != 8 || written[7] != 0x04 {
+		t.Errorf("Expected only the screw_rpm message, received: %x", written)
+	}
+}
+
+// Test for executeCommand: invalid values are rejected by controls validation
+func TestBridge_InvalidCommand(t *testing.T) {
+	bridge := &Bridge{prefix: "extruder/test"}
+	if err := bridge.executeCommand("heater_pwm", []byte(`{"value": 500}`)); err == nil {
+		t.Errorf("Expected error for out of range heater PWM")
+	}
+	if err := bridge.executeCommand("unknown", []byte("1")); err == nil {
+		t.Errorf("Expected error for unknown command")
+	}
+}
+
+// Test for packet encoding: remaining length round trip
+func TestRemainingLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151} {
+		var buf bytes.Buffer
+		writePacket(&buf, packet{kind: packetPublish, body: make([]byte, n)})
+		p, err := readPacket(bufio.NewReader(&buf))
+		if err != nil || len(p.body) != n {
+			t.Errorf("Remaining length %d not decoded correctly: %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	packetConnect    byte = 1
+	packetConnack    byte = 2
+	packetPublish    byte = 3
+	packetPuback     byte = 4
+	packetSubscribe  byte = 8
+	packetSuback     byte = 9
+	packetPingreq    byte = 12
+	packetPingresp   byte = 13
+	packetDisconnect byte = 14
+)
+
+// Largest remaining length allowed by the protocol
+const maxRemainingLength = 268435455
+
+// Packet with fixed header flags and variable header + payload
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// Encode remaining length as variable byte integer
+func encodeRemainingLength(n int) []byte {
+	var out []byte
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			return out
+		}
+	}
+}
+
+// Encode string with 2 byte length prefix
+func encodeString(s string) []byte {
+	out := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(out, uint16(len(s)))
+	return append(out, s...)
+}
+
+// Decode string with 2 byte length prefix, return string and remaining bytes
+func decodeString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("mqtt: string length missing")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("mqtt: string truncated")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// Write packet to w
+func writePacket(w io.Writer, p packet) error {
+	buf := []byte{p.kind<<4 | p.flags&0x0f}
+	buf = append(buf, encodeRemainingLength(len(p.body))...)
+	buf = append(buf, p.body...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Read packet from r
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+		if i == 3 {
+			return packet{}, errors.New("mqtt: malformed remaining length")
+		}
+	}
+	if length > maxRemainingLength {
+		return packet{}, errors.New("mqtt: packet too large")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+// Build PUBLISH packet
+func publishPacket(topic string, payload []byte, qos byte, retain bool, id uint16) packet {
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	body := encodeString(topic)
+	if qos > 0 {
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	body = append(body, payload...)
+	return packet{kind: packetPublish, flags: flags, body: body}
+}
+
+// Parse PUBLISH packet into topic, packet ID (QoS > 0) and payload
+func parsePublish(p packet) (topic string, id uint16, payload []byte, err error) {
+	topic, rest, err := decodeString(p.body)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if (p.flags>>1)&0x03 > 0 {
+		if len(rest) < 2 {
+			return "", 0, nil, errors.New("mqtt: packet id missing")
+		}
+		id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	return topic, id, rest, nil
+}
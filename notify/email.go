@@ -0,0 +1,290 @@
+package notify
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"extruder_web_gui/config"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Defaults of the email notifications if not configured
+const (
+	defaultBatch       = 30 * time.Second
+	defaultCooldown    = 10 * time.Minute
+	defaultSMTPTimeout = 10 * time.Second
+)
+
+// Mails kept for /notifications
+const mailLogSize = 100
+
+// Default templates of subject and body, see MailData
+const (
+	defaultSubject = `[Extruder] {{.Severity}}: {{(index .Events 0).Message}}{{if .More}} (+{{.More}} more){{end}}`
+	defaultBody    = `{{range .Events}}{{.Time.Format "2006-01-02 15:04:05"}} {{.Machine}} {{.Type}}
+{{.Message}}
+{{range $name, $value := .Values}}  {{$name}}: {{printf "%.2f" $value}}
+{{end}}
+{{end}}{{if .Suppressed}}{{.Suppressed}} repeated events were suppressed by the cool-down.
+{{end}}`
+)
+
+// Event of a mail with the last signal values of its machine
+type MailEvent struct {
+	Event
+	Values map[string]float64
+}
+
+// Data of the subject and body templates
+type MailData struct {
+	Severity   string
+	Events     []MailEvent //Oldest first
+	More       int         //Number of events besides the first
+	Suppressed int         //Events of the severity dropped by the cool-down since the last mail
+}
+
+// Sent or failed mail
+type Mail struct {
+	ID       int       `json:"id"`
+	Severity string    `json:"severity"`
+	To       []string  `json:"to"`
+	Subject  string    `json:"subject"`
+	Events   []string  `json:"events"` //Event IDs
+	Status   string    `json:"status"` //"delivered" or "failed"
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Mailer sending events as batched mails to the recipients of their severity
+type Mailer struct {
+	mu         sync.Mutex
+	cfg        config.EmailConfig
+	subject    *template.Template
+	body       *template.Template
+	pending    map[string][]MailEvent // Per severity, waiting for the end of the batch
+	suppressed map[string]int         // Per severity since the last mail
+	last       map[string]time.Time   // Last mailed event per cool-down key
+	mails      []Mail                 // Newest last
+	nextID     int
+
+	Values func(machine string) map[string]float64 // Last signal values of a machine shown in mails, nil = none
+
+	send  func(cfg config.EmailConfig, to []string, msg []byte) error
+	now   func() time.Time
+	after func(d time.Duration, fn func())
+}
+
+// Create mailer without server
+func NewMailer() *Mailer {
+	m := &Mailer{
+		pending:    map[string][]MailEvent{},
+		suppressed: map[string]int{},
+		last:       map[string]time.Time{},
+		send:       sendMail,
+		now:        time.Now,
+		after:      func(d time.Duration, fn func()) { time.AfterFunc(d, fn) },
+	}
+	m.subject = template.Must(template.New("subject").Parse(defaultSubject))
+	m.body = template.Must(template.New("body").Parse(defaultBody))
+	return m
+}
+
+// Apply config, the old config is kept if a template is invalid
+func (m *Mailer) Configure(cfg config.EmailConfig) error {
+	subject, err := template.New("subject").Parse(cmp.Or(cfg.Subject, defaultSubject))
+	if err != nil {
+		return fmt.Errorf("Email subject: %w", err)
+	}
+	body, err := template.New("body").Parse(cmp.Or(cfg.Body, defaultBody))
+	if err != nil {
+		return fmt.Errorf("Email body: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg, m.subject, m.body = cfg, subject, body
+	return nil
+}
+
+// Queue event for the next mail to the recipients of its severity.
+// The same event of the same alarm and machine is mailed once per cool-down, events without an
+// alarm such as emergency stops are always mailed.
+func (m *Mailer) Add(e Event) {
+	m.mu.Lock()
+	cfg := m.cfg
+	m.mu.Unlock()
+	if cfg.Server == "" || len(cfg.Recipients[e.Severity]) == 0 || !Matches(cfg.Events, e.Type) {
+		return
+	}
+	var values map[string]float64
+	if m.Values != nil {
+		values = m.Values(e.Machine)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if alarm, ok := e.Data["alarm"]; ok {
+		now := m.now()
+		key := fmt.Sprintf("%s/%s/%v", e.Type, e.Machine, alarm)
+		if last, ok := m.last[key]; ok && now.Sub(last) < duration(cfg.Cooldown, defaultCooldown) {
+			m.suppressed[e.Severity]++
+			return
+		}
+		m.last[key] = now
+	}
+	m.pending[e.Severity] = append(m.pending[e.Severity], MailEvent{Event: e, Values: values})
+	if len(m.pending[e.Severity]) == 1 {
+		m.after(duration(cfg.Batch, defaultBatch), func() { m.flush(e.Severity) })
+	}
+}
+
+// Send the queued events of a severity as one mail
+func (m *Mailer) flush(severity string) {
+	m.mu.Lock()
+	cfg, events, suppressed := m.cfg, m.pending[severity], m.suppressed[severity]
+	delete(m.pending, severity)
+	delete(m.suppressed, severity)
+	subjectTmpl, bodyTmpl := m.subject, m.body
+	m.mu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	to := cfg.Recipients[severity]
+	data := MailData{Severity: severity, Events: events, More: len(events) - 1, Suppressed: suppressed}
+	var subject, body bytes.Buffer
+	err := subjectTmpl.Execute(&subject, data)
+	if err == nil {
+		err = bodyTmpl.Execute(&body, data)
+	}
+	if err == nil && len(to) == 0 {
+		err = errors.New("No recipients")
+	}
+	if err == nil {
+		err = m.send(cfg, to, message(cfg.From, to, subject.String(), body.String(), m.now()))
+	}
+
+	sent := Mail{Severity: severity, To: to, Subject: subject.String(), Status: StatusDelivered, Time: m.now()}
+	for _, e := range events {
+		sent.Events = append(sent.Events, e.ID)
+	}
+	if err != nil {
+		sent.Status, sent.Error = StatusFailed, err.Error()
+		log.Printf("Email %q to %s not sent: %v", sent.Subject, strings.Join(to, ", "), err)
+	}
+	m.mu.Lock()
+	m.nextID++
+	sent.ID = m.nextID
+	m.mails = append(m.mails, sent)
+	if len(m.mails) > mailLogSize {
+		m.mails = m.mails[len(m.mails)-mailLogSize:]
+	}
+	m.mu.Unlock()
+}
+
+// Mail log, newest last
+func (m *Mailer) Mails() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Mail{}, m.mails...)
+}
+
+// Plain text mail with headers
+func message(from string, to []string, subject string, body string, date time.Time) []byte {
+	subject = strings.Join(strings.Fields(subject), " ")
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Deliver mail via the configured SMTP server
+func sendMail(cfg config.EmailConfig, to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(cfg.Server)
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return fmt.Errorf("Sender: %w", err)
+	}
+	timeout := duration(cfg.Timeout, defaultSMTPTimeout)
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: cfg.Insecure}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if cfg.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", cfg.Server, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", cfg.Server)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if cfg.TLS == "" || cfg.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP server does not offer STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		address, err := mail.ParseAddress(rcpt)
+		if err != nil {
+			return fmt.Errorf("Recipient: %w", err)
+		}
+		if err := c.Rcpt(address.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Configured milliseconds or the default
+func duration(ms int, def time.Duration) time.Duration {
+	if ms == 0 {
+		return def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
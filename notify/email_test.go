@@ -0,0 +1,213 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/base64"
+	"extruder_web_gui/config"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Received mail of the fake SMTP server
+type smtpMail struct {
+	auth string // Decoded AUTH PLAIN credentials
+	from string
+	to   []string
+	data string
+}
+
+// Local SMTP stand-in accepting every mail, STARTTLS is never offered
+type fakeSMTP struct {
+	listener net.Listener
+	mu       sync.Mutex
+	mails    []smtpMail
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	var m smtpMail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case cmd == "EHLO":
+			tp.PrintfLine("250-fake")
+			tp.PrintfLine("250 AUTH PLAIN")
+		case cmd == "AUTH":
+			fields := strings.Fields(line)
+			decoded, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			m.auth = string(decoded)
+			tp.PrintfLine("235 Authenticated")
+		case cmd == "MAIL":
+			m.from = line
+			tp.PrintfLine("250 OK")
+		case cmd == "RCPT":
+			m.to = append(m.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			tp.PrintfLine("250 OK")
+		case cmd == "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, _ := tp.ReadDotBytes()
+			m.data = string(data)
+			s.mu.Lock()
+			s.mails = append(s.mails, m)
+			s.mu.Unlock()
+			m = smtpMail{}
+			tp.PrintfLine("250 Queued")
+		case cmd == "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) received() []smtpMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMail{}, s.mails...)
+}
+
+// Mailer of the fake server with a manual clock, batches are sent by calling the returned flush
+func testMailer(t *testing.T, server string, cfg config.EmailConfig) (*Mailer, *time.Time, func()) {
+	now := time.Date(2026, 3, 1, 6, 30, 0, 0, time.UTC)
+	var batches []func()
+	m := NewMailer()
+	m.now = func() time.Time { return now }
+	m.after = func(d time.Duration, fn func()) { batches = append(batches, fn) }
+	m.Values = func(machine string) map[string]float64 {
+		return map[string]float64{"temperature": 231.5, "diameter": 1.82}
+	}
+	cfg.Server, cfg.TLS, cfg.From = server, "none", "Extruder <extruder@example.com>"
+	if err := m.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	flush := func() {
+		for _, fn := range batches {
+			fn()
+		}
+		batches = nil
+	}
+	return m, &now, flush
+}
+
+// Test for Add and flush: batch per severity with last values, cool-down of a flapping alarm
+func TestMailer_BatchAndCooldown(t *testing.T) {
+	s := newFakeSMTP(t)
+	m, now, flush := testMailer(t, s.listener.Addr().String(), config.EmailConfig{
+		Username:   "extruder",
+		Password:   "pw",
+		Recipients: map[string][]string{"critical": {"maintenance@example.com", "Shift Lead <lead@example.com>"}},
+		Cooldown:   60000,
+	})
+
+	raised := Event{ID: "1", Type: "alarm.raised", Machine: "main", Severity: "critical", Message: "Temperature high", Data: map[string]any{"alarm": "temp-high"}}
+	m.Add(raised)
+	m.Add(Event{ID: "2", Type: "alarm.cleared", Machine: "main", Severity: "info", Message: "Cleared"}) // No info recipients
+	*now = now.Add(10 * time.Second)
+	raised.ID = "3"
+	m.Add(raised) // Flapping, within the cool-down
+	m.Add(Event{ID: "4", Type: "estop.triggered", Machine: "main", Severity: "critical", Message: "Emergency stop"})
+	m.Add(Event{ID: "5", Type: "estop.triggered", Machine: "main", Severity: "critical", Message: "Emergency stop"}) // Never cooled down
+	flush()
+
+	mails := s.received()
+	if len(mails) != 1 {
+		t.Fatalf("Expected: %v, received: %v mails", 1, len(mails))
+	}
+	mail := mails[0]
+	if mail.auth != "\x00extruder\x00pw" || !strings.Contains(mail.from, "extruder@example.com") {
+		t.Errorf("Unexpected auth or sender: %q %q", mail.auth, mail.from)
+	}
+	if strings.Join(mail.to, ",") != "maintenance@example.com,lead@example.com" {
+		t.Errorf("Unexpected recipients: %v", mail.to)
+	}
+	for _, text := range []string{"Subject: [Extruder] critical: Temperature high (+2 more)", "Emergency stop", "temperature: 231.50", "1 repeated events"} {
+		if !strings.Contains(mail.data, text) {
+			t.Errorf("Mail does not contain %q:\n%s", text, mail.data)
+		}
+	}
+	if log := m.Mails(); len(log) != 1 || log[0].Status != StatusDelivered || strings.Join(log[0].Events, ",") != "1,4,5" {
+		t.Errorf("Unexpected mail log: %+v", log)
+	}
+
+	*now = now.Add(time.Minute)
+	raised.ID = "6"
+	m.Add(raised) // Cool-down over
+	flush()
+	if mails := s.received(); len(mails) != 2 || strings.Contains(mails[1].data, "repeated events") {
+		t.Errorf("Expected second mail without suppressed events, received: %+v", mails)
+	}
+}
+
+// Test for Configure and flush: custom templates, missing STARTTLS fails the mail
+func TestMailer_TemplatesAndTLS(t *testing.T) {
+	s := newFakeSMTP(t)
+	m, _, flush := testMailer(t, s.listener.Addr().String(), config.EmailConfig{
+		Recipients: map[string][]string{"warning": {"ops@example.com"}},
+		Subject:    `{{len .Events}} warnings`,
+		Body:       `{{range .Events}}{{.Machine}}: {{.Message}} at {{index .Values "diameter"}} mm{{end}}`,
+	})
+	if err := m.Configure(config.EmailConfig{Subject: "{{.Severity"}); err == nil {
+		t.Errorf("Invalid template should be rejected")
+	}
+
+	m.Add(Event{ID: "1", Type: "sequence.finished", Machine: "line2", Severity: "warning", Message: "Startup failed"})
+	flush()
+	if mails := s.received(); len(mails) != 1 || !strings.Contains(mails[0].data, "Subject: 1 warnings") || !strings.Contains(mails[0].data, "line2: Startup failed at 1.82 mm") {
+		t.Errorf("Unexpected mails: %+v", mails)
+	}
+
+	cfg := m.cfg
+	cfg.TLS = "starttls"
+	m.Configure(cfg)
+	m.Add(Event{ID: "2", Type: "sequence.finished", Machine: "line2", Severity: "warning", Message: "Shutdown failed"})
+	flush()
+	if log := m.Mails(); len(log) != 2 || log[1].Status != StatusFailed || !strings.Contains(log[1].Error, "STARTTLS") {
+		t.Errorf("Unexpected mail log: %+v", log)
+	}
+}
+
+// Test for message: headers, encoded subject and CRLF line endings
+func TestMessage(t *testing.T) {
+	msg := string(message("a@example.com", []string{"b@example.com", "c@example.com"}, "Temperatur zu hoch:\n 250 °C", "line 1\nline 2\n", time.Date(2026, 3, 1, 6, 30, 0, 0, time.UTC)))
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(msg)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("To") != "b@example.com, c@example.com" || !strings.HasPrefix(header.Get("Subject"), "=?utf-8?q?") {
+		t.Errorf("Unexpected header: %v", header)
+	}
+	if !strings.HasSuffix(msg, "\r\n\r\nline 1\r\nline 2\r\n") {
+		t.Errorf("Unexpected body: %q", msg)
+	}
+}
@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"extruder_web_gui/estop"
+	"extruder_web_gui/sequence"
+	"extruder_web_gui/watchdog"
+	"fmt"
+)
+
+// Event of a completed spool with its final stats
+func SpoolEvent(machine string, stats data.SpoolStats) Event {
+	return Event{
+		Type:     "spool.completed",
+		Machine:  machine,
+		Severity: string(alarms.SeverityInfo),
+		Message:  fmt.Sprintf("Spool completed: %.0f g, %.0f windings", stats.FilamentMass.Value, stats.NbrOfWindings.Value),
+		Data: map[string]any{
+			"windingDiameter": stats.WindingDiameter.Value,
+			"avgFilDiameter":  stats.AvgFilDiameter.Value,
+			"nbrOfWindings":   stats.NbrOfWindings.Value,
+			"filamentMass":    stats.FilamentMass.Value,
+		},
+	}
+}
+
+// Events of a raised or cleared alarm, the loss of the machine link is also sent as connection event
+func AlarmEvents(a alarms.Alarm) []Event {
+	machine := a.Fields["machine"]
+	if machine == "" {
+		machine = config.DefaultMachineID
+	}
+	data := map[string]any{"alarm": a.ID, "source": a.Source}
+	for k, v := range a.Fields {
+		data[k] = v
+	}
+	e := Event{Type: "alarm.raised", Machine: machine, Severity: string(a.Severity), Message: a.Message, Data: data}
+	if !a.Active {
+		e.Type, e.Severity, e.Message = "alarm.cleared", string(alarms.SeverityInfo), "Cleared: "+a.Message
+	}
+	events := []Event{e}
+	if watchdog.IsCommLost(a) {
+		link := Event{Type: "connection.lost", Machine: machine, Severity: string(alarms.SeverityCritical), Message: a.Message, Data: data}
+		if !a.Active {
+			link.Type, link.Severity, link.Message = "connection.restored", string(alarms.SeverityInfo), "Communication with machine restored"
+		}
+		events = append(events, link)
+	}
+	return events
+}
+
+// Event of a triggered or reset emergency stop
+func EStopEvent(machine string, e estop.Event) Event {
+	data := map[string]any{"estop": e.ID, "actor": e.Actor, "reason": e.Reason, "state": e.State, "values": e.Values}
+	if e.Reset != nil {
+		data["resetBy"] = e.ResetBy
+		return Event{Type: "estop.reset", Machine: machine, Severity: string(alarms.SeverityInfo), Message: "Emergency stop reset by " + e.ResetBy, Data: data}
+	}
+	return Event{Type: "estop.triggered", Machine: machine, Severity: string(alarms.SeverityCritical), Message: fmt.Sprintf("Emergency stop by %s: %s", e.Actor, e.Reason), Data: data}
+}
+
+// Event of a finished sequence run, failed runs are sent as warning
+func SequenceEvent(p sequence.Progress) Event {
+	severity := alarms.SeverityInfo
+	if p.Status == sequence.StatusFailed {
+		severity = alarms.SeverityWarning
+	}
+	return Event{
+		Type:     "sequence.finished",
+		Severity: string(severity),
+		Message:  fmt.Sprintf("Sequence %s %s: %s", p.Sequence, p.Status, p.Message),
+		Data:     map[string]any{"sequence": p.Sequence, "run": p.Run, "status": p.Status, "step": p.Step, "steps": p.Steps, "startedBy": p.StartedBy},
+	}
+}
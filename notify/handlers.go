@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"encoding/json"
+	"extruder_web_gui/audit"
+	"net/http"
+)
+
+// Webhook as shown by /notifications, without secret
+type Webhook struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Signed bool     `json:"signed"`
+}
+
+// Webhooks with the delivery log and the mail log
+type Status struct {
+	Webhooks   []Webhook  `json:"webhooks"`
+	Deliveries []Delivery `json:"deliveries"` //Newest last
+	Email      bool       `json:"email"`      //SMTP server configured
+	Mails      []Mail     `json:"mails"`      //Newest last
+}
+
+// Configured webhooks without secrets
+func (d *Dispatcher) Webhooks() []Webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hooks := make([]Webhook, len(d.cfg.Webhooks))
+	for i, hook := range d.cfg.Webhooks {
+		hooks[i] = Webhook{Name: hook.Name, URL: hook.URL, Events: hook.Events, Signed: hook.Secret != ""}
+	}
+	return hooks
+}
+
+// Handler for /notifications: webhooks, delivery log and mail log
+func (d *Dispatcher) Handler(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	email := d.cfg.Email.Server != ""
+	d.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Status{Webhooks: d.Webhooks(), Deliveries: d.Deliveries(), Email: email, Mails: d.Email.Mails()})
+}
+
+// Handler for /notifications/test: sends a test event to the webhooks subscribed to it and the info recipients
+func (d *Dispatcher) TestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		return
+	}
+	actor := audit.Actor(r)
+	e := d.Publish(Event{Type: "test", Severity: "info", Message: "Test notification sent by " + actor})
+	audit.Record(audit.Entry{Actor: actor, Action: "notifications.test", Result: audit.ResultOK, Message: "Test event " + e.ID})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,254 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"extruder_web_gui/config"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults if not configured
+const (
+	defaultMaxAttempts = 5
+	defaultBackoff     = time.Second
+	defaultMaxBackoff  = time.Minute
+	defaultTimeout     = 5 * time.Second
+)
+
+// Deliveries kept for /notifications
+const logSize = 200
+
+// Status of a delivery
+const (
+	StatusPending   = "pending" //Waiting for the next attempt
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed" //All attempts failed or the receiver rejected the event
+)
+
+// Event sent to the webhooks
+type Event struct {
+	ID       string         `json:"id"`
+	Type     string         `json:"type"` //One of config.NotificationEvents
+	Time     time.Time      `json:"time"`
+	Machine  string         `json:"machine"`
+	Severity string         `json:"severity"` //"info", "warning" or "critical"
+	Message  string         `json:"message"`
+	Data     map[string]any `json:"data,omitempty"`
+}
+
+// Delivery of an event to one webhook
+type Delivery struct {
+	ID        int        `json:"id"`
+	Webhook   string     `json:"webhook"`
+	Event     string     `json:"event"` //Event ID
+	Type      string     `json:"type"`
+	Status    string     `json:"status"`
+	Attempts  int        `json:"attempts"`
+	Code      int        `json:"code,omitempty"`  //HTTP status of the last attempt
+	Error     string     `json:"error,omitempty"` //Error of the last attempt
+	Created   time.Time  `json:"created"`
+	Updated   time.Time  `json:"updated"`
+	NextRetry *time.Time `json:"nextRetry,omitempty"`
+}
+
+// Dispatcher posting events to the configured webhooks with retries and a delivery log
+type Dispatcher struct {
+	mu         sync.Mutex
+	cfg        config.NotificationConfig
+	deliveries []*Delivery // Newest last
+	nextID     int
+	events     int
+
+	Email *Mailer // Mails about the published events
+
+	client *http.Client
+	now    func() time.Time
+	sleep  func(d time.Duration)
+}
+
+// Create dispatcher without webhooks and mail server
+func New() *Dispatcher {
+	return &Dispatcher{Email: NewMailer(), client: &http.Client{}, now: time.Now, sleep: time.Sleep}
+}
+
+// Dispatcher of the application
+var Default = New()
+
+// Apply config of the default dispatcher
+func Configure(cfg config.NotificationConfig) error {
+	return Default.Configure(cfg)
+}
+
+// Send event via the default dispatcher
+func Publish(e Event) Event {
+	return Default.Publish(e)
+}
+
+// Apply config, deliveries in progress keep their webhook
+func (d *Dispatcher) Configure(cfg config.NotificationConfig) error {
+	if err := d.Email.Configure(cfg.Email); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cfg = cfg
+	return nil
+}
+
+// Report if the event type passes the filter of a webhook, an empty filter passes all events
+func Matches(filter []string, eventType string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if f == eventType || (strings.HasSuffix(f, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(f, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// HMAC-SHA256 signature of a request: hex of HMAC(secret, timestamp + "." + body)
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send event to every webhook whose filter matches and queue it for the mail of its severity,
+// returns the event with ID and time set. Deliveries run in the background.
+func (d *Dispatcher) Publish(e Event) Event {
+	d.mu.Lock()
+	d.events++
+	if e.Time.IsZero() {
+		e.Time = d.now()
+	}
+	if e.ID == "" {
+		e.ID = fmt.Sprintf("%d-%d", e.Time.UnixMilli(), d.events)
+	}
+	if e.Machine == "" {
+		e.Machine = config.DefaultMachineID
+	}
+	cfg := d.cfg
+	type job struct {
+		hook     config.WebhookConfig
+		delivery *Delivery
+	}
+	var jobs []job
+	for _, hook := range cfg.Webhooks {
+		if !Matches(hook.Events, e.Type) {
+			continue
+		}
+		d.nextID++
+		delivery := &Delivery{ID: d.nextID, Webhook: hook.Name, Event: e.ID, Type: e.Type, Status: StatusPending, Created: e.Time, Updated: e.Time}
+		d.deliveries = append(d.deliveries, delivery)
+		jobs = append(jobs, job{hook, delivery})
+	}
+	if len(d.deliveries) > logSize {
+		d.deliveries = d.deliveries[len(d.deliveries)-logSize:]
+	}
+	d.mu.Unlock()
+
+	d.Email.Add(e)
+	if len(jobs) == 0 {
+		return e
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Notification %s: %v", e.Type, err)
+		return e
+	}
+	for _, j := range jobs {
+		go d.deliver(cfg, j.hook, j.delivery, body)
+	}
+	return e
+}
+
+// Post body until the webhook accepts it, the receiver rejects it or the attempts are used up
+func (d *Dispatcher) deliver(cfg config.NotificationConfig, hook config.WebhookConfig, delivery *Delivery, body []byte) {
+	attempts := cfg.MaxAttempts
+	if attempts == 0 {
+		attempts = defaultMaxAttempts
+	}
+	backoff := duration(cfg.Backoff, defaultBackoff)
+	maxBackoff := duration(cfg.MaxBackoff, defaultMaxBackoff)
+	timeout := duration(cfg.Timeout, defaultTimeout)
+
+	for attempt := 1; ; attempt++ {
+		code, err := d.post(hook, delivery, body, timeout)
+		retry := err != nil || code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+		if err == nil && (code < 200 || code >= 300) {
+			err = fmt.Errorf("Webhook answered %d", code)
+		}
+
+		d.mu.Lock()
+		delivery.Attempts, delivery.Code, delivery.Updated, delivery.NextRetry = attempt, code, d.now(), nil
+		delivery.Error = ""
+		switch {
+		case err == nil:
+			delivery.Status = StatusDelivered
+		case !retry || attempt >= attempts:
+			delivery.Status, delivery.Error = StatusFailed, err.Error()
+		default:
+			next := delivery.Updated.Add(backoff)
+			delivery.Error, delivery.NextRetry = err.Error(), &next
+		}
+		status := delivery.Status
+		d.mu.Unlock()
+
+		if status != StatusPending {
+			if status == StatusFailed {
+				log.Printf("Webhook %s: %s event %s not delivered after %d attempts: %v", hook.Name, delivery.Type, delivery.Event, attempt, err)
+			}
+			return
+		}
+		d.sleep(backoff)
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// Send one request, returns the HTTP status
+func (d *Dispatcher) post(hook config.WebhookConfig, delivery *Delivery, body []byte, timeout time.Duration) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "extruder_web_gui")
+	req.Header.Set("X-Extruder-Event", delivery.Type)
+	req.Header.Set("X-Extruder-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Extruder-Timestamp", timestamp)
+	if hook.Secret != "" {
+		req.Header.Set("X-Extruder-Signature", Sign(hook.Secret, timestamp, body))
+	}
+	client := *d.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// Delivery log, newest last
+func (d *Dispatcher) Deliveries() []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]Delivery, len(d.deliveries))
+	for i, delivery := range d.deliveries {
+		list[i] = *delivery
+	}
+	return list
+}
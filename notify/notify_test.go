@@ -0,0 +1,155 @@
+package notify
+
+import (
+	"encoding/json"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/watchdog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Local webhook stand-in answering with the given status codes in turn, then 200
+type receiver struct {
+	mu       sync.Mutex
+	codes    []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	code := http.StatusOK
+	if len(rc.codes) > 0 {
+		code, rc.codes = rc.codes[0], rc.codes[1:]
+	}
+	rc.mu.Unlock()
+	w.WriteHeader(code)
+}
+
+func (rc *receiver) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.requests)
+}
+
+// Dispatcher without waiting between retries
+func testDispatcher(cfg config.NotificationConfig) *Dispatcher {
+	d := New()
+	d.sleep = func(time.Duration) {}
+	d.Configure(cfg)
+	return d
+}
+
+// Wait until the deliveries are finished or fail after a second
+func waitDelivered(t *testing.T, d *Dispatcher, n int) []Delivery {
+	deadline := time.Now().Add(time.Second)
+	for {
+		deliveries := d.Deliveries()
+		done := len(deliveries) == n
+		for _, delivery := range deliveries {
+			done = done && delivery.Status != StatusPending
+		}
+		if done {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Deliveries not finished: %+v", deliveries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Test for Publish: signed JSON post with event headers
+func TestPublish_Signed(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	d := testDispatcher(config.NotificationConfig{Webhooks: []config.WebhookConfig{{Name: "ops", URL: server.URL, Secret: "s3cret"}}})
+
+	e := d.Publish(Event{Type: "spool.completed", Severity: "info", Message: "Spool completed"})
+	deliveries := waitDelivered(t, d, 1)
+	if deliveries[0].Status != StatusDelivered || deliveries[0].Attempts != 1 {
+		t.Errorf("Unexpected delivery: %+v", deliveries[0])
+	}
+	req, body := rc.requests[0], rc.bodies[0]
+	if got := req.Header.Get("X-Extruder-Event"); got != "spool.completed" {
+		t.Errorf("Event header. Expected: %v, received: %v", "spool.completed", got)
+	}
+	expected := Sign("s3cret", req.Header.Get("X-Extruder-Timestamp"), body)
+	if got := req.Header.Get("X-Extruder-Signature"); got != expected {
+		t.Errorf("Signature. Expected: %v, received: %v", expected, got)
+	}
+	var received Event
+	if err := json.Unmarshal(body, &received); err != nil || received.ID != e.ID || received.Machine != config.DefaultMachineID {
+		t.Errorf("Unexpected body: %s (%v)", body, err)
+	}
+}
+
+// Test for deliver: retries on server errors, gives up on rejection or after the last attempt
+func TestPublish_Retries(t *testing.T) {
+	tests := []struct {
+		name     string
+		codes    []int
+		status   string
+		attempts int
+	}{
+		{"Retried", []int{500, 503}, StatusDelivered, 3},
+		{"Rejected", []int{400}, StatusFailed, 1},
+		{"Attempts used up", []int{500, 500, 500}, StatusFailed, 3},
+	}
+	for _, tc := range tests {
+		rc := &receiver{codes: tc.codes}
+		server := httptest.NewServer(rc)
+		var waits []time.Duration
+		d := testDispatcher(config.NotificationConfig{MaxAttempts: 3, Backoff: 100, MaxBackoff: 150, Webhooks: []config.WebhookConfig{{Name: "ops", URL: server.URL}}})
+		d.sleep = func(wait time.Duration) { waits = append(waits, wait) }
+
+		d.Publish(Event{Type: "alarm.raised"})
+		delivery := waitDelivered(t, d, 1)[0]
+		if delivery.Status != tc.status || delivery.Attempts != tc.attempts || rc.count() != tc.attempts {
+			t.Errorf("%s: Unexpected delivery: %+v", tc.name, delivery)
+		}
+		if tc.attempts == 3 && (len(waits) != 2 || waits[0] != 100*time.Millisecond || waits[1] != 150*time.Millisecond) {
+			t.Errorf("%s: Unexpected backoff: %v", tc.name, waits)
+		}
+		server.Close()
+	}
+}
+
+// Test for the event filter: exact types and prefixes
+func TestPublish_Filter(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	d := testDispatcher(config.NotificationConfig{Webhooks: []config.WebhookConfig{
+		{Name: "alarms", URL: server.URL, Events: []string{"alarm.*"}},
+		{Name: "spools", URL: server.URL, Events: []string{"spool.completed"}},
+	}})
+	for _, e := range AlarmEvents(alarms.Alarm{ID: watchdog.CommLostAlarm, Severity: alarms.SeverityCritical, Message: "Lost", Active: true}) {
+		d.Publish(e)
+	}
+	d.Publish(Event{Type: "sequence.finished"})
+	deliveries := waitDelivered(t, d, 1)
+	if deliveries[0].Webhook != "alarms" || deliveries[0].Type != "alarm.raised" {
+		t.Errorf("Unexpected delivery: %+v", deliveries[0])
+	}
+	if !Matches(nil, "test") || Matches([]string{"alarm.*"}, "alarms.raised") {
+		t.Errorf("Unexpected filter result")
+	}
+}
+
+// Test for AlarmEvents: loss of the machine link is also sent as connection event
+func TestAlarmEvents(t *testing.T) {
+	events := AlarmEvents(alarms.Alarm{ID: watchdog.CommLostAlarm + ":line2", Message: "Lost", Fields: map[string]string{"machine": "line2"}})
+	if len(events) != 2 || events[0].Type != "alarm.cleared" || events[1].Type != "connection.restored" || events[1].Machine != "line2" {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+}
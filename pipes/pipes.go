@@ -3,88 +3,222 @@ package pipes
 import (
 	"bufio"
 	"encoding/binary"
-	"extruder_web_gui/config"
+	"errors"
 	"extruder_web_gui/data"
+	"extruder_web_gui/eventlog"
+	"extruder_web_gui/metrics"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"syscall"
 	"time"
 )
 
-// Handler for (User Program -> Web UI) Pipe
-func FromUserPipeHandler() {
+var reconnectCounter = metrics.NewCounterVec("extruder_pipe_reconnects_total", "Reconnect attempts per pipe.", "pipe")
+
+// Connection events of a pipe, failed opens are recorded once until the pipe is connected again
+type pipeEvents struct {
+	store   *data.Store
+	name    string
+	path    string
+	failing bool
+}
+
+func (p *pipeEvents) connected() {
+	p.failing = false
+	p.store.RecordEvent(eventlog.CategoryConnection, eventlog.SeverityInfo, fmt.Sprintf("Pipe (%s) connected", p.name), map[string]string{"pipe": p.path})
+}
+
+func (p *pipeEvents) disconnected() {
+	p.store.RecordEvent(eventlog.CategoryConnection, eventlog.SeverityWarning, fmt.Sprintf("Pipe (%s) disconnected", p.name), map[string]string{"pipe": p.path})
+}
+
+func (p *pipeEvents) failed(err error) {
+	if !p.failing {
+		p.failing = true
+		p.store.RecordEvent(eventlog.CategoryConnection, eventlog.SeverityWarning, fmt.Sprintf("Pipe (%s) could not be opened: %v", p.name, err), map[string]string{"pipe": p.path})
+	}
+}
+
+// Handler for (User Program -> Web UI) Pipe, messages are stored in store. Runs until stop is closed.
+func FromUserPipeHandler(path string, store *data.Store, stop <-chan struct{}) {
 	var delayReconnect time.Duration = 2 * time.Second
+	events := pipeEvents{store: store, name: "User->UI", path: path}
 	for {
-		file, err := os.OpenFile(config.Cfg.MsgFromSimPipe, os.O_RDONLY, os.ModeNamedPipe)
+		file, err := openPipe(path, stop)
+		if errors.Is(err, errStopped) {
+			return
+		}
 		if err != nil {
-			log.Printf("Failed to open pipe (User->UI) file (%s): %v", config.Cfg.MsgFromSimPipe, err)
-			time.Sleep(delayReconnect)
+			log.Printf("Failed to open pipe (User->UI) file (%s): %v", path, err)
+			events.failed(err)
+			reconnectCounter.Inc("user")
+			if !sleep(delayReconnect, stop) {
+				return
+			}
 			continue
 		}
 		log.Println("Pipe (User->UI) connected successfully")
+		events.connected()
+		done := closeOnStop(file, stop)
 
 		reader := bufio.NewReader(file)
 		buffer := make([]byte, 8)
 		for {
 			_, err := io.ReadFull(reader, buffer)
 			if err != nil {
+				if stopped(stop) {
+					close(done)
+					log.Println("Pipe (User->UI) stopped")
+					return
+				}
 				if err == io.EOF {
 					log.Println("Pipe (User->UI) closed by writer. Trying to reestablish connection...")
 					break
 				}
-				log.Fatal("Error reading from Pipe (User -> UI):", err)
+				log.Println("Error reading from Pipe (User -> UI):", err)
+				break
 			}
 			buffer = reverseBytes(buffer)
-			data.GetValueFromMsg(buffer)
+			store.GetValueFromMsg(buffer)
 		}
 		//only reached when writer closes connection
 		log.Println("Pipe (User->UI) disconnected. Reconnecting...")
+		events.disconnected()
+		reconnectCounter.Inc("user")
+		close(done)
 		file.Close()
 	}
 }
 
-// Handler for (Simulator --> Web-UI) Pipe
-func FromSimPipeHandler() {
+// Handler for (Simulator --> Web-UI) Pipe, process values are only read from it if values is set (SimMode).
+// Rows are stored in store, runs until stop is closed.
+func FromSimPipeHandler(path string, values bool, store *data.Store, stop <-chan struct{}) {
 	var delayReconnect time.Duration = 2 * time.Second
+	events := pipeEvents{store: store, name: "Sim->UI", path: path}
 	for {
 		//Open pipe with Read Only permissions
-		file, err := os.OpenFile(config.Cfg.SimModePipe, os.O_RDONLY, os.ModeNamedPipe)
+		file, err := openPipe(path, stop)
+		if errors.Is(err, errStopped) {
+			return
+		}
 		if err != nil {
-			log.Printf("Failed to open pipe (Sim->UI) file (%s): %v", config.Cfg.SimModePipe, err)
-			time.Sleep(delayReconnect)
+			log.Printf("Failed to open pipe (Sim->UI) file (%s): %v", path, err)
+			events.failed(err)
+			reconnectCounter.Inc("sim")
+			if !sleep(delayReconnect, stop) {
+				return
+			}
 			continue
 		}
 		log.Println("Pipe (Sim->UI) connected successfully")
+		events.connected()
+		done := closeOnStop(file, stop)
 
 		reader := bufio.NewReader(file)
 		for {
 			// Read pipe by line
 			line, err := reader.ReadString('\n')
 			if err != nil {
+				if stopped(stop) {
+					close(done)
+					log.Println("Pipe (Sim->UI) stopped")
+					return
+				}
 				if err == io.EOF {
 					log.Println("Pipe (Sim->UI) closed by writer. Trying to reestablish connection...")
 					break
 				}
 			}
 
-			data.GetStatsFromRow(line, "|")
-			if config.Cfg.Mode == "SimMode" {
-				data.GetValuesFromRow(line, "|")
+			// Parse the timestamp once, the clock statistics count every row once
+			parsedTime, err := store.ParseRowTime(line, "|")
+			if err != nil {
+				continue
+			}
+			store.GetStatsFromRowAt(line, "|", parsedTime)
+			if values {
+				store.GetValuesFromRowAt(line, "|", parsedTime)
 			}
 		}
 		//only reached when writer closes connection
 		log.Println("Pipe (Sim->UI) disconnected, reconnecting...")
+		events.disconnected()
+		reconnectCounter.Inc("sim")
+		close(done)
 		file.Close()
 	}
 }
 
-// Function to write Msg to Pipe
-func ToUserPipe(pipePath string, id byte, val uint32) {
+var errStopped = errors.New("Pipe handler stopped")
+
+// Open pipe for reading. Opening a named pipe blocks until a writer connects,
+// on stop the open is released by connecting a writer ourselves.
+func openPipe(path string, stop <-chan struct{}) (*os.File, error) {
+	type result struct {
+		file *os.File
+		err  error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		file, err := os.OpenFile(path, os.O_RDONLY, os.ModeNamedPipe)
+		opened <- result{file, err}
+	}()
+	select {
+	case r := <-opened:
+		return r.file, r.err
+	case <-stop:
+		if w, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+			w.Close()
+		}
+		go func() {
+			if r := <-opened; r.file != nil {
+				r.file.Close()
+			}
+		}()
+		return nil, errStopped
+	}
+}
+
+// Close file when stop is closed to release a blocked read, close done when the file is no longer used
+func closeOnStop(file *os.File, stop <-chan struct{}) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			file.Close()
+		case <-done:
+		}
+	}()
+	return done
+}
+
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait for d, return false if stop was closed meanwhile
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Function to write Msg to Pipe, fails instead of blocking if no reader has the pipe open
+func ToUserPipe(pipePath string, id byte, val uint32) error {
 	//Open pipe with Write Only permissions
-	pipe, err := os.OpenFile(pipePath, os.O_WRONLY, os.ModeNamedPipe)
+	pipe, err := os.OpenFile(pipePath, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
 	if err != nil {
-		log.Fatalf("Failed to open file.")
+		return fmt.Errorf("Failed to open pipe %s: %w", pipePath, err)
 	}
 	defer pipe.Close()
 
@@ -94,12 +228,12 @@ func ToUserPipe(pipePath string, id byte, val uint32) {
 	binary.LittleEndian.PutUint32(messageBytes[0:], val)
 
 	//Write 8 byte message to pipe
-	_, err = pipe.Write(messageBytes)
-	if err != nil {
-		log.Fatalf("Failed to write to pipe")
+	if _, err = pipe.Write(messageBytes); err != nil {
+		return fmt.Errorf("Failed to write to pipe %s: %w", pipePath, err)
 	}
 
 	fmt.Printf("Message sent to pipe: %x\n", reverseBytes(messageBytes))
+	return nil
 }
 
 // Helper function to reverse byte order
@@ -0,0 +1,112 @@
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"extruder_web_gui/audit"
+	"net/http"
+)
+
+// Uploaded profiles with the running and finished runs
+type Status struct {
+	Profiles []Profile  `json:"profiles"`
+	Active   *Progress  `json:"active,omitempty"`
+	History  []Progress `json:"history"` //Finished runs, newest last
+}
+
+// Optional body of start, pause, resume and cancel requests
+type Request struct {
+	Operator string `json:"operator"` //Default: X-Operator header or remote address
+	Reason   string `json:"reason"`   //cancel only
+}
+
+// Parse optional request body, the operator defaults to the actor of the request
+func parseRequest(r *http.Request) (Request, error) {
+	var req Request
+	if r.ContentLength != 0 && r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, errors.New("Invalid JSON")
+		}
+	}
+	if req.Operator == "" {
+		req.Operator = audit.Actor(r)
+	}
+	return req, nil
+}
+
+// Answer error of a runner call: 404 for unknown profiles, 409 for everything refused in the current state
+func profileError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrUnknown) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusConflict)
+}
+
+// Handler for /profiles: GET profiles and progress, POST uploads a profile
+func (r *Runner) Handler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Status{Profiles: r.Profiles(), Active: r.Active(), History: r.History()})
+	case http.MethodPost:
+		var p Profile
+		if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := r.Upload(p, audit.Actor(req)); err != nil {
+			if errors.Is(err, ErrBusy) {
+				profileError(w, err)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status": "success"}`))
+	default:
+		http.Error(w, "Nur GET- und POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+	}
+}
+
+// Handler for POST requests calling action with the parsed request
+func (r *Runner) action(action func(req Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := parseRequest(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := action(body); err != nil {
+			profileError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Active())
+	}
+}
+
+// Handler for /profiles/{name}/start
+func (r *Runner) StartHandler(w http.ResponseWriter, req *http.Request) {
+	r.action(func(body Request) error { return r.Start(req.PathValue("name"), body.Operator) })(w, req)
+}
+
+// Handler for /profiles/pause
+func (r *Runner) PauseHandler(w http.ResponseWriter, req *http.Request) {
+	r.action(func(body Request) error { return r.Pause(body.Operator) })(w, req)
+}
+
+// Handler for /profiles/resume
+func (r *Runner) ResumeHandler(w http.ResponseWriter, req *http.Request) {
+	r.action(func(body Request) error { return r.Resume(body.Operator) })(w, req)
+}
+
+// Handler for /profiles/cancel
+func (r *Runner) CancelHandler(w http.ResponseWriter, req *http.Request) {
+	r.action(func(body Request) error { return r.Cancel(body.Operator, body.Reason) })(w, req)
+}
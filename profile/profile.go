@@ -0,0 +1,423 @@
+package profile
+
+import (
+	"errors"
+	"extruder_web_gui/audit"
+	"extruder_web_gui/controls"
+	"extruder_web_gui/ramp"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status of a profile run
+const (
+	StatusRunning   = "running"
+	StatusPaused    = "paused" //Setpoints hold their values, the profile time stands still
+	StatusCompleted = "completed"
+	StatusCancelled = "cancelled"
+	StatusFailed    = "failed" //Command refused or not delivered
+)
+
+// Finished runs kept for /profiles
+const historySize = 20
+
+var (
+	ErrUnknown    = errors.New("Unknown profile")
+	ErrBusy       = errors.New("Another profile is running")
+	ErrNotRunning = errors.New("No profile running")
+	ErrPaused     = errors.New("Profile is paused")
+	ErrNotPaused  = errors.New("Profile is not paused")
+)
+
+// Setpoint change at a time of the profile
+type Point struct {
+	Time     int    `json:"time"` //ms since the start of the profile
+	Command  string `json:"command"`
+	Value    uint32 `json:"value"`
+	Duration int    `json:"duration,omitempty"` //ms, ramp from the previous value of the command to Value, 0 = jump
+}
+
+// Time-based setpoint profile, e.g. a heater profile for a material changeover
+type Profile struct {
+	Name   string  `json:"name"`
+	Points []Point `json:"points"`
+}
+
+// Check points: settable commands with valid values, changes of a command must not overlap
+func (p Profile) Validate() error {
+	if p.Name == "" {
+		return errors.New("Profile name must not be empty")
+	}
+	if len(p.Points) == 0 {
+		return errors.New("Profile needs at least one point")
+	}
+	var errs []error
+	end := map[string]int{} // End of the last change per command
+	for i, pt := range p.sorted() {
+		id, ok := controls.CommandID(pt.Command)
+		switch {
+		case !ok || !controls.Rampable(pt.Command):
+			errs = append(errs, fmt.Errorf("Point %d: %q is no setpoint", i+1, pt.Command))
+			continue
+		case pt.Time < 0 || pt.Duration < 0:
+			errs = append(errs, fmt.Errorf("Point %d: time and duration must not be negative", i+1))
+		case pt.Time < end[pt.Command]:
+			errs = append(errs, fmt.Errorf("Point %d: %s changes before its previous change ended", i+1, pt.Command))
+		}
+		if err := controls.ValidateCommand(id, pt.Value); err != nil {
+			errs = append(errs, fmt.Errorf("Point %d: %w", i+1, err))
+		}
+		end[pt.Command] = pt.Time + pt.Duration
+	}
+	return errors.Join(errs...)
+}
+
+// Points ordered by time
+func (p Profile) sorted() []Point {
+	points := append([]Point{}, p.Points...)
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time < points[j].Time })
+	return points
+}
+
+// Time until the last change ended
+func (p Profile) Length() time.Duration {
+	var length int
+	for _, pt := range p.Points {
+		length = max(length, pt.Time+pt.Duration)
+	}
+	return time.Duration(length) * time.Millisecond
+}
+
+// Commands changed by the profile
+func (p Profile) commands() []string {
+	seen := map[string]bool{}
+	var commands []string
+	for _, pt := range p.sorted() {
+		if !seen[pt.Command] {
+			seen[pt.Command] = true
+			commands = append(commands, pt.Command)
+		}
+	}
+	return commands
+}
+
+// Value of command at elapsed time, start is the value before the first point of the command
+func (p Profile) valueAt(command string, start uint32, elapsed time.Duration) uint32 {
+	ms := float64(elapsed) / float64(time.Millisecond)
+	value := start
+	for _, pt := range p.sorted() {
+		if pt.Command != command {
+			continue
+		}
+		if ms < float64(pt.Time) {
+			break
+		}
+		if ms < float64(pt.Time+pt.Duration) {
+			f := (ms - float64(pt.Time)) / float64(pt.Duration)
+			return uint32(math.Round(float64(value) + (float64(pt.Value)-float64(value))*f))
+		}
+		value = pt.Value
+	}
+	return value
+}
+
+// Progress of a profile run
+type Progress struct {
+	Run       int               `json:"run"` //Number of the run since server start
+	Profile   string            `json:"profile"`
+	Status    string            `json:"status"`
+	Elapsed   int64             `json:"elapsed"` //Profile time in ms, paused time not counted
+	Length    int64             `json:"length"`  //ms
+	Percent   float64           `json:"percent"`
+	Values    map[string]uint32 `json:"values"` //Last value sent per command
+	Message   string            `json:"message,omitempty"`
+	StartedBy string            `json:"startedBy"`
+	Started   time.Time         `json:"started"`
+	Updated   time.Time         `json:"updated"`
+	Finished  *time.Time        `json:"finished,omitempty"`
+}
+
+// Active run with its profile clock
+type run struct {
+	profile  Profile
+	start    map[string]uint32 // Values before the profile started
+	progress Progress
+	elapsed  time.Duration // Profile time until the last pause
+	resumed  time.Time     // Start of the current running period
+	stop     chan struct{} // Closed by Cancel
+	reason   string
+}
+
+// Runner executing one setpoint profile at a time via the controls send path
+type Runner struct {
+	mu       sync.Mutex
+	profiles map[string]Profile
+	active   *run
+	runs     int
+	history  []Progress
+
+	send     func(command string, value uint32) error
+	lastSent func(command string) (uint32, bool)
+	now      func() time.Time
+	interval time.Duration // Time between updates of the setpoints
+	ramps    *ramp.Manager // Ramps of the profile commands are cancelled at the start
+
+	// Optional check before the start and during the run, e.g. latched emergency stop
+	Interlock func() error
+	// Optional check before the start for other owners of the setpoints, e.g. a running sequence
+	Conflict func() error
+}
+
+// Create runner for the default machine, commands go through controls
+func New() *Runner {
+	return &Runner{
+		profiles: map[string]Profile{},
+		send:     controls.SendCommandByName,
+		lastSent: controls.LastCommandValue,
+		now:      time.Now,
+		interval: 250 * time.Millisecond,
+		ramps:    controls.Ramps,
+	}
+}
+
+// Store profile, replacing a profile with the same name unless it is running
+func (r *Runner) Upload(p Profile, actor string) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active != nil && r.active.profile.Name == p.Name {
+		return fmt.Errorf("%w: %s", ErrBusy, p.Name)
+	}
+	r.profiles[p.Name] = p
+	audit.Record(audit.Entry{Actor: actor, Action: "profile.upload", Result: audit.ResultOK, Message: fmt.Sprintf("Profile %s uploaded with %d points", p.Name, len(p.Points))})
+	return nil
+}
+
+// Uploaded profiles ordered by name
+func (r *Runner) Profiles() []Profile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	profiles := make([]Profile, 0, len(r.profiles))
+	for _, p := range r.profiles {
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// Start profile by name on behalf of actor, running ramps of its commands are cancelled
+func (r *Runner) Start(name string, actor string) error {
+	if r.Interlock != nil {
+		if err := r.Interlock(); err != nil {
+			return err
+		}
+	}
+	if r.Conflict != nil {
+		if err := r.Conflict(); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active != nil {
+		return fmt.Errorf("%w: %s", ErrBusy, r.active.profile.Name)
+	}
+	p, ok := r.profiles[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknown, name)
+	}
+	r.runs++
+	now := r.now()
+	a := &run{profile: p, start: map[string]uint32{}, resumed: now, stop: make(chan struct{})}
+	values := map[string]uint32{}
+	for _, command := range p.commands() {
+		if r.ramps != nil {
+			r.ramps.Cancel(command)
+		}
+		a.start[command], _ = r.lastSent(command)
+		values[command] = a.start[command]
+	}
+	a.progress = Progress{Run: r.runs, Profile: name, Status: StatusRunning, Length: p.Length().Milliseconds(), Values: values, StartedBy: actor, Started: now, Updated: now}
+	r.active = a
+	audit.Record(audit.Entry{Actor: actor, Action: "profile.start", Result: audit.ResultOK, Message: "Profile " + name + " started"})
+	go r.execute(a)
+	return nil
+}
+
+// Pause running profile, the setpoints hold their current values
+func (r *Runner) Pause(actor string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a := r.active
+	if a == nil {
+		return ErrNotRunning
+	}
+	if a.progress.Status == StatusPaused {
+		return ErrPaused
+	}
+	now := r.now()
+	a.elapsed += now.Sub(a.resumed)
+	a.progress.Status, a.progress.Elapsed, a.progress.Updated = StatusPaused, a.elapsed.Milliseconds(), now
+	audit.Record(audit.Entry{Actor: actor, Action: "profile.pause", Result: audit.ResultOK, Message: "Profile " + a.profile.Name + " paused"})
+	return nil
+}
+
+// Resume paused profile where it was paused
+func (r *Runner) Resume(actor string) error {
+	if r.Interlock != nil {
+		if err := r.Interlock(); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a := r.active
+	if a == nil {
+		return ErrNotRunning
+	}
+	if a.progress.Status != StatusPaused {
+		return ErrNotPaused
+	}
+	a.resumed = r.now()
+	a.progress.Status, a.progress.Updated = StatusRunning, a.resumed
+	audit.Record(audit.Entry{Actor: actor, Action: "profile.resume", Result: audit.ResultOK, Message: "Profile " + a.profile.Name + " resumed"})
+	return nil
+}
+
+// Cancel running or paused profile, the setpoints keep their last values
+func (r *Runner) Cancel(actor string, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a := r.active
+	if a == nil {
+		return ErrNotRunning
+	}
+	select {
+	case <-a.stop:
+		return nil // Already cancelling
+	default:
+	}
+	if reason == "" {
+		reason = "Cancelled by " + actor
+	}
+	a.reason = reason
+	close(a.stop)
+	audit.Record(audit.Entry{Actor: actor, Action: "profile.cancel", Result: audit.ResultOK, Message: fmt.Sprintf("Profile %s cancelled: %s", a.profile.Name, reason)})
+	return nil
+}
+
+// Progress of the running profile, nil if none runs
+func (r *Runner) Active() *Progress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active == nil {
+		return nil
+	}
+	p := r.active.progress
+	p.Values = copyValues(p.Values)
+	return &p
+}
+
+// Finished runs, newest last
+func (r *Runner) History() []Progress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Progress{}, r.history...)
+}
+
+func copyValues(values map[string]uint32) map[string]uint32 {
+	c := make(map[string]uint32, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
+
+// Profile time of the run, requires r.mu
+func (r *Runner) elapsed(a *run) time.Duration {
+	if a.progress.Status == StatusPaused {
+		return a.elapsed
+	}
+	return a.elapsed + r.now().Sub(a.resumed)
+}
+
+// Send the profile values every interval until the profile ended, failed or was cancelled
+func (r *Runner) execute(a *run) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	length := a.profile.Length()
+	status, message := StatusCompleted, "Profile completed"
+	for done := false; !done; {
+		if r.Interlock != nil {
+			if err := r.Interlock(); err != nil {
+				status, message = StatusFailed, err.Error()
+				break
+			}
+		}
+		r.mu.Lock()
+		paused := a.progress.Status == StatusPaused
+		elapsed := min(r.elapsed(a), length)
+		values := copyValues(a.progress.Values)
+		r.mu.Unlock()
+
+		if !paused {
+			var err error
+			for _, command := range a.profile.commands() {
+				v := a.profile.valueAt(command, a.start[command], elapsed)
+				if v == values[command] {
+					continue
+				}
+				if err = r.send(command, v); err != nil {
+					break
+				}
+				values[command] = v
+			}
+			r.mu.Lock()
+			a.progress.Values, a.progress.Elapsed, a.progress.Updated = values, elapsed.Milliseconds(), r.now()
+			if length > 0 {
+				a.progress.Percent = math.Round(float64(elapsed)/float64(length)*1000) / 10
+			} else {
+				a.progress.Percent = 100
+			}
+			r.mu.Unlock()
+			if err != nil {
+				status, message = StatusFailed, err.Error()
+				break
+			}
+			done = elapsed >= length
+		}
+		if !done {
+			select {
+			case <-a.stop:
+				status, message, done = StatusCancelled, a.reason, true
+			case <-ticker.C:
+			}
+		}
+	}
+
+	r.mu.Lock()
+	now := r.now()
+	a.progress.Status, a.progress.Message, a.progress.Finished, a.progress.Updated = status, message, &now, now
+	r.active = nil
+	r.history = append(r.history, a.progress)
+	if len(r.history) > historySize {
+		r.history = r.history[len(r.history)-historySize:]
+	}
+	r.mu.Unlock()
+	if status != StatusCompleted {
+		log.Printf("Profile %s %s at %d ms: %s", a.profile.Name, status, a.progress.Elapsed, message)
+	}
+	if status != StatusCancelled {
+		result := audit.ResultOK
+		if status == StatusFailed {
+			result = audit.ResultFailed
+		}
+		audit.Record(audit.Entry{Actor: "profile", Action: "profile.finish", Result: result, Message: fmt.Sprintf("Profile %s %s: %s", a.profile.Name, status, message)})
+	}
+}
@@ -0,0 +1,207 @@
+package profile
+
+import (
+	"errors"
+	"extruder_web_gui/ramp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var changeover = Profile{
+	Name: "changeover",
+	Points: []Point{
+		{Time: 0, Command: "heater_pwm", Value: 60, Duration: 100},
+		{Time: 200, Command: "heater_pwm", Value: 40},
+		{Time: 50, Command: "screw_rpm", Value: 20},
+	},
+}
+
+// Runner recording the last sent value per command
+func testRunner(t *testing.T) (*Runner, func() map[string]uint32) {
+	r := New()
+	r.interval = 5 * time.Millisecond
+	var mu sync.Mutex
+	last := map[string]uint32{"heater_pwm": 20}
+	r.send = func(command string, value uint32) error {
+		mu.Lock()
+		defer mu.Unlock()
+		last[command] = value
+		return nil
+	}
+	r.lastSent = func(command string) (uint32, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		v, ok := last[command]
+		return v, ok
+	}
+	if err := r.Upload(changeover, "operator1"); err != nil {
+		t.Fatal(err)
+	}
+	return r, func() map[string]uint32 {
+		mu.Lock()
+		defer mu.Unlock()
+		return copyValues(last)
+	}
+}
+
+// Wait until no profile runs or fail after a second
+func waitFinished(t *testing.T, r *Runner) Progress {
+	deadline := time.Now().Add(time.Second)
+	for r.Active() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Profile still running: %+v", r.Active())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	h := r.History()
+	return h[len(h)-1]
+}
+
+// Test for valueAt: ramp from the start value, jumps, value held after the last point
+func TestProfile_ValueAt(t *testing.T) {
+	tests := []struct {
+		command  string
+		elapsed  time.Duration
+		expected uint32
+	}{
+		{"heater_pwm", 0, 20},
+		{"heater_pwm", 50 * time.Millisecond, 40},
+		{"heater_pwm", 150 * time.Millisecond, 60},
+		{"heater_pwm", 250 * time.Millisecond, 40},
+		{"screw_rpm", 49 * time.Millisecond, 0},
+		{"screw_rpm", 50 * time.Millisecond, 20},
+	}
+	for _, tc := range tests {
+		if got := changeover.valueAt(tc.command, map[string]uint32{"heater_pwm": 20}[tc.command], tc.elapsed); got != tc.expected {
+			t.Errorf("%s at %v: Expected: %v, received: %v", tc.command, tc.elapsed, tc.expected, got)
+		}
+	}
+	if changeover.Length() != 200*time.Millisecond {
+		t.Errorf("Length. Expected: %v, received: %v", 200*time.Millisecond, changeover.Length())
+	}
+}
+
+// Test for Validate: unknown commands, values out of range and overlapping ramps
+func TestProfile_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile Profile
+	}{
+		{"Without name", Profile{Points: changeover.Points}},
+		{"Without points", Profile{Name: "x"}},
+		{"No setpoint", Profile{Name: "x", Points: []Point{{Command: "start", Value: 1}}}},
+		{"Out of range", Profile{Name: "x", Points: []Point{{Command: "heater_pwm", Value: 101}}}},
+		{"Overlap", Profile{Name: "x", Points: []Point{{Command: "heater_pwm", Value: 50, Duration: 100}, {Time: 50, Command: "heater_pwm", Value: 60}}}},
+	}
+	for _, tc := range tests {
+		if err := tc.profile.Validate(); err == nil {
+			t.Errorf("%s: Expected error", tc.name)
+		}
+	}
+	if err := changeover.Validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// Test for Runner: profile runs to its last values, pause holds the profile time
+func TestRunner_Run(t *testing.T) {
+	r, last := testRunner(t)
+	if err := r.Start("changeover", "operator1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start("changeover", "operator1"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected: %v, received: %v", ErrBusy, err)
+	}
+	if err := r.Resume("operator1"); !errors.Is(err, ErrNotPaused) {
+		t.Errorf("Expected: %v, received: %v", ErrNotPaused, err)
+	}
+	if err := r.Pause("operator1"); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := r.Active().Elapsed
+	time.Sleep(250 * time.Millisecond)
+	if p := r.Active(); p == nil || p.Status != StatusPaused || p.Elapsed != elapsed {
+		t.Fatalf("Profile did not hold while paused: %+v", p)
+	}
+	if err := r.Resume("operator1"); err != nil {
+		t.Fatal(err)
+	}
+	p := waitFinished(t, r)
+	if p.Status != StatusCompleted || p.Percent != 100 {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+	if got := last(); got["heater_pwm"] != 40 || got["screw_rpm"] != 20 {
+		t.Errorf("Unexpected final values: %v", got)
+	}
+}
+
+// Test for Runner: cancel and failed commands end the run
+func TestRunner_CancelAndFail(t *testing.T) {
+	r, _ := testRunner(t)
+	r.Start("changeover", "operator1")
+	if err := r.Cancel("operator2", "Wrong material"); err != nil {
+		t.Fatal(err)
+	}
+	if p := waitFinished(t, r); p.Status != StatusCancelled || p.Message != "Wrong material" {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+
+	r.send = func(string, uint32) error { return errors.New("Emergency stop latched") }
+	r.Start("changeover", "operator1")
+	if p := waitFinished(t, r); p.Status != StatusFailed || p.Message != "Emergency stop latched" {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+}
+
+// Test for Start: other owners of the setpoints refuse the start, ramps of the profile commands are cancelled
+func TestRunner_Conflicts(t *testing.T) {
+	r, _ := testRunner(t)
+	r.Conflict = func() error { return errors.New("Sequence startup is running") }
+	if err := r.Start("changeover", "operator1"); err == nil || r.Active() != nil {
+		t.Errorf("Start during a sequence should be refused, received: %v", err)
+	}
+
+	r.Conflict = nil
+	r.ramps = ramp.NewManager(r.send, r.lastSent)
+	r.ramps.Start("screw_rpm", 200, time.Hour)
+	if err := r.Start("changeover", "operator1"); err != nil {
+		t.Fatal(err)
+	}
+	if s := r.ramps.Status()["screw_rpm"]; s.Status != ramp.StatusCancelled {
+		t.Errorf("Ramp of a profile command. Expected: %v, received: %v", ramp.StatusCancelled, s.Status)
+	}
+	r.Cancel("operator1", "")
+	waitFinished(t, r)
+}
+
+// Test for handlers: upload, unknown profile, nothing to pause, POST only
+func TestHandlers(t *testing.T) {
+	r, _ := testRunner(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/profiles", r.Handler)
+	mux.HandleFunc("/profiles/{name}/start", r.StartHandler)
+	mux.HandleFunc("/profiles/pause", r.PauseHandler)
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/profiles", `{"name": "purge", "points": [{"time": 0, "command": "screw_rpm", "value": 10}]}`, http.StatusOK},
+		{"POST", "/profiles", `{"name": "purge", "points": [{"time": 0, "command": "screw_rpm", "value": 5000}]}`, http.StatusBadRequest},
+		{"POST", "/profiles/warmup/start", "", http.StatusNotFound},
+		{"GET", "/profiles/purge/start", "", http.StatusMethodNotAllowed},
+		{"POST", "/profiles/pause", "", http.StatusConflict},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if w.Code != tc.code {
+			t.Errorf("%s %s: Expected: %d, received: %d (%s)", tc.method, tc.path, tc.code, w.Code, w.Body.String())
+		}
+	}
+	if profiles := r.Profiles(); len(profiles) != 2 || profiles[1].Name != "purge" {
+		t.Errorf("Unexpected profiles: %+v", profiles)
+	}
+}
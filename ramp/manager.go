@@ -0,0 +1,166 @@
+package ramp
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Status of a ramp
+const (
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusCancelled = "cancelled" //Replaced by a new command or cancelled by an operator
+	StatusFailed    = "failed"    //Intermediate command refused or not delivered
+)
+
+// Progress of the ramp of one command
+type Progress struct {
+	Command  string     `json:"command"`
+	From     uint32     `json:"from"`
+	To       uint32     `json:"to"`
+	Value    uint32     `json:"value"`    //Last value sent
+	Duration int64      `json:"duration"` //ms
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Running ramp with its stop channel, done is closed when the ramp goroutine has finished
+type active struct {
+	progress Progress
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Ramps of the setpoints of one machine, at most one per command
+type Manager struct {
+	mu     sync.Mutex
+	ramps  map[string]*active
+	recent map[string]Progress // Last finished ramp per command
+
+	send     func(command string, value uint32) error
+	lastSent func(command string) (uint32, bool)
+	now      func() time.Time
+	interval time.Duration
+}
+
+// Create manager sending intermediate commands via send, ramps start at the last sent value
+func NewManager(send func(command string, value uint32) error, lastSent func(command string) (uint32, bool)) *Manager {
+	return &Manager{
+		ramps:    map[string]*active{},
+		recent:   map[string]Progress{},
+		send:     send,
+		lastSent: lastSent,
+		now:      time.Now,
+		interval: DefaultInterval,
+	}
+}
+
+// Duration of a ramp from one value to another at rate units per second, 0 for a rate <= 0
+func ForRate(from uint32, to uint32, rate float64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(math.Abs(float64(to)-float64(from)) / rate * float64(time.Second))
+}
+
+// Value the next ramp of command starts at
+func (m *Manager) From(command string) uint32 {
+	from, _ := m.lastSent(command)
+	return from
+}
+
+// Start ramp of command to value over duration, replacing a running ramp of the command
+func (m *Manager) Start(command string, to uint32, duration time.Duration) Progress {
+	m.Cancel(command)
+	from := m.From(command)
+	a := &active{
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		progress: Progress{Command: command, From: from, To: to, Value: from, Duration: duration.Milliseconds(), Status: StatusRunning, Started: m.now()},
+	}
+	m.mu.Lock()
+	m.ramps[command] = a
+	p := a.progress
+	m.mu.Unlock()
+
+	go func() {
+		err := Run(Ramp{From: from, To: to, Duration: duration, Interval: m.interval}, func(v uint32) error {
+			if err := m.send(command, v); err != nil {
+				return err
+			}
+			m.mu.Lock()
+			a.progress.Value = v
+			m.mu.Unlock()
+			return nil
+		}, a.stop)
+		m.finish(a, err)
+		close(a.done)
+	}()
+	return p
+}
+
+// Record the end of a ramp
+func (m *Manager) finish(a *active, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	a.progress.Finished = &now
+	switch {
+	case err == ErrStopped:
+		a.progress.Status = StatusCancelled
+	case err != nil:
+		a.progress.Status, a.progress.Error = StatusFailed, err.Error()
+	default:
+		a.progress.Status = StatusCompleted
+	}
+	if m.ramps[a.progress.Command] == a {
+		delete(m.ramps, a.progress.Command)
+	}
+	m.recent[a.progress.Command] = a.progress
+}
+
+// Stop running ramp of command at its current value, false if none runs.
+// Returns after the last intermediate command of the ramp has been sent.
+func (m *Manager) Cancel(command string) bool {
+	m.mu.Lock()
+	a, ok := m.ramps[command]
+	if ok {
+		delete(m.ramps, command)
+	}
+	m.mu.Unlock()
+	if ok {
+		close(a.stop)
+		<-a.done
+	}
+	return ok
+}
+
+// Stop all running ramps
+func (m *Manager) CancelAll() {
+	m.mu.Lock()
+	commands := make([]string, 0, len(m.ramps))
+	for command := range m.ramps {
+		commands = append(commands, command)
+	}
+	m.mu.Unlock()
+	for _, command := range commands {
+		m.Cancel(command)
+	}
+}
+
+// Running ramps and the last finished ramp of every other command
+func (m *Manager) Status() map[string]Progress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := map[string]Progress{}
+	for command, p := range m.recent {
+		status[command] = p
+	}
+	for command, a := range m.ramps {
+		status[command] = a.progress
+	}
+	return status
+}
@@ -0,0 +1,76 @@
+package ramp
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Interval between intermediate commands if none is set
+const DefaultInterval = 250 * time.Millisecond
+
+// Ramp stopped before the target was reached
+var ErrStopped = errors.New("Ramp stopped")
+
+// Linear change of a command value over time
+type Ramp struct {
+	From     uint32
+	To       uint32
+	Duration time.Duration
+	Interval time.Duration // Time between intermediate commands, default DefaultInterval
+}
+
+func (r Ramp) interval() time.Duration {
+	if r.Interval <= 0 {
+		return DefaultInterval
+	}
+	return r.Interval
+}
+
+// Number of intervals, at least 1
+func (r Ramp) steps() int {
+	return max(1, int(math.Ceil(float64(r.Duration)/float64(r.interval()))))
+}
+
+// Value after step i of n
+func (r Ramp) value(i int, n int) uint32 {
+	return uint32(math.Round(float64(r.From) + (float64(r.To)-float64(r.From))*float64(i)/float64(n)))
+}
+
+// Values of the intermediate commands, the last value is To. Repeated values are skipped.
+func (r Ramp) Values() []uint32 {
+	var values []uint32
+	n := r.steps()
+	for i := 1; i <= n; i++ {
+		if v := r.value(i, n); len(values) == 0 || values[len(values)-1] != v {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Send a value after each interval until To was sent after Duration, a ramp without duration sends To at once.
+// Returns ErrStopped if stop is closed first or the error of a failed send.
+func Run(r Ramp, send func(val uint32) error, stop <-chan struct{}) error {
+	if r.Duration <= 0 {
+		return send(r.To)
+	}
+	ticker := time.NewTicker(r.interval())
+	defer ticker.Stop()
+	n := r.steps()
+	last := r.From
+	for i := 1; i <= n; i++ {
+		select {
+		case <-stop:
+			return ErrStopped
+		case <-ticker.C:
+		}
+		if v := r.value(i, n); v != last || i == n {
+			if err := send(v); err != nil {
+				return err
+			}
+			last = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package ramp
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test for Values: linear steps, repeated values skipped
+func TestRamp_Values(t *testing.T) {
+	tests := []struct {
+		name     string
+		ramp     Ramp
+		expected []uint32
+	}{
+		{"Up", Ramp{From: 0, To: 100, Duration: time.Second}, []uint32{25, 50, 75, 100}},
+		{"Down", Ramp{From: 100, To: 40, Duration: 3 * time.Second, Interval: time.Second}, []uint32{80, 60, 40}},
+		{"Small change", Ramp{From: 10, To: 11, Duration: time.Second}, []uint32{10, 11}},
+		{"Without duration", Ramp{From: 10, To: 50}, []uint32{50}},
+	}
+	for _, tc := range tests {
+		if got := tc.ramp.Values(); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: Expected: %v, received: %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+// Test for Run: values sent in order, stop and failed send end the ramp
+func TestRun(t *testing.T) {
+	var sent []uint32
+	send := func(v uint32) error {
+		sent = append(sent, v)
+		return nil
+	}
+	r := Ramp{From: 0, To: 30, Duration: 30 * time.Millisecond, Interval: 10 * time.Millisecond}
+	if err := Run(r, send, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sent, []uint32{10, 20, 30}) {
+		t.Errorf("Expected: %v, received: %v", []uint32{10, 20, 30}, sent)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if err := Run(r, send, stop); !errors.Is(err, ErrStopped) {
+		t.Errorf("Expected: %v, received: %v", ErrStopped, err)
+	}
+
+	failed := errors.New("Pipe closed")
+	if err := Run(r, func(uint32) error { return failed }, nil); !errors.Is(err, failed) {
+		t.Errorf("Expected: %v, received: %v", failed, err)
+	}
+}
+
+// Test for Manager: ramp starts at the last sent value, a new ramp replaces the running one
+func TestManager(t *testing.T) {
+	var mu sync.Mutex
+	last := map[string]uint32{"screw_rpm": 10}
+	m := NewManager(func(command string, v uint32) error {
+		mu.Lock()
+		defer mu.Unlock()
+		last[command] = v
+		return nil
+	}, func(command string) (uint32, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		v, ok := last[command]
+		return v, ok
+	})
+	m.interval = 5 * time.Millisecond
+
+	p := m.Start("screw_rpm", 50, time.Hour)
+	if p.From != 10 || p.Status != StatusRunning {
+		t.Errorf("Unexpected start: %+v", p)
+	}
+	m.Start("screw_rpm", 30, 20*time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for m.Status()["screw_rpm"].Status == StatusRunning && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s := m.Status()["screw_rpm"]; s.Status != StatusCompleted || s.Value != 30 {
+		t.Errorf("Expected completed ramp at 30, received: %+v", s)
+	}
+	if m.Cancel("screw_rpm") {
+		t.Errorf("Cancel without running ramp should return false")
+	}
+
+	if d := ForRate(10, 30, 4); d != 5*time.Second {
+		t.Errorf("ForRate. Expected: %v, received: %v", 5*time.Second, d)
+	}
+}
+
+// Test for Manager.Cancel: returns only after the intermediate command being sent is delivered
+func TestManager_CancelWaits(t *testing.T) {
+	sending, release := make(chan struct{}, 1), make(chan struct{})
+	m := NewManager(func(command string, v uint32) error {
+		select {
+		case sending <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	}, func(string) (uint32, bool) { return 0, true })
+	m.interval = time.Millisecond
+
+	m.Start("screw_rpm", 50, 50*time.Millisecond) // Blocked in the first send until released
+	<-sending
+	cancelled := make(chan bool)
+	go func() { cancelled <- m.Cancel("screw_rpm") }()
+	select {
+	case <-cancelled:
+		t.Fatalf("Cancel returned while a command was being sent")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if ok := <-cancelled; !ok {
+		t.Errorf("Expected: %v, received: %v", true, ok)
+	}
+	if s := m.Status()["screw_rpm"]; s.Status != StatusCancelled {
+		t.Errorf("Expected: %v, received: %v", StatusCancelled, s.Status)
+	}
+}
@@ -0,0 +1,396 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Limits keeping expressions small, they are evaluated on every data update
+const (
+	maxExprLength = 500
+	maxExprDepth  = 32
+)
+
+// Compiled expression over named numeric values. Comparisons and logic yield 1 (true) or 0 (false),
+// there are no assignments, loops or calls other than the functions below.
+type Expr struct {
+	src   string
+	root  node
+	names []string // Identifiers used, in order of appearance
+}
+
+// Values available to an expression
+type Env func(name string) (float64, bool)
+
+type node interface {
+	eval(env Env) (float64, error)
+}
+
+type number float64
+
+type ident string
+
+type unary struct {
+	op string
+	x  node
+}
+
+type binary struct {
+	op   string
+	x, y node
+}
+
+type call struct {
+	fn   string
+	args []node
+}
+
+// Functions callable from expressions with their number of arguments
+var functions = map[string]struct {
+	args int
+	fn   func(args []float64) float64
+}{
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"min":   {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max":   {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+	"clamp": {3, func(a []float64) float64 { return math.Max(a[1], math.Min(a[2], a[0])) }},
+}
+
+// Compile expression, known reports the identifiers that may be used
+func Compile(src string, known func(name string) bool) (*Expr, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, errors.New("Expression is empty")
+	}
+	if len(src) > maxExprLength {
+		return nil, fmt.Errorf("Expression longer than %d characters", maxExprLength)
+	}
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, known: known}
+	root, err := p.or(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected %q", p.tokens[p.pos])
+	}
+	return &Expr{src: src, root: root, names: p.names}, nil
+}
+
+// Evaluate expression with the values of env
+func (e *Expr) Eval(env Env) (float64, error) {
+	v, err := e.root.eval(env)
+	if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		err = fmt.Errorf("%s is not a number", e.src)
+	}
+	return v, err
+}
+
+// Evaluate expression as condition, true for every value other than 0
+func (e *Expr) True(env Env) (bool, error) {
+	v, err := e.Eval(env)
+	return v != 0, err
+}
+
+// Identifiers used by the expression
+func (e *Expr) Names() []string {
+	return e.names
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+func (n number) eval(Env) (float64, error) {
+	return float64(n), nil
+}
+
+func (n ident) eval(env Env) (float64, error) {
+	v, ok := env(string(n))
+	if !ok {
+		return 0, fmt.Errorf("No value for %s", string(n))
+	}
+	return v, nil
+}
+
+func boolean(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (n unary) eval(env Env) (float64, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	if n.op == "-" {
+		return -x, nil
+	}
+	return boolean(x == 0), nil
+}
+
+func (n binary) eval(env Env) (float64, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	// Short circuit: the right side may have no value yet
+	switch {
+	case n.op == "&&" && x == 0:
+		return 0, nil
+	case n.op == "||" && x != 0:
+		return 1, nil
+	}
+	y, err := n.y.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/", "%":
+		if y == 0 {
+			return 0, errors.New("Division by zero")
+		}
+		if n.op == "%" {
+			return math.Mod(x, y), nil
+		}
+		return x / y, nil
+	case "<":
+		return boolean(x < y), nil
+	case "<=":
+		return boolean(x <= y), nil
+	case ">":
+		return boolean(x > y), nil
+	case ">=":
+		return boolean(x >= y), nil
+	case "==":
+		return boolean(x == y), nil
+	case "!=":
+		return boolean(x != y), nil
+	default: // && and || with the left side decided above
+		return boolean(y != 0), nil
+	}
+}
+
+func (n call) eval(env Env) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	return functions[n.fn].fn(args), nil
+}
+
+// Split source into numbers, identifiers, operators and parentheses
+func tokenize(src string) ([]string, error) {
+	var tokens []string
+	runes := []rune(src)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		default:
+			if i+1 < len(runes) {
+				if two := string(runes[i : i+2]); two == "<=" || two == ">=" || two == "==" || two == "!=" || two == "&&" || two == "||" {
+					tokens = append(tokens, two)
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%<>!(),", r) {
+				return nil, fmt.Errorf("Unexpected character %q", r)
+			}
+			tokens = append(tokens, string(r))
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// Recursive descent parser, one method per precedence level
+type parser struct {
+	tokens []string
+	pos    int
+	known  func(name string) bool
+	names  []string
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// Keywords "and", "or", "not" are accepted for &&, ||, !
+func (p *parser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	switch t {
+	case "and":
+		t = "&&"
+	case "or":
+		t = "||"
+	case "not":
+		t = "!"
+	}
+	for _, op := range ops {
+		if t == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+// Parse binary operators of a level, operand parses the next higher level
+func (p *parser) level(depth int, operand func(int) (node, error), ops ...string) (node, error) {
+	x, err := operand(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return x, nil
+		}
+		y, err := operand(depth)
+		if err != nil {
+			return nil, err
+		}
+		x = binary{op: op, x: x, y: y}
+	}
+}
+
+func (p *parser) or(depth int) (node, error) {
+	if depth > maxExprDepth {
+		return nil, errors.New("Expression nested too deeply")
+	}
+	return p.level(depth, p.and, "||")
+}
+
+func (p *parser) and(depth int) (node, error) {
+	return p.level(depth, p.comparison, "&&")
+}
+
+func (p *parser) comparison(depth int) (node, error) {
+	return p.level(depth, p.sum, "<=", ">=", "<", ">", "==", "!=")
+}
+
+func (p *parser) sum(depth int) (node, error) {
+	return p.level(depth, p.product, "+", "-")
+}
+
+func (p *parser) product(depth int) (node, error) {
+	return p.level(depth, p.unary, "*", "/", "%")
+}
+
+func (p *parser) unary(depth int) (node, error) {
+	if op, ok := p.accept("-", "!"); ok {
+		if depth > maxExprDepth {
+			return nil, errors.New("Expression nested too deeply")
+		}
+		x, err := p.unary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return unary{op: op, x: x}, nil
+	}
+	return p.primary(depth)
+}
+
+func (p *parser) primary(depth int) (node, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, errors.New("Unexpected end of expression")
+	case t == "(":
+		x, err := p.or(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("Missing )")
+		}
+		return x, nil
+	case t == "true" || t == "false":
+		return number(boolean(t == "true")), nil
+	case unicode.IsDigit(rune(t[0])) || t[0] == '.':
+		v, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %q", t)
+		}
+		return number(v), nil
+	case unicode.IsLetter(rune(t[0])) || t[0] == '_':
+		if p.peek() == "(" {
+			return p.call(t, depth)
+		}
+		if p.known != nil && !p.known(t) {
+			return nil, fmt.Errorf("Unknown name %q", t)
+		}
+		p.names = append(p.names, t)
+		return ident(t), nil
+	}
+	return nil, fmt.Errorf("Unexpected %q", t)
+}
+
+func (p *parser) call(name string, depth int) (node, error) {
+	f, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown function %q", name)
+	}
+	p.next() // (
+	var args []node
+	for p.peek() != ")" {
+		if len(args) > 0 && p.next() != "," {
+			return nil, fmt.Errorf("Missing , in %s()", name)
+		}
+		arg, err := p.or(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next() // )
+	if len(args) != f.args {
+		return nil, fmt.Errorf("%s() takes %d arguments, received %d", name, f.args, len(args))
+	}
+	return call{fn: name, args: args}, nil
+}
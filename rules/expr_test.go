@@ -0,0 +1,66 @@
+package rules
+
+import (
+	"testing"
+)
+
+func testEnv(name string) (float64, bool) {
+	v, ok := map[string]float64{"diameter": 1.85, "screw_rpm": 100, "filamentMass": 1000}[name]
+	return v, ok
+}
+
+// Test for Eval: precedence, comparisons, logic and functions
+func TestExpr_Eval(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"-2 * -3", 6},
+		{"7 % 4", 3},
+		{"screw_rpm * 0.98", 98},
+		{"diameter > 1.80", 1},
+		{"diameter > 1.80 && filamentMass >= 1000", 1},
+		{"diameter > 1.90 or not (filamentMass < 1000)", 1},
+		{"!true", 0},
+		{"abs(1.75 - diameter) <= 0.05", 0},
+		{"clamp(screw_rpm * 2, 0, 150)", 150},
+		{"max(min(3, 4), 2)", 3},
+		{"round(diameter * 10)", 19},
+		{"false && missing > 0", 0}, // Short circuit, missing has no value
+	}
+	for _, tc := range tests {
+		e, err := Compile(tc.src, nil)
+		if err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		if got, err := e.Eval(testEnv); err != nil || got != tc.expected {
+			t.Errorf("%s: Expected: %v, received: %v (%v)", tc.src, tc.expected, got, err)
+		}
+	}
+}
+
+// Test for Compile and Eval: invalid expressions and missing values
+func TestExpr_Errors(t *testing.T) {
+	known := func(name string) bool { _, ok := testEnv(name); return ok || name == "missing" }
+	deep := ""
+	for range maxExprDepth + 1 {
+		deep += "("
+	}
+	for _, src := range []string{"", "diameter >", "(1 + 2", "1 2", "speed > 3", "exec(1)", "min(1)", "diameter = 1", "1 # 2", deep + "1"} {
+		if _, err := Compile(src, known); err == nil {
+			t.Errorf("%q should not compile", src)
+		}
+	}
+	for _, src := range []string{"missing + 1", "1 / (screw_rpm - 100)"} {
+		e, err := Compile(src, known)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.Eval(testEnv); err == nil {
+			t.Errorf("%q should fail to evaluate", src)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"extruder_web_gui/audit"
+	"net/http"
+)
+
+// Handler for /rules: GET rules with their state, POST adds or replaces a rule
+func (e *Engine) Handler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e.Rules())
+	case http.MethodPost:
+		var def Rule
+		if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		e.put(w, r, def)
+	default:
+		http.Error(w, "Nur GET- und POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+	}
+}
+
+// Handler for /rules/{name}: GET rule, PUT replaces it, DELETE removes it
+func (e *Engine) RuleHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodGet:
+		status, ok := e.Get(name)
+		if !ok {
+			http.Error(w, ErrUnknown.Error()+": "+name, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case http.MethodPut:
+		var def Rule
+		if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		def.Name = name
+		e.put(w, r, def)
+	case http.MethodDelete:
+		if err := e.Delete(name); err != nil {
+			if errors.Is(err, ErrUnknown) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		audit.Record(audit.Entry{Actor: audit.Actor(r), Action: "rules.delete", Result: audit.ResultOK, Message: "Rule " + name + " deleted"})
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status": "success"}`))
+	default:
+		http.Error(w, "Nur GET-, PUT- und DELETE-Anfragen erlaubt", http.StatusMethodNotAllowed)
+	}
+}
+
+// Store rule and answer with its state, invalid rules are rejected with 400
+func (e *Engine) put(w http.ResponseWriter, r *http.Request, def Rule) {
+	if err := e.Put(def); err != nil {
+		audit.Record(audit.Entry{Actor: audit.Actor(r), Action: "rules.put", Result: audit.ResultRejected, Message: err.Error(), Fields: map[string]string{"rule": def.Name}})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	audit.Record(audit.Entry{Actor: audit.Actor(r), Action: "rules.put", Result: audit.ResultOK, Message: "Rule " + def.Name + " saved: " + def.When})
+	status, _ := e.Get(def.Name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,499 @@
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/controls"
+	"extruder_web_gui/data"
+	"extruder_web_gui/eventlog"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults if not configured
+const (
+	defaultMaxActionsPerMinute = 30
+	defaultCooldown            = 10 * time.Second
+)
+
+// Action types
+var ActionTypes = []string{"control", "alarm", "log"}
+
+var ErrUnknown = errors.New("Unknown rule")
+
+// Automation rule: when the condition held for For ms, the actions run
+type Rule struct {
+	Name     string   `json:"name"`
+	When     string   `json:"when"`               //Condition, e.g. "diameter > 1.80"
+	For      int      `json:"for,omitempty"`      //ms the condition must hold before the actions run, also between repeats
+	Cooldown int      `json:"cooldown,omitempty"` //ms between two firings, 0 = rules.defaultCooldown
+	Disabled bool     `json:"disabled,omitempty"`
+	Actions  []Action `json:"actions"`
+}
+
+// Action of a rule
+type Action struct {
+	Type     string `json:"type"`               //Options "control", "alarm", "log"
+	Command  string `json:"command,omitempty"`  //control: command name, e.g. "screw_rpm"
+	Value    string `json:"value,omitempty"`    //control: expression, e.g. "screw_rpm * 0.98", clamped to the command range
+	Severity string `json:"severity,omitempty"` //alarm: "info", "warning" (default), "critical"
+	Message  string `json:"message,omitempty"`  //alarm, log: text, {expression} is replaced by its value
+}
+
+// Rule with its evaluation state, served by /rules
+type Status struct {
+	Rule
+	Active     bool       `json:"active"` //Condition true at the last evaluation
+	Since      *time.Time `json:"since,omitempty"`
+	LastFired  *time.Time `json:"lastFired,omitempty"`
+	Fired      int        `json:"fired"`
+	Suppressed int        `json:"suppressed"`            //Firings dropped by the action rate limit
+	Error      string     `json:"error,omitempty"`       //Evaluation error, e.g. no good value for a signal
+	ActionErr  string     `json:"actionError,omitempty"` //Error of the last firing
+}
+
+// Message with {expression} placeholders
+type template struct {
+	text  []string // Text before each expression and after the last one
+	exprs []*Expr
+}
+
+// Action with compiled expressions
+type action struct {
+	Action
+	value   *Expr
+	message template
+}
+
+// Rule with compiled expressions and state
+type rule struct {
+	status      Status
+	when        *Expr
+	actions     []action
+	since       time.Time // Condition holding since, zero if false
+	lastAttempt time.Time // Last firing incl. suppressed ones, start of the cooldown
+}
+
+// Engine evaluating the rules of the default machine on each data update
+type Engine struct {
+	mu      sync.Mutex
+	cfg     config.RulesConfig
+	rules   []*rule     // In order of creation
+	actions []time.Time // Actions of the last minute for the rate limit
+
+	store    *data.Store
+	send     func(command string, value uint32) error
+	lastSent func(command string) (uint32, bool)
+	now      func() time.Time
+	run      func(fn func()) // Runs actions off the data update path
+}
+
+// Create engine reading signals and spool stats of store, commands go through controls
+func New(store *data.Store) *Engine {
+	return &Engine{
+		store:    store,
+		send:     controls.SendCommandByName,
+		lastSent: controls.LastCommandValue,
+		now:      time.Now,
+		run:      func(fn func()) { go fn() },
+	}
+}
+
+// Apply config, loads the rules file if it changed
+func (e *Engine) Configure(cfg config.RulesConfig) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	reload := cfg.File != e.cfg.File
+	e.cfg = cfg
+	if !reload || cfg.File == "" {
+		return nil
+	}
+	content, err := os.ReadFile(cfg.File)
+	if errors.Is(err, os.ErrNotExist) {
+		e.rules = nil
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Error reading rules: %w", err)
+	}
+	var defs []Rule
+	if err := json.Unmarshal(content, &defs); err != nil {
+		return fmt.Errorf("Error decoding rules: %w", err)
+	}
+	var rules []*rule
+	for _, def := range defs {
+		r, err := e.compile(def)
+		if err != nil {
+			return fmt.Errorf("Rule %s: %w", def.Name, err)
+		}
+		rules = append(rules, r)
+	}
+	e.rules = rules
+	return nil
+}
+
+// Start evaluating the rules on every update of the store
+func (e *Engine) Start() {
+	e.store.Subscribe(func(data.Update) { e.Evaluate() })
+}
+
+// Report if name can be used in expressions: signals, spool stats and last sent command values
+func known(name string) bool {
+	if _, ok := controls.CommandID(name); ok {
+		return true
+	}
+	for _, signal := range data.SignalNames() {
+		if signal == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Value of a signal or of the last sent command. Signals never received or with a quality other than
+// good or substituted have no value, rules using them report an error instead of acting.
+func (e *Engine) value(name string) (float64, bool) {
+	if _, ok := controls.CommandID(name); ok {
+		v, ok := e.lastSent(name)
+		return float64(v), ok
+	}
+	dp, ok := e.store.Value(name)
+	if !ok || dp.Timestamp.IsZero() {
+		return 0, false
+	}
+	if q := dp.QualityOrStale(); q != data.QualityGood && q != data.QualitySubstituted {
+		return 0, false
+	}
+	return float64(dp.Value), true
+}
+
+// Compile message with {expression} placeholders
+func compileTemplate(msg string) (template, error) {
+	var t template
+	for {
+		start := strings.IndexByte(msg, '{')
+		if start < 0 {
+			t.text = append(t.text, msg)
+			return t, nil
+		}
+		end := strings.IndexByte(msg[start:], '}')
+		if end < 0 {
+			return t, errors.New("Missing } in message")
+		}
+		expr, err := Compile(msg[start+1:start+end], known)
+		if err != nil {
+			return t, err
+		}
+		t.text = append(t.text, msg[:start])
+		t.exprs = append(t.exprs, expr)
+		msg = msg[start+end+1:]
+	}
+}
+
+// Message with the current values of the placeholders
+func (t template) render(env Env) string {
+	var b strings.Builder
+	for i, text := range t.text {
+		b.WriteString(text)
+		if i < len(t.exprs) {
+			if v, err := t.exprs[i].Eval(env); err != nil {
+				b.WriteString("?")
+			} else {
+				b.WriteString(strconv.FormatFloat(math.Round(v*1000)/1000, 'f', -1, 64))
+			}
+		}
+	}
+	return b.String()
+}
+
+// Check rule and compile its expressions
+func (e *Engine) compile(def Rule) (*rule, error) {
+	if def.Name == "" {
+		return nil, errors.New("Rule name must not be empty")
+	}
+	if def.For < 0 || def.Cooldown < 0 {
+		return nil, errors.New("for and cooldown must not be negative")
+	}
+	if len(def.Actions) == 0 {
+		return nil, errors.New("Rule needs at least one action")
+	}
+	when, err := Compile(def.When, known)
+	if err != nil {
+		return nil, fmt.Errorf("when: %w", err)
+	}
+	r := &rule{status: Status{Rule: def}, when: when}
+	for i, a := range def.Actions {
+		c := action{Action: a}
+		switch a.Type {
+		case "control":
+			if !controls.Rampable(a.Command) {
+				return nil, fmt.Errorf("Action %d: %q is no setpoint", i+1, a.Command)
+			}
+			if c.value, err = Compile(a.Value, known); err != nil {
+				return nil, fmt.Errorf("Action %d value: %w", i+1, err)
+			}
+		case "alarm", "log":
+			switch alarms.Severity(a.Severity) {
+			case "", alarms.SeverityInfo, alarms.SeverityWarning, alarms.SeverityCritical:
+			default:
+				return nil, fmt.Errorf("Action %d: unknown severity %q", i+1, a.Severity)
+			}
+			if c.message, err = compileTemplate(a.Message); err != nil {
+				return nil, fmt.Errorf("Action %d message: %w", i+1, err)
+			}
+		default:
+			return nil, fmt.Errorf("Action %d: unknown type %q, options: %s", i+1, a.Type, strings.Join(ActionTypes, ", "))
+		}
+		r.actions = append(r.actions, c)
+	}
+	return r, nil
+}
+
+// Add rule or replace the rule with the same name, the rules file is rewritten.
+// The alarm of a replaced rule is cleared.
+func (e *Engine) Put(def Rule) error {
+	r, err := e.compile(def)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	var replaced *rule
+	for i, old := range e.rules {
+		if old.status.Name == def.Name {
+			e.rules[i], replaced = r, old
+		}
+	}
+	if replaced == nil {
+		e.rules = append(e.rules, r)
+	}
+	err = e.save()
+	e.mu.Unlock()
+	if replaced != nil {
+		clearAlarm(replaced)
+	}
+	return err
+}
+
+// Remove rule by name and clear its alarm, the rules file is rewritten
+func (e *Engine) Delete(name string) error {
+	e.mu.Lock()
+	var removed *rule
+	for i, r := range e.rules {
+		if r.status.Name == name {
+			removed = r
+			e.rules = append(e.rules[:i], e.rules[i+1:]...)
+			break
+		}
+	}
+	if removed == nil {
+		e.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknown, name)
+	}
+	err := e.save()
+	e.mu.Unlock()
+	clearAlarm(removed)
+	return err
+}
+
+// Rules with their state in order of creation
+func (e *Engine) Rules() []Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	statuses := make([]Status, len(e.rules))
+	for i, r := range e.rules {
+		statuses[i] = r.status
+	}
+	return statuses
+}
+
+// Rule with its state by name
+func (e *Engine) Get(name string) (Status, bool) {
+	for _, s := range e.Rules() {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Status{}, false
+}
+
+// Write rules file atomically (caller holds mu)
+func (e *Engine) save() error {
+	if e.cfg.File == "" {
+		return nil
+	}
+	defs := make([]Rule, len(e.rules))
+	for i, r := range e.rules {
+		defs[i] = r.status.Rule
+	}
+	content, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(e.cfg.File), ".rules-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), e.cfg.File)
+}
+
+// Alarm ID raised by the alarm actions of a rule
+func alarmID(r *rule) string {
+	return "rule:" + r.status.Name
+}
+
+// Clear alarm of the rule if it raised one
+func clearAlarm(r *rule) {
+	if alarms.IsActive(alarmID(r)) {
+		alarms.Clear(alarmID(r))
+	}
+}
+
+// Actions per minute of all rules together
+func (e *Engine) limit() int {
+	if e.cfg.MaxActionsPerMinute == 0 {
+		return defaultMaxActionsPerMinute
+	}
+	return e.cfg.MaxActionsPerMinute
+}
+
+// Reserve n actions from the rate limit of all rules (caller holds mu)
+func (e *Engine) reserve(now time.Time, n int) bool {
+	recent := e.actions[:0]
+	for _, t := range e.actions {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	e.actions = recent
+	if len(e.actions)+n > e.limit() {
+		return false
+	}
+	for range n {
+		e.actions = append(e.actions, now)
+	}
+	return true
+}
+
+// Evaluate all enabled rules and run the actions of the rules that fire
+func (e *Engine) Evaluate() {
+	e.mu.Lock()
+	now := e.now()
+	cooldown := time.Duration(e.cfg.DefaultCooldown) * time.Millisecond
+	if cooldown == 0 {
+		cooldown = defaultCooldown
+	}
+	var firing []func()
+	var cleared []*rule
+	for _, r := range e.rules {
+		if r.status.Disabled {
+			continue
+		}
+		active, err := r.when.True(e.value)
+		if err != nil {
+			r.status.Error = err.Error()
+			continue
+		}
+		r.status.Active, r.status.Error = active, ""
+		if !active {
+			if !r.since.IsZero() {
+				cleared = append(cleared, r)
+			}
+			r.since, r.status.Since = time.Time{}, nil
+			continue
+		}
+		if r.since.IsZero() {
+			r.since = now
+			since := now
+			r.status.Since = &since
+		}
+		wait := cooldown
+		if r.status.Cooldown > 0 {
+			wait = time.Duration(r.status.Cooldown) * time.Millisecond
+		}
+		if now.Sub(r.since) < time.Duration(r.status.For)*time.Millisecond || (!r.lastAttempt.IsZero() && now.Sub(r.lastAttempt) < wait) {
+			continue
+		}
+		r.lastAttempt = now
+		r.since = now // The condition must hold again for the next firing
+		if !e.reserve(now, len(r.actions)) {
+			r.status.Suppressed++
+			log.Printf("Rule %s suppressed: more than %d actions per minute", r.status.Name, e.limit())
+			continue
+		}
+		fired := now
+		r.status.LastFired = &fired
+		r.status.Fired++
+		firing = append(firing, e.prepare(r))
+	}
+	e.mu.Unlock()
+
+	for _, r := range cleared {
+		clearAlarm(r)
+	}
+	for _, fn := range firing {
+		e.run(fn)
+	}
+}
+
+// Evaluate the action values now and return function executing them (caller holds mu)
+func (e *Engine) prepare(r *rule) func() {
+	var steps []func() error
+	for _, a := range r.actions {
+		switch a.Type {
+		case "control":
+			v, err := a.value.Eval(e.value)
+			if err != nil {
+				steps = append(steps, func() error { return fmt.Errorf("%s: %w", a.Command, err) })
+				continue
+			}
+			lo, hi, _ := controls.CommandRange(a.Command)
+			value := uint32(math.Round(math.Max(float64(lo), math.Min(float64(hi), v))))
+			command := a.Command
+			steps = append(steps, func() error { return e.send(command, value) })
+		case "alarm":
+			severity := alarms.Severity(a.Severity)
+			if severity == "" {
+				severity = alarms.SeverityWarning
+			}
+			alarm := alarms.Alarm{ID: alarmID(r), Severity: severity, Source: "rules", Message: a.message.render(e.value), Fields: map[string]string{"rule": r.status.Name}}
+			steps = append(steps, func() error { alarms.Raise(alarm); return nil })
+		case "log":
+			message := fmt.Sprintf("Rule %s: %s", r.status.Name, a.message.render(e.value))
+			event := eventlog.Event{Category: eventlog.CategoryRule, Source: e.store.Source, Message: message, Fields: map[string]string{"rule": r.status.Name}}
+			steps = append(steps, func() error {
+				log.Print(message)
+				eventlog.Record(event)
+				return nil
+			})
+		}
+	}
+	return func() {
+		var errs []error
+		for _, step := range steps {
+			if err := step(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		r.status.ActionErr = ""
+		if err := errors.Join(errs...); err != nil {
+			r.status.ActionErr = err.Error()
+			log.Printf("Rule %s: %v", r.status.Name, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package rules
+
+import (
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Engine on a new store with a manual clock, actions run synchronously
+func testEngine(t *testing.T, cfg config.RulesConfig) (*Engine, *data.Store, *time.Time, map[string]uint32) {
+	store, err := data.NewStore(data.DefaultDictionary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	sent := map[string]uint32{"screw_rpm": 100}
+	e := New(store)
+	e.now = func() time.Time { return now }
+	e.run = func(fn func()) { fn() }
+	e.send = func(command string, v uint32) error {
+		sent[command] = v
+		return nil
+	}
+	e.lastSent = func(command string) (uint32, bool) {
+		v, ok := sent[command]
+		return v, ok
+	}
+	if err := e.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	e.Start()
+	return e, store, &now, sent
+}
+
+// Test for Evaluate: condition must hold for its time, actions repeat while it holds, alarm follows the condition
+func TestEngine_DiameterRule(t *testing.T) {
+	e, store, now, sent := testEngine(t, config.RulesConfig{})
+	err := e.Put(Rule{Name: "diameter-high", When: "diameter > 1.80", For: 10000, Actions: []Action{
+		{Type: "control", Command: "screw_rpm", Value: "screw_rpm * 0.98"},
+		{Type: "alarm", Message: "Diameter {diameter} too high"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alarms.Clear("rule:diameter-high")
+
+	steps := []struct {
+		after    time.Duration
+		diameter float32
+		rpm      uint32
+	}{
+		{0, 1.85, 100},
+		{5 * time.Second, 1.85, 100},
+		{5 * time.Second, 1.85, 98}, // Held for 10 s
+		{time.Second, 1.85, 98},
+		{9 * time.Second, 1.85, 96}, // Held again for 10 s
+		{time.Second, 1.75, 96},
+	}
+	for i, step := range steps {
+		*now = now.Add(step.after)
+		store.SetValue("diameter", step.diameter, *now)
+		if sent["screw_rpm"] != step.rpm {
+			t.Errorf("Step %d: Expected: %v, received: %v", i+1, step.rpm, sent["screw_rpm"])
+		}
+		if i == 2 && !alarms.IsActive("rule:diameter-high") {
+			t.Errorf("Step %d: alarm not raised", i+1)
+		}
+	}
+	if alarms.IsActive("rule:diameter-high") {
+		t.Errorf("Alarm not cleared with the condition")
+	}
+	if s, _ := e.Get("diameter-high"); s.Fired != 2 || s.Active {
+		t.Errorf("Unexpected status: %+v", s)
+	}
+}
+
+// Test for value: signals never received or with bad quality make the rule report an error instead of acting
+func TestEngine_MissingAndBadValues(t *testing.T) {
+	e, store, now, sent := testEngine(t, config.RulesConfig{})
+	e.Put(Rule{Name: "diameter-low", When: "diameter < 1.70", Actions: []Action{{Type: "control", Command: "screw_rpm", Value: "90"}}})
+
+	store.SetValue("temperature", 210, *now)
+	if s, _ := e.Get("diameter-low"); sent["screw_rpm"] != 100 || s.Error == "" {
+		t.Errorf("Rule without diameter fired or reported no error: %v %+v", sent, s)
+	}
+
+	store.SetValue("diameter", 1.75, *now)
+	store.SetQuality("diameter", data.QualityStale)
+	if s, _ := e.Get("diameter-low"); sent["screw_rpm"] != 100 || s.Error == "" {
+		t.Errorf("Rule with stale diameter fired or reported no error: %v %+v", sent, s)
+	}
+
+	store.SetValue("diameter", 1.65, *now)
+	if s, _ := e.Get("diameter-low"); sent["screw_rpm"] != 90 || s.Error != "" {
+		t.Errorf("Rule with good diameter should fire: %v %+v", sent, s)
+	}
+}
+
+// Test for the rate limit: actions beyond the limit per minute are suppressed
+func TestEngine_RateLimit(t *testing.T) {
+	e, store, now, sent := testEngine(t, config.RulesConfig{MaxActionsPerMinute: 1, DefaultCooldown: 1000})
+	e.Put(Rule{Name: "mass", When: "filamentMass >= 1000", Actions: []Action{{Type: "control", Command: "spooler_rpm", Value: "10"}}})
+	e.Put(Rule{Name: "mass-log", When: "filamentMass >= 1000", Actions: []Action{{Type: "log", Message: "Spool at {filamentMass} g"}}})
+
+	store.GetStatsFromRow("12:00:00.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 60 | 1.75 | 100 | 1000", "|")
+	if s, _ := e.Get("mass-log"); sent["spooler_rpm"] != 10 || s.Suppressed != 1 {
+		t.Errorf("Expected suppressed log action, received: %v %+v", sent, s)
+	}
+	e.Put(Rule{Name: "mass", When: "filamentMass >= 1000", Disabled: true, Actions: []Action{{Type: "control", Command: "spooler_rpm", Value: "10"}}})
+	*now = now.Add(time.Minute)
+	store.GetStatsFromRow("12:01:00.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 60 | 1.75 | 101 | 1001", "|")
+	if s, _ := e.Get("mass-log"); s.Fired != 1 {
+		t.Errorf("Log action should fire after a minute: %+v", s)
+	}
+}
+
+// Test for Put, Delete and Configure: invalid rules rejected, rules file written and loaded
+func TestEngine_Persistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.json")
+	e, _, _, _ := testEngine(t, config.RulesConfig{File: file})
+	invalid := []Rule{
+		{Name: "", When: "diameter > 1", Actions: []Action{{Type: "log"}}},
+		{Name: "x", When: "diameter >", Actions: []Action{{Type: "log"}}},
+		{Name: "x", When: "diameter > 1"},
+		{Name: "x", When: "diameter > 1", Actions: []Action{{Type: "control", Command: "start", Value: "1"}}},
+		{Name: "x", When: "diameter > 1", Actions: []Action{{Type: "shell", Message: "rm -rf /"}}},
+		{Name: "x", When: "diameter > 1", Actions: []Action{{Type: "log", Message: "{speed}"}}},
+	}
+	for i, r := range invalid {
+		if err := e.Put(r); err == nil {
+			t.Errorf("Rule %d should be rejected", i+1)
+		}
+	}
+	e.Put(Rule{Name: "a", When: "temperature > 250", Actions: []Action{{Type: "log", Message: "hot"}}})
+	e.Put(Rule{Name: "b", When: "temperature < 150", Actions: []Action{{Type: "log", Message: "cold"}}})
+	if err := e.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, _, _, _ := testEngine(t, config.RulesConfig{File: file})
+	if r := loaded.Rules(); len(r) != 1 || r[0].Name != "b" {
+		t.Errorf("Unexpected rules loaded: %+v", r)
+	}
+}
+
+// Test for handlers: create, invalid rule, unknown rule, delete
+func TestHandlers(t *testing.T) {
+	e, _, _, _ := testEngine(t, config.RulesConfig{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules", e.Handler)
+	mux.HandleFunc("/rules/{name}", e.RuleHandler)
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/rules", `{"name": "hot", "when": "temperature > 250", "actions": [{"type": "alarm", "severity": "critical", "message": "hot"}]}`, http.StatusOK},
+		{"POST", "/rules", `{"name": "bad", "when": "temperature >", "actions": [{"type": "log"}]}`, http.StatusBadRequest},
+		{"PUT", "/rules/cold", `{"when": "temperature < 150", "actions": [{"type": "log", "message": "cold"}]}`, http.StatusOK},
+		{"GET", "/rules/hot", "", http.StatusOK},
+		{"GET", "/rules/warm", "", http.StatusNotFound},
+		{"DELETE", "/rules/hot", "", http.StatusOK},
+		{"DELETE", "/rules/hot", "", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if w.Code != tc.code {
+			t.Errorf("%s %s: Expected: %d, received: %d (%s)", tc.method, tc.path, tc.code, w.Code, w.Body.String())
+		}
+	}
+	if r := e.Rules(); len(r) != 1 || r[0].Name != "cold" {
+		t.Errorf("Unexpected rules: %+v", r)
+	}
+}
@@ -0,0 +1,141 @@
+package sequence
+
+import (
+	"encoding/json"
+	"errors"
+	"extruder_web_gui/audit"
+	"extruder_web_gui/config"
+	"fmt"
+	"net/http"
+)
+
+// Sequences with the running and finished runs
+type Status struct {
+	Sequences []config.SequenceConfig `json:"sequences"`
+	Active    *Progress               `json:"active,omitempty"`
+	History   []Progress              `json:"history"` //Finished runs, newest last
+}
+
+// Optional body of abort and confirm requests
+type Request struct {
+	Operator string `json:"operator"` //Default: X-Operator header or remote address
+	Reason   string `json:"reason"`   //abort only
+}
+
+// Handler for /sequences: configured sequences and progress
+func (s *Sequencer) Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Status{Sequences: s.Sequences(), Active: s.Active(), History: s.History()})
+}
+
+// Parse optional request body, the operator defaults to the actor of the request
+func parseRequest(r *http.Request) (Request, error) {
+	var req Request
+	if r.ContentLength != 0 && r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, errors.New("Invalid JSON")
+		}
+	}
+	if req.Operator == "" {
+		req.Operator = audit.Actor(r)
+	}
+	return req, nil
+}
+
+// Answer error of a sequencer call: 404 for unknown sequences, 409 for everything refused in the current state
+func sequenceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrUnknown) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusConflict)
+}
+
+// Handler for /sequences/{name}/start
+func (s *Sequencer) StartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Start(r.PathValue("name"), req.Operator); err != nil {
+		sequenceError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Active())
+}
+
+// Handler for /sequences/abort
+func (s *Sequencer) AbortHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Abort(req.Operator, req.Reason); err != nil {
+		sequenceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "success"}`))
+}
+
+// Handler for /sequences/confirm: operator confirms the current step
+func (s *Sequencer) ConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Confirm(req.Operator); err != nil {
+		sequenceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "success"}`))
+}
+
+// Handler for progress updates via SSE: GET /sequences/events, starts with the running sequence
+func (s *Sequencer) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	updates, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+	if p := s.Active(); p != nil {
+		payload, _ := json.Marshal(p)
+		fmt.Fprintf(w, "data: %s\n\n", payload)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case p := <-updates:
+			payload, _ := json.Marshal(p)
+			fmt.Fprintf(w, "data: %s\n\n", payload)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package sequence
+
+import (
+	"errors"
+	"extruder_web_gui/audit"
+	"extruder_web_gui/config"
+	"extruder_web_gui/controls"
+	"extruder_web_gui/data"
+	"extruder_web_gui/ramp"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Status of a sequence run
+const (
+	StatusRunning   = "running"
+	StatusConfirm   = "confirm" //Waiting for operator confirmation
+	StatusCompleted = "completed"
+	StatusAborted   = "aborted" //Aborted by an operator
+	StatusFailed    = "failed"  //Step failed or timed out
+)
+
+// Finished runs kept for /sequences
+const historySize = 20
+
+// Interval wait steps check their condition, timeout and interlock
+const pollInterval = 100 * time.Millisecond
+
+var (
+	ErrUnknown    = errors.New("Unknown sequence")
+	ErrBusy       = errors.New("Another sequence is running")
+	ErrNotRunning = errors.New("No sequence running")
+	ErrNoConfirm  = errors.New("Sequence is not waiting for confirmation")
+)
+
+// Progress of a sequence run, published on every change
+type Progress struct {
+	Run       int        `json:"run"` //Number of the run since server start
+	Sequence  string     `json:"sequence"`
+	Status    string     `json:"status"`
+	Step      int        `json:"step"` //Current step, 1-based, 0 before the first step
+	Steps     int        `json:"steps"`
+	StepType  string     `json:"stepType,omitempty"`
+	Message   string     `json:"message"` //Current step or reason of the abort
+	StartedBy string     `json:"startedBy"`
+	Started   time.Time  `json:"started"`
+	Updated   time.Time  `json:"updated"`
+	Finished  *time.Time `json:"finished,omitempty"`
+}
+
+// Active run with its abort and confirmation channels
+type run struct {
+	def       config.SequenceConfig
+	progress  Progress
+	abort     chan struct{} // Closed by Abort
+	reason    string
+	confirmed chan string // Operator confirming the current step
+}
+
+// Sequencer running one step list at a time via the controls send path
+type Sequencer struct {
+	mu      sync.Mutex
+	defs    []config.SequenceConfig
+	store   *data.Store
+	active  *run
+	runs    int
+	history []Progress
+
+	listenerMu sync.Mutex
+	listeners  map[chan Progress]struct{}
+
+	send     func(command string, value uint32) error
+	lastSent func(command string) (uint32, bool)
+	now      func() time.Time
+	interval time.Duration // Ramp interval
+
+	// Optional check before and during every step, e.g. latched emergency stop
+	Interlock func() error
+	// Optional check before the start for other owners of the setpoints, e.g. a running profile
+	Conflict func() error
+}
+
+// Create sequencer for the default machine: commands go through controls, conditions read store
+func New(store *data.Store) *Sequencer {
+	return &Sequencer{
+		store:     store,
+		listeners: map[chan Progress]struct{}{},
+		send:      controls.SendCommandByName,
+		lastSent:  controls.LastCommandValue,
+		now:       time.Now,
+		interval:  ramp.DefaultInterval,
+	}
+}
+
+// Check command names of the sequences, the config validation cannot know them
+func Validate(defs []config.SequenceConfig) error {
+	var errs []error
+	for _, def := range defs {
+		for i, step := range append(append([]config.SequenceStep{}, def.Steps...), def.OnAbort...) {
+			if step.Type != "set" && step.Type != "ramp" {
+				continue
+			}
+			if _, ok := controls.CommandID(step.Command); !ok {
+				errs = append(errs, fmt.Errorf("Sequence %s step %d: unknown command %q", def.Name, i+1, step.Command))
+			} else if _, _, hasValue := controls.CommandRange(step.Command); !hasValue && step.Type == "ramp" {
+				errs = append(errs, fmt.Errorf("Sequence %s step %d: %s cannot be ramped", def.Name, i+1, step.Command))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Replace the sequence definitions, a running sequence keeps its steps
+func (s *Sequencer) Configure(defs []config.SequenceConfig) error {
+	if err := Validate(defs); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defs = defs
+	return nil
+}
+
+// Start sequence by name on behalf of actor
+func (s *Sequencer) Start(name string, actor string) error {
+	if s.Interlock != nil {
+		if err := s.Interlock(); err != nil {
+			return err
+		}
+	}
+	if s.Conflict != nil {
+		if err := s.Conflict(); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active != nil {
+		return fmt.Errorf("%w: %s", ErrBusy, s.active.def.Name)
+	}
+	var def *config.SequenceConfig
+	for i := range s.defs {
+		if s.defs[i].Name == name {
+			def = &s.defs[i]
+		}
+	}
+	if def == nil {
+		return fmt.Errorf("%w: %s", ErrUnknown, name)
+	}
+	s.runs++
+	now := s.now()
+	r := &run{
+		def:       *def,
+		abort:     make(chan struct{}),
+		confirmed: make(chan string, 1),
+		progress:  Progress{Run: s.runs, Sequence: name, Status: StatusRunning, Steps: len(def.Steps), StartedBy: actor, Started: now, Updated: now},
+	}
+	s.active = r
+	audit.Record(audit.Entry{Actor: actor, Action: "sequence.start", Result: audit.ResultOK, Message: "Sequence " + name + " started"})
+	go s.execute(r)
+	return nil
+}
+
+// Abort running sequence, its abort steps are sent afterwards
+func (s *Sequencer) Abort(actor string, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.active
+	if r == nil {
+		return ErrNotRunning
+	}
+	select {
+	case <-r.abort:
+		return nil // Already aborting
+	default:
+	}
+	if reason == "" {
+		reason = "Aborted by " + actor
+	}
+	r.reason = reason
+	close(r.abort)
+	audit.Record(audit.Entry{Actor: actor, Action: "sequence.abort", Result: audit.ResultOK, Message: fmt.Sprintf("Sequence %s aborted: %s", r.def.Name, reason)})
+	return nil
+}
+
+// Confirm the current step of the running sequence on behalf of operator
+func (s *Sequencer) Confirm(operator string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.active
+	if r == nil {
+		return ErrNotRunning
+	}
+	if r.progress.Status != StatusConfirm {
+		return ErrNoConfirm
+	}
+	select {
+	case r.confirmed <- operator:
+	default:
+		return ErrNoConfirm // Confirmed already
+	}
+	audit.Record(audit.Entry{Actor: operator, Action: "sequence.confirm", Result: audit.ResultOK, Message: fmt.Sprintf("Sequence %s step %d confirmed", r.def.Name, r.progress.Step)})
+	return nil
+}
+
+// Progress of the running sequence, nil if none runs
+func (s *Sequencer) Active() *Progress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	p := s.active.progress
+	return &p
+}
+
+// Finished runs, newest last
+func (s *Sequencer) History() []Progress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Progress{}, s.history...)
+}
+
+// Names of the configured sequences with their number of steps
+func (s *Sequencer) Sequences() []config.SequenceConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]config.SequenceConfig{}, s.defs...)
+}
+
+// Register channel receiving every progress change, returns function to unsubscribe
+func (s *Sequencer) Subscribe() (<-chan Progress, func()) {
+	ch := make(chan Progress, 16)
+	s.listenerMu.Lock()
+	s.listeners[ch] = struct{}{}
+	s.listenerMu.Unlock()
+	return ch, func() {
+		s.listenerMu.Lock()
+		delete(s.listeners, ch)
+		s.listenerMu.Unlock()
+	}
+}
+
+// Update progress of the run and publish it
+func (s *Sequencer) update(r *run, change func(p *Progress)) {
+	s.mu.Lock()
+	change(&r.progress)
+	r.progress.Updated = s.now()
+	p := r.progress
+	s.mu.Unlock()
+
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	for ch := range s.listeners {
+		select {
+		case ch <- p:
+		default: // Slow client, drop update
+		}
+	}
+}
+
+// Run the steps, on abort or failure send the abort steps
+func (s *Sequencer) execute(r *run) {
+	var err error
+	for i, step := range r.def.Steps {
+		s.update(r, func(p *Progress) {
+			p.Step, p.StepType, p.Message, p.Status = i+1, step.Type, describe(step), StatusRunning
+		})
+		if err = s.step(r, step); err != nil {
+			break
+		}
+	}
+
+	status, message := StatusCompleted, "Sequence completed"
+	if err != nil {
+		status, message = StatusFailed, err.Error()
+		select {
+		case <-r.abort:
+			status, message = StatusAborted, r.reason
+		default:
+		}
+		log.Printf("Sequence %s %s at step %d: %s", r.def.Name, status, r.progress.Step, message)
+		for _, step := range r.def.OnAbort {
+			if err := s.send(step.Command, step.Value); err != nil {
+				log.Printf("Sequence %s: abort step %s failed: %v", r.def.Name, step.Command, err)
+			}
+		}
+	}
+	s.update(r, func(p *Progress) {
+		now := s.now()
+		p.Status, p.Message, p.Finished = status, message, &now
+	})
+
+	s.mu.Lock()
+	s.active = nil
+	s.history = append(s.history, r.progress)
+	if len(s.history) > historySize {
+		s.history = s.history[len(s.history)-historySize:]
+	}
+	s.mu.Unlock()
+	if status != StatusAborted {
+		result := audit.ResultOK
+		if status == StatusFailed {
+			result = audit.ResultFailed
+		}
+		audit.Record(audit.Entry{Actor: "sequencer", Action: "sequence.finish", Result: result, Message: fmt.Sprintf("Sequence %s %s: %s", r.def.Name, status, message)})
+	}
+}
+
+// Execute single step until done, aborted, timed out or blocked by the interlock
+func (s *Sequencer) step(r *run, step config.SequenceStep) error {
+	var timeout <-chan time.Time
+	if step.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(step.Timeout) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	if err := s.interlock(r); err != nil {
+		return err
+	}
+
+	switch step.Type {
+	case "set":
+		return s.send(step.Command, step.Value)
+	case "ramp":
+		from, _ := s.lastSent(step.Command)
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- ramp.Run(ramp.Ramp{From: from, To: step.Value, Duration: time.Duration(step.Duration) * time.Millisecond, Interval: s.interval},
+				func(v uint32) error { return s.send(step.Command, v) }, stop)
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-r.abort:
+			close(stop)
+			<-done
+			return errors.New(r.reason)
+		case <-timeout:
+			close(stop)
+			<-done
+			return fmt.Errorf("Timeout: %s", describe(step))
+		}
+	case "wait":
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for !s.satisfied(step) {
+			select {
+			case <-r.abort:
+				return errors.New(r.reason)
+			case <-timeout:
+				return fmt.Errorf("Timeout: %s", describe(step))
+			case <-ticker.C:
+			}
+			if err := s.interlock(r); err != nil {
+				return err
+			}
+		}
+	case "confirm":
+		s.update(r, func(p *Progress) { p.Status = StatusConfirm })
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.confirmed:
+				return nil
+			case <-r.abort:
+				return errors.New(r.reason)
+			case <-timeout:
+				return fmt.Errorf("Timeout: %s", describe(step))
+			case <-ticker.C:
+			}
+			if err := s.interlock(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Sequencer) interlock(r *run) error {
+	select {
+	case <-r.abort:
+		return errors.New(r.reason)
+	default:
+	}
+	if s.Interlock == nil {
+		return nil
+	}
+	return s.Interlock()
+}
+
+// Check wait condition on the current value, only good or substituted values satisfy it
+func (s *Sequencer) satisfied(step config.SequenceStep) bool {
+	dp, ok := s.store.Value(step.Signal)
+	if !ok || dp.Timestamp.IsZero() {
+		return false
+	}
+	if q := dp.QualityOrStale(); q != data.QualityGood && q != data.QualitySubstituted {
+		return false
+	}
+	v := float64(dp.Value)
+	switch step.Condition {
+	case ">=":
+		return v >= step.Threshold
+	case "<=":
+		return v <= step.Threshold
+	case ">":
+		return v > step.Threshold
+	case "<":
+		return v < step.Threshold
+	case "==":
+		return v == step.Threshold
+	}
+	return false
+}
+
+// Description of a step for the progress
+func describe(step config.SequenceStep) string {
+	if step.Message != "" {
+		return step.Message
+	}
+	switch step.Type {
+	case "set":
+		return fmt.Sprintf("Set %s to %d", step.Command, step.Value)
+	case "ramp":
+		return fmt.Sprintf("Ramp %s to %d in %s", step.Command, step.Value, time.Duration(step.Duration)*time.Millisecond)
+	case "wait":
+		return fmt.Sprintf("Wait for %s %s %g", step.Signal, step.Condition, step.Threshold)
+	}
+	return "Confirm to continue"
+}
@@ -0,0 +1,220 @@
+package sequence
+
+import (
+	"errors"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Sequencer on a new store recording sent commands as "command=value"
+func testSequencer(t *testing.T, defs ...config.SequenceConfig) (*Sequencer, *data.Store, func() []string) {
+	store, err := data.NewStore(data.DefaultDictionary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(store)
+	s.interval = 5 * time.Millisecond
+	var mu sync.Mutex
+	var sent []string
+	last := map[string]uint32{}
+	s.send = func(command string, value uint32) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, fmt.Sprintf("%s=%d", command, value))
+		last[command] = value
+		return nil
+	}
+	s.lastSent = func(command string) (uint32, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		v, ok := last[command]
+		return v, ok
+	}
+	if err := s.Configure(defs); err != nil {
+		t.Fatal(err)
+	}
+	return s, store, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, sent...)
+	}
+}
+
+// Wait for progress with status or fail after a second
+func waitStatus(t *testing.T, updates <-chan Progress, status string) Progress {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case p := <-updates:
+			if p.Status == status {
+				return p
+			}
+		case <-timeout:
+			t.Fatalf("Timeout waiting for status %s", status)
+		}
+	}
+}
+
+var startup = config.SequenceConfig{
+	Name: "startup",
+	Steps: []config.SequenceStep{
+		{Type: "set", Command: "heater_pwm", Value: 80},
+		{Type: "wait", Signal: "temperature", Condition: ">=", Threshold: 200, Timeout: 1000},
+		{Type: "confirm", Message: "Filament path clear?"},
+		{Type: "ramp", Command: "screw_rpm", Value: 30, Duration: 15},
+	},
+	OnAbort: []config.SequenceStep{{Type: "set", Command: "heater_pwm", Value: 0}},
+}
+
+// Test for Sequencer: steps run in order, wait and confirm block until satisfied
+func TestSequencer_Startup(t *testing.T) {
+	s, store, sent := testSequencer(t, startup)
+	updates, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	if err := s.Start("startup", "operator1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start("startup", "operator1"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Second start. Expected: %v, received: %v", ErrBusy, err)
+	}
+	if err := s.Confirm("operator1"); !errors.Is(err, ErrNoConfirm) {
+		t.Errorf("Confirm while heating. Expected: %v, received: %v", ErrNoConfirm, err)
+	}
+	store.SetValue("temperature", 201, time.Now())
+	p := waitStatus(t, updates, StatusConfirm)
+	if p.Step != 3 || p.Message != "Filament path clear?" {
+		t.Errorf("Unexpected confirm progress: %+v", p)
+	}
+	if err := s.Confirm("operator1"); err != nil {
+		t.Fatal(err)
+	}
+	p = waitStatus(t, updates, StatusCompleted)
+	if p.Finished == nil || s.Active() != nil {
+		t.Errorf("Run not finished: %+v", p)
+	}
+	expected := []string{"heater_pwm=80", "screw_rpm=10", "screw_rpm=20", "screw_rpm=30"}
+	if got := sent(); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Expected: %v, received: %v", expected, got)
+	}
+	if h := s.History(); len(h) != 1 || h[0].Status != StatusCompleted {
+		t.Errorf("Unexpected history: %+v", h)
+	}
+}
+
+// Test for Sequencer: timeout and abort stop the run and send the abort steps
+func TestSequencer_TimeoutAndAbort(t *testing.T) {
+	def := startup
+	def.Steps = append([]config.SequenceStep{}, startup.Steps...)
+	def.Steps[1].Timeout = 20
+	s, store, sent := testSequencer(t, def)
+	updates, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	s.Start("startup", "operator1")
+	p := waitStatus(t, updates, StatusFailed)
+	if p.Step != 2 {
+		t.Errorf("Failed step. Expected: %v, received: %v", 2, p.Step)
+	}
+	if got := sent(); fmt.Sprint(got) != fmt.Sprint([]string{"heater_pwm=80", "heater_pwm=0"}) {
+		t.Errorf("Abort steps not sent: %v", got)
+	}
+
+	store.SetValue("temperature", 201, time.Now())
+	s.Start("startup", "operator1")
+	waitStatus(t, updates, StatusConfirm)
+	if err := s.Abort("operator2", "Filament missing"); err != nil {
+		t.Fatal(err)
+	}
+	p = waitStatus(t, updates, StatusAborted)
+	if p.Message != "Filament missing" {
+		t.Errorf("Expected: %v, received: %v", "Filament missing", p.Message)
+	}
+	if err := s.Abort("operator2", ""); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected: %v, received: %v", ErrNotRunning, err)
+	}
+}
+
+// Test for Sequencer: interlock prevents the start and stops a running sequence
+func TestSequencer_Interlock(t *testing.T) {
+	s, _, _ := testSequencer(t, startup)
+	var mu sync.Mutex
+	var latched error
+	s.Interlock = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return latched
+	}
+	updates, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	s.Start("startup", "operator1")
+	mu.Lock()
+	latched = errors.New("Emergency stop latched")
+	mu.Unlock()
+	if p := waitStatus(t, updates, StatusFailed); p.Message != "Emergency stop latched" {
+		t.Errorf("Expected: %v, received: %v", "Emergency stop latched", p.Message)
+	}
+	if err := s.Start("startup", "operator1"); err == nil {
+		t.Errorf("Start should be refused while the interlock is active")
+	}
+}
+
+// Test for satisfied: values outside the plausible range don't satisfy a wait step
+func TestSequencer_WaitQuality(t *testing.T) {
+	s, store, _ := testSequencer(t, startup)
+	step := startup.Steps[1]
+	if s.satisfied(step) {
+		t.Errorf("Never received signal shouldn't satisfy the wait step")
+	}
+	store.ConfigureRanges(map[string][2]float64{"temperature": {0, 150}})
+	store.SetValue("temperature", 201, time.Now())
+	if s.satisfied(step) {
+		t.Errorf("Out-of-range value shouldn't satisfy the wait step")
+	}
+	store.ConfigureRanges(nil)
+	store.SetValue("temperature", 201, time.Now())
+	if !s.satisfied(step) {
+		t.Errorf("Good value should satisfy the wait step")
+	}
+}
+
+// Test for Configure: unknown commands and ramps of commands without value are rejected
+func TestConfigure_Commands(t *testing.T) {
+	s := New(data.Default)
+	for _, step := range []config.SequenceStep{{Type: "set", Command: "warp_drive"}, {Type: "ramp", Command: "start"}} {
+		if err := s.Configure([]config.SequenceConfig{{Name: "x", Steps: []config.SequenceStep{step}}}); err == nil {
+			t.Errorf("%s %s should be rejected", step.Type, step.Command)
+		}
+	}
+}
+
+// Test for handlers: unknown sequence, nothing to confirm, POST only
+func TestHandlers_Errors(t *testing.T) {
+	s, _, _ := testSequencer(t, startup)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sequences/{name}/start", s.StartHandler)
+	mux.HandleFunc("/sequences/confirm", s.ConfirmHandler)
+	mux.HandleFunc("/sequences/abort", s.AbortHandler)
+	for _, tc := range []struct {
+		method, path string
+		code         int
+	}{
+		{"POST", "/sequences/warmup/start", http.StatusNotFound},
+		{"GET", "/sequences/startup/start", http.StatusMethodNotAllowed},
+		{"POST", "/sequences/confirm", http.StatusConflict},
+		{"POST", "/sequences/abort", http.StatusConflict},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s %s: Expected: %d, received: %d (%s)", tc.method, tc.path, tc.code, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"extruder_web_gui/audit"
+	"extruder_web_gui/config"
+	"extruder_web_gui/controls"
+	"extruder_web_gui/data"
+	"extruder_web_gui/eventlog"
+	"extruder_web_gui/machine"
+	"extruder_web_gui/modbus"
+	"extruder_web_gui/mqtt"
+	"extruder_web_gui/notify"
+	"extruder_web_gui/pipes"
+	"extruder_web_gui/supervisor"
+	"extruder_web_gui/tags"
+	"extruder_web_gui/tcp"
+	"extruder_web_gui/watchdog"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Interval the config file is checked for changes
+const configWatchInterval = 2 * time.Second
+
+// Services restarted by the supervisor when their config sections change
+func services(sup func() *supervisor.Supervisor) []supervisor.Service {
+	return []supervisor.Service{
+		{Name: "audit", Sections: []string{"audit"}, Start: startAudit},
+		{Name: "eventLog", Sections: []string{"eventLog"}, Start: func(c *config.Config) (func(), error) {
+			return noop, eventlog.Configure(c.EventLog)
+		}},
+		{Name: "signals", Sections: []string{"timestamps", "signalRanges"}, Start: startSignals},
+		{Name: "transport", Sections: []string{"mode", "tcpAddress", "simModePipe", "msgFromSimPipe", "msgToSimPipe", "modbusClient"}, Start: startTransport},
+		{Name: "machines", Sections: []string{"machines", "timestamps"}, Start: func(c *config.Config) (func(), error) {
+			return machine.Start(c.Machines, c.Timestamps)
+		}},
+		{Name: "state", Sections: []string{"state", "targets", "estop"}, Start: func(c *config.Config) (func(), error) {
+			processState.Configure(c.State, defaultSetpoint)
+			emergencyStop.Configure(c.EStop, nil)
+			return noop, nil
+		}},
+		{Name: "spool", Sections: []string{"spool", "spc"}, Start: func(c *config.Config) (func(), error) {
+			spools.Configure(c.Spool)
+			lsl, usl := specLimits(c.Spool)
+			spcMonitor.Configure(c.SPC, lsl, usl)
+			return noop, nil
+		}},
+		{Name: "sequences", Sections: []string{"sequences"}, Start: func(c *config.Config) (func(), error) {
+			return noop, sequencer.Configure(c.Sequences)
+		}},
+		{Name: "rules", Sections: []string{"rules"}, Start: func(c *config.Config) (func(), error) {
+			return noop, ruleEngine.Configure(c.Rules)
+		}},
+		{Name: "notifications", Sections: []string{"notifications"}, Start: func(c *config.Config) (func(), error) {
+			return noop, notify.Configure(c.Notifications)
+		}},
+		{Name: "mqtt", Sections: []string{"mqtt"}, Start: startMQTT},
+		{Name: "modbusServer", Sections: []string{"modbusServer"}, Start: startModbusServer},
+		{Name: "watchdog", Sections: []string{"watchdog", "mode", "modbusClient"}, Start: startWatchdog},
+		{Name: "configWatcher", Sections: []string{"watchConfig"}, Start: func(c *config.Config) (func(), error) {
+			stop := make(chan struct{})
+			if c.WatchConfig {
+				go sup().Watch(configWatchInterval, stop)
+			}
+			return func() { close(stop) }, nil
+		}},
+	}
+}
+
+func noop() {}
+
+func startAudit(c *config.Config) (func(), error) {
+	return noop, audit.Configure(c.Audit.File)
+}
+
+// Timestamp parsing and plausible ranges
+func startSignals(c *config.Config) (func(), error) {
+	if err := data.ConfigureTimestamps(c.Timestamps.Layouts, c.Timestamps.TimeZone); err != nil {
+		return nil, err
+	}
+	return noop, data.ConfigureRanges(c.SignalRanges)
+}
+
+// Data source of the configured mode
+func startTransport(c *config.Config) (func(), error) {
+	stop := make(chan struct{})
+	switch c.Mode {
+	case "SimMode":
+		log.Println("Starting in mode: Sim-Pipe")
+		go pipes.FromSimPipeHandler(c.SimModePipe, true, data.Default, stop)
+	case "PipeMode":
+		log.Println("Starting in mode: Msg-Pipe")
+		go pipes.FromSimPipeHandler(c.SimModePipe, false, data.Default, stop)
+		go pipes.FromUserPipeHandler(c.MsgFromSimPipe, data.Default, stop)
+	case "TCPMode":
+		manager := tcp.GetConnectionManager(c.TCPAddress)
+		log.Println("Starting in mode: TCP/IP-Socket")
+		go tcp.TCPDataHandler(c.TCPAddress, data.Default, stop)
+		return func() {
+			close(stop)
+			manager.CloseConnection()
+		}, nil
+	case "ModbusMode":
+		log.Println("Starting in mode: Modbus TCP client")
+		if err := modbus.StartTransport(c.ModbusClient, stop); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Mode unknown: %s", c.Mode)
+	}
+	return func() { close(stop) }, nil
+}
+
+func startMQTT(c *config.Config) (func(), error) {
+	if !c.MQTT.Enabled {
+		return noop, nil
+	}
+	bridge := mqtt.NewBridge(c.MQTT)
+	go bridge.Run()
+	return bridge.Stop, nil
+}
+
+// Start Modbus TCP server with signals from data and writes routed to controls
+func startModbusServer(c *config.Config) (func(), error) {
+	if !c.ModbusServer.Enabled {
+		return noop, nil
+	}
+	cfg := c.ModbusServer
+	modbus.DefaultServerMap(&cfg, data.SignalNames())
+	server, err := modbus.NewServer(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Modbus server config invalid: %w", err)
+	}
+	// Registers address signals and commands by tag path or name
+	server.ReadSignal = func(name string) (float64, bool) {
+		v, err := tags.Read(name)
+		return float64(v.Value), err == nil
+	}
+	server.ReadSetpoint = func(name string) (uint32, bool) {
+		if t, ok := tags.Lookup(name); ok && t.Command != "" {
+			name = t.Command
+		}
+		return controls.LastCommandValue(name)
+	}
+	server.Send, server.Check = tags.Write, tags.Check
+	listener, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting Modbus server on %s: %w", cfg.Address, err)
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Println(err)
+		}
+	}()
+	return server.Close, nil
+}
+
+var (
+	watchdogMu     sync.Mutex
+	activeWatchdog *watchdog.Watchdog
+)
+
+func startWatchdog(c *config.Config) (func(), error) {
+	if !c.Watchdog.Enabled {
+		return noop, nil
+	}
+	wd := watchdog.New(c.Watchdog, data.Default, c.Mode, c.ModbusClient.PollInterval)
+	stop := make(chan struct{})
+	go wd.Run(stop)
+	watchdogMu.Lock()
+	activeWatchdog = wd
+	watchdogMu.Unlock()
+	return func() {
+		close(stop)
+		watchdogMu.Lock()
+		if activeWatchdog == wd {
+			activeWatchdog = nil
+		}
+		watchdogMu.Unlock()
+	}, nil
+}
+
+// Handler for the status of the running watchdog
+func watchdogHandler(w http.ResponseWriter, r *http.Request) {
+	watchdogMu.Lock()
+	wd := activeWatchdog
+	watchdogMu.Unlock()
+	if wd == nil {
+		http.Error(w, "Watchdog disabled", http.StatusNotFound)
+		return
+	}
+	wd.Handler(w, r)
+}
@@ -0,0 +1,104 @@
+package spc
+
+import (
+	"math"
+)
+
+// Violation of a Western Electric / Nelson rule
+type Violation struct {
+	Rule        string `json:"rule"`
+	Description string `json:"description"`
+	Subgroup    int    `json:"subgroup"` //Index of the subgroup completing the pattern
+}
+
+// Rules evaluated on the X-bar chart
+var ruleDescriptions = map[string]string{
+	"we1":     "One point beyond 3 sigma",
+	"we2":     "2 of 3 consecutive points beyond 2 sigma on the same side",
+	"we3":     "4 of 5 consecutive points beyond 1 sigma on the same side",
+	"we4":     "8 consecutive points on the same side of the center line",
+	"nelson3": "6 consecutive points steadily increasing or decreasing",
+	"nelson4": "14 consecutive points alternating up and down",
+	"rchart1": "Range beyond control limits",
+}
+
+// Check rules for the subgroup at index i against the X-bar/R limits
+func checkRules(means []float64, ranges []float64, i int, limits ChartLimits) []Violation {
+	cl := limits.XbarR.CL
+	sigma := (limits.XbarR.UCL - cl) / 3
+	if sigma <= 0 {
+		return nil
+	}
+	// Zone of a point in sigma units, positive above the center line
+	z := func(j int) float64 { return (means[j] - cl) / sigma }
+
+	var found []Violation
+	add := func(rule string) {
+		found = append(found, Violation{Rule: rule, Description: ruleDescriptions[rule], Subgroup: i})
+	}
+	if math.Abs(z(i)) > 3 {
+		add("we1")
+	}
+	if countBeyond(z, i, 3, 2) >= 2 {
+		add("we2")
+	}
+	if countBeyond(z, i, 5, 1) >= 4 {
+		add("we3")
+	}
+	if i >= 7 && sameSide(z, i, 8) {
+		add("we4")
+	}
+	if i >= 5 && monotonic(means, i, 6) {
+		add("nelson3")
+	}
+	if i >= 13 && alternating(means, i, 14) {
+		add("nelson4")
+	}
+	if ranges[i] > limits.R.UCL || ranges[i] < limits.R.LCL {
+		add("rchart1")
+	}
+	return found
+}
+
+// Maximum number of the last window points beyond limit on one side (point i must be one of them)
+func countBeyond(z func(int) float64, i int, window int, limit float64) int {
+	if i < window-1 || math.Abs(z(i)) <= limit {
+		return 0
+	}
+	side := math.Copysign(1, z(i))
+	count := 0
+	for j := i - window + 1; j <= i; j++ {
+		if z(j)*side > limit {
+			count++
+		}
+	}
+	return count
+}
+
+func sameSide(z func(int) float64, i int, window int) bool {
+	side := math.Copysign(1, z(i))
+	for j := i - window + 1; j <= i; j++ {
+		if z(j)*side <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func monotonic(values []float64, i int, window int) bool {
+	up, down := true, true
+	for j := i - window + 2; j <= i; j++ {
+		up = up && values[j] > values[j-1]
+		down = down && values[j] < values[j-1]
+	}
+	return up || down
+}
+
+func alternating(values []float64, i int, window int) bool {
+	for j := i - window + 3; j <= i; j++ {
+		if (values[j]-values[j-1])*(values[j-1]-values[j-2]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,238 @@
+package spc
+
+import (
+	"encoding/json"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Subgroup of consecutive diameter samples
+type Subgroup struct {
+	Index  int       `json:"index"`
+	Spool  int       `json:"spool"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Values []float64 `json:"values"`
+	Mean   float64   `json:"mean"`
+	Range  float64   `json:"range"`
+	StdDev float64   `json:"stdDev"`
+}
+
+// Monitor building subgroups from diameter samples and checking control rules
+type Monitor struct {
+	mu        sync.Mutex
+	cfg       config.SPCConfig
+	lsl, usl  float64
+	spoolID   func() int
+	pending   []float64
+	pendStart time.Time
+	pendSpool int
+	subgroups []Subgroup
+	nextIndex int
+	active    map[string]bool // Rules with active alarm
+}
+
+// Create monitor. Specification limits come from the nominal diameter and tolerance,
+// spoolID returns the ID of the running spool.
+func NewMonitor(cfg config.SPCConfig, lsl, usl float64, spoolID func() int) *Monitor {
+	return &Monitor{cfg: withDefaults(cfg), lsl: lsl, usl: usl, spoolID: spoolID, active: map[string]bool{}}
+}
+
+func withDefaults(cfg config.SPCConfig) config.SPCConfig {
+	if cfg.SubgroupSize < minSubgroupSize || cfg.SubgroupSize > maxSubgroupSize {
+		cfg.SubgroupSize = 5
+	}
+	if cfg.BaselineSubgroups <= 0 {
+		cfg.BaselineSubgroups = 25
+	}
+	if cfg.MaxSubgroups <= 0 {
+		cfg.MaxSubgroups = 10000
+	}
+	return cfg
+}
+
+// Apply changed config and specification limits. The subgroup size is only changed at start,
+// as the baseline limits need subgroups of one size.
+func (m *Monitor) Configure(cfg config.SPCConfig, lsl, usl float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cfg = withDefaults(cfg)
+	cfg.SubgroupSize = m.cfg.SubgroupSize
+	m.cfg, m.lsl, m.usl = cfg, lsl, usl
+}
+
+// Subscribe to diameter updates
+func (m *Monitor) Start() {
+	data.Subscribe(m.onUpdate)
+}
+
+// Collect good diameter samples into subgroups
+func (m *Monitor) onUpdate(u data.Update) {
+	if u.Signal != "diameter" || u.Point.Quality != data.QualityGood {
+		return
+	}
+	spool := m.spoolID()
+	m.mu.Lock()
+	if spool != m.pendSpool {
+		m.pending = nil // Subgroups don't span spool changes
+		m.pendSpool = spool
+	}
+	if len(m.pending) == 0 {
+		m.pendStart = u.Point.Timestamp
+	}
+	m.pending = append(m.pending, float64(u.Point.Value))
+	if len(m.pending) < m.cfg.SubgroupSize {
+		m.mu.Unlock()
+		return
+	}
+	mean, rng, stdDev := describe(m.pending)
+	m.subgroups = append(m.subgroups, Subgroup{
+		Index: m.nextIndex, Spool: spool, Start: m.pendStart, End: u.Point.Timestamp,
+		Values: m.pending, Mean: mean, Range: rng, StdDev: stdDev,
+	})
+	m.nextIndex++
+	m.pending = nil
+	if len(m.subgroups) > m.cfg.MaxSubgroups {
+		m.subgroups = m.subgroups[len(m.subgroups)-m.cfg.MaxSubgroups:]
+	}
+	violations := m.evaluateLatest(spool)
+	raise, clear := m.updateActive(violations)
+	m.mu.Unlock()
+
+	for _, v := range raise {
+		alarms.Raise(alarms.Alarm{
+			ID:       "spc:" + v.Rule,
+			Severity: alarms.SeverityWarning,
+			Source:   "spc",
+			Message:  "SPC diameter: " + v.Description,
+			Fields:   map[string]string{"rule": v.Rule, "spool": strconv.Itoa(spool), "subgroup": strconv.Itoa(v.Subgroup)},
+		})
+	}
+	for _, rule := range clear {
+		alarms.Clear("spc:" + rule)
+	}
+}
+
+// Check rules for the newest subgroup against the baseline limits of its spool (caller holds mu)
+func (m *Monitor) evaluateLatest(spool int) []Violation {
+	groups := filterSpool(m.subgroups, spool)
+	if len(groups) <= m.cfg.BaselineSubgroups {
+		return nil // Baseline not complete
+	}
+	limits := computeLimits(groups[:m.cfg.BaselineSubgroups], m.cfg.SubgroupSize)
+	means, ranges := series(groups)
+	last := len(groups) - 1
+	violations := checkRules(means, ranges, last, limits)
+	for i := range violations {
+		violations[i].Subgroup = groups[last].Index
+	}
+	return violations
+}
+
+// Track rules with active alarm, return violations to raise and rules to clear (caller holds mu)
+func (m *Monitor) updateActive(violations []Violation) (raise []Violation, clear []string) {
+	violated := map[string]bool{}
+	for _, v := range violations {
+		violated[v.Rule] = true
+		if !m.active[v.Rule] {
+			raise = append(raise, v)
+		}
+	}
+	for rule := range m.active {
+		if !violated[rule] {
+			clear = append(clear, rule)
+		}
+	}
+	m.active = violated
+	return raise, clear
+}
+
+func filterSpool(groups []Subgroup, spool int) []Subgroup {
+	var out []Subgroup
+	for _, g := range groups {
+		if g.Spool == spool {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+func series(groups []Subgroup) (means []float64, ranges []float64) {
+	for _, g := range groups {
+		means = append(means, g.Mean)
+		ranges = append(ranges, g.Range)
+	}
+	return means, ranges
+}
+
+// Statistics of a selection of subgroups
+type Report struct {
+	SubgroupSize int         `json:"subgroupSize"`
+	Subgroups    []Subgroup  `json:"subgroups"`
+	Limits       ChartLimits `json:"limits"`
+	Capability   Capability  `json:"capability"`
+	Violations   []Violation `json:"violations"`
+}
+
+// Compute report for subgroups of a spool (spool > 0) or a time window
+func (m *Monitor) Report(spool int, from, to time.Time) Report {
+	m.mu.Lock()
+	var groups []Subgroup
+	for _, g := range m.subgroups {
+		if spool > 0 && g.Spool != spool {
+			continue
+		}
+		if (!from.IsZero() && g.End.Before(from)) || (!to.IsZero() && g.Start.After(to)) {
+			continue
+		}
+		groups = append(groups, g)
+	}
+	n := m.cfg.SubgroupSize
+	lsl, usl := m.lsl, m.usl
+	m.mu.Unlock()
+
+	r := Report{SubgroupSize: n, Subgroups: groups, Violations: []Violation{}}
+	r.Limits = computeLimits(groups, n)
+	r.Capability = computeCapability(groups, r.Limits, lsl, usl)
+	means, ranges := series(groups)
+	for i := range groups {
+		for _, v := range checkRules(means, ranges, i, r.Limits) {
+			v.Subgroup = groups[i].Index
+			r.Violations = append(r.Violations, v)
+		}
+	}
+	return r
+}
+
+// Handler for SPC statistics: /spc?spool=3 or /spc?from=...&to=... (RFC 3339)
+func (m *Monitor) Handler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var spool int
+	var from, to time.Time
+	var err error
+	if s := query.Get("spool"); s != "" {
+		if spool, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "Invalid spool", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Report(spool, from, to))
+}
@@ -0,0 +1,92 @@
+package spc
+
+import (
+	"encoding/json"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Feed diameter samples into the monitor
+func feed(m *Monitor, start time.Time, values ...float32) {
+	for i, v := range values {
+		m.onUpdate(data.Update{Signal: "diameter", Point: data.Datapoint{
+			Timestamp: start.Add(time.Duration(i) * time.Second), Value: v, Quality: data.QualityGood,
+		}})
+	}
+}
+
+// Test for describe: mean, range and sample standard deviation
+func TestDescribe(t *testing.T) {
+	mean, rng, stdDev := describe([]float64{2, 4, 4, 4, 5, 5, 7, 9})
+	if mean != 5 || rng != 7 || math.Abs(stdDev-2.138) > 0.001 {
+		t.Errorf("Expected: 5 7 2.138, received: %v %v %v", mean, rng, stdDev)
+	}
+}
+
+// Test for checkRules: single point beyond 3 sigma and run on one side
+func TestCheckRules(t *testing.T) {
+	limits := ChartLimits{XbarR: Limits{CL: 0, UCL: 3, LCL: -3}, R: Limits{CL: 1, UCL: 2, LCL: 0}}
+	means := []float64{0.1, -0.2, 3.5}
+	ranges := []float64{1, 1, 1}
+	if v := checkRules(means, ranges, 2, limits); len(v) != 1 || v[0].Rule != "we1" {
+		t.Errorf("Expected: we1, received: %+v", v)
+	}
+	means = []float64{0.5, 0.4, 0.3, 0.6, 0.2, 0.5, 0.1, 0.4}
+	ranges = make([]float64, len(means))
+	found := false
+	for _, v := range checkRules(means, ranges, 7, limits) {
+		if v.Rule == "we4" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected we4 violation for 8 points above center line")
+	}
+}
+
+// Test for Monitor: subgroups, baseline limits, alarm on shift and report per spool
+func TestMonitor_ShiftRaisesAlarm(t *testing.T) {
+	spool := 1
+	m := NewMonitor(config.SPCConfig{SubgroupSize: 4, BaselineSubgroups: 5}, 1.70, 1.80, func() int { return spool })
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		feed(m, start, 1.74, 1.75, 1.76, 1.75)
+	}
+	if alarms.IsActive("spc:we1") {
+		t.Fatalf("Unexpected alarm during baseline")
+	}
+	feed(m, start, 1.90, 1.91, 1.90, 1.91)
+	if !alarms.IsActive("spc:we1") {
+		t.Errorf("Expected spc:we1 alarm after shift")
+	}
+	feed(m, start, 1.74, 1.75, 1.76, 1.75)
+	if alarms.IsActive("spc:we1") {
+		t.Errorf("Expected spc:we1 alarm to clear")
+	}
+
+	// Incomplete subgroup is dropped on spool change
+	feed(m, start, 1.75, 1.75)
+	spool = 2
+	feed(m, start, 1.75, 1.76, 1.74, 1.75)
+
+	rec := httptest.NewRecorder()
+	m.Handler(rec, httptest.NewRequest("GET", "/spc?spool=1", nil))
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("Could not decode report: %v", err)
+	}
+	if len(report.Subgroups) != 7 {
+		t.Errorf("Subgroups of spool 1. Expected: %v, received: %v", 7, len(report.Subgroups))
+	}
+	if report.Capability.Cp <= 0 {
+		t.Errorf("Expected positive Cp, received: %v", report.Capability.Cp)
+	}
+	if r := m.Report(2, time.Time{}, time.Time{}); len(r.Subgroups) != 1 {
+		t.Errorf("Subgroups of spool 2. Expected: %v, received: %v", 1, len(r.Subgroups))
+	}
+}
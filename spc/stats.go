@@ -0,0 +1,115 @@
+package spc
+
+import (
+	"math"
+)
+
+// Control chart constants per subgroup size n (index = n), ASTM STP 15D
+var (
+	constA2 = []float64{0, 0, 1.880, 1.023, 0.729, 0.577, 0.483, 0.419, 0.373, 0.337, 0.308}
+	constD2 = []float64{0, 0, 1.128, 1.693, 2.059, 2.326, 2.534, 2.704, 2.847, 2.970, 3.078}
+	constD3 = []float64{0, 0, 0, 0, 0, 0, 0, 0.076, 0.136, 0.184, 0.223}
+	constD4 = []float64{0, 0, 3.267, 2.574, 2.282, 2.114, 2.004, 1.924, 1.864, 1.816, 1.777}
+	constA3 = []float64{0, 0, 2.659, 1.954, 1.628, 1.427, 1.287, 1.182, 1.099, 1.032, 0.975}
+	constB3 = []float64{0, 0, 0, 0, 0, 0, 0.030, 0.118, 0.185, 0.239, 0.284}
+	constB4 = []float64{0, 0, 3.267, 2.568, 2.266, 2.089, 1.970, 1.882, 1.815, 1.761, 1.716}
+)
+
+// Supported subgroup sizes
+const (
+	minSubgroupSize = 2
+	maxSubgroupSize = 10
+)
+
+// Control limits of one chart
+type Limits struct {
+	CL  float64 `json:"cl"`
+	UCL float64 `json:"ucl"`
+	LCL float64 `json:"lcl"`
+}
+
+// Limits of X-bar/R and X-bar/S charts
+type ChartLimits struct {
+	XbarR Limits  `json:"xbarR"` //X-bar chart with limits from R-bar
+	R     Limits  `json:"r"`
+	XbarS Limits  `json:"xbarS"` //X-bar chart with limits from S-bar
+	S     Limits  `json:"s"`
+	Sigma float64 `json:"sigma"` //Within subgroup sigma estimate R-bar/d2
+}
+
+// Process capability against the specification limits
+type Capability struct {
+	LSL float64 `json:"lsl"`
+	USL float64 `json:"usl"`
+	Cp  float64 `json:"cp"`
+	Cpk float64 `json:"cpk"`
+	Pp  float64 `json:"pp"`  //With overall standard deviation
+	Ppk float64 `json:"ppk"` //With overall standard deviation
+}
+
+// Mean, range and sample standard deviation of values
+func describe(values []float64) (mean, rng, stdDev float64) {
+	if len(values) == 0 {
+		return 0, 0, 0
+	}
+	min, max, sum := values[0], values[0], 0.0
+	for _, v := range values {
+		sum += v
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	mean = sum / float64(len(values))
+	if len(values) > 1 {
+		var ss float64
+		for _, v := range values {
+			ss += (v - mean) * (v - mean)
+		}
+		stdDev = math.Sqrt(ss / float64(len(values)-1))
+	}
+	return mean, max - min, stdDev
+}
+
+// Compute X-bar/R and X-bar/S limits from subgroups of size n
+func computeLimits(groups []Subgroup, n int) ChartLimits {
+	if len(groups) == 0 || n < minSubgroupSize || n > maxSubgroupSize {
+		return ChartLimits{}
+	}
+	var xbarbar, rbar, sbar float64
+	for _, g := range groups {
+		xbarbar += g.Mean
+		rbar += g.Range
+		sbar += g.StdDev
+	}
+	k := float64(len(groups))
+	xbarbar, rbar, sbar = xbarbar/k, rbar/k, sbar/k
+	return ChartLimits{
+		XbarR: Limits{CL: xbarbar, UCL: xbarbar + constA2[n]*rbar, LCL: xbarbar - constA2[n]*rbar},
+		R:     Limits{CL: rbar, UCL: constD4[n] * rbar, LCL: constD3[n] * rbar},
+		XbarS: Limits{CL: xbarbar, UCL: xbarbar + constA3[n]*sbar, LCL: xbarbar - constA3[n]*sbar},
+		S:     Limits{CL: sbar, UCL: constB4[n] * sbar, LCL: constB3[n] * sbar},
+		Sigma: rbar / constD2[n],
+	}
+}
+
+// Compute Cp/Cpk (within sigma) and Pp/Ppk (overall sigma)
+func computeCapability(groups []Subgroup, limits ChartLimits, lsl, usl float64) Capability {
+	c := Capability{LSL: lsl, USL: usl}
+	if len(groups) == 0 || usl <= lsl {
+		return c
+	}
+	var all []float64
+	for _, g := range groups {
+		all = append(all, g.Values...)
+	}
+	mean, _, overall := describe(all)
+	c.Cp, c.Cpk = capability(mean, limits.Sigma, lsl, usl)
+	c.Pp, c.Ppk = capability(mean, overall, lsl, usl)
+	return c
+}
+
+func capability(mean, sigma, lsl, usl float64) (float64, float64) {
+	if sigma <= 0 {
+		return 0, 0
+	}
+	return (usl - lsl) / (6 * sigma), math.Min(usl-mean, mean-lsl) / (3 * sigma)
+}
@@ -0,0 +1,86 @@
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Handler for spool list: current spool and history
+func (t *Tracker) ListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current": t.Current(),
+		"spools":  t.History(),
+	})
+}
+
+// Handler for manual spool change
+func (t *Tracker) NewSpoolHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		return
+	}
+	completed := t.NewSpool()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(completed)
+}
+
+// Handler for per-spool quality report download: /spools/report?id=3
+func (t *Tracker) ReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Parameter id missing or invalid", http.StatusBadRequest)
+		return
+	}
+	s, ok := t.Get(id)
+	if !ok {
+		http.Error(w, "Unknown spool", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="spool_%d_report.txt"`, s.ID))
+	t.WriteReport(w, s)
+}
+
+// Write quality report of a spool as plain text
+func (t *Tracker) WriteReport(w io.Writer, s Spool) {
+	end := "running"
+	if !s.End.IsZero() {
+		end = s.End.Format(time.RFC3339)
+	}
+	detection := "automatic"
+	if s.Manual {
+		detection = "manual"
+	}
+	fmt.Fprintf(w, "Spool quality report\n")
+	fmt.Fprintf(w, "====================\n\n")
+	fmt.Fprintf(w, "Spool ID:              %d\n", s.ID)
+	fmt.Fprintf(w, "Start:                 %s\n", s.Start.Format(time.RFC3339))
+	fmt.Fprintf(w, "End:                   %s\n", end)
+	fmt.Fprintf(w, "Duration:              %s\n", spoolDuration(s).Round(time.Second))
+	fmt.Fprintf(w, "Spool change:          %s\n\n", detection)
+	fmt.Fprintf(w, "Final mass:            %.2f g\n", s.FinalMass)
+	fmt.Fprintf(w, "Windings:              %.0f\n", s.Windings)
+	fmt.Fprintf(w, "Winding diameter:      %.2f mm\n", s.WindingDiameter)
+	fmt.Fprintf(w, "Est. filament length:  %.1f m\n\n", s.Length)
+	fmt.Fprintf(w, "Diameter\n")
+	fmt.Fprintf(w, "  Nominal:             %.3f +/- %.3f\n", t.cfg.NominalDiameter, t.cfg.Tolerance)
+	fmt.Fprintf(w, "  Samples:             %d\n", s.Samples)
+	fmt.Fprintf(w, "  Average:             %.3f\n", s.AvgDiameter)
+	fmt.Fprintf(w, "  Average (simulator): %.3f\n", s.AvgFilDiameter)
+	fmt.Fprintf(w, "  Min / Max:           %.3f / %.3f\n", s.MinDiameter, s.MaxDiameter)
+	fmt.Fprintf(w, "  Std. deviation:      %.4f\n", s.StdDevDiameter)
+	fmt.Fprintf(w, "  Out of tolerance:    %d samples, %.1f m\n", s.OutOfToleranceCount, s.OutOfToleranceLength)
+}
+
+// Duration of spool, running spools up to now
+func spoolDuration(s Spool) time.Duration {
+	if s.End.IsZero() {
+		return time.Since(s.Start)
+	}
+	return s.End.Sub(s.Start)
+}
@@ -0,0 +1,293 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Completed or running spool
+type Spool struct {
+	ID                   int       `json:"id"`
+	Start                time.Time `json:"start"`
+	End                  time.Time `json:"end,omitempty"` //Zero while running
+	Manual               bool      `json:"manual"`        //Completed by operator instead of detection rule
+	FinalMass            float64   `json:"finalMass"`     //g
+	Windings             float64   `json:"windings"`
+	WindingDiameter      float64   `json:"windingDiameter"`
+	AvgFilDiameter       float64   `json:"avgFilDiameter"` //As reported by the simulator
+	Samples              int       `json:"samples"`        //Diameter samples during the spool
+	AvgDiameter          float64   `json:"avgDiameter"`
+	MinDiameter          float64   `json:"minDiameter"`
+	MaxDiameter          float64   `json:"maxDiameter"`
+	StdDevDiameter       float64   `json:"stdDevDiameter"`
+	OutOfToleranceCount  int       `json:"outOfToleranceCount"`
+	Length               float64   `json:"length"`               //Estimated filament length in m
+	OutOfToleranceLength float64   `json:"outOfToleranceLength"` //Estimated length outside tolerance in m
+}
+
+// Running diameter statistics of the current spool
+type accumulator struct {
+	n, oot         int
+	sum, sumSquare float64
+	min, max       float64
+}
+
+func (a *accumulator) add(v float64, outOfTolerance bool) {
+	if a.n == 0 || v < a.min {
+		a.min = v
+	}
+	if a.n == 0 || v > a.max {
+		a.max = v
+	}
+	a.n++
+	a.sum += v
+	a.sumSquare += v * v
+	if outOfTolerance {
+		a.oot++
+	}
+}
+
+// Tracker of the current spool and the spool history
+type Tracker struct {
+	mu      sync.Mutex
+	cfg     config.SpoolConfig
+	history []Spool
+	current Spool
+	stats   accumulator
+	now     func() time.Time
+
+	manualMu sync.Mutex // Serializes manual spool changes
+	manual   chan Spool // Receives the spool completed by the running manual change
+}
+
+// Create tracker, load history and install detection rule
+func NewTracker(cfg config.SpoolConfig) (*Tracker, error) {
+	t := &Tracker{cfg: withDefaults(cfg), now: time.Now}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	nextID := 1
+	if n := len(t.history); n > 0 {
+		nextID = t.history[n-1].ID + 1
+	}
+	t.current = Spool{ID: nextID, Start: t.now()}
+	return t, nil
+}
+
+func withDefaults(cfg config.SpoolConfig) config.SpoolConfig {
+	if cfg.MinWindingDiameter == 0 {
+		cfg.MinWindingDiameter = 12
+	}
+	if cfg.Density == 0 {
+		cfg.Density = 1.24
+	}
+	if cfg.DiameterScale == 0 {
+		cfg.DiameterScale = 1
+	}
+	return cfg
+}
+
+// Apply changed detection, tolerance and length settings. The history file is only read at start.
+func (t *Tracker) Configure(cfg config.SpoolConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cfg = withDefaults(cfg)
+	cfg.HistoryFile = t.cfg.HistoryFile
+	t.cfg = cfg
+}
+
+// Start tracking: spool change rule and data listeners
+func (t *Tracker) Start() {
+	data.SetSpoolChangeRule(t.changeRule)
+	data.Subscribe(t.onUpdate)
+	data.SubscribeSpoolCompleted(func(stats data.SpoolStats) {
+		t.complete(stats)
+	})
+}
+
+// Configurable spool change rule: mass was reset while a run was active
+func (t *Tracker) changeRule(prev data.SpoolStats, cur data.SpoolStats) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	drop := float64(prev.FilamentMass.Value - cur.FilamentMass.Value)
+	return drop > t.cfg.MinMassDrop && drop > 0 && float64(prev.WindingDiameter.Value) > t.cfg.MinWindingDiameter
+}
+
+// Collect good diameter samples for the current spool
+func (t *Tracker) onUpdate(u data.Update) {
+	if u.Signal != "diameter" || u.Point.Quality != data.QualityGood {
+		return
+	}
+	v := float64(u.Point.Value)
+	t.mu.Lock()
+	t.stats.add(v, t.outOfTolerance(v))
+	t.mu.Unlock()
+}
+
+// Check diameter against nominal value and tolerance (disabled without tolerance)
+func (t *Tracker) outOfTolerance(v float64) bool {
+	return t.cfg.Tolerance > 0 && math.Abs(v-t.cfg.NominalDiameter) > t.cfg.Tolerance
+}
+
+// Mark spool change by operator, returns the completed spool
+func (t *Tracker) NewSpool() Spool {
+	t.manualMu.Lock()
+	defer t.manualMu.Unlock()
+	done := make(chan Spool, 1)
+	t.mu.Lock()
+	t.current.Manual = true
+	t.manual = done
+	t.mu.Unlock()
+	data.CompleteSpool() // Calls complete via the spool listener
+	t.mu.Lock()
+	t.manual = nil
+	t.mu.Unlock()
+	select {
+	case s := <-done:
+		return s
+	default:
+		return Spool{} // Tracker not started
+	}
+}
+
+// Finish current spool with final stats, persist history and start next spool.
+// Returns the finished spool, a manual change waiting for it receives it as well.
+func (t *Tracker) complete(stats data.SpoolStats) Spool {
+	t.mu.Lock()
+	s := t.current
+	s.End = t.now()
+	s.FinalMass = float64(stats.FilamentMass.Value)
+	s.Windings = float64(stats.NbrOfWindings.Value)
+	s.WindingDiameter = float64(stats.WindingDiameter.Value)
+	s.AvgFilDiameter = float64(stats.AvgFilDiameter.Value)
+	t.applyStats(&s)
+	t.history = append(t.history, s)
+	t.current = Spool{ID: s.ID + 1, Start: s.End}
+	t.stats = accumulator{}
+	if s.Manual && t.manual != nil {
+		t.manual <- s
+		t.manual = nil
+	}
+	err := t.save()
+	t.mu.Unlock()
+
+	if err != nil {
+		log.Println("Error saving spool history:", err)
+	}
+	log.Printf("Spool %d completed: %.1f g, %d diameter samples", s.ID, s.FinalMass, s.Samples)
+	return s
+}
+
+// Copy diameter statistics and length estimate into spool (caller holds mu)
+func (t *Tracker) applyStats(s *Spool) {
+	a := t.stats
+	s.Samples = a.n
+	s.OutOfToleranceCount = a.oot
+	if a.n > 0 {
+		s.AvgDiameter = a.sum / float64(a.n)
+		s.MinDiameter, s.MaxDiameter = a.min, a.max
+		if a.n > 1 {
+			variance := (a.sumSquare - a.sum*a.sum/float64(a.n)) / float64(a.n-1)
+			s.StdDevDiameter = math.Sqrt(math.Max(variance, 0))
+		}
+	}
+	// Length from mass: m = density * pi * (d/2)^2 * L
+	d := t.cfg.NominalDiameter
+	if d == 0 {
+		d = s.AvgDiameter
+	}
+	d *= t.cfg.DiameterScale // mm
+	if d > 0 && s.FinalMass > 0 {
+		areaCm2 := math.Pi * math.Pow(d/20, 2)
+		s.Length = s.FinalMass / (t.cfg.Density * areaCm2) / 100
+		if a.n > 0 {
+			s.OutOfToleranceLength = s.Length * float64(a.oot) / float64(a.n)
+		}
+	}
+}
+
+// Return current spool with statistics so far
+func (t *Tracker) Current() Spool {
+	stats := data.CurrentSpool() // Before mu, the change rule is called with the data lock held
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.current
+	s.FinalMass = float64(stats.FilamentMass.Value)
+	t.applyStats(&s)
+	return s
+}
+
+// Return ID of the running spool
+func (t *Tracker) CurrentID() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current.ID
+}
+
+// Return completed spools, oldest first
+func (t *Tracker) History() []Spool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Spool{}, t.history...)
+}
+
+// Return spool by ID (completed or current)
+func (t *Tracker) Get(id int) (Spool, bool) {
+	if cur := t.Current(); cur.ID == id {
+		return cur, true
+	}
+	for _, s := range t.History() {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return Spool{}, false
+}
+
+// Load history file, a missing file starts an empty history
+func (t *Tracker) load() error {
+	if t.cfg.HistoryFile == "" {
+		return nil
+	}
+	content, err := os.ReadFile(t.cfg.HistoryFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Error reading spool history: %w", err)
+	}
+	if err := json.Unmarshal(content, &t.history); err != nil {
+		return fmt.Errorf("Error decoding spool history: %w", err)
+	}
+	return nil
+}
+
+// Write history file atomically (caller holds mu)
+func (t *Tracker) save() error {
+	if t.cfg.HistoryFile == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(t.history, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.cfg.HistoryFile), ".spools-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), t.cfg.HistoryFile)
+}
@@ -0,0 +1,137 @@
+package spool
+
+import (
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"math"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test for Tracker: diameter statistics, detection rule and persistence
+func TestTracker_Lifecycle(t *testing.T) {
+	cfg := config.SpoolConfig{
+		HistoryFile:     filepath.Join(t.TempDir(), "spools.json"),
+		NominalDiameter: 1.75,
+		Tolerance:       0.05,
+	}
+	tracker, err := NewTracker(cfg)
+	if err != nil {
+		t.Fatalf("Could not create tracker: %v", err)
+	}
+	tracker.Start()
+
+	for _, d := range []float32{1.70, 1.75, 1.80, 1.85} {
+		data.SetValue("diameter", d, time.Now())
+	}
+	// Spool grows, then mass is reset by the simulator
+	data.GetStatsFromRow("12:00:00.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 60 | 1.75 | 100 | 500", "|")
+	data.GetStatsFromRow("12:00:01.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 10 | 1.75 | 0 | 0", "|")
+
+	history := tracker.History()
+	if len(history) != 1 {
+		t.Fatalf("Expected 1 completed spool, received: %d", len(history))
+	}
+	s := history[0]
+	if s.FinalMass != 500 || s.Windings != 100 || s.Samples != 4 || s.OutOfToleranceCount != 1 {
+		t.Errorf("Unexpected spool stats: %+v", s)
+	}
+	if math.Abs(s.AvgDiameter-1.775) > 1e-3 || math.Abs(s.MinDiameter-1.70) > 1e-3 || math.Abs(s.MaxDiameter-1.85) > 1e-3 {
+		t.Errorf("Unexpected diameter stats: %+v", s)
+	}
+	// 500 g PLA with 1.75 mm is about 167 m
+	if math.Abs(s.Length-167.6) > 1 || math.Abs(s.OutOfToleranceLength-s.Length/4) > 1e-6 {
+		t.Errorf("Unexpected length estimate: %v / %v", s.Length, s.OutOfToleranceLength)
+	}
+	if tracker.Current().ID != 2 {
+		t.Errorf("Next spool should have ID 2, received: %d", tracker.Current().ID)
+	}
+
+	// History is loaded again with continued IDs
+	reloaded, err := NewTracker(cfg)
+	if err != nil || len(reloaded.History()) != 1 || reloaded.Current().ID != 2 {
+		t.Errorf("History not persisted: %v, %+v", err, reloaded.History())
+	}
+}
+
+// Test for changeRule: minimum winding diameter and mass drop
+func TestTracker_ChangeRule(t *testing.T) {
+	tracker := &Tracker{cfg: config.SpoolConfig{MinWindingDiameter: 12, MinMassDrop: 50}}
+	stats := func(mass, winding float32) data.SpoolStats {
+		return data.SpoolStats{FilamentMass: data.Datapoint{Value: mass}, WindingDiameter: data.Datapoint{Value: winding}}
+	}
+	if !tracker.changeRule(stats(500, 60), stats(0, 10)) {
+		t.Errorf("Mass reset on full spool should be a spool change")
+	}
+	if tracker.changeRule(stats(500, 60), stats(480, 60)) {
+		t.Errorf("Mass drop below threshold shouldn't be a spool change")
+	}
+	if tracker.changeRule(stats(500, 10), stats(0, 10)) {
+		t.Errorf("Spool change requires a winding diameter above minimum")
+	}
+}
+
+// Test for Configure: detection settings change, the history file is kept
+func TestTracker_Configure(t *testing.T) {
+	tracker := &Tracker{cfg: config.SpoolConfig{HistoryFile: "spools.json", MinWindingDiameter: 12, MinMassDrop: 50}}
+	tracker.Configure(config.SpoolConfig{HistoryFile: "other.json", MinMassDrop: 600})
+	stats := func(mass, winding float32) data.SpoolStats {
+		return data.SpoolStats{FilamentMass: data.Datapoint{Value: mass}, WindingDiameter: data.Datapoint{Value: winding}}
+	}
+	if tracker.changeRule(stats(500, 60), stats(0, 10)) {
+		t.Errorf("Mass drop below the configured threshold shouldn't be a spool change")
+	}
+	if tracker.cfg.HistoryFile != "spools.json" || tracker.cfg.MinWindingDiameter != 12 {
+		t.Errorf("Unexpected config: %+v", tracker.cfg)
+	}
+}
+
+// Test for NewSpool: returns the completed spool, the later mass reset of the machine is no further spool change
+func TestTracker_NewSpoolBaseline(t *testing.T) {
+	tracker, _ := NewTracker(config.SpoolConfig{})
+	tracker.Start()
+	data.GetStatsFromRow("12:00:00.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 60 | 1.75 | 100 | 500", "|")
+	if s := tracker.NewSpool(); s.ID != 1 || !s.Manual || s.FinalMass != 500 {
+		t.Errorf("Unexpected spool: %+v", s)
+	}
+	data.GetStatsFromRow("12:00:01.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 60 | 1.75 | 102 | 510", "|")
+	if s := tracker.Current(); s.FinalMass != 10 {
+		t.Errorf("Mass of the current spool. Expected: %v, received: %v", 10, s.FinalMass)
+	}
+	data.GetStatsFromRow("12:00:02.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 10 | 1.75 | 0 | 0", "|")
+	if n := len(tracker.History()); n != 1 {
+		t.Errorf("Mass reset after a manual change. Expected: 1 spool, received: %v", n)
+	}
+	data.GetStatsFromRow("12:00:03.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 60 | 1.75 | 100 | 400", "|")
+	data.GetStatsFromRow("12:00:04.000 | 0 | 0 | 0 | 0 | 0 | 0 | 0 | 10 | 1.75 | 0 | 0", "|")
+	if history := tracker.History(); len(history) != 2 || history[1].FinalMass != 400 || history[1].Manual {
+		t.Errorf("Expected detected spool of 400 g, received: %+v", history)
+	}
+}
+
+// Test for NewSpoolHandler and ReportHandler: manual spool change and report
+func TestTracker_ManualAndReport(t *testing.T) {
+	tracker, _ := NewTracker(config.SpoolConfig{})
+	tracker.Start()
+
+	w := httptest.NewRecorder()
+	tracker.NewSpoolHandler(w, httptest.NewRequest("POST", "/spools/new", nil))
+	history := tracker.History()
+	if w.Code != 200 || len(history) != 1 || !history[0].Manual {
+		t.Fatalf("Manual spool change failed: %d, %+v", w.Code, history)
+	}
+
+	w = httptest.NewRecorder()
+	tracker.ReportHandler(w, httptest.NewRequest("GET", "/spools/report?id=1", nil))
+	if !strings.Contains(w.Body.String(), "Spool change:          manual") {
+		t.Errorf("Unexpected report:\n%s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	tracker.ReportHandler(w, httptest.NewRequest("GET", "/spools/report?id=99", nil))
+	if w.Code != 404 {
+		t.Errorf("Expected 404 for unknown spool, received: %d", w.Code)
+	}
+}
@@ -0,0 +1,372 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/audit"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Process state of an extruder line
+type State string
+
+const (
+	Idle    State = "idle"    //Heater off, nothing driven
+	Heating State = "heating" //Heater on, temperature below the setpoint band
+	Ready   State = "ready"   //Temperature reached, screw and spooler stopped
+	Running State = "running" //Screw and spooler driven
+	Fault   State = "fault"   //Critical alarm or interlock, latched until reset
+	EStop   State = "e-stop"  //Emergency stop sent, latched until reset
+)
+
+// Valid transitions per state
+var transitions = map[State][]State{
+	Idle:    {Heating, Fault, EStop},
+	Heating: {Idle, Ready, Fault, EStop},
+	Ready:   {Idle, Heating, Running, Fault, EStop},
+	Running: {Ready, Fault, EStop},
+	Fault:   {Idle, EStop},
+	EStop:   {Idle},
+}
+
+// Causes of a transition
+const (
+	CauseCommand  = "command"
+	CauseFeedback = "feedback"
+	CauseAlarm    = "alarm"
+	CauseReset    = "reset"
+)
+
+// Temperature below setpoint - tolerance * hysteresis drops a ready machine back to heating
+const (
+	defaultTolerance = 5.0
+	hysteresis       = 2.0
+)
+
+// Rejected command or reset, the state is unchanged
+var ErrInvalid = errors.New("Not allowed in current state")
+
+// Entry of the transition history
+type Transition struct {
+	Time   time.Time `json:"time"`
+	From   State     `json:"from"`
+	To     State     `json:"to"`
+	Cause  string    `json:"cause"`
+	Reason string    `json:"reason"`
+}
+
+// Current state with mode and transition history, newest last
+type Status struct {
+	State   State        `json:"state"`
+	Since   time.Time    `json:"since"`
+	Manual  bool         `json:"manual"`  //Mode switch as last sent, auto until switched
+	Faults  []string     `json:"faults"`  //Active critical alarms
+	History []Transition `json:"history"` //Transitions, newest last
+}
+
+// State machine of one extruder line, driven by commands, signal feedback and critical alarms
+type Machine struct {
+	mu       sync.Mutex
+	cfg      config.StateConfig
+	setpoint func() (setpoint float64, tolerance float64)
+	state    State
+	since    time.Time
+	manual   bool
+	started  bool               // Start command accepted, the auto program runs once ready
+	command  bool               // State was entered by a command and awaits confirming feedback
+	values   map[string]float32 // Last feedback per signal
+	faults   map[string]string  // Active critical alarms: ID -> message
+	history  []Transition
+	now      func() time.Time
+
+	// Optional check before a reset, e.g. a latched emergency stop with its own reset
+	Interlock func() error
+	// Optional receiver of every transition, called with mu held and must not call back into the machine
+	OnTransition func(t Transition)
+}
+
+// Create state machine in state Idle, setpoint returns temperature setpoint and tolerance (0 = none)
+func New(cfg config.StateConfig, setpoint func() (float64, float64)) *Machine {
+	m := &Machine{
+		setpoint: setpoint,
+		state:    Idle,
+		values:   map[string]float32{},
+		faults:   map[string]string{},
+		now:      time.Now,
+	}
+	m.since = m.now()
+	m.Configure(cfg, setpoint)
+	return m
+}
+
+// Apply changed config and setpoint source, the current state is kept
+func (m *Machine) Configure(cfg config.StateConfig, setpoint func() (float64, float64)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cfg.SettleTime == 0 {
+		cfg.SettleTime = 10000
+	}
+	if cfg.HistorySize == 0 {
+		cfg.HistorySize = 200
+	}
+	m.cfg = cfg
+	if setpoint != nil {
+		m.setpoint = setpoint
+	}
+}
+
+// Feed signal updates of the store into the state machine, returns function to unsubscribe
+func (m *Machine) Attach(store *data.Store) func() {
+	return store.Subscribe(func(u data.Update) {
+		if u.Point.Quality == data.QualityBadParse {
+			return
+		}
+		m.Feedback(u.Signal, u.Point.Value)
+	})
+}
+
+// Current state
+func (m *Machine) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Current state with mode, active faults and history
+func (m *Machine) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := Status{State: m.state, Since: m.since, Manual: m.manual, Faults: []string{}, History: append([]Transition{}, m.history...)}
+	for _, msg := range m.faults {
+		s.Faults = append(s.Faults, msg)
+	}
+	sort.Strings(s.Faults)
+	return s
+}
+
+// Switch state if the transition is valid, caller holds mu
+func (m *Machine) transition(to State, cause string, reason string) bool {
+	if to == m.state {
+		return true
+	}
+	valid := false
+	for _, s := range transitions[m.state] {
+		valid = valid || s == to
+	}
+	if !valid {
+		return false
+	}
+	t := Transition{Time: m.now(), From: m.state, To: to, Cause: cause, Reason: reason}
+	m.history = append(m.history, t)
+	if len(m.history) > m.cfg.HistorySize {
+		m.history = m.history[len(m.history)-m.cfg.HistorySize:]
+	}
+	m.state, m.since, m.command = to, t.Time, cause == CauseCommand
+	if to != Heating && to != Ready {
+		m.started = false // Start done or aborted
+	}
+	log.Printf("State %s -> %s (%s): %s", t.From, t.To, cause, reason)
+	if m.OnTransition != nil {
+		m.OnTransition(t)
+	}
+	return true
+}
+
+// Check if a command makes sense in the current state, see controls command names.
+// Zero setpoints are always allowed so a machine can be brought into a safe state.
+func (m *Machine) Allow(command string, val uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch command {
+	case "emergency_stop":
+		return nil
+	case "start":
+		switch {
+		case m.state == Fault || m.state == EStop:
+			return fmt.Errorf("%w: reset %s before starting", ErrInvalid, m.state)
+		case m.manual:
+			return fmt.Errorf("%w: start is only available in auto mode", ErrInvalid)
+		case m.state == Running:
+			return fmt.Errorf("%w: already running", ErrInvalid)
+		}
+	case "mode_switch":
+		if m.state == Fault || m.state == EStop {
+			return fmt.Errorf("%w: mode cannot be switched in state %s", ErrInvalid, m.state)
+		}
+	case "heater_pwm", "screw_rpm", "spooler_rpm":
+		switch {
+		case val == 0:
+			return nil
+		case m.state == Fault || m.state == EStop:
+			return fmt.Errorf("%w: %s cannot be set in state %s", ErrInvalid, command, m.state)
+		case !m.manual:
+			return fmt.Errorf("%w: %s can only be set in manual mode", ErrInvalid, command)
+		}
+	}
+	return nil
+}
+
+// Apply a command that was sent to the machine
+func (m *Machine) Sent(command string, val uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch command {
+	case "emergency_stop":
+		m.transition(EStop, CauseCommand, "Emergency stop")
+	case "mode_switch":
+		m.manual = val == 1
+	case "start":
+		m.started = true
+		switch m.state {
+		case Idle:
+			m.transition(Heating, CauseCommand, "Start: heating up")
+		case Ready:
+			m.transition(Running, CauseCommand, "Start")
+		}
+	}
+}
+
+// Apply feedback of a signal (heaterPwm, temperature, screwRpm, spoolerRpm, contactSwitch)
+func (m *Machine) Feedback(signal string, value float32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch signal {
+	case "heaterPwm", "temperature", "screwRpm", "spoolerRpm", "contactSwitch":
+		m.values[signal] = value
+		m.evaluate()
+	}
+}
+
+// Derive transitions from the last feedback until the state is stable, caller holds mu
+func (m *Machine) evaluate() {
+	for i := 0; i < len(transitions); i++ {
+		before := m.state
+		m.step()
+		if m.state == before {
+			return
+		}
+	}
+}
+
+// Single transition derived from the last feedback, caller holds mu
+func (m *Machine) step() {
+	heater := m.values["heaterPwm"] > 0
+	turning := m.values["screwRpm"] > 0 && m.values["spoolerRpm"] > 0
+	stopped := m.values["screwRpm"] == 0 && m.values["spoolerRpm"] == 0
+	setpoint, tolerance := m.setpoint()
+	if tolerance <= 0 {
+		tolerance = defaultTolerance
+	}
+	temperature := float64(m.values["temperature"])
+	// Without setpoint every heated machine counts as at temperature
+	atTemperature := setpoint <= 0 || temperature >= setpoint-tolerance
+	cooled := setpoint > 0 && temperature < setpoint-hysteresis*tolerance
+	// A state entered by command is kept for the settle time without confirming feedback
+	pending := m.command && m.now().Sub(m.since) < time.Duration(m.cfg.SettleTime)*time.Millisecond
+	contactOpen := m.cfg.ContactSwitchFault && m.values["contactSwitch"] == 0
+	if _, ok := m.values["contactSwitch"]; !ok {
+		contactOpen = false
+	}
+
+	switch m.state {
+	case Idle:
+		if heater {
+			m.transition(Heating, CauseFeedback, "Heater on")
+		}
+	case Heating:
+		if !heater && !pending {
+			m.transition(Idle, CauseFeedback, "Heater off")
+		} else if atTemperature && heater {
+			m.transition(Ready, CauseFeedback, fmt.Sprintf("Temperature %.1f °C reached", temperature))
+		}
+	case Ready:
+		switch {
+		case turning:
+			m.transition(Running, CauseFeedback, "Screw and spooler turning")
+		case m.started && !m.manual:
+			m.transition(Running, CauseCommand, "Start: temperature reached")
+		case !heater && !pending:
+			m.transition(Idle, CauseFeedback, "Heater off")
+		case cooled:
+			m.transition(Heating, CauseFeedback, fmt.Sprintf("Temperature %.1f °C below setpoint", temperature))
+		}
+	case Running:
+		if turning {
+			m.command = false // Feedback confirms the start
+		}
+		switch {
+		case contactOpen:
+			m.transition(Fault, CauseFeedback, "Contact switch open while running")
+		case stopped && !pending:
+			m.transition(Ready, CauseFeedback, "Screw and spooler stopped")
+		}
+	}
+}
+
+// Apply a raised or cleared alarm of the machine, critical alarms latch state Fault
+func (m *Machine) Alarm(a alarms.Alarm) {
+	if a.Severity != alarms.SeverityCritical {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !a.Active {
+		delete(m.faults, a.ID)
+		return
+	}
+	m.faults[a.ID] = a.Message
+	m.transition(Fault, CauseAlarm, a.Message)
+}
+
+// Leave Fault or E-Stop to Idle, not possible while a critical alarm is active
+func (m *Machine) Reset(reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state != Fault && m.state != EStop {
+		return fmt.Errorf("%w: nothing to reset in state %s", ErrInvalid, m.state)
+	}
+	if len(m.faults) > 0 {
+		return fmt.Errorf("%w: %d critical alarm(s) active", ErrInvalid, len(m.faults))
+	}
+	if m.Interlock != nil {
+		if err := m.Interlock(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+	m.transition(Idle, CauseReset, reason)
+	m.evaluate()
+	return nil
+}
+
+// Handler for /state: current state, mode and transition history
+func (m *Machine) Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Status())
+}
+
+// Handler for /state/reset: leave Fault or E-Stop, recorded in the audit log
+func (m *Machine) ResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		return
+	}
+	from := m.State()
+	entry := audit.Entry{Actor: audit.Actor(r), Action: "state.reset", Result: audit.ResultOK, Fields: map[string]string{"from": string(from)}}
+	if err := m.Reset("Reset by " + entry.Actor); err != nil {
+		entry.Result, entry.Message = audit.ResultRejected, err.Error()
+		audit.Record(entry)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	entry.Message = fmt.Sprintf("State reset from %s", from)
+	audit.Record(entry)
+	m.Handler(w, r)
+}
@@ -0,0 +1,184 @@
+package state
+
+import (
+	"errors"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// State machine with setpoint 200 ± 5 °C and controllable clock
+func testMachine(cfg config.StateConfig) (*Machine, *time.Time) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m := New(cfg, func() (float64, float64) { return 200, 5 })
+	m.now = func() time.Time { return now }
+	return m, &now
+}
+
+// Test for Machine: manual run Idle -> Heating -> Ready -> Running -> Ready -> Idle
+func TestMachine_ManualRun(t *testing.T) {
+	m, _ := testMachine(config.StateConfig{})
+	m.Sent("mode_switch", 1)
+	steps := []struct {
+		signal   string
+		value    float32
+		expected State
+	}{
+		{"heaterPwm", 80, Heating},
+		{"temperature", 150, Heating},
+		{"temperature", 196, Ready},
+		{"screwRpm", 30, Ready},
+		{"spoolerRpm", 20, Running},
+		{"temperature", 192, Running},
+		{"screwRpm", 0, Running},
+		{"spoolerRpm", 0, Ready},
+		{"heaterPwm", 0, Idle},
+	}
+	for i, s := range steps {
+		m.Feedback(s.signal, s.value)
+		if state := m.State(); state != s.expected {
+			t.Fatalf("Step %d (%s=%v): Expected: %v, received: %v", i, s.signal, s.value, s.expected, state)
+		}
+	}
+	if n := len(m.Status().History); n != 5 {
+		t.Errorf("Transitions in history. Expected: %v, received: %v", 5, n)
+	}
+}
+
+// Test for Machine: auto start waits for the temperature and settles without feedback
+func TestMachine_AutoStart(t *testing.T) {
+	m, now := testMachine(config.StateConfig{SettleTime: 1000})
+	if err := m.Allow("start", 1); err != nil {
+		t.Fatalf("Start should be allowed in Idle: %v", err)
+	}
+	m.Sent("start", 1)
+	m.Feedback("temperature", 20)
+	if state := m.State(); state != Heating {
+		t.Fatalf("Expected: %v, received: %v", Heating, state)
+	}
+	m.Feedback("heaterPwm", 100)
+	m.Feedback("temperature", 199)
+	if state := m.State(); state != Running {
+		t.Fatalf("Started machine should run once ready. Expected: %v, received: %v", Running, state)
+	}
+	if err := m.Allow("start", 1); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Second start should be rejected, received: %v", err)
+	}
+	*now = now.Add(2 * time.Second)
+	m.Feedback("screwRpm", 0)
+	if state := m.State(); state != Ready {
+		t.Errorf("Without RPM feedback after the settle time. Expected: %v, received: %v", Ready, state)
+	}
+}
+
+// Test for Machine: commands rejected depending on state and mode
+func TestMachine_Allow(t *testing.T) {
+	m, _ := testMachine(config.StateConfig{})
+	if err := m.Allow("screw_rpm", 100); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Setpoint in auto mode should be rejected, received: %v", err)
+	}
+	if err := m.Allow("screw_rpm", 0); err != nil {
+		t.Errorf("Zero setpoint should always be allowed: %v", err)
+	}
+	m.Sent("mode_switch", 1)
+	if err := m.Allow("screw_rpm", 100); err != nil {
+		t.Errorf("Setpoint in manual mode should be allowed: %v", err)
+	}
+	if err := m.Allow("start", 1); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Start in manual mode should be rejected, received: %v", err)
+	}
+
+	m.Sent("emergency_stop", 1)
+	if state := m.State(); state != EStop {
+		t.Fatalf("Expected: %v, received: %v", EStop, state)
+	}
+	for _, cmd := range []string{"heater_pwm", "mode_switch", "start"} {
+		if err := m.Allow(cmd, 1); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s should be rejected in E-Stop, received: %v", cmd, err)
+		}
+	}
+	if err := m.Allow("emergency_stop", 1); err != nil {
+		t.Errorf("Emergency stop should always be allowed: %v", err)
+	}
+	m.Feedback("heaterPwm", 50)
+	if state := m.State(); state != EStop {
+		t.Errorf("Feedback must not leave E-Stop. Expected: %v, received: %v", EStop, state)
+	}
+}
+
+// Test for Machine: critical alarm latches Fault, reset only after the alarm is cleared
+func TestMachine_FaultReset(t *testing.T) {
+	m, _ := testMachine(config.StateConfig{})
+	m.Alarm(alarms.Alarm{ID: "warn", Severity: alarms.SeverityWarning, Active: true})
+	if state := m.State(); state != Idle {
+		t.Fatalf("Warning must not cause a fault. Expected: %v, received: %v", Idle, state)
+	}
+	alarm := alarms.Alarm{ID: "link", Severity: alarms.SeverityCritical, Message: "Link lost", Active: true}
+	m.Alarm(alarm)
+	if state := m.State(); state != Fault {
+		t.Fatalf("Expected: %v, received: %v", Fault, state)
+	}
+	if err := m.Reset("test"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Reset with active alarm should be rejected, received: %v", err)
+	}
+	alarm.Active = false
+	m.Alarm(alarm)
+	if state := m.State(); state != Fault {
+		t.Errorf("Fault should stay latched. Expected: %v, received: %v", Fault, state)
+	}
+	if err := m.Reset("test"); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if state := m.State(); state != Idle {
+		t.Errorf("Expected: %v, received: %v", Idle, state)
+	}
+	if err := m.Reset("test"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Reset in Idle should be rejected, received: %v", err)
+	}
+}
+
+// Test for Machine: open contact switch while running is a fault if configured
+func TestMachine_ContactSwitchFault(t *testing.T) {
+	m, _ := testMachine(config.StateConfig{ContactSwitchFault: true})
+	for _, f := range []struct {
+		signal string
+		value  float32
+	}{{"contactSwitch", 1}, {"heaterPwm", 50}, {"temperature", 200}, {"screwRpm", 10}, {"spoolerRpm", 10}} {
+		m.Feedback(f.signal, f.value)
+	}
+	if state := m.State(); state != Running {
+		t.Fatalf("Expected: %v, received: %v", Running, state)
+	}
+	m.Feedback("contactSwitch", 0)
+	if state := m.State(); state != Fault {
+		t.Errorf("Expected: %v, received: %v", Fault, state)
+	}
+}
+
+// Test for ResetHandler: POST only, conflict if nothing to reset
+func TestResetHandler(t *testing.T) {
+	m, _ := testMachine(config.StateConfig{})
+	tests := []struct {
+		method   string
+		expected int
+	}{
+		{http.MethodGet, http.StatusMethodNotAllowed},
+		{http.MethodPost, http.StatusConflict},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		m.ResetHandler(rec, httptest.NewRequest(tc.method, "/state/reset", nil))
+		if rec.Code != tc.expected {
+			t.Errorf("%s: Expected: %v, received: %v", tc.method, tc.expected, rec.Code)
+		}
+	}
+	m.Sent("emergency_stop", 1)
+	rec := httptest.NewRecorder()
+	m.ResetHandler(rec, httptest.NewRequest(http.MethodPost, "/state/reset", nil))
+	if rec.Code != http.StatusOK || m.State() != Idle {
+		t.Errorf("Reset from E-Stop. Expected: %v, received: %v (%v)", http.StatusOK, rec.Code, m.State())
+	}
+}
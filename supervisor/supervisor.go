@@ -0,0 +1,266 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"extruder_web_gui/audit"
+	"extruder_web_gui/config"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service started from the config and restarted when one of its config sections changes
+type Service struct {
+	Name     string
+	Sections []string // Top level json keys of the config the service depends on
+	Start    func(c *config.Config) (stop func(), err error)
+}
+
+// Supervisor applying config changes to running services
+type Supervisor struct {
+	mu       sync.Mutex
+	loader   *config.Loader
+	services []Service
+	stops    map[string]func()
+	cfg      *config.Config
+}
+
+// Result of applying a config
+type Result struct {
+	Changed         []string `json:"changed"`         // Changed config sections
+	Restarted       []string `json:"restarted"`       // Services restarted with the new config
+	RestartRequired []string `json:"restartRequired"` // Changed sections only applied on the next start
+}
+
+// Create supervisor, loader resolves the config on reload
+func New(loader *config.Loader, services []Service) *Supervisor {
+	return &Supervisor{loader: loader, services: services, stops: map[string]func(){}}
+}
+
+// Start all services with the initial config
+func (s *Supervisor) Start(cfg *config.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config.Set(cfg)
+	s.cfg = cfg
+	for _, svc := range s.services {
+		stop, err := svc.Start(cfg)
+		if err != nil {
+			return fmt.Errorf("Error starting %s: %w", svc.Name, err)
+		}
+		s.stops[svc.Name] = stop
+	}
+	return nil
+}
+
+// Return the applied config
+func (s *Supervisor) Current() *config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// Apply validated config: restart services whose sections changed. If a service fails
+// to start, all restarted services are switched back to the old config.
+func (s *Supervisor) Apply(cfg *config.Config, actor string) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.cfg
+	result := Result{Changed: changedSections(old, cfg)}
+	if len(result.Changed) == 0 {
+		return result, nil
+	}
+	covered := map[string]bool{}
+	var affected []Service
+	for _, svc := range s.services {
+		if intersects(svc.Sections, result.Changed) {
+			affected = append(affected, svc)
+		}
+		for _, section := range svc.Sections {
+			covered[section] = true
+		}
+	}
+	for _, section := range result.Changed {
+		if !covered[section] {
+			result.RestartRequired = append(result.RestartRequired, section)
+		}
+	}
+
+	config.Set(cfg)
+	for i, svc := range affected {
+		s.stop(svc.Name)
+		stop, err := svc.Start(cfg)
+		if err == nil {
+			s.stops[svc.Name] = stop
+			result.Restarted = append(result.Restarted, svc.Name)
+			continue
+		}
+		// Roll back: failed service and those already switched
+		config.Set(old)
+		for j := i; j >= 0; j-- {
+			s.stop(affected[j].Name)
+			if stop, rerr := affected[j].Start(old); rerr == nil {
+				s.stops[affected[j].Name] = stop
+			} else {
+				log.Printf("Error restoring %s: %v", affected[j].Name, rerr)
+			}
+		}
+		err = fmt.Errorf("Error starting %s: %w", svc.Name, err)
+		audit.Record(audit.Entry{Actor: actor, Action: "config.apply", Result: audit.ResultFailed,
+			Message: err.Error() + ", old config restored", Fields: map[string]string{"changed": strings.Join(result.Changed, ",")}})
+		return result, err
+	}
+	s.cfg = cfg
+	audit.Record(audit.Entry{Actor: actor, Action: "config.apply", Result: audit.ResultOK, Message: "Config applied",
+		Fields: map[string]string{
+			"changed":         strings.Join(result.Changed, ","),
+			"restarted":       strings.Join(result.Restarted, ","),
+			"restartRequired": strings.Join(result.RestartRequired, ","),
+		}})
+	return result, nil
+}
+
+// Stop running service (caller holds mu)
+func (s *Supervisor) stop(name string) {
+	if stop := s.stops[name]; stop != nil {
+		stop()
+	}
+	delete(s.stops, name)
+}
+
+// Reload config file and apply it
+func (s *Supervisor) Reload(actor string) (Result, error) {
+	cfg, err := s.loader.Load()
+	if err != nil {
+		audit.Record(audit.Entry{Actor: actor, Action: "config.reload", Result: audit.ResultRejected, Message: err.Error()})
+		return Result{}, err
+	}
+	return s.Apply(cfg, actor)
+}
+
+// Top level json keys whose values differ
+func changedSections(old, cfg *config.Config) []string {
+	var changed []string
+	a, b := reflect.ValueOf(old).Elem(), reflect.ValueOf(cfg).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0])
+		}
+	}
+	return changed
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Poll the config file and reload it when it changes, until stop is closed
+func (s *Supervisor) Watch(interval time.Duration, stop <-chan struct{}) {
+	path := s.loader.Options().File
+	last := fileVersion(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		version := fileVersion(path)
+		if version == last {
+			continue
+		}
+		last = version
+		log.Println("Config file changed, reloading:", path)
+		if _, err := s.Reload("file-watcher"); err != nil {
+			log.Println("Config reload failed:", err)
+		}
+	}
+}
+
+// Modification time and size of a file, empty if missing
+func fileVersion(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// Handler for the active config: GET returns it, PUT applies a new config (not written to the file).
+// File and pipe paths are only taken from the config file, a PUT setting other paths is refused.
+func (s *Supervisor) ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		config.Print(w, s.Current())
+	case http.MethodPut:
+		cfg, err := s.loader.Decode(r.Body)
+		if err != nil {
+			audit.Record(audit.Entry{Actor: audit.Actor(r), Action: "config.put", Result: audit.ResultRejected, Message: err.Error()})
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		config.Unmask(cfg, s.Current()) // Masked values from GET
+		if changed := changedPaths(s.Current(), cfg); len(changed) > 0 {
+			err := fmt.Errorf("File paths can only be changed in the config file: %s", strings.Join(changed, ", "))
+			audit.Record(audit.Entry{Actor: audit.Actor(r), Action: "config.put", Result: audit.ResultRejected, Message: err.Error()})
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		s.respond(w, cfg, audit.Actor(r))
+	default:
+		http.Error(w, "Nur GET- und PUT-Anfragen erlaubt", http.StatusMethodNotAllowed)
+	}
+}
+
+// Settings of cfg pointing to another file or pipe than in the old config, clearing a path is allowed
+func changedPaths(old, cfg *config.Config) []string {
+	oldPaths := config.FilePaths(old)
+	var changed []string
+	for name, path := range config.FilePaths(cfg) {
+		if path != "" && path != oldPaths[name] {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Handler to reload the config file
+func (s *Supervisor) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, err := s.loader.Load()
+	if err != nil {
+		audit.Record(audit.Entry{Actor: audit.Actor(r), Action: "config.reload", Result: audit.ResultRejected, Message: err.Error()})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.respond(w, cfg, audit.Actor(r))
+}
+
+func (s *Supervisor) respond(w http.ResponseWriter, cfg *config.Config, actor string) {
+	result, err := s.Apply(cfg, actor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,146 @@
+package supervisor
+
+import (
+	"errors"
+	"extruder_web_gui/audit"
+	"extruder_web_gui/config"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func noEnv(string) (string, bool) { return "", false }
+
+// Service recording its starts and stops
+type fakeService struct {
+	starts []string // Mode per start
+	stops  int
+	fail   string // Mode that fails to start
+}
+
+func (f *fakeService) service(name string, sections ...string) Service {
+	return Service{Name: name, Sections: sections, Start: func(c *config.Config) (func(), error) {
+		if c.Mode == f.fail {
+			return nil, errors.New("start failed")
+		}
+		f.starts = append(f.starts, c.Mode)
+		return func() { f.stops++ }, nil
+	}}
+}
+
+func newTestSupervisor(t *testing.T, services ...Service) (*Supervisor, string) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"mode": "TCPMode", "tcpAddress": "localhost:9000"}`), 0644)
+	loader, err := config.NewLoader([]string{"--config", path}, noEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s := New(loader, services)
+	if err := s.Start(cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return s, path
+}
+
+// Test for Apply: only services with changed sections are restarted
+func TestApply_RestartsChangedServices(t *testing.T) {
+	transport, mqtt := &fakeService{}, &fakeService{}
+	s, _ := newTestSupervisor(t, transport.service("transport", "mode", "tcpAddress"), mqtt.service("mqtt", "mqtt"))
+
+	next := *s.Current()
+	next.TCPAddress = "localhost:9001"
+	next.Spool.Tolerance = 0.1
+	result, err := s.Apply(&next, "tester")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(transport.starts) != 2 || transport.stops != 1 || len(mqtt.starts) != 1 || mqtt.stops != 0 {
+		t.Errorf("Unexpected restarts: transport %v/%d, mqtt %v/%d", transport.starts, transport.stops, mqtt.starts, mqtt.stops)
+	}
+	if strings.Join(result.Restarted, ",") != "transport" || strings.Join(result.RestartRequired, ",") != "spool" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if config.Current().TCPAddress != "localhost:9001" {
+		t.Errorf("Active config. Expected: %v, received: %v", "localhost:9001", config.Current().TCPAddress)
+	}
+	entries := audit.Entries()
+	if e := entries[len(entries)-1]; e.Action != "config.apply" || e.Result != audit.ResultOK {
+		t.Errorf("Unexpected audit entry: %+v", e)
+	}
+}
+
+// Test for Apply: failed start restores the old config
+func TestApply_RollbackOnFailure(t *testing.T) {
+	transport := &fakeService{fail: "SimMode"}
+	s, _ := newTestSupervisor(t, transport.service("transport", "mode"))
+
+	next := *s.Current()
+	next.Mode = "SimMode"
+	if _, err := s.Apply(&next, "tester"); err == nil {
+		t.Fatalf("Expected error, but no error thrown.")
+	}
+	if s.Current().Mode != "TCPMode" || config.Current().Mode != "TCPMode" {
+		t.Errorf("Config not restored. Expected: TCPMode, received: %v", s.Current().Mode)
+	}
+	if last := transport.starts[len(transport.starts)-1]; last != "TCPMode" {
+		t.Errorf("Transport not restarted with old config. Expected: TCPMode, received: %v", last)
+	}
+	entries := audit.Entries()
+	if e := entries[len(entries)-1]; e.Result != audit.ResultFailed {
+		t.Errorf("Expected failed audit entry, received: %+v", e)
+	}
+}
+
+// Test for ConfigHandler: invalid config is rejected, valid config applied
+func TestConfigHandler(t *testing.T) {
+	transport := &fakeService{}
+	s, _ := newTestSupervisor(t, transport.service("transport", "mode"))
+
+	rec := httptest.NewRecorder()
+	s.ConfigHandler(rec, httptest.NewRequest("PUT", "/config", strings.NewReader(`{"mode": "FooMode"}`)))
+	if rec.Code != 400 || s.Current().Mode != "TCPMode" {
+		t.Errorf("Invalid config. Expected: 400, received: %v (mode %v)", rec.Code, s.Current().Mode)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ConfigHandler(rec, httptest.NewRequest("PUT", "/config", strings.NewReader(`{"mode": "ModbusMode", "modbusClient": {"address": "localhost:502"}}`)))
+	if rec.Code != 200 || s.Current().Mode != "ModbusMode" {
+		t.Errorf("Valid config. Expected: 200, received: %v %s", rec.Code, rec.Body.String())
+	}
+
+	// File paths only come from the config file
+	rec = httptest.NewRecorder()
+	s.ConfigHandler(rec, httptest.NewRequest("PUT", "/config", strings.NewReader(`{"mode": "ModbusMode", "modbusClient": {"address": "localhost:502"}, "eventLog": {"file": "/etc/cron.d/events"}, "rules": {"file": "rules.json"}}`)))
+	if expected := "File paths can only be changed in the config file: eventLog.file, rules.file"; rec.Code != 403 || strings.TrimSpace(rec.Body.String()) != expected {
+		t.Errorf("File paths. Expected: 403 %v, received: %v %s", expected, rec.Code, rec.Body.String())
+	}
+	if s.Current().EventLog.File != "" {
+		t.Errorf("Event log file changed via PUT: %v", s.Current().EventLog.File)
+	}
+}
+
+// Test for Watch: changed file is reloaded
+func TestWatch(t *testing.T) {
+	transport := &fakeService{}
+	s, path := newTestSupervisor(t, transport.service("transport", "mode"))
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.Watch(10*time.Millisecond, stop)
+
+	time.Sleep(20 * time.Millisecond)
+	os.WriteFile(path, []byte(`{"mode": "ModbusMode", "modbusClient": {"address": "localhost:502"}, "httpPort": "8081"}`), 0644)
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Current().Mode != "ModbusMode" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Current().Mode != "ModbusMode" {
+		t.Errorf("Config not reloaded. Expected: ModbusMode, received: %v", s.Current().Mode)
+	}
+}
@@ -0,0 +1,108 @@
+package tags
+
+import (
+	"encoding/json"
+	"extruder_web_gui/data"
+	"fmt"
+	"net/http"
+)
+
+// Handler for tag browsing: GET /tags?path=Extruder/Heater
+func BrowseHandler(w http.ResponseWriter, r *http.Request) {
+	node, ok := Browse(r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Unknown tag path", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(node)
+}
+
+// Handler for reading tags: GET /tags/read?path=A&path=B
+func ReadHandler(w http.ResponseWriter, r *http.Request) {
+	paths := r.URL.Query()["path"]
+	if len(paths) == 0 {
+		http.Error(w, "Parameter path missing", http.StatusBadRequest)
+		return
+	}
+	values := make([]Value, 0, len(paths))
+	for _, path := range paths {
+		v, err := Read(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		values = append(values, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(values)
+}
+
+// Request body of /tags/write
+type writeRequest struct {
+	Path  string `json:"path"`
+	Value uint32 `json:"value"`
+}
+
+// Handler for writing tags: POST /tags/write {"path": "...", "value": n}
+func WriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Nur POST-Anfragen erlaubt", http.StatusMethodNotAllowed)
+		return
+	}
+	var req writeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if _, ok := Lookup(req.Path); !ok {
+		http.Error(w, "Unknown tag: "+req.Path, http.StatusNotFound)
+		return
+	}
+	if err := Write(req.Path, req.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "success"}`))
+}
+
+// Handler for tag subscriptions via SSE: GET /tags/subscribe?path=Extruder
+func SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	filters := r.URL.Query()["path"]
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	values := make(chan Value, 64)
+	unsubscribe := data.Subscribe(func(u data.Update) {
+		path, ok := PathOfSignal(u.Signal)
+		if !ok || !matches(path, filters) {
+			return
+		}
+		t, _ := Lookup(path)
+		select {
+		case values <- Value{Path: path, Value: u.Point.Value, Timestamp: u.Point.Timestamp, Unit: t.Unit, Quality: u.Point.QualityOrStale()}:
+		default: // Slow client, drop update
+		}
+	})
+	defer unsubscribe()
+
+	for {
+		select {
+		case v := <-values:
+			payload, _ := json.Marshal(v)
+			fmt.Fprintf(w, "data: %s\n\n", payload)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
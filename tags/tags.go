@@ -0,0 +1,247 @@
+package tags
+
+import (
+	"extruder_web_gui/controls"
+	"extruder_web_gui/data"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Access rights of a tag
+const (
+	AccessRead      = "read"
+	AccessWrite     = "write"
+	AccessReadWrite = "readwrite"
+)
+
+// Tag metadata returned by the browse API
+type Tag struct {
+	Path        string      `json:"path"`
+	Description string      `json:"description"`
+	Unit        string      `json:"unit"`
+	Type        string      `json:"type"`
+	Access      string      `json:"access"`
+	Range       *[2]float64 `json:"range,omitempty"`   //Allowed write range
+	Signal      string      `json:"signal,omitempty"`  //Signal name in /data
+	Command     string      `json:"command,omitempty"` //Command name for writes
+	Source      data.Source `json:"source"`
+}
+
+// Tag definition: path, signal for reads, command for writes
+type definition struct {
+	path    string
+	signal  string
+	command string
+}
+
+// Namespace of all tags
+var definitions = []definition{
+	{path: "Extruder/Filament/Diameter", signal: "diameter"},
+	{path: "Extruder/Heater/Temperature", signal: "temperature"},
+	{path: "Extruder/Heater/Pwm", signal: "heaterPwm", command: "heater_pwm"},
+	{path: "Extruder/Screw/Rpm", signal: "screwRpm", command: "screw_rpm"},
+	{path: "Extruder/Spooler/Rpm", signal: "spoolerRpm", command: "spooler_rpm"},
+	{path: "Extruder/Spooler/ContactSwitch", signal: "contactSwitch"},
+	{path: "Extruder/Control/Mode", command: "mode_switch"},
+	{path: "Extruder/Control/Start", command: "start"},
+	{path: "Extruder/Control/EmergencyStop", command: "emergency_stop"},
+	{path: "Spool/Current/WindingDiameter", signal: "windingDiameter"},
+	{path: "Spool/Current/AvgFilDiameter", signal: "avgFilDiameter"},
+	{path: "Spool/Current/Windings", signal: "nbrOfWindings"},
+	{path: "Spool/Current/Mass", signal: "filamentMass"},
+	{path: "Spool/Previous/WindingDiameter", signal: "prevWindingDiameter"},
+	{path: "Spool/Previous/AvgFilDiameter", signal: "prevAvgFilDiameter"},
+	{path: "Spool/Previous/Windings", signal: "prevNbrOfWindings"},
+	{path: "Spool/Previous/Mass", signal: "prevFilamentMass"},
+}
+
+// Build tag metadata from definition, signal table and command ranges
+func (d definition) tag() Tag {
+	t := Tag{Path: d.path, Signal: d.signal, Command: d.command, Type: "float32"}
+	if d.signal != "" {
+		sig, _ := data.SignalInfo(d.signal)
+		t.Description = strings.TrimSuffix(sig.Help, ".")
+		t.Unit = sig.Unit
+		t.Source = data.SignalSource(d.signal)
+		t.Access = AccessRead
+	}
+	if d.command != "" {
+		t.Access = AccessWrite
+		if d.signal != "" {
+			t.Access = AccessReadWrite
+		} else {
+			t.Type = "uint32"
+			t.Description = "Command " + d.command
+		}
+		if min, max, ok := controls.CommandRange(d.command); ok {
+			t.Range = &[2]float64{float64(min), float64(max)}
+		}
+	}
+	return t
+}
+
+// Return all tags, sorted by path
+func All() []Tag {
+	tags := make([]Tag, 0, len(definitions))
+	for _, d := range definitions {
+		tags = append(tags, d.tag())
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Path < tags[j].Path })
+	return tags
+}
+
+// Find definition by tag path or signal / command name
+func lookup(pathOrName string) (definition, bool) {
+	for _, d := range definitions {
+		if d.path == pathOrName {
+			return d, true
+		}
+	}
+	for _, d := range definitions {
+		if d.signal == pathOrName {
+			return d, true
+		}
+	}
+	for _, d := range definitions {
+		if d.command == pathOrName {
+			return d, true
+		}
+	}
+	return definition{}, false
+}
+
+// Return tag by path (signal and command names are accepted as aliases)
+func Lookup(pathOrName string) (Tag, bool) {
+	d, ok := lookup(pathOrName)
+	if !ok {
+		return Tag{}, false
+	}
+	return d.tag(), true
+}
+
+// Current value of a tag
+type Value struct {
+	Path      string       `json:"path"`
+	Value     float32      `json:"value"`
+	Timestamp time.Time    `json:"timestamp"`
+	Unit      string       `json:"unit"`
+	Quality   data.Quality `json:"quality,omitempty"`
+}
+
+// Read tag value, write-only tags return the last sent command value
+func Read(pathOrName string) (Value, error) {
+	d, ok := lookup(pathOrName)
+	if !ok {
+		return Value{}, fmt.Errorf("Unknown tag: %s", pathOrName)
+	}
+	t := d.tag()
+	if d.signal != "" {
+		dp, _ := data.Value(d.signal)
+		return Value{Path: d.path, Value: dp.Value, Timestamp: dp.Timestamp, Unit: t.Unit, Quality: dp.QualityOrStale()}, nil
+	}
+	v, _ := controls.LastCommandValue(d.command)
+	return Value{Path: d.path, Value: float32(v), Unit: t.Unit}, nil
+}
+
+// Write tag value through the controls send path
+func Write(pathOrName string, value uint32) error {
+	d, ok := lookup(pathOrName)
+	if !ok {
+		return fmt.Errorf("Unknown tag: %s", pathOrName)
+	}
+	if d.command == "" {
+		return fmt.Errorf("Tag %s is read-only", d.path)
+	}
+	return controls.SendCommandByName(d.command, value)
+}
+
+// Check tag value like Write without sending it
+func Check(pathOrName string, value uint32) error {
+	d, ok := lookup(pathOrName)
+	if !ok {
+		return fmt.Errorf("Unknown tag: %s", pathOrName)
+	}
+	if d.command == "" {
+		return fmt.Errorf("Tag %s is read-only", d.path)
+	}
+	id, ok := controls.CommandID(d.command)
+	if !ok {
+		return fmt.Errorf("Unknown command: %s", d.command)
+	}
+	return controls.Check(id, value)
+}
+
+// Return tag path of a signal name
+func PathOfSignal(signal string) (string, bool) {
+	for _, d := range definitions {
+		if d.signal == signal {
+			return d.path, true
+		}
+	}
+	return "", false
+}
+
+// Node of the browse tree
+type Node struct {
+	Name     string  `json:"name"`
+	Path     string  `json:"path"`
+	Tag      *Tag    `json:"tag,omitempty"`
+	Children []*Node `json:"children,omitempty"`
+}
+
+// Build tree of all tags below path ("" = root)
+func Browse(path string) (*Node, bool) {
+	path = strings.Trim(path, "/")
+	root := &Node{Name: "", Path: ""}
+	for _, t := range All() {
+		node := root
+		parts := strings.Split(t.Path, "/")
+		for i, part := range parts {
+			var child *Node
+			for _, c := range node.Children {
+				if c.Name == part {
+					child = c
+				}
+			}
+			if child == nil {
+				child = &Node{Name: part, Path: strings.Join(parts[:i+1], "/")}
+				node.Children = append(node.Children, child)
+			}
+			node = child
+		}
+		tag := t
+		node.Tag = &tag
+	}
+	if path == "" {
+		return root, true
+	}
+	return findNode(root, path)
+}
+
+func findNode(node *Node, path string) (*Node, bool) {
+	if node.Path == path {
+		return node, true
+	}
+	for _, c := range node.Children {
+		if c.Path == path || strings.HasPrefix(path, c.Path+"/") {
+			return findNode(c, path)
+		}
+	}
+	return nil, false
+}
+
+// Check if tag path is equal to or below one of the filter paths
+func matches(path string, filters []string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		f = strings.Trim(f, "/")
+		if path == f || strings.HasPrefix(path, f+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package tags
+
+import (
+	"bufio"
+	"encoding/json"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test for All: metadata from signal table, message map and command ranges
+func TestAll_Metadata(t *testing.T) {
+	tag, ok := Lookup("Extruder/Heater/Pwm")
+	if !ok {
+		t.Fatalf("Tag Extruder/Heater/Pwm missing")
+	}
+	if tag.Unit != "%" || tag.Access != AccessReadWrite || tag.Source.MsgID != 0x05 || tag.Source.Column != 4 {
+		t.Errorf("Unexpected metadata: %+v", tag)
+	}
+	if tag.Range == nil || tag.Range[1] != 100 {
+		t.Errorf("Unexpected range: %v", tag.Range)
+	}
+	if tag, _ := Lookup("Spool/Current/Mass"); tag.Source.Column != 11 || tag.Access != AccessRead {
+		t.Errorf("Unexpected metadata for spool mass: %+v", tag)
+	}
+	// Every signal served by /data has a tag
+	for _, name := range data.SignalNames() {
+		if _, ok := PathOfSignal(name); !ok {
+			t.Errorf("Signal %s has no tag", name)
+		}
+	}
+}
+
+// Test for Browse: subtree lookup
+func TestBrowse(t *testing.T) {
+	node, ok := Browse("Extruder/Heater")
+	if !ok || len(node.Children) != 2 {
+		t.Fatalf("Expected 2 children below Extruder/Heater, received: %+v", node)
+	}
+	if _, ok := Browse("Extruder/Unknown"); ok {
+		t.Errorf("Expected unknown path to fail")
+	}
+}
+
+// Test for Read / Write: values and read-only tags
+func TestReadWrite(t *testing.T) {
+	pipePath := filepath.Join(t.TempDir(), "msgToSim")
+	os.WriteFile(pipePath, nil, 0644)
+	config.Cfg = &config.Config{Mode: "PipeMode", MsgToSimPipe: pipePath}
+
+	data.SetValue("temperature", 215, time.Now())
+	v, err := Read("Extruder/Heater/Temperature")
+	if err != nil || v.Value != 215 || v.Unit != "°C" {
+		t.Errorf("Unexpected read result: %+v, %v", v, err)
+	}
+	if err := Write("Extruder/Heater/Temperature", 1); err == nil {
+		t.Errorf("Expected error for read-only tag")
+	}
+	if err := Write("Extruder/Screw/Rpm", 5000); err == nil {
+		t.Errorf("Expected error for out of range value")
+	}
+	if err := Write("Extruder/Control/Mode", 1); err != nil {
+		t.Errorf("Unexpected write error: %v", err)
+	}
+	if v, _ := Read("Extruder/Control/Mode"); v.Value != 1 {
+		t.Errorf("Write-only tag should read last sent value, received: %v", v.Value)
+	}
+}
+
+// Test for SubscribeHandler: updates below filter path are streamed
+func TestSubscribeHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(SubscribeHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?path=Extruder/Screw")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		data.SetValue("temperature", 200, time.Now()) // Filtered
+		data.SetValue("screwRpm", 42, time.Now())
+	}()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	var v Value
+	json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "data: ")), &v)
+	if v.Path != "Extruder/Screw/Rpm" || v.Value != 42 {
+		t.Errorf("Unexpected event: %s", line)
+	}
+}
@@ -6,45 +6,80 @@ import (
 	"encoding/hex"
 	"extruder_web_gui/config"
 	"extruder_web_gui/data"
+	"extruder_web_gui/eventlog"
+	"extruder_web_gui/metrics"
+	"fmt"
 	"log"
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 type ConnectionManager struct {
 	mu      sync.Mutex
 	conn    net.Conn
 	address string
+	dialed  bool
 }
 
 var manager *ConnectionManager
 var once sync.Once
 
-// Return singleton instance of connection manager
+// Timeout for establishing the connection and writing a message
+const dialTimeout = 2 * time.Second
+
+var reconnectCounter = metrics.NewCounter("extruder_tcp_reconnects_total", "TCP connections re-established after the first one.")
+
+// Create connection manager of another machine, the connection is established on the first send
+func NewConnectionManager(address string) *ConnectionManager {
+	return &ConnectionManager{address: address}
+}
+
+// Return singleton instance of connection manager, a changed address closes the old connection
 func GetConnectionManager(address string) *ConnectionManager {
 	once.Do(func() {
 		manager = &ConnectionManager{
 			address: address,
 		}
 	})
+	manager.setAddress(address)
 	return manager
 }
 
+// Switch to another address, e.g. after a config reload
+func (cm *ConnectionManager) setAddress(address string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.address == address {
+		return
+	}
+	if cm.conn != nil {
+		cm.conn.Close()
+		cm.conn = nil
+	}
+	cm.address = address
+	log.Println("TCP address changed:", address)
+}
+
 // Establish TCP connection
-func (cm *ConnectionManager) GetConnection() net.Conn {
+func (cm *ConnectionManager) GetConnection() (net.Conn, error) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
 	if cm.conn == nil {
-		var err error
-		cm.conn, err = net.Dial("tcp", cm.address)
+		conn, err := net.DialTimeout("tcp", cm.address, dialTimeout)
 		if err != nil {
-			log.Fatalf("Failed to establish TCP connection: %v", err)
+			return nil, fmt.Errorf("Failed to establish TCP connection: %w", err)
 		}
+		cm.conn = conn
 		log.Println("TCP connection established:", cm.address)
+		if cm.dialed {
+			reconnectCounter.Inc()
+		}
+		cm.dialed = true
 	}
-	return cm.conn
+	return cm.conn, nil
 }
 
 // Function to close tcp connection
@@ -61,7 +96,11 @@ func (cm *ConnectionManager) CloseConnection() {
 
 // Handle incoming data
 func (cm *ConnectionManager) ReadLoop(processFunc func(string)) {
-	conn := cm.GetConnection()
+	conn, err := cm.GetConnection()
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	reader := bufio.NewReader(conn)
 	for {
 		line, err := reader.ReadString('\n')
@@ -73,54 +112,92 @@ func (cm *ConnectionManager) ReadLoop(processFunc func(string)) {
 	}
 }
 
-func TCPDataHandler(address string) {
+// Read messages from the TCP server into store until the connection fails or stop is closed
+func TCPDataHandler(address string, store *data.Store, stop <-chan struct{}) {
+	fields := map[string]string{"address": address}
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		log.Printf("Error connectiong to %s: %v", address, err)
+		store.RecordEvent(eventlog.CategoryConnection, eventlog.SeverityWarning, "TCP connection failed: "+err.Error(), fields)
 		return
 	}
 	defer conn.Close()
 	log.Println("Connected to TCP-Server:", address)
+	store.RecordEvent(eventlog.CategoryConnection, eventlog.SeverityInfo, "Connected to TCP server "+address, fields)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Close() // Release blocked read
+		case <-done:
+		}
+	}()
 
 	reader := bufio.NewReader(conn)
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			log.Println("Error reading data:", err)
+			select {
+			case <-stop:
+				log.Println("TCP connection stopped:", address)
+				store.RecordEvent(eventlog.CategoryConnection, eventlog.SeverityInfo, "TCP connection stopped", fields)
+			default:
+				log.Println("Error reading data:", err)
+				store.RecordEvent(eventlog.CategoryConnection, eventlog.SeverityWarning, "TCP connection lost: "+err.Error(), fields)
+			}
 			break
 		}
-		ProcessTCPData(strings.TrimSpace(line))
+		ProcessTCPData(store, strings.TrimSpace(line))
 	}
 }
 
-func ProcessTCPData(line string) {
+func ProcessTCPData(store *data.Store, line string) {
 	msg, err := hex.DecodeString((line))
 	//fmt.Println(line)
 	if err != nil {
-		log.Fatalf("Hex string decoding failed: %v", err)
-
+		log.Printf("Hex string decoding failed: %v", err)
+		data.CountMalformedFrame()
+		store.ParseError("hex", "Hex string decoding failed: "+err.Error(), map[string]string{"message": line})
+		return // Skip this message
 	}
 
 	if len(msg) != 8 {
 		log.Printf("Expected 8 bytes, got %d bytes", len(msg))
+		data.CountMalformedFrame()
+		store.ParseError("length", fmt.Sprintf("Expected 8 bytes, got %d bytes", len(msg)), map[string]string{"message": line})
 		return // Skip this message
 	}
-	data.GetValueFromMsg(msg)
+	store.GetValueFromMsg(msg)
 }
 
-func SendTCPData(id byte, val uint32) {
-	manager := GetConnectionManager(config.Cfg.TCPAddress)
-	conn := manager.GetConnection()
+func SendTCPData(id byte, val uint32) error {
+	return GetConnectionManager(config.Current().TCPAddress).Send(id, val)
+}
+
+// Send message over the connection of the manager, a failed write drops the connection so the next send redials
+func (cm *ConnectionManager) Send(id byte, val uint32) error {
+	conn, err := cm.GetConnection()
+	if err != nil {
+		return err
+	}
 
 	messageBytes := make([]byte, 8)
 	messageBytes[7] = id
 	binary.LittleEndian.PutUint32(messageBytes[0:], val)
 
-	_, err := conn.Write(messageBytes)
-	if err != nil {
-		log.Fatalf("Failed to write to TCP connection: %v", err)
+	conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+	if _, err := conn.Write(messageBytes); err != nil {
+		cm.mu.Lock()
+		if cm.conn == conn {
+			cm.conn.Close()
+			cm.conn = nil
+		}
+		cm.mu.Unlock()
+		return fmt.Errorf("Failed to write to TCP connection: %w", err)
 	}
 	log.Printf("Message sent via TCP: %x\n", reverseBytes(messageBytes))
+	return nil
 }
 
 // Helper function to reverse byte order
@@ -0,0 +1,264 @@
+package watchdog
+
+import (
+	"encoding/json"
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/controls"
+	"extruder_web_gui/data"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alarm ID raised when no monitored signal is updated anymore, "communication-lost:<machine>" for further machines
+const CommLostAlarm = "communication-lost"
+
+// Report if the alarm is the communication lost alarm of a machine
+func IsCommLost(a alarms.Alarm) bool {
+	return a.ID == CommLostAlarm || strings.HasPrefix(a.ID, CommLostAlarm+":")
+}
+
+// Update state of a monitored signal
+type signalState struct {
+	timeout  time.Duration
+	lastSeen time.Time // Server time of the last update, zero until the signal was received once
+	stale    bool
+}
+
+// Watchdog flagging stale signals and detecting loss of the machine link
+type Watchdog struct {
+	mu       sync.Mutex
+	cfg      config.WatchdogConfig
+	store    *data.Store
+	source   string
+	signals  map[string]*signalState
+	linkLost bool
+	now      func() time.Time
+
+	// Safe action commands, default: controls of the default machine
+	Send          func(command string, value uint32) error
+	EmergencyStop func(actor string, reason string) error
+}
+
+// Expected timeout of a signal depending on the data source
+func defaultTimeout(cfg config.WatchdogConfig, mode string, pollInterval int) time.Duration {
+	if cfg.DefaultTimeout > 0 {
+		return time.Duration(cfg.DefaultTimeout) * time.Millisecond
+	}
+	if mode == "ModbusMode" && pollInterval > 0 {
+		// Three missed poll cycles
+		return 3 * time.Duration(pollInterval) * time.Millisecond
+	}
+	return 5 * time.Second
+}
+
+// Create watchdog for monitored signals of the store, fed by the configured mode
+func New(cfg config.WatchdogConfig, store *data.Store, mode string, pollInterval int) *Watchdog {
+	w := &Watchdog{
+		cfg:           cfg,
+		store:         store,
+		source:        mode,
+		signals:       map[string]*signalState{},
+		now:           time.Now,
+		Send:          controls.SendCommandByName,
+		EmergencyStop: controls.EmergencyStop,
+	}
+	names := cfg.Signals
+	if len(names) == 0 {
+		names = data.ProcessSignalNames()
+	}
+	fallback := defaultTimeout(cfg, mode, pollInterval)
+	start := w.now()
+	for _, name := range names {
+		timeout := fallback
+		if ms, ok := cfg.Timeouts[name]; ok && ms > 0 {
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+		state := &signalState{timeout: timeout}
+		if dp, _ := store.Value(name); !dp.Timestamp.IsZero() {
+			state.lastSeen = start // Received before the (re)start of the watchdog
+		}
+		w.signals[name] = state
+	}
+	return w
+}
+
+// Alarm ID of the store's machine, e.g. "stale:temperature" or "stale:line2:temperature"
+func (w *Watchdog) alarmID(prefix string, name string) string {
+	if w.store.Source != "" {
+		prefix += ":" + w.store.Source
+	}
+	if name == "" {
+		return prefix
+	}
+	return prefix + ":" + name
+}
+
+// Alarm fields with the machine of the store
+func (w *Watchdog) fields(fields map[string]string) map[string]string {
+	if w.store.Source != "" {
+		fields["machine"] = w.store.Source
+	}
+	return fields
+}
+
+// Record update of a signal (data listener)
+func (w *Watchdog) onUpdate(u data.Update) {
+	if u.Point.Quality == data.QualityStale || u.Point.Quality == data.QualitySubstituted {
+		return // Not a value from the source
+	}
+	w.mu.Lock()
+	var recovered, restored bool
+	if s, ok := w.signals[u.Signal]; ok {
+		s.lastSeen = w.now()
+		recovered = s.stale
+		s.stale = false
+	}
+	if w.linkLost {
+		w.linkLost = false
+		restored = true
+	}
+	w.mu.Unlock()
+
+	if recovered {
+		alarms.Clear(w.alarmID("stale", u.Signal))
+	}
+	if restored {
+		alarms.Clear(w.alarmID(CommLostAlarm, ""))
+		log.Println("Watchdog: Machine link restored")
+	}
+}
+
+// Check all signals for timeouts, signals never received are not stale yet (e.g. before the simulator runs)
+func (w *Watchdog) check() {
+	w.mu.Lock()
+	now := w.now()
+	var newlyStale []string
+	seen, allStale := false, true
+	for name, s := range w.signals {
+		if s.lastSeen.IsZero() {
+			continue
+		}
+		if !s.stale && now.Sub(s.lastSeen) > s.timeout {
+			s.stale = true
+			newlyStale = append(newlyStale, name)
+		}
+		seen, allStale = true, allStale && s.stale
+	}
+	allStale = seen && allStale
+	linkLost := allStale && !w.linkLost
+	if linkLost {
+		w.linkLost = true
+	}
+	w.mu.Unlock()
+
+	sort.Strings(newlyStale)
+	for _, name := range newlyStale {
+		w.store.SetQuality(name, data.QualityStale)
+		alarms.Raise(alarms.Alarm{
+			ID:       w.alarmID("stale", name),
+			Severity: alarms.SeverityWarning,
+			Source:   "watchdog",
+			Message:  "No update for signal " + name,
+			Fields:   w.fields(map[string]string{"signal": name}),
+		})
+	}
+	if linkLost {
+		alarms.Raise(alarms.Alarm{
+			ID:       w.alarmID(CommLostAlarm, ""),
+			Severity: alarms.SeverityCritical,
+			Source:   "watchdog",
+			Message:  "Communication with machine lost (" + w.source + ")",
+			Fields:   w.fields(map[string]string{"mode": w.source}),
+		})
+		if w.running() {
+			// Sending may block while the link is down
+			go w.safeAction()
+		}
+	}
+}
+
+// Machine counts as running while heater, screw or spooler are driven
+func (w *Watchdog) running() bool {
+	for _, name := range []string{"heaterPwm", "screwRpm", "spoolerRpm"} {
+		if dp, _ := w.store.Value(name); dp.Value > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Send safe action command, the emergency stop takes the priority path
+func (w *Watchdog) send(command string, value uint32) error {
+	if command == "emergency_stop" {
+		return w.EmergencyStop("watchdog", "Machine link lost while running")
+	}
+	return w.Send(command, value)
+}
+
+// Send configured safe action commands
+func (w *Watchdog) safeAction() {
+	if len(w.cfg.SafeAction) == 0 {
+		return
+	}
+	log.Println("Watchdog: Machine link lost while running, sending safe action")
+	for _, cmd := range w.cfg.SafeAction {
+		if err := w.send(cmd.Command, cmd.Value); err != nil {
+			log.Printf("Watchdog: Safe action %s failed: %v", cmd.Command, err)
+		}
+	}
+}
+
+// Subscribe to data updates and check timeouts until stop is closed
+func (w *Watchdog) Run(stop <-chan struct{}) {
+	unsubscribe := w.store.Subscribe(w.onUpdate)
+	defer unsubscribe()
+	interval := time.Duration(w.cfg.CheckInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Status of a monitored signal for /watchdog
+type SignalStatus struct {
+	Signal   string    `json:"signal"`
+	Timeout  float64   `json:"timeoutSeconds"`
+	LastSeen time.Time `json:"lastSeen"`
+	Stale    bool      `json:"stale"`
+}
+
+// Return status of all monitored signals
+func (w *Watchdog) Status() (signals []SignalStatus, linkLost bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name, s := range w.signals {
+		signals = append(signals, SignalStatus{Signal: name, Timeout: s.timeout.Seconds(), LastSeen: s.lastSeen, Stale: s.stale})
+	}
+	sort.Slice(signals, func(i, j int) bool { return signals[i].Signal < signals[j].Signal })
+	return signals, w.linkLost
+}
+
+// Handler for watchdog status
+func (w *Watchdog) Handler(rw http.ResponseWriter, r *http.Request) {
+	signals, linkLost := w.Status()
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"source":   w.source,
+		"linkLost": linkLost,
+		"signals":  signals,
+	})
+}
@@ -0,0 +1,130 @@
+package watchdog
+
+import (
+	"extruder_web_gui/alarms"
+	"extruder_web_gui/config"
+	"extruder_web_gui/data"
+	"testing"
+	"time"
+)
+
+// Watchdog of the store with controllable clock and recorded safe action commands, all signals were seen
+func testWatchdog(cfg config.WatchdogConfig, store *data.Store) (*Watchdog, *time.Time, chan string) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	sent := make(chan string, 10)
+	w := New(cfg, store, "PipeMode", 0)
+	w.now = func() time.Time { return now }
+	for _, s := range w.signals {
+		s.lastSeen = now
+	}
+	w.Send = func(command string, value uint32) error {
+		sent <- command
+		return nil
+	}
+	w.EmergencyStop = func(actor string, reason string) error {
+		sent <- "emergency_stop"
+		return nil
+	}
+	return w, &now, sent
+}
+
+// Test for Watchdog: single signal turns stale and recovers
+func TestWatchdog_StaleSignal(t *testing.T) {
+	w, now, _ := testWatchdog(config.WatchdogConfig{
+		Signals:  []string{"temperature", "diameter"},
+		Timeouts: map[string]int{"temperature": 1000, "diameter": 10000},
+	}, data.Default)
+
+	*now = now.Add(2 * time.Second)
+	w.check()
+	if dp, _ := data.Value("temperature"); dp.Quality != data.QualityStale {
+		t.Errorf("Temperature should be stale, quality: %v", dp.Quality)
+	}
+	if !alarms.IsActive("stale:temperature") || alarms.IsActive("stale:diameter") {
+		t.Errorf("Unexpected stale alarms: %v", alarms.Active())
+	}
+	if alarms.IsActive(CommLostAlarm) {
+		t.Errorf("Link shouldn't be lost while diameter is updated")
+	}
+
+	w.onUpdate(data.Update{Signal: "temperature", Point: data.Datapoint{Value: 200, Quality: data.QualityGood}})
+	if alarms.IsActive("stale:temperature") {
+		t.Errorf("Stale alarm should be cleared after update")
+	}
+}
+
+// Test for Watchdog: link loss while running triggers safe action
+func TestWatchdog_LinkLostSafeAction(t *testing.T) {
+	w, now, sent := testWatchdog(config.WatchdogConfig{
+		Signals:        []string{"screwRpm"},
+		DefaultTimeout: 1000,
+		SafeAction:     []config.CommandValue{{Command: "heater_pwm", Value: 0}, {Command: "emergency_stop", Value: 1}},
+	}, data.Default)
+	data.SetValue("screwRpm", 50, time.Now())
+
+	*now = now.Add(2 * time.Second)
+	w.check()
+	if !alarms.IsActive(CommLostAlarm) {
+		t.Fatalf("Communication lost alarm expected")
+	}
+	for _, expected := range []string{"heater_pwm", "emergency_stop"} {
+		select {
+		case command := <-sent:
+			if command != expected {
+				t.Errorf("Unexpected safe action command. Expected: %s, received: %s", expected, command)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Safe action command %s not sent", expected)
+		}
+	}
+
+	w.onUpdate(data.Update{Signal: "screwRpm", Point: data.Datapoint{Value: 50, Quality: data.QualityGood}})
+	if alarms.IsActive(CommLostAlarm) {
+		t.Errorf("Communication lost alarm should be cleared")
+	}
+}
+
+// Test for Watchdog: signals never received are not stale, alarms of a further machine carry its ID
+func TestWatchdog_NotSeenAndMachine(t *testing.T) {
+	store, err := data.NewStore(data.DefaultDictionary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Source = "line2"
+	w, now, _ := testWatchdog(config.WatchdogConfig{Signals: []string{"temperature", "diameter"}, DefaultTimeout: 1000}, store)
+	w.signals["diameter"].lastSeen = time.Time{}
+	t.Cleanup(func() {
+		alarms.Clear("stale:line2:temperature")
+		alarms.Clear(CommLostAlarm + ":line2")
+	})
+
+	*now = now.Add(2 * time.Second)
+	w.check()
+	if alarms.IsActive("stale:line2:diameter") {
+		t.Errorf("Diameter was never received and shouldn't be stale")
+	}
+	if dp, _ := store.Value("temperature"); dp.Quality != data.QualityStale {
+		t.Errorf("Expected: %v, received: %v", data.QualityStale, dp.Quality)
+	}
+	var lost alarms.Alarm
+	for _, a := range alarms.Active() {
+		if a.ID == CommLostAlarm+":line2" {
+			lost = a
+		}
+	}
+	if !IsCommLost(lost) || lost.Fields["machine"] != "line2" || alarms.IsActive(CommLostAlarm) {
+		t.Errorf("Expected communication lost alarm of line2, received: %+v", lost)
+	}
+}
+
+// Test for Watchdog: nothing is stale before the first value arrives
+func TestWatchdog_NeverReceived(t *testing.T) {
+	store, _ := data.NewStore(data.DefaultDictionary())
+	w := New(config.WatchdogConfig{DefaultTimeout: 1000}, store, "PipeMode", 0)
+	start := time.Now()
+	w.now = func() time.Time { return start.Add(time.Minute) }
+	w.check()
+	if signals, linkLost := w.Status(); linkLost || signals[0].Stale {
+		t.Errorf("Unexpected status before the first value: %+v, link lost: %v", signals, linkLost)
+	}
+}